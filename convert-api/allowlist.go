@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+)
+
+// ADMIN_ALLOWED_CIDRS limits admin and debug routes to these networks
+// (comma-separated CIDRs or single IPs), checked before authentication so a
+// leaked admin credential alone isn't enough. Unset denies every network;
+// "0.0.0.0/0,::/0" opts out of the check.
+var adminAllowedCIDRs = os.Getenv("ADMIN_ALLOWED_CIDRS")
+
+// TRUSTED_PROXIES lists the proxies, e.g. Kong, whose X-Forwarded-For is used
+// for the client IP. Without it gin trusts the header from any peer, which lets
+// callers spoof their address past the allowlist.
+var trustedProxies = os.Getenv("TRUSTED_PROXIES")
+
+var adminNetworks []netip.Prefix
+
+func parseNetworkList(list string) ([]netip.Prefix, error) {
+	networks := []netip.Prefix{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			networks = append(networks, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		networks = append(networks, prefix.Masked())
+	}
+	return networks, nil
+}
+
+// initNetworkConfig parses the admin allowlist and applies the trusted proxies to the router
+func initNetworkConfig(r *gin.Engine) error {
+	var err error
+	if adminNetworks, err = parseNetworkList(adminAllowedCIDRs); err != nil {
+		return fmt.Errorf("ADMIN_ALLOWED_CIDRS: %v", err)
+	}
+
+	if trustedProxies != "" {
+		proxies := []string{}
+		for _, proxy := range strings.Split(trustedProxies, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				proxies = append(proxies, proxy)
+			}
+		}
+		if err := r.SetTrustedProxies(proxies); err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES: %v", err)
+		}
+	} else if len(adminNetworks) > 0 {
+		log.Printf("ADMIN_ALLOWED_CIDRS is set without TRUSTED_PROXIES; X-Forwarded-For is trusted from any peer")
+	}
+	if len(adminNetworks) == 0 {
+		log.Printf("ADMIN_ALLOWED_CIDRS is not set; admin and debug routes refuse every request")
+	}
+	return nil
+}
+
+// requireAllowedNetwork rejects requests from outside ADMIN_ALLOWED_CIDRS
+func requireAllowedNetwork(c *gin.Context) {
+	if addr, err := netip.ParseAddr(c.ClientIP()); err == nil {
+		addr = addr.Unmap()
+		for _, network := range adminNetworks {
+			if network.Contains(addr) {
+				c.Next()
+				return
+			}
+		}
+	}
+
+	log.Printf("Rejected %s %s from %s: not in ADMIN_ALLOWED_CIDRS", c.Request.Method, c.Request.URL.Path, c.ClientIP())
+	response.Abort(c, http.StatusForbidden, "access denied from this network")
+}
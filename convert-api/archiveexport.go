@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"convert-api/objstore"
+
+	"shared/secrets"
+)
+
+// export-archive copies links the reaper archived to a directory or bucket
+// (see openObjectStore) for cold storage or analysis, in the backup format:
+// a gzipped JSON-lines file and a manifest with its SHA-256 and row count.
+// Rows stay in urls_archive, where they keep their short codes from being
+// issued again.
+//
+//	convertapi export-archive -to s3://archive/2024-06 -since 2024-06-01 -until 2024-07-01
+const archiveExportFile = "urls_archive.jsonl.gz"
+
+// ArchiveExport is the manifest of an export, with the archived_at range it covers
+type ArchiveExport struct {
+	CreatedAt time.Time    `json:"createdAt"`
+	Since     *time.Time   `json:"since,omitempty"`
+	Until     *time.Time   `json:"until,omitempty"`
+	Files     []BackupFile `json:"files"`
+}
+
+// archivedURL is a urls_archive row as exported, with original_url as stored
+type archivedURL struct {
+	ID             int        `json:"id"`
+	OriginalURL    string     `json:"originalUrl"`
+	ShortCode      string     `json:"shortCode"`
+	Owner          string     `json:"owner"`
+	FlagReason     *string    `json:"flagReason,omitempty"`
+	DisabledAt     *time.Time `json:"disabledAt,omitempty"`
+	DisabledReason *string    `json:"disabledReason,omitempty"`
+	Clicks         int64      `json:"clicks"`
+	CreatedAt      *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+	ArchivedAt     *time.Time `json:"archivedAt,omitempty"`
+	Source         *string    `json:"source,omitempty"`
+}
+
+// parseExportTime reads a date or an RFC 3339 time, empty meaning unbounded
+func parseExportTime(name, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-%s must be a date or an RFC 3339 time", name)
+	}
+	return &t, nil
+}
+
+func (srv *server) exportArchiveCommand(args []string) error {
+	flags := flag.NewFlagSet("export-archive", flag.ExitOnError)
+	to := flags.String("to", "", "directory, s3:// or gs:// location to write the export to (must not hold one yet)")
+	sinceFlag := flags.String("since", "", "only links archived at or after this date or time")
+	untilFlag := flags.String("until", "", "only links archived before this date or time")
+	flags.Parse(args)
+	if *to == "" {
+		return fmt.Errorf("-to is required")
+	}
+	since, err := parseExportTime("since", *sinceFlag)
+	if err != nil {
+		return err
+	}
+	until, err := parseExportTime("until", *untilFlag)
+	if err != nil {
+		return err
+	}
+	store, err := openObjectStore(*to)
+	if err != nil {
+		return err
+	}
+
+	secrets.Init()
+	srv.initDatabase()
+	srv.initRedis()
+
+	export, err := srv.exportArchive(store, since, until)
+	if err != nil {
+		return err
+	}
+	for _, f := range export.Files {
+		log.Printf("Exported %d archived links to %s/%s", f.Rows, store, f.Name)
+	}
+	return nil
+}
+
+func (srv *server) exportArchive(store objstore.Store, since, until *time.Time) (*ArchiveExport, error) {
+	exists, err := store.Exists(srv.ctx, backupManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%s already holds an export", store)
+	}
+
+	export := &ArchiveExport{CreatedAt: time.Now().UTC(), Since: since, Until: until}
+	file, err := srv.writeBackupFile(store, archiveExportFile, `
+		SELECT id, original_url, short_code, owner, flag_reason, disabled_at, disabled_reason,
+			clicks, created_at, updated_at, expires_at, archived_at, source
+		FROM urls_archive
+		WHERE ($1::timestamptz IS NULL OR archived_at >= $1) AND ($2::timestamptz IS NULL OR archived_at < $2)
+		ORDER BY id
+	`, func(rows *sql.Rows) (interface{}, error) {
+		var u archivedURL
+		err := rows.Scan(&u.ID, &u.OriginalURL, &u.ShortCode, &u.Owner, &u.FlagReason, &u.DisabledAt, &u.DisabledReason,
+			&u.Clicks, &u.CreatedAt, &u.UpdatedAt, &u.ExpiresAt, &u.ArchivedAt, &u.Source)
+		return u, err
+	}, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export urls_archive: %v", err)
+	}
+	export.Files = append(export.Files, file)
+
+	// The manifest goes last, like a backup's
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(srv.ctx, backupManifestFile, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return export, nil
+}
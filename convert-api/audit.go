@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+	"shared/urlcrypto"
+)
+
+const (
+	auditLinkCreate        = "link.create"
+	auditLinkUpdate        = "link.update"
+	auditLinkDelete        = "link.delete"
+	auditLinkDisable       = "link.disable"
+	auditLinkApprove       = "link.approve"
+	auditLinkRotate        = "link.rotate"
+	auditLinkTransfer      = "link.transfer"
+	auditDomainRuleCreate  = "domain_rule.create"
+	auditDomainRuleDelete  = "domain_rule.delete"
+	auditWebhookCreate     = "webhook.create"
+	auditWebhookUpdate     = "webhook.update"
+	auditWebhookDelete     = "webhook.delete"
+	auditReportCreate      = "report.create"
+	auditReportResolve     = "report.resolve"
+	auditPageCreate        = "page.create"
+	auditPageUpdate        = "page.update"
+	auditPageDelete        = "page.delete"
+	auditDomainCreate      = "domain.create"
+	auditDomainVerify      = "domain.verify"
+	auditDomainDelete      = "domain.delete"
+	auditTenantUpdate      = "tenant.update"
+	auditTenantCacheFlush  = "tenant.cache_flush"
+	auditErrorPageUpdate   = "error_page.update"
+	auditErrorPageDelete   = "error_page.delete"
+	auditTransferCreate    = "transfer.create"
+	auditTransferResolve   = "transfer.resolve"
+	auditFolderCreate      = "folder.create"
+	auditFolderUpdate      = "folder.update"
+	auditFolderDelete      = "folder.delete"
+	auditTargetLink        = "link"
+	auditTargetDomainRule  = "domain_rule"
+	auditTargetWebhook     = "webhook"
+	auditTargetAbuseReport = "abuse_report"
+	auditTargetPage        = "page"
+	auditTargetDomain      = "domain"
+	auditTargetTenant      = "tenant"
+	auditTargetErrorPage   = "error_page"
+	auditTargetTransfer    = "transfer"
+	auditTargetFolder      = "folder"
+)
+
+// audit_log is append-only: a trigger rejects every UPDATE and DELETE, except the
+// anonymizing updates made by an erasure job
+const auditTablesQuery = `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		before JSONB,
+		after JSONB,
+		ip TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at DESC, id DESC);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor);
+
+	CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		-- GDPR erasure may anonymize rows inside its own transaction; rows are never deleted
+		IF TG_OP = 'UPDATE' AND current_setting('audit_log.erasure', true) = 'on' THEN
+			RETURN NEW;
+		END IF;
+		RAISE EXCEPTION 'audit_log is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE TRIGGER audit_log_append_only
+		BEFORE UPDATE OR DELETE ON audit_log
+		FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+`
+
+// auditActor is who performed a mutation: a consumer, "system:<job>" or "" for anonymous
+type auditActor struct {
+	ID string
+	IP string
+}
+
+// AuditEntry is one recorded mutation
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"`
+	TargetID   string          `json:"targetId"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	IP         string          `json:"ip"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+type clientIPContextKey struct{}
+
+func actorFromGin(c *gin.Context) auditActor {
+	return auditActor{ID: callerID(c), IP: c.ClientIP()}
+}
+
+func systemActor(job string) auditActor {
+	return auditActor{ID: "system:" + job}
+}
+
+func withClientIP(parent context.Context, ip string) context.Context {
+	return context.WithValue(parent, clientIPContextKey{}, ip)
+}
+
+// actorFromContext resolves the caller for GraphQL and gRPC calls, from the
+// request context set by graphQLHandler or grpcAuth
+func actorFromContext(c context.Context) auditActor {
+	actor := auditActor{ID: ownerFromContext(c)}
+	if ip, ok := c.Value(clientIPContextKey{}).(string); ok {
+		actor.IP = ip
+	}
+	return actor
+}
+
+// linkAuditState keeps audit snapshots of links in the same shape the API returns.
+// Destinations stay encrypted in the snapshot when encryption at rest is on.
+func linkAuditState(u *URL) interface{} {
+	if u == nil {
+		return nil
+	}
+	state := toLinkResponse(u)
+	if urlcrypto.Enabled() {
+		stored, err := urlcrypto.Encrypt(state.OriginalURL)
+		if err != nil {
+			log.Printf("Failed to encrypt audit snapshot of %s: %v", u.ShortCode, err)
+			stored = ""
+		}
+		state.OriginalURL = stored
+		state.DisplayURL = ""
+
+		if state.FallbackURL != nil {
+			fallback, err := urlcrypto.Encrypt(*state.FallbackURL)
+			if err != nil {
+				log.Printf("Failed to encrypt audit snapshot of %s: %v", u.ShortCode, err)
+				fallback = ""
+			}
+			state.FallbackURL = &fallback
+		}
+	}
+	return state
+}
+
+// execer is what writeAudit and the other writers need of *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordAudit appends an entry to the audit log. before/after are JSON-encoded
+// snapshots of the target, nil when it didn't exist. Failures are logged, never
+// surfaced, so auditing can't fail the action it records.
+func (srv *server) recordAudit(actor auditActor, action, targetType, targetID string, before, after interface{}) {
+	if err := writeAudit(srv.db, actor, action, targetType, targetID, before, after); err != nil {
+		log.Printf("Failed to record audit entry %s %s/%s: %v", action, targetType, targetID, err)
+	}
+}
+
+// writeAudit is recordAudit for callers that commit the entry, and a link's
+// history, with the change itself, and so must fail with it
+func writeAudit(exec execer, actor auditActor, action, targetType, targetID string, before, after interface{}) error {
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %v", err)
+	}
+
+	query := `
+		INSERT INTO audit_log (actor, action, target_type, target_id, before, after, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	if _, err := exec.Exec(query, actor.ID, action, targetType, targetID, beforeJSON, afterJSON, actor.IP); err != nil {
+		return err
+	}
+
+	if targetType == auditTargetLink {
+		return writeLinkHistory(exec, actor, action, targetID, before, after)
+	}
+	return nil
+}
+
+func auditJSON(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// listAuditLogHandler queries the audit log newest first, filtered by any of
+// actor, action, target_type, target_id, since and until
+func (srv *server) listAuditLogHandler(c *gin.Context) {
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	conditions := []string{}
+	args := []interface{}{}
+	// Query parameters share their names with the columns they filter
+	for _, column := range []string{"actor", "action", "target_type", "target_id"} {
+		if v := c.Query(column); v != "" {
+			args = append(args, v)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", column, len(args)))
+		}
+	}
+	for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<"}} {
+		v := c.Query(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			response.Fail(c, http.StatusBadRequest, bound.param+" must be an RFC 3339 timestamp")
+			return
+		}
+		args = append(args, t)
+		conditions = append(conditions, fmt.Sprintf("created_at %s $%d", bound.op, len(args)))
+	}
+	if after != nil {
+		var condition string
+		condition, args = keysetCondition("created_at", "id", after, args)
+		conditions = append(conditions, condition)
+	}
+
+	query := `SELECT id, actor, action, target_type, target_id, before, after, ip, created_at FROM audit_log`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to query audit log: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to query audit log")
+		return
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.TargetType, &e.TargetID, &before, &after, &e.IP, &e.CreatedAt); err != nil {
+			log.Printf("Failed to query audit log: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to query audit log")
+			return
+		}
+		e.Before, e.After = before, after
+		entries = append(entries, &e)
+	}
+
+	nextCursor := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[len(entries)-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: last.ID}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"entries": entries}, nextCursor)
+}
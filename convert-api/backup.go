@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"convert-api/objstore"
+
+	"shared/secrets"
+)
+
+// Backups are directories holding one gzipped JSON-lines file per table and a
+// manifest with each file's SHA-256 and row count, plus the URL counter and
+// the last ID of its Postgres fallback sequence at backup time. They can also be written straight to a bucket (see
+// openObjectStore). Destinations are copied as stored, so a restore of
+// encrypted links needs the same URL_ENCRYPTION_KEYS.
+//
+//	convertapi backup -out /backups/2024-06-01 [-clicks]
+//	convertapi backup -out s3://backups/2024-06-01
+//	convertapi restore -in /backups/2024-06-01
+const (
+	backupManifestFile = "manifest.json"
+	backupFoldersFile  = "folders.jsonl.gz"
+	backupURLsFile     = "urls.jsonl.gz"
+	backupTargetsFile  = "link_targets.jsonl.gz"
+	backupClicksFile   = "link_clicks.jsonl.gz"
+)
+
+// backupColumns are the columns each backed up table is copied with, in the
+// order they are scanned and inserted. Backups and restores refuse to run
+// when a table has a column missing here, so a new column can't silently
+// be left out of them.
+var backupColumns = map[string][]string{
+	"folders": {"id", "owner", "name", "parent_id", "created_at", "updated_at"},
+	"urls": {"id", "original_url", "short_code", "owner", "flag_reason", "disabled_at", "disabled_reason",
+		"last_scanned_at", "created_at", "updated_at", "expires_at", "source", "code_generator",
+		"expiry_reminder_sent_for", "fallback_url", "folder_id", "public_stats", "rotated_to", "retire_at"},
+	"link_targets": {"short_code", "position", "original_url", "weight"},
+	"link_clicks":  {"short_code", "clicks", "last_clicked_at"},
+}
+
+type BackupManifest struct {
+	CreatedAt       time.Time    `json:"createdAt"`
+	Counter         int64        `json:"counter"`
+	FallbackCounter int64        `json:"fallbackCounter,omitempty"`
+	Files           []BackupFile `json:"files"`
+}
+
+type BackupFile struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupURL is a urls row as written to a backup, with original_url as stored
+type backupURL struct {
+	ID                    int        `json:"id"`
+	OriginalURL           string     `json:"originalUrl"`
+	ShortCode             string     `json:"shortCode"`
+	Owner                 string     `json:"owner"`
+	FlagReason            *string    `json:"flagReason,omitempty"`
+	DisabledAt            *time.Time `json:"disabledAt,omitempty"`
+	DisabledReason        *string    `json:"disabledReason,omitempty"`
+	LastScannedAt         *time.Time `json:"lastScannedAt,omitempty"`
+	CreatedAt             time.Time  `json:"createdAt"`
+	UpdatedAt             time.Time  `json:"updatedAt"`
+	ExpiresAt             *time.Time `json:"expiresAt,omitempty"`
+	Source                *string    `json:"source,omitempty"`
+	CodeGenerator         *string    `json:"codeGenerator,omitempty"`
+	ExpiryReminderSentFor *time.Time `json:"expiryReminderSentFor,omitempty"`
+	FallbackURL           *string    `json:"fallbackUrl,omitempty"`
+	FolderID              *int       `json:"folderId,omitempty"`
+	PublicStats           bool       `json:"publicStats,omitempty"`
+	RotatedTo             *string    `json:"rotatedTo,omitempty"`
+	RetireAt              *time.Time `json:"retireAt,omitempty"`
+}
+
+type backupFolder struct {
+	ID        int        `json:"id"`
+	Owner     string     `json:"owner"`
+	Name      string     `json:"name"`
+	ParentID  *int       `json:"parentId,omitempty"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+// backupTarget is a link_targets row, with original_url as stored
+type backupTarget struct {
+	ShortCode   string `json:"shortCode"`
+	Position    int    `json:"position"`
+	OriginalURL string `json:"originalUrl"`
+	Weight      int    `json:"weight"`
+}
+
+type backupClicks struct {
+	ShortCode     string     `json:"shortCode"`
+	Clicks        int64      `json:"clicks"`
+	LastClickedAt *time.Time `json:"lastClickedAt,omitempty"`
+}
+
+// runCommand runs a maintenance subcommand instead of the server. It returns
+// false for unknown commands.
+func (srv *server) runCommand(name string, args []string) bool {
+	var err error
+	switch name {
+	case "backup":
+		err = srv.backupCommand(args)
+	case "restore":
+		err = srv.restoreCommand(args)
+	case "rebase-counter":
+		err = srv.rebaseCounterCommand(args)
+	case "import":
+		err = srv.importCommand(args)
+	case "sync-link-store":
+		err = srv.syncLinkStoreCommand(args)
+	case "export-archive":
+		err = srv.exportArchiveCommand(args)
+	default:
+		return false
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", name, err)
+	}
+	return true
+}
+
+func (srv *server) backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "directory, s3:// or gs:// location to write the backup to (must not hold one yet)")
+	clicks := flags.Bool("clicks", false, "also back up link_clicks")
+	flags.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	store, err := openObjectStore(*out)
+	if err != nil {
+		return err
+	}
+
+	secrets.Init()
+	srv.initDatabase()
+	srv.initRedis()
+
+	manifest, err := srv.writeBackup(store, *clicks)
+	if err != nil {
+		return err
+	}
+	for _, f := range manifest.Files {
+		log.Printf("Backed up %d rows to %s/%s", f.Rows, store, f.Name)
+	}
+	return nil
+}
+
+func (srv *server) restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := flags.String("in", "", "backup directory, s3:// or gs:// location to restore from")
+	flags.Parse(args)
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+	store, err := openObjectStore(*in)
+	if err != nil {
+		return err
+	}
+
+	secrets.Init()
+	srv.initDatabase()
+	srv.initRedis()
+
+	return srv.restoreBackup(store)
+}
+
+// writeBackup reads the counter before the rows, so every backed up link has
+// an ID at or below the recorded counter
+func (srv *server) writeBackup(store objstore.Store, withClicks bool) (*BackupManifest, error) {
+	exists, err := store.Exists(srv.ctx, backupManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%s already holds a backup", store)
+	}
+
+	manifest := &BackupManifest{CreatedAt: time.Now().UTC()}
+	counter, err := srv.ids.Current(srv.ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Counter = max(counter, srv.ids.Checkpoint())
+	if manifest.FallbackCounter, err = srv.ids.FallbackLast(srv.ctx); err != nil {
+		return nil, err
+	}
+
+	tables := []string{"folders", "urls", "link_targets"}
+	if withClicks {
+		tables = append(tables, "link_clicks")
+	}
+	if err := srv.checkBackupColumns(tables...); err != nil {
+		return nil, err
+	}
+
+	// Folders go before the links filed in them, targets after their links
+	backups := []struct {
+		table, name, orderBy string
+		scan                 func(*sql.Rows) (interface{}, error)
+	}{
+		{"folders", backupFoldersFile, "id", func(rows *sql.Rows) (interface{}, error) {
+			var f backupFolder
+			err := rows.Scan(&f.ID, &f.Owner, &f.Name, &f.ParentID, &f.CreatedAt, &f.UpdatedAt)
+			return f, err
+		}},
+		{"urls", backupURLsFile, "id", func(rows *sql.Rows) (interface{}, error) {
+			var u backupURL
+			err := rows.Scan(&u.ID, &u.OriginalURL, &u.ShortCode, &u.Owner, &u.FlagReason, &u.DisabledAt,
+				&u.DisabledReason, &u.LastScannedAt, &u.CreatedAt, &u.UpdatedAt, &u.ExpiresAt, &u.Source, &u.CodeGenerator,
+				&u.ExpiryReminderSentFor, &u.FallbackURL, &u.FolderID, &u.PublicStats, &u.RotatedTo, &u.RetireAt)
+			return u, err
+		}},
+		{"link_targets", backupTargetsFile, "short_code, position", func(rows *sql.Rows) (interface{}, error) {
+			var t backupTarget
+			err := rows.Scan(&t.ShortCode, &t.Position, &t.OriginalURL, &t.Weight)
+			return t, err
+		}},
+		{"link_clicks", backupClicksFile, "short_code", func(rows *sql.Rows) (interface{}, error) {
+			var c backupClicks
+			err := rows.Scan(&c.ShortCode, &c.Clicks, &c.LastClickedAt)
+			return c, err
+		}},
+	}
+	for _, b := range backups {
+		if b.table == "link_clicks" && !withClicks {
+			continue
+		}
+		query := fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", strings.Join(backupColumns[b.table], ", "), b.table, b.orderBy)
+		file, err := srv.writeBackupFile(store, b.name, query, b.scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %v", b.table, err)
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	// The manifest goes last, so a directory without one is an incomplete backup
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Put(srv.ctx, backupManifestFile, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// checkBackupColumns fails when one of tables has a column that
+// backupColumns doesn't list
+func (srv *server) checkBackupColumns(tables ...string) error {
+	for _, table := range tables {
+		rows, err := srv.db.Query(`
+			SELECT column_name FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = $1
+			ORDER BY ordinal_position
+		`, table)
+		if err != nil {
+			return err
+		}
+		listed := make(map[string]bool)
+		for _, column := range backupColumns[table] {
+			listed[column] = true
+		}
+		var missing []string
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return err
+			}
+			if !listed[column] {
+				missing = append(missing, column)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%s has columns the backup doesn't copy: %s (add them to backupColumns)", table, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// writeBackupFile streams the rows of query as gzipped JSON lines into the
+// object name, hashing the compressed bytes as they are written
+func (srv *server) writeBackupFile(store objstore.Store, name, query string, scan func(*sql.Rows) (interface{}, error), args ...interface{}) (BackupFile, error) {
+	result := BackupFile{Name: name}
+
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := store.Put(srv.ctx, name, pr)
+		// Stops the writes below if the upload gave up early
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	hash := sha256.New()
+	rows, err := srv.writeJSONLines(io.MultiWriter(pw, hash), query, scan, args...)
+	// An error here also fails the upload, so no partial file is left
+	pw.CloseWithError(err)
+	if uploadErr := <-uploaded; err == nil {
+		err = uploadErr
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Rows = rows
+	result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return result, nil
+}
+
+// writeJSONLines writes the rows of query to w as gzipped JSON lines
+func (srv *server) writeJSONLines(w io.Writer, query string, scan func(*sql.Rows) (interface{}, error), args ...interface{}) (int64, error) {
+	buffered := bufio.NewWriter(w)
+	gz := gzip.NewWriter(buffered)
+	enc := json.NewEncoder(gz)
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var n int64
+	for rows.Next() {
+		row, err := scan(rows)
+		if err != nil {
+			return n, err
+		}
+		if err := enc.Encode(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return n, err
+	}
+	return n, buffered.Flush()
+}
+
+// restoreBackup verifies every file against the manifest before touching the
+// database, replays the rows in one transaction and then rebases the counter.
+// Links whose ID or short code already exist are kept as they are, so a
+// restore can be rerun or applied on top of a live database.
+func (srv *server) restoreBackup(store objstore.Store) error {
+	data, err := srv.readObject(store, backupManifestFile)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest: %v", err)
+	}
+
+	for _, f := range manifest.Files {
+		if err := srv.verifyBackupFile(store, f.Name, f.SHA256); err != nil {
+			return err
+		}
+	}
+	// Columns missing from backupColumns would come back with their defaults
+	if err := srv.checkBackupColumns("folders", "urls", "link_targets", "link_clicks"); err != nil {
+		return err
+	}
+
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Targets are only added to the links this restore created, so a kept
+	// link doesn't end up with a mix of its own and the backed up targets
+	restoredLinks := make(map[string]bool)
+	for _, f := range manifest.Files {
+		var restored int64
+		switch f.Name {
+		case backupFoldersFile:
+			restored, err = srv.restoreFolders(tx, store)
+		case backupURLsFile:
+			restored, err = srv.restoreURLs(tx, store, restoredLinks)
+		case backupTargetsFile:
+			restored, err = srv.restoreTargets(tx, store, restoredLinks)
+		case backupClicksFile:
+			restored, err = srv.restoreClicks(tx, store)
+		default:
+			err = fmt.Errorf("unknown backup file %s", f.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %v", f.Name, err)
+		}
+		log.Printf("Restored %d of %d rows from %s", restored, f.Rows, f.Name)
+	}
+
+	// Keep the SERIAL sequences ahead of the restored IDs
+	for _, table := range []string{"folders", "urls"} {
+		if _, err := tx.Exec(fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), GREATEST((SELECT MAX(id) FROM %[1]s), 1))`, table)); err != nil {
+			return fmt.Errorf("failed to reset %s sequence: %v", table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := srv.ids.RaiseFallback(srv.ctx, manifest.FallbackCounter); err != nil {
+		return err
+	}
+	return srv.rebaseCounter(manifest.Counter)
+}
+
+// readObject reads a small object, such as a manifest, whole
+func (srv *server) readObject(store objstore.Store, name string) ([]byte, error) {
+	f, err := store.Get(srv.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (srv *server) verifyBackupFile(store objstore.Store, name, want string) error {
+	f, err := store.Get(srv.ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", name, err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, manifest has %s", name, got, want)
+	}
+	return nil
+}
+
+// readBackupFile decodes every JSON line of a backup file into a fresh value from newRow
+func (srv *server) readBackupFile(store objstore.Store, name string, newRow func() interface{}, apply func(interface{}) error) error {
+	f, err := store.Get(srv.ctx, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(gz)
+	for {
+		row := newRow()
+		if err := dec.Decode(row); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := apply(row); err != nil {
+			return err
+		}
+	}
+}
+
+// restoreFolders inserts parents before their subfolders. A folder whose
+// parent wasn't restored, or belongs to someone else, lands at the top.
+func (srv *server) restoreFolders(tx *sql.Tx, store objstore.Store) (int64, error) {
+	var folders []*backupFolder
+	err := srv.readBackupFile(store, backupFoldersFile, func() interface{} { return &backupFolder{} }, func(row interface{}) error {
+		folders = append(folders, row.(*backupFolder))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	parents := make(map[int]int, len(folders))
+	for _, f := range folders {
+		if f.ParentID != nil {
+			parents[f.ID] = *f.ParentID
+		}
+	}
+	depth := func(id int) int {
+		d := 0
+		for parent, ok := parents[id]; ok && d <= len(folders); parent, ok = parents[parent] {
+			d++
+		}
+		return d
+	}
+	sort.SliceStable(folders, func(i, j int) bool { return depth(folders[i].ID) < depth(folders[j].ID) })
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO folders (id, owner, name, parent_id, created_at, updated_at)
+		VALUES ($1, $2, $3, (SELECT id FROM folders WHERE id = $4 AND owner = $2), $5, $6)
+		ON CONFLICT DO NOTHING
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var restored int64
+	for _, f := range folders {
+		res, err := stmt.Exec(f.ID, f.Owner, f.Name, f.ParentID, f.CreatedAt, f.UpdatedAt)
+		if err != nil {
+			return restored, fmt.Errorf("folder %d: %v", f.ID, err)
+		}
+		n, _ := res.RowsAffected()
+		restored += n
+	}
+	return restored, nil
+}
+
+// restoreURLs records the short codes it created in restored. Links are only
+// filed into folders of their own owner.
+func (srv *server) restoreURLs(tx *sql.Tx, store objstore.Store, restored map[string]bool) (int64, error) {
+	stmt, err := tx.Prepare(`
+		INSERT INTO urls (id, original_url, short_code, owner, flag_reason, disabled_at, disabled_reason,
+			last_scanned_at, created_at, updated_at, expires_at, source, code_generator,
+			expiry_reminder_sent_for, fallback_url, folder_id, public_stats, rotated_to, retire_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13,
+			$14, $15, (SELECT id FROM folders WHERE id = $16 AND owner = $4), $17, $18, $19)
+		ON CONFLICT DO NOTHING
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var count int64
+	err = srv.readBackupFile(store, backupURLsFile, func() interface{} { return &backupURL{} }, func(row interface{}) error {
+		u := row.(*backupURL)
+		res, err := stmt.Exec(u.ID, u.OriginalURL, u.ShortCode, u.Owner, u.FlagReason, u.DisabledAt,
+			u.DisabledReason, u.LastScannedAt, u.CreatedAt, u.UpdatedAt, u.ExpiresAt, u.Source, u.CodeGenerator,
+			u.ExpiryReminderSentFor, u.FallbackURL, u.FolderID, u.PublicStats, u.RotatedTo, u.RetireAt)
+		if err != nil {
+			return fmt.Errorf("short code %s: %v", u.ShortCode, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			restored[u.ShortCode] = true
+			count += n
+		}
+		return nil
+	})
+	return count, err
+}
+
+// restoreTargets restores the weighted targets of the links in links
+func (srv *server) restoreTargets(tx *sql.Tx, store objstore.Store, links map[string]bool) (int64, error) {
+	stmt, err := tx.Prepare(`
+		INSERT INTO link_targets (short_code, position, original_url, weight)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var restored int64
+	err = srv.readBackupFile(store, backupTargetsFile, func() interface{} { return &backupTarget{} }, func(row interface{}) error {
+		t := row.(*backupTarget)
+		if !links[t.ShortCode] {
+			return nil
+		}
+		res, err := stmt.Exec(t.ShortCode, t.Position, t.OriginalURL, t.Weight)
+		if err != nil {
+			return fmt.Errorf("short code %s: %v", t.ShortCode, err)
+		}
+		n, _ := res.RowsAffected()
+		restored += n
+		return nil
+	})
+	return restored, err
+}
+
+// restoreClicks keeps the higher count of the backup and the database, so
+// replaying a backup never double counts
+func (srv *server) restoreClicks(tx *sql.Tx, store objstore.Store) (int64, error) {
+	stmt, err := tx.Prepare(`
+		INSERT INTO link_clicks (short_code, clicks, last_clicked_at)
+		SELECT short_code, $2, $3 FROM urls WHERE short_code = $1
+		ON CONFLICT (short_code) DO UPDATE
+		SET clicks = GREATEST(link_clicks.clicks, EXCLUDED.clicks),
+			last_clicked_at = GREATEST(link_clicks.last_clicked_at, EXCLUDED.last_clicked_at)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var restored int64
+	err = srv.readBackupFile(store, backupClicksFile, func() interface{} { return &backupClicks{} }, func(row interface{}) error {
+		c := row.(*backupClicks)
+		res, err := stmt.Exec(c.ShortCode, c.Clicks, c.LastClickedAt)
+		if err != nil {
+			return fmt.Errorf("short code %s: %v", c.ShortCode, err)
+		}
+		n, _ := res.RowsAffected()
+		restored += n
+		return nil
+	})
+	return restored, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// When the health checker marks a destination down, the owner gets a
+// link.broken webhook event and, if they have a notification address, an
+// email. With HEALTH_CHECK_AUTO_DISABLE=true the link is also disabled, unless
+// it has a fallback to serve; the owner then gets the usual disabled notice
+// instead of the broken one. Disabled links aren't checked again, so they stay
+// disabled until the owner fixes the destination and an admin approves it.
+const (
+	emailTemplateLinkBroken = "link_broken"
+	brokenReasonPrefix      = "broken:"
+)
+
+var healthCheckAutoDisable = os.Getenv("HEALTH_CHECK_AUTO_DISABLE") == "true"
+
+func init() {
+	registerEmailTemplate(emailTemplateLinkBroken,
+		`Your short link {{.shortUrl}} points to a broken destination`,
+		`Hello {{.owner}},
+
+The destination of your short link {{.shortUrl}} failed {{.failures}} health checks in a row ({{.status}}):
+
+  {{.originalUrl}}
+{{if .fallback}}
+Visitors are sent to its fallback destination until it recovers.
+{{else}}
+Visitors still get redirected to it. Update the link or set a fallback
+destination to keep them from landing on a broken page.
+{{end}}`)
+}
+
+// linkBrokenEmail is the data of emailTemplateLinkBroken
+type linkBrokenEmail struct {
+	Owner       string `json:"owner"`
+	ShortURL    string `json:"shortUrl"`
+	OriginalURL string `json:"originalUrl"`
+	Status      string `json:"status"`
+	Failures    int    `json:"failures"`
+	Fallback    bool   `json:"fallback"`
+}
+
+// reportBrokenLink tells the owner of a link that its destination went down,
+// disabling the link first when auto-disable is on and it has no fallback
+func (srv *server) reportBrokenLink(shortCode, status string) {
+	u, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		if !errors.Is(err, errShortCodeNotFound) {
+			log.Printf("Failed to report broken link %s: %v", shortCode, err)
+		}
+		return
+	}
+
+	if healthCheckAutoDisable && u.FallbackURL == nil {
+		if _, err := srv.disableURL(systemActor("health-checker"), shortCode, brokenReasonPrefix+status); err != nil {
+			if !errors.Is(err, errShortCodeNotFound) {
+				log.Printf("Failed to disable broken link %s: %v", shortCode, err)
+			}
+			return
+		}
+		log.Printf("Disabled %s after its destination went down (%s)", shortCode, status)
+		return
+	}
+
+	srv.emitLinkEvent(eventLinkBroken, u)
+	srv.notifyOwner(u.Owner, emailTemplateLinkBroken, linkBrokenEmail{
+		Owner:       u.Owner,
+		ShortURL:    shortURL(u.ShortCode),
+		OriginalURL: u.OriginalURL,
+		Status:      status,
+		Failures:    healthCheckFailures,
+		Fallback:    u.FallbackURL != nil,
+	})
+}
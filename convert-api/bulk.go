@@ -0,0 +1,380 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/env"
+	"shared/response"
+)
+
+// Owners can delete or disable many of their links at once, listed by short
+// code or matched by a filter (campaign domain, folder, creation date range),
+// or move them to another destination host, see rewrite.go.
+// The matching links are recorded with the job when it is queued; a worker on
+// any instance then processes them in batches of BULK_BATCH_SIZE, dropping
+// each batch from the redirect cache, and records its progress so a job
+// resumes where it stopped when its worker dies.
+const (
+	auditBulkJobCreate = "bulk_job.create"
+	auditTargetBulkJob = "bulk_job"
+
+	bulkActionDelete  = "delete"
+	bulkActionDisable = "disable"
+	bulkActionRewrite = "rewrite"
+
+	bulkDisabledReason = "disabled by owner"
+	bulkPollInterval   = 30 * time.Second
+	bulkStaleAfter     = 10 * time.Minute
+
+	// maxBulkLinks caps the links of one job
+	maxBulkLinks = 10000
+)
+
+var bulkBatchSize = env.Int("BULK_BATCH_SIZE", 500)
+
+const bulkTablesQuery = `
+	CREATE TABLE IF NOT EXISTS bulk_jobs (
+		id SERIAL PRIMARY KEY,
+		owner TEXT NOT NULL,
+		action TEXT NOT NULL CHECK (action IN ('delete', 'disable', 'rewrite')),
+		reason TEXT,
+		from_host TEXT,
+		to_host TEXT,
+		short_codes TEXT[] NOT NULL,
+		status TEXT NOT NULL DEFAULT 'queued',
+		processed INTEGER NOT NULL DEFAULT 0,
+		affected INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		started_at TIMESTAMP WITH TIME ZONE,
+		completed_at TIMESTAMP WITH TIME ZONE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_bulk_jobs_status ON bulk_jobs(status, id);
+	CREATE INDEX IF NOT EXISTS idx_bulk_jobs_owner ON bulk_jobs(owner, id);
+`
+
+// BulkJob is a queued bulk delete, disable or destination rewrite. Matched
+// links are processed in order; Affected counts those actually changed,
+// leaving out links already gone, disabled or edited by then.
+type BulkJob struct {
+	ID          int        `json:"id"`
+	Action      string     `json:"action"`
+	From        *string    `json:"from,omitempty"`
+	To          *string    `json:"to,omitempty"`
+	Status      string     `json:"status"`
+	Matched     int        `json:"matched"`
+	Processed   int        `json:"processed"`
+	Affected    int        `json:"affected"`
+	Error       *string    `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+type BulkRequestBody struct {
+	Action     string      `json:"action" binding:"required,oneof=delete disable"`
+	ShortCodes []string    `json:"shortCodes"`
+	Filter     *BulkFilter `json:"filter"`
+	// Reason is recorded on disabled links
+	Reason string `json:"reason"`
+}
+
+// BulkFilter selects the caller's links; set fields are ANDed together
+type BulkFilter struct {
+	// Domain selects a campaign, in domain rule syntax: "example.com" or "*.example.com"
+	Domain        string     `json:"domain"`
+	FolderID      *int64     `json:"folderId"`
+	CreatedAfter  *time.Time `json:"createdAfter"`
+	CreatedBefore *time.Time `json:"createdBefore"`
+}
+
+// bulkWake nudges the worker when a job is queued instead of waiting for the next poll
+var bulkWake = make(chan struct{}, 1)
+
+const bulkJobColumns = "id, action, from_host, to_host, status, cardinality(short_codes), processed, affected, error, created_at, started_at, completed_at"
+
+func scanBulkJob(row rowScanner) (*BulkJob, error) {
+	var job BulkJob
+	err := row.Scan(&job.ID, &job.Action, &job.From, &job.To, &job.Status, &job.Matched, &job.Processed, &job.Affected, &job.Error,
+		&job.CreatedAt, &job.StartedAt, &job.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// matchBulkLinks returns the caller's links a bulk request selects
+func (srv *server) matchBulkLinks(owner string, body *BulkRequestBody) ([]string, error) {
+	if len(body.ShortCodes) > 0 {
+		return srv.ownedShortCodes(owner, body.ShortCodes)
+	}
+
+	f := body.Filter
+	filter := BulkDisableFilter{
+		Owner:           owner,
+		CreatedAfter:    f.CreatedAfter,
+		CreatedBefore:   f.CreatedBefore,
+		IncludeDisabled: body.Action == bulkActionDelete,
+	}
+	if f.Domain != "" {
+		pattern, ok := normalizeDomainPattern(f.Domain)
+		if !ok {
+			return nil, errInvalidBulkFilter
+		}
+		filter.Domain = pattern
+	}
+	if f.FolderID != nil {
+		if err := checkFolderOwner(srv.db, owner, f.FolderID); err != nil {
+			return nil, err
+		}
+		filter.FolderIDs = []int64{*f.FolderID}
+	}
+	return srv.matchBulkDisable(filter)
+}
+
+var errInvalidBulkFilter = errors.New("invalid domain pattern")
+
+func (srv *server) createBulkJobHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body BulkRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if (len(body.ShortCodes) == 0) == (body.Filter == nil) {
+		response.Fail(c, http.StatusBadRequest, "exactly one of shortCodes or filter is required")
+		return
+	}
+	if body.Filter != nil && *body.Filter == (BulkFilter{}) {
+		response.Fail(c, http.StatusBadRequest, "filter must set at least one field")
+		return
+	}
+	if len(body.ShortCodes) > maxBulkLinks {
+		response.Fail(c, http.StatusBadRequest, fmt.Sprintf("shortCodes must contain at most %d codes", maxBulkLinks))
+		return
+	}
+
+	codes, err := srv.matchBulkLinks(owner, &body)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidBulkFilter):
+			response.Fail(c, http.StatusBadRequest, err.Error())
+		case errors.Is(err, errShortCodeNotFound), errors.Is(err, errFolderNotFound):
+			failNotFound(c, err)
+		default:
+			log.Printf("Failed to match links for bulk %s: %v", body.Action, err)
+			response.Fail(c, http.StatusInternalServerError, "failed to queue bulk job")
+		}
+		return
+	}
+	if len(codes) > maxBulkLinks {
+		response.Fail(c, http.StatusUnprocessableEntity, fmt.Sprintf("the filter matches %d links, at most %d can be changed at once", len(codes), maxBulkLinks))
+		return
+	}
+
+	task := bulkTask{owner: owner, action: body.Action, codes: codes}
+	if body.Action == bulkActionDisable {
+		reason := bulkDisabledReason
+		if body.Reason != "" {
+			reason = body.Reason
+		}
+		task.reason = &reason
+	}
+	srv.queueBulkJob(c, task)
+}
+
+// queueBulkJob stores the task, wakes the worker and answers 202 with the job
+func (srv *server) queueBulkJob(c *gin.Context, task bulkTask) {
+	query := `
+		INSERT INTO bulk_jobs (owner, action, reason, from_host, to_host, short_codes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + bulkJobColumns
+	job, err := scanBulkJob(srv.db.QueryRow(query, task.owner, task.action, task.reason, task.fromHost, task.toHost, pq.Array(task.codes)))
+	if err != nil {
+		log.Printf("Failed to queue bulk job: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to queue bulk job")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditBulkJobCreate, auditTargetBulkJob, strconv.Itoa(job.ID), nil, job)
+
+	select {
+	case bulkWake <- struct{}{}:
+	default:
+	}
+
+	c.Header("Location", fmt.Sprintf("/api/v1/urls/bulk/%d", job.ID))
+	response.OK(c, http.StatusAccepted, job)
+}
+
+func (srv *server) getBulkJobHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid bulk job id")
+		return
+	}
+
+	job, err := scanBulkJob(srv.db.QueryRow(`SELECT `+bulkJobColumns+` FROM bulk_jobs WHERE id = $1 AND owner = $2`, id, owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeBulkJobNotFound)
+			return
+		}
+		log.Printf("Failed to get bulk job: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get bulk job")
+		return
+	}
+
+	response.OK(c, http.StatusOK, job)
+}
+
+// bulkTask is a bulk job as the worker sees it
+type bulkTask struct {
+	id        int
+	owner     string
+	action    string
+	reason    *string
+	fromHost  *string
+	toHost    *string
+	codes     []string
+	processed int
+}
+
+// claimBulkJob takes the oldest queued job, or one whose worker stopped reporting progress
+func (srv *server) claimBulkJob() (*bulkTask, error) {
+	query := `
+		UPDATE bulk_jobs SET status = 'running', started_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM bulk_jobs
+			WHERE status = 'queued' OR (status = 'running' AND started_at < $1)
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, owner, action, reason, from_host, to_host, short_codes, processed
+	`
+	var t bulkTask
+	err := srv.db.QueryRow(query, time.Now().Add(-bulkStaleAfter)).
+		Scan(&t.id, &t.owner, &t.action, &t.reason, &t.fromHost, &t.toHost, pq.Array(&t.codes), &t.processed)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// applyBulkBatch deletes or disables one batch of the owner's links and
+// returns how many changed
+func (srv *server) applyBulkBatch(t *bulkTask, codes []string) (int, error) {
+	var changed []*URL
+	var err error
+	if t.action == bulkActionDisable {
+		var rows []dbq.Url
+		rows, err = srv.queries.DisableOwnedURLs(srv.ctx, dbq.DisableOwnedURLsParams{ShortCodes: codes, Owner: t.owner, DisabledReason: toNullString(t.reason)})
+		if err == nil {
+			changed, err = urlsFromRows(rows)
+		}
+	} else {
+		changed, err = srv.deleteOwnedURLs(srv.ctx, t.owner, codes)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to %s links: %v", t.action, err)
+	}
+
+	srv.invalidateURLCaches(codes)
+	actor := auditActor{ID: t.owner}
+	for _, u := range changed {
+		if t.action == bulkActionDelete {
+			srv.recordAudit(actor, auditLinkDelete, auditTargetLink, u.ShortCode, linkAuditState(u), nil)
+			srv.emitLinkEvent(eventLinkDeleted, u)
+			continue
+		}
+		before := *u
+		before.DisabledAt, before.DisabledReason = nil, nil
+		srv.recordAudit(actor, auditLinkDisable, auditTargetLink, u.ShortCode, linkAuditState(&before), linkAuditState(u))
+		srv.emitLinkEvent(eventLinkDisabled, u)
+	}
+	return len(changed), nil
+}
+
+func (srv *server) runBulkJob() bool {
+	t, err := srv.claimBulkJob()
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to claim bulk job: %v", err)
+		return false
+	}
+
+	apply := srv.applyBulkBatch
+	if t.action == bulkActionRewrite {
+		apply = srv.rewriteBulkBatch
+	}
+
+	for t.processed < len(t.codes) {
+		batch := t.codes[t.processed:min(t.processed+bulkBatchSize, len(t.codes))]
+		changed, err := apply(t, batch)
+		if err != nil {
+			log.Printf("Bulk job %d failed: %v", t.id, err)
+			if _, err := srv.db.Exec(`
+				UPDATE bulk_jobs SET status = 'failed', error = $2, completed_at = CURRENT_TIMESTAMP
+				WHERE id = $1
+			`, t.id, err.Error()); err != nil {
+				log.Printf("Failed to record bulk job %d failure: %v", t.id, err)
+			}
+			return true
+		}
+
+		// Progress also refreshes started_at, so a live job is never reclaimed
+		t.processed += len(batch)
+		if _, err := srv.db.Exec(`
+			UPDATE bulk_jobs SET processed = $2, affected = affected + $3, started_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, t.id, t.processed, changed); err != nil {
+			log.Printf("Failed to record bulk job %d progress: %v", t.id, err)
+		}
+	}
+
+	if _, err := srv.db.Exec(`UPDATE bulk_jobs SET status = 'completed', completed_at = CURRENT_TIMESTAMP WHERE id = $1`, t.id); err != nil {
+		log.Printf("Failed to complete bulk job %d: %v", t.id, err)
+		return true
+	}
+	log.Printf("Bulk job %d completed: %s of %d links", t.id, t.action, len(t.codes))
+	return true
+}
+
+// startBulkWorker processes bulk jobs in the background. Jobs are claimed
+// with SKIP LOCKED, so every instance can run a worker.
+func (srv *server) startBulkWorker() {
+	go func() {
+		ticker := time.NewTicker(bulkPollInterval)
+		defer ticker.Stop()
+		for {
+			for srv.runBulkJob() {
+			}
+			select {
+			case <-ticker.C:
+			case <-bulkWake:
+			}
+		}
+	}()
+}
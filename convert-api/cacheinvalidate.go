@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"shared/response"
+	"shared/tenantcache"
+)
+
+// Support staff can drop a stale redirect from every cache layer at once:
+// POST /api/admin/cache/invalidate deletes the redirect, preview and public
+// stats entries of the given short codes, and of every code matching the
+// given Redis glob patterns (abc*, promo-202?), from the redirect cache Redis
+// and its shards (see urlcache.go).
+// It then publishes the request on cacheEvictChannel, so redirect-api
+// instances also drop the codes from their in-memory hot snapshot.
+const (
+	cacheEvictChannel     = "cache:evict"
+	previewCacheKeyPrefix = "preview:"
+
+	auditCacheInvalidate = "cache.invalidate"
+	auditTargetCache     = "cache"
+
+	maxInvalidateCodes    = 1000
+	maxInvalidatePatterns = 10
+)
+
+// invalidatedKeyPrefixes are the redirect cache entries kept per short code
+var invalidatedKeyPrefixes = []string{urlCacheKeyPrefix, previewCacheKeyPrefix, publicStatsCacheKeyPrefix}
+
+type CacheInvalidateRequestBody struct {
+	ShortCodes []string `json:"shortCodes"`
+	Patterns   []string `json:"patterns"`
+}
+
+// CacheEviction is the message published on cacheEvictChannel
+type CacheEviction struct {
+	ShortCodes []string `json:"shortCodes,omitempty"`
+	Patterns   []string `json:"patterns,omitempty"`
+}
+
+type CacheInvalidateResponse struct {
+	KeysDeleted int64 `json:"keysDeleted"`
+	// Receivers is how many redirect-api instances got the eviction
+	Receivers int64 `json:"receivers"`
+}
+
+func validateCacheInvalidation(body *CacheInvalidateRequestBody) error {
+	if len(body.ShortCodes) == 0 && len(body.Patterns) == 0 {
+		return fmt.Errorf("shortCodes or patterns is required")
+	}
+	if len(body.ShortCodes) > maxInvalidateCodes {
+		return fmt.Errorf("at most %d short codes per request", maxInvalidateCodes)
+	}
+	if len(body.Patterns) > maxInvalidatePatterns {
+		return fmt.Errorf("at most %d patterns per request", maxInvalidatePatterns)
+	}
+	for _, code := range body.ShortCodes {
+		if code == "" || strings.ContainsAny(code, "*?[") {
+			return fmt.Errorf("invalid short code %q, use patterns for wildcards", code)
+		}
+	}
+	for _, pattern := range body.Patterns {
+		// A bare wildcard would empty the whole cache and send every redirect to Postgres
+		if strings.Trim(pattern, "*?") == "" {
+			return fmt.Errorf("pattern %q matches every short code", pattern)
+		}
+	}
+	return nil
+}
+
+// invalidateCache deletes the entries of the codes and the patterns' matches
+// and broadcasts the eviction
+func (srv *server) invalidateCache(eviction CacheEviction) (*CacheInvalidateResponse, error) {
+	keys := []string{}
+	for _, code := range eviction.ShortCodes {
+		for _, prefix := range invalidatedKeyPrefixes {
+			keys = append(keys, prefix+cacheShortCode(code))
+		}
+	}
+	for _, pattern := range eviction.Patterns {
+		for _, prefix := range invalidatedKeyPrefixes {
+			// url:* entries may be spread over several shards, each scanned in turn
+			clients := []*redis.Client{srv.cacheRdb}
+			if prefix == urlCacheKeyPrefix {
+				clients = clients[:0]
+				for _, node := range srv.urlCache.Nodes() {
+					clients = append(clients, node.Client)
+				}
+			}
+			for _, client := range clients {
+				// Entries live under their tenant's prefix; their pointers are named after them
+				iter := client.Scan(srv.ctx, 0, tenantcache.OwnerKey(prefix+cacheShortCode(pattern)), 1000).Iterator()
+				for iter.Next(srv.ctx) {
+					keys = append(keys, tenantcache.Name(iter.Val()))
+				}
+				if err := iter.Err(); err != nil {
+					return nil, fmt.Errorf("failed to scan for %s%s: %v", prefix, pattern, err)
+				}
+			}
+		}
+	}
+
+	byClient := map[*redis.Client][]string{}
+	for _, key := range keys {
+		client := srv.cacheRdb
+		if isURLCacheKey(key) {
+			client = srv.urlCache.Client(key)
+		}
+		byClient[client] = append(byClient[client], key)
+	}
+	resp := &CacheInvalidateResponse{}
+	for client, clientKeys := range byClient {
+		for start := 0; start < len(clientKeys); start += cacheInvalidationBatch {
+			end := min(start+cacheInvalidationBatch, len(clientKeys))
+			n, err := tenantcache.Del(srv.ctx, client, clientKeys[start:end]...)
+			if err != nil {
+				return nil, fmt.Errorf("failed to delete cache entries: %v", err)
+			}
+			resp.KeysDeleted += n
+		}
+	}
+
+	message, err := json.Marshal(eviction)
+	if err != nil {
+		return nil, err
+	}
+	resp.Receivers, err = srv.cacheRdb.Publish(srv.ctx, cacheEvictChannel, message).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to broadcast eviction: %v", err)
+	}
+	return resp, nil
+}
+
+func (srv *server) invalidateCacheHandler(c *gin.Context) {
+	var body CacheInvalidateRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateCacheInvalidation(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Bring the link store up to date too, since it backs cache misses when set
+	for _, code := range body.ShortCodes {
+		srv.syncLinkStore(code)
+	}
+	eviction := CacheEviction{ShortCodes: body.ShortCodes, Patterns: body.Patterns}
+	resp, err := srv.invalidateCache(eviction)
+	if err != nil {
+		log.Printf("Failed to invalidate cache: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to invalidate cache")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditCacheInvalidate, auditTargetCache, "redirect", nil, eviction)
+	log.Printf("Cache invalidated by %s: %d keys deleted, %d instances notified", callerID(c), resp.KeysDeleted, resp.Receivers)
+	response.OK(c, http.StatusOK, resp)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+	"shared/tracing"
+)
+
+var (
+	errCaptchaRequired    = errors.New("captcha token required")
+	errCaptchaFailed      = errors.New("captcha verification failed")
+	errCaptchaUnavailable = errors.New("captcha verification unavailable")
+)
+
+// captchaHeader carries the widget response token on anonymous create requests
+const captchaHeader = "X-Captcha-Token"
+
+var captchaVerifyEndpoints = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// CAPTCHA_PROVIDER ("hcaptcha" or "turnstile") turns on verification for anonymous creates
+var (
+	captchaProvider = strings.ToLower(os.Getenv("CAPTCHA_PROVIDER"))
+	captchaSecret   = os.Getenv("CAPTCHA_SECRET")
+)
+
+var captchaClient = tracing.Client(&http.Client{Timeout: 5 * time.Second})
+
+type captchaChallenge struct {
+	token    string
+	remoteIP string
+}
+
+type captchaContextKey struct{}
+
+type captchaVerifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func captchaEnabled() bool {
+	return captchaProvider != ""
+}
+
+// validateCaptchaConfig fails fast on a provider that can't be verified
+func validateCaptchaConfig() error {
+	if !captchaEnabled() {
+		return nil
+	}
+	if _, ok := captchaVerifyEndpoints[captchaProvider]; !ok {
+		return fmt.Errorf("unknown CAPTCHA_PROVIDER %q", captchaProvider)
+	}
+	if captchaSecret == "" {
+		return fmt.Errorf("CAPTCHA_SECRET is required when CAPTCHA_PROVIDER is set")
+	}
+	return nil
+}
+
+// verifyCaptcha validates the token with the provider's siteverify API. Tokens
+// are single use, so a retried request needs a fresh one.
+func verifyCaptcha(token, remoteIP string) error {
+	if token == "" {
+		return errCaptchaRequired
+	}
+
+	form := url.Values{}
+	form.Set("secret", captchaSecret)
+	form.Set("response", token)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	resp, err := captchaClient.PostForm(captchaVerifyEndpoints[captchaProvider], form)
+	if err != nil {
+		log.Printf("Captcha verification request failed: %v", err)
+		return errCaptchaUnavailable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Captcha verification returned status %d", resp.StatusCode)
+		return errCaptchaUnavailable
+	}
+
+	var result captchaVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Printf("Failed to decode captcha verification response: %v", err)
+		return errCaptchaUnavailable
+	}
+	if !result.Success {
+		log.Printf("Captcha rejected from %s: %v", remoteIP, result.ErrorCodes)
+		return errCaptchaFailed
+	}
+	return nil
+}
+
+// requireCaptcha verifies anonymous callers; authenticated consumers skip the challenge
+func requireCaptcha(c *gin.Context) {
+	if !captchaEnabled() || callerID(c) != "" {
+		c.Next()
+		return
+	}
+
+	err := verifyCaptcha(c.GetHeader(captchaHeader), c.ClientIP())
+	switch {
+	case err == nil:
+		c.Next()
+	case errors.Is(err, errCaptchaUnavailable):
+		response.Abort(c, http.StatusServiceUnavailable, err.Error())
+	default:
+		response.Abort(c, http.StatusForbidden, err.Error())
+	}
+}
+
+func withCaptchaChallenge(parent context.Context, c *gin.Context) context.Context {
+	return withCaptchaToken(parent, c.GetHeader(captchaHeader), c.ClientIP())
+}
+
+// withCaptchaToken keeps the caller's widget response token for verifyCaptchaFromContext
+func withCaptchaToken(parent context.Context, token, remoteIP string) context.Context {
+	return context.WithValue(parent, captchaContextKey{}, captchaChallenge{token: token, remoteIP: remoteIP})
+}
+
+// verifyCaptchaFromContext is the GraphQL and gRPC counterpart of
+// requireCaptcha, applied per call so anonymous reads stay unchallenged
+func verifyCaptchaFromContext(c context.Context, owner string) error {
+	if !captchaEnabled() || owner != "" {
+		return nil
+	}
+	challenge, _ := c.Value(captchaContextKey{}).(captchaChallenge)
+	return verifyCaptcha(challenge.token, challenge.remoteIP)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"shared/env"
+)
+
+// CASE_INSENSITIVE_CODES=true (set on both services) matches short codes
+// regardless of case, so links read out loud or typed from print still
+// resolve. New codes are generated in lowercase base36, and redirect-api
+// lower-cases codes before looking them up through the functional index
+// below; its cache keys are lower-cased too. Links created earlier keep their
+// mixed-case codes and resolve in any case, which needs codes differing only
+// in case to be gone before the mode is switched on.
+var caseInsensitiveCodes = env.Get("CASE_INSENSITIVE_CODES", "false") == "true"
+
+const caseInsensitiveTablesQuery = `
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_urls_short_code_lower ON urls(lower(short_code));
+	CREATE INDEX IF NOT EXISTS idx_urls_archive_short_code_lower ON urls_archive(lower(short_code));
+`
+
+// initCaseInsensitiveCodes creates the lower-case indexes; building the unique
+// one fails while two links have codes differing only in case
+func (srv *server) initCaseInsensitiveCodes() error {
+	if !caseInsensitiveCodes {
+		return nil
+	}
+	if _, err := srv.db.Exec(caseInsensitiveTablesQuery); err != nil {
+		return fmt.Errorf("failed to index lower-cased short codes, are there codes differing only in case? %v", err)
+	}
+	return nil
+}
+
+func encodeBase36(num int) string {
+	return fmt.Sprintf("%07s", strconv.FormatInt(int64(num), 36))
+}
+
+// cacheShortCode is the form of a short code redirect-api keys its caches and click counts by
+func cacheShortCode(shortCode string) string {
+	if caseInsensitiveCodes {
+		return strings.ToLower(shortCode)
+	}
+	return shortCode
+}
+
+// urlCacheKey is the redirect cache key of a short code
+func urlCacheKey(shortCode string) string {
+	return urlCacheKeyPrefix + cacheShortCode(shortCode)
+}
+
+// codeTakenIgnoringCase reports whether a link, live, archived or trashed, has code in any case
+func (srv *server) codeTakenIgnoringCase(code string) (bool, error) {
+	var taken bool
+	err := srv.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM urls WHERE lower(short_code) = lower($1))
+			OR EXISTS (SELECT 1 FROM urls_archive WHERE lower(short_code) = lower($1))
+			OR EXISTS (SELECT 1 FROM urls_trash WHERE lower(short_code) = lower($1))
+	`, code).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("failed to check short code: %v", err)
+	}
+	return taken, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"shared/env"
+)
+
+// Health checks of https destinations also keep the expiry of the certificate
+// served with the final response, or why the handshake failed. Lookups then
+// warn when it expires within CERT_EXPIRY_WARNING, so owners can get the
+// destination fixed before visitors hit certificate errors.
+var certExpiryWarning = env.Duration("CERT_EXPIRY_WARNING", 14*24*time.Hour)
+
+const certMonitorTablesQuery = `
+	ALTER TABLE destination_health ADD COLUMN IF NOT EXISTS cert_expires_at TIMESTAMP WITH TIME ZONE;
+	ALTER TABLE destination_health ADD COLUMN IF NOT EXISTS cert_error TEXT;
+`
+
+// certExpiry returns when the leaf certificate of a TLS connection expires, nil over plain HTTP
+func certExpiry(state *tls.ConnectionState) *time.Time {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	notAfter := state.PeerCertificates[0].NotAfter
+	return &notAfter
+}
+
+// certErrorDetail describes a failed request's certificate or TLS error, nil for other failures
+func certErrorDetail(err error) *string {
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+
+	var detail error
+	switch {
+	case errors.As(err, &hostnameErr):
+		detail = hostnameErr
+	case errors.As(err, &authorityErr):
+		detail = authorityErr
+	case errors.As(err, &invalidErr):
+		detail = invalidErr
+	case errors.As(err, &certErr):
+		detail = certErr
+	case errors.As(err, &recordErr):
+		detail = recordErr
+	default:
+		return nil
+	}
+	message := detail.Error()
+	return &message
+}
+
+// certWarnings lists the certificate problems of a destination for its owner
+func certWarnings(h *DestinationHealth) []string {
+	if h.CertError != nil {
+		return []string{"certificate is invalid: " + *h.CertError}
+	}
+	if h.CertExpiresAt == nil {
+		return nil
+	}
+
+	left := time.Until(*h.CertExpiresAt)
+	switch {
+	case left <= 0:
+		return []string{"certificate has expired"}
+	case left <= 24*time.Hour:
+		return []string{"certificate expires within a day"}
+	case left <= certExpiryWarning:
+		return []string{fmt.Sprintf("certificate expires in %d days", int(left.Hours()/24))}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"shared/response"
+	"shared/tenantcache"
+)
+
+// clicksPendingKey is the redirect cache hash, under the owner's tenant
+// prefix, redirect-api counts a link's clicks in before they are persisted to
+// link_clicks
+const clicksPendingKey = "clicks:pending"
+
+// link_clicks is kept apart from urls so click writes don't bump updated_at
+// (and with it ETags) or churn the hot urls rows. link_clicks_daily breaks the
+// same clicks down by UTC day for summary reports. click_batches records the
+// batches redirect-api has added, so it can retry one without counting it twice.
+const clickTablesQuery = `
+	CREATE TABLE IF NOT EXISTS link_clicks (
+		short_code VARCHAR(10) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+		clicks BIGINT NOT NULL DEFAULT 0,
+		last_clicked_at TIMESTAMP WITH TIME ZONE
+	);
+
+	CREATE TABLE IF NOT EXISTS link_clicks_daily (
+		short_code VARCHAR(10) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+		day DATE NOT NULL,
+		clicks BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (short_code, day)
+	);
+
+	CREATE TABLE IF NOT EXISTS click_batches (
+		batch_id TEXT PRIMARY KEY,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_click_batches_applied_at ON click_batches(applied_at);
+`
+
+type LinkClicksResponse struct {
+	ShortCode     string     `json:"shortCode"`
+	Clicks        int64      `json:"clicks"`
+	LastClickedAt *time.Time `json:"lastClickedAt,omitempty"`
+	// Health is the latest check of the destination, see healthcheck.go
+	Health *DestinationHealth `json:"health,omitempty"`
+}
+
+// getLinkClicksHandler returns the persisted click count plus the clicks still
+// pending in Redis, which trail real time by a few seconds at most. Only the
+// owner and admins see them; public stats are opt-in, see publicstats.go.
+func (srv *server) getLinkClicksHandler(c *gin.Context) {
+	u, ok := srv.visibleLink(c, "clicks")
+	if !ok {
+		return
+	}
+
+	resp := LinkClicksResponse{ShortCode: u.ShortCode}
+	var err error
+	resp.Clicks, resp.LastClickedAt, err = srv.linkClickTotal(u)
+	if err != nil {
+		log.Printf("Failed to get clicks: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to retrieve clicks")
+		return
+	}
+
+	if resp.Health, err = srv.linkHealth(u.ShortCode); err != nil {
+		log.Printf("Failed to get destination health: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to retrieve clicks")
+		return
+	}
+
+	response.OK(c, http.StatusOK, resp)
+}
+
+// linkClickTotal returns a link's persisted clicks plus the ones still pending
+// in Redis, and when it was last clicked. Pending clicks are left out while
+// Redis can't be read.
+func (srv *server) linkClickTotal(u *URL) (int64, *time.Time, error) {
+	shortCode := u.ShortCode
+	var clicks int64
+	var lastClickedAt *time.Time
+	err := srv.db.QueryRow(`SELECT clicks, last_clicked_at FROM link_clicks WHERE short_code = $1`, shortCode).
+		Scan(&clicks, &lastClickedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, nil, err
+	}
+
+	pending, err := srv.cacheRdb.HGet(srv.ctx, tenantcache.Key(u.Owner, clicksPendingKey), shortCode).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to get pending clicks for %s: %v", shortCode, err)
+	}
+	return clicks + pending, lastClickedAt, nil
+}
+
+// linkDailyClicks returns a link's persisted clicks on each of the last days
+// UTC days, oldest first with every day present
+func (srv *server) linkDailyClicks(shortCode string, days int) ([]DayCount, error) {
+	first := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+	daily := make([]DayCount, days)
+	index := make(map[string]int, days)
+	for i := range daily {
+		daily[i].Date = first.AddDate(0, 0, i).Format(time.DateOnly)
+		index[daily[i].Date] = i
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT to_char(day, 'YYYY-MM-DD'), clicks FROM link_clicks_daily
+		WHERE short_code = $1 AND day >= $2::date
+	`, shortCode, first.Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date string
+		var clicks int64
+		if err := rows.Scan(&date, &clicks); err != nil {
+			return nil, err
+		}
+		if i, ok := index[date]; ok {
+			daily[i].Count = clicks
+		}
+	}
+	return daily, rows.Err()
+}
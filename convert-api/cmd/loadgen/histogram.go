@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subBucketBits splits every power-of-two range of microseconds into 8 buckets,
+// keeping each bucket within 12.5% of its value
+const subBucketBits = 3
+
+// histogram is a log-linear latency histogram, safe for concurrent use
+type histogram struct {
+	mu     sync.Mutex
+	counts []int64
+	total  int64
+	max    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, (64+1)<<subBucketBits)}
+}
+
+func bucketIndex(us uint64) int {
+	if us < 1<<subBucketBits {
+		return int(us)
+	}
+	exp := bits.Len64(us) - 1 - subBucketBits
+	sub := (us >> exp) & (1<<subBucketBits - 1)
+	return (exp+1)<<subBucketBits + int(sub)
+}
+
+// bucketUpperBound is the largest latency that falls into bucket i
+func bucketUpperBound(i int) time.Duration {
+	if i < 1<<subBucketBits {
+		return time.Duration(i) * time.Microsecond
+	}
+	exp := i>>subBucketBits - 1
+	sub := uint64(i & (1<<subBucketBits - 1))
+	lower := (1<<subBucketBits | sub) << exp
+	return time.Duration(lower+(1<<exp)-1) * time.Microsecond
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := bucketIndex(uint64(d / time.Microsecond))
+
+	h.mu.Lock()
+	h.counts[i]++
+	h.total++
+	if d > h.max {
+		h.max = d
+	}
+	h.mu.Unlock()
+}
+
+// percentile returns the upper bound of the bucket holding the p-th percentile (0-100)
+func (h *histogram) percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(float64(h.total)*p/100 + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			return min(bucketUpperBound(i), h.max)
+		}
+	}
+	return h.max
+}
+
+// print writes the non-empty buckets with a bar scaled to the fullest one
+func (h *histogram) print(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var peak int64
+	for _, n := range h.counts {
+		peak = max(peak, n)
+	}
+	if peak == 0 {
+		return
+	}
+
+	const width = 40
+	var cumulative int64
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		cumulative += n
+		bar := strings.Repeat("█", int((n*width+peak-1)/peak))
+		fmt.Fprintf(w, "  ≤ %-10s %8d %6.2f%%  %s\n",
+			bucketUpperBound(i), n, float64(cumulative)*100/float64(h.total), bar)
+	}
+}
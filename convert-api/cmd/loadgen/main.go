@@ -0,0 +1,298 @@
+// Command loadgen drives the create and redirect endpoints at a fixed request
+// rate and reports latency percentiles and histograms per operation.
+//
+//	go run ./cmd/loadgen -base http://localhost:8000 -mode mixed -rps 500 -duration 1m
+//
+// Requests are scheduled open-loop and latency is measured from each request's
+// scheduled start, so a slow server shows up as latency instead of silently
+// lowering the offered rate. -max-p99 and -max-error-rate make it exit non-zero
+// for use as a CI gate.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"shared/response"
+)
+
+type config struct {
+	base         string
+	mode         string
+	rps          float64
+	duration     time.Duration
+	concurrency  int
+	createRatio  float64
+	seedLinks    int
+	apiKey       string
+	timeout      time.Duration
+	maxP99       time.Duration
+	maxErrorRate float64
+}
+
+// opStats collects the results of one operation
+type opStats struct {
+	name     string
+	latency  *histogram
+	ok       atomic.Int64
+	errors   atomic.Int64
+	statusMu sync.Mutex
+	statuses map[string]int64
+}
+
+func newOpStats(name string) *opStats {
+	return &opStats{name: name, latency: newHistogram(), statuses: map[string]int64{}}
+}
+
+func (s *opStats) record(latency time.Duration, status string, ok bool) {
+	s.latency.record(latency)
+	if ok {
+		s.ok.Add(1)
+	} else {
+		s.errors.Add(1)
+	}
+	s.statusMu.Lock()
+	s.statuses[status]++
+	s.statusMu.Unlock()
+}
+
+type loadgen struct {
+	cfg      config
+	client   *http.Client
+	create   *opStats
+	redirect *opStats
+
+	// codes are short codes available to redirect to
+	codesMu sync.RWMutex
+	codes   []string
+	seq     atomic.Int64
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.base, "base", "http://localhost:8000", "gateway base URL serving /api/v1/urls and /{shortCode}")
+	flag.StringVar(&cfg.mode, "mode", "mixed", "create, redirect or mixed")
+	flag.Float64Var(&cfg.rps, "rps", 100, "requests per second")
+	flag.DurationVar(&cfg.duration, "duration", 30*time.Second, "how long to run")
+	flag.IntVar(&cfg.concurrency, "concurrency", 64, "maximum requests in flight")
+	flag.Float64Var(&cfg.createRatio, "create-ratio", 0.1, "share of creates in mixed mode")
+	flag.IntVar(&cfg.seedLinks, "seed-links", 100, "links created before redirect and mixed runs")
+	flag.StringVar(&cfg.apiKey, "apikey", os.Getenv("LOADGEN_API_KEY"), "Kong key-auth key sent as the apikey header")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "per-request timeout")
+	flag.DurationVar(&cfg.maxP99, "max-p99", 0, "fail if any operation's p99 exceeds this (0 = off)")
+	flag.Float64Var(&cfg.maxErrorRate, "max-error-rate", 0, "fail if any operation's error rate exceeds this fraction (0 = off)")
+	flag.Parse()
+
+	if cfg.mode != "create" && cfg.mode != "redirect" && cfg.mode != "mixed" {
+		log.Fatalf("invalid -mode %q, expected create, redirect or mixed", cfg.mode)
+	}
+	if cfg.rps <= 0 || cfg.concurrency <= 0 {
+		log.Fatalf("-rps and -concurrency must be positive")
+	}
+	cfg.base = strings.TrimSuffix(cfg.base, "/")
+
+	g := &loadgen{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.timeout,
+			Transport: &http.Transport{
+				MaxIdleConns:        cfg.concurrency,
+				MaxIdleConnsPerHost: cfg.concurrency,
+			},
+			// Redirects are measured, not followed
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		create:   newOpStats("create"),
+		redirect: newOpStats("redirect"),
+	}
+
+	if cfg.mode != "create" {
+		if err := g.seed(); err != nil {
+			log.Fatalf("Failed to seed links: %v", err)
+		}
+	}
+
+	log.Printf("Running %s at %.0f rps for %s against %s", cfg.mode, cfg.rps, cfg.duration, cfg.base)
+	elapsed := g.run()
+
+	if !g.report(os.Stdout, elapsed) {
+		os.Exit(1)
+	}
+}
+
+// seed creates the links redirects are sent to, outside of the measured run
+func (g *loadgen) seed() error {
+	for i := 0; i < g.cfg.seedLinks; i++ {
+		code, _, err := g.doCreate()
+		if err != nil {
+			return err
+		}
+		g.codes = append(g.codes, code)
+	}
+	if len(g.codes) == 0 {
+		return errors.New("no links to redirect to, raise -seed-links")
+	}
+	return nil
+}
+
+// run schedules requests at the configured rate until the duration is over
+func (g *loadgen) run() time.Duration {
+	scheduled := make(chan time.Time, g.cfg.concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < g.cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range scheduled {
+				g.fire(start)
+			}
+		}()
+	}
+
+	interval := time.Duration(float64(time.Second) / g.cfg.rps)
+	begin := time.Now()
+	for next := begin; next.Sub(begin) < g.cfg.duration; next = next.Add(interval) {
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		}
+		scheduled <- next
+	}
+	close(scheduled)
+	wg.Wait()
+
+	return time.Since(begin)
+}
+
+func (g *loadgen) fire(scheduledAt time.Time) {
+	create := g.cfg.mode == "create" || (g.cfg.mode == "mixed" && rand.Float64() < g.cfg.createRatio)
+
+	if create {
+		code, status, err := g.doCreate()
+		g.create.record(time.Since(scheduledAt), status, err == nil)
+		if err == nil && g.cfg.mode == "mixed" {
+			g.codesMu.Lock()
+			g.codes = append(g.codes, code)
+			g.codesMu.Unlock()
+		}
+		return
+	}
+
+	g.codesMu.RLock()
+	code := g.codes[rand.Intn(len(g.codes))]
+	g.codesMu.RUnlock()
+
+	status, err := g.doRedirect(code)
+	g.redirect.record(time.Since(scheduledAt), status, err == nil)
+}
+
+func (g *loadgen) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if g.cfg.apiKey != "" {
+		req.Header.Set("apikey", g.cfg.apiKey)
+	}
+	return req, nil
+}
+
+// doCreate shortens a unique URL and returns its short code and the response status
+func (g *loadgen) doCreate() (string, string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"originalUrl": fmt.Sprintf("https://example.com/loadgen/%d/%d", time.Now().UnixNano(), g.seq.Add(1)),
+	})
+	req, err := g.newRequest(http.MethodPost, g.cfg.base+"/api/v1/urls", bytes.NewReader(body))
+	if err != nil {
+		return "", "error", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", "error", err
+	}
+	defer resp.Body.Close()
+
+	status := fmt.Sprint(resp.StatusCode)
+	if resp.StatusCode != http.StatusCreated {
+		io.Copy(io.Discard, resp.Body)
+		return "", status, fmt.Errorf("create returned %d", resp.StatusCode)
+	}
+
+	var created struct {
+		ShortCode string `json:"shortCode"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response.Envelope{Data: &created}); err != nil {
+		return "", status, err
+	}
+	return created.ShortCode, status, nil
+}
+
+func (g *loadgen) doRedirect(code string) (string, error) {
+	req, err := g.newRequest(http.MethodGet, g.cfg.base+"/"+code, nil)
+	if err != nil {
+		return "error", err
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "error", err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	status := fmt.Sprint(resp.StatusCode)
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return status, fmt.Errorf("redirect returned %d", resp.StatusCode)
+	}
+	return status, nil
+}
+
+// report prints the results and returns false when a threshold was exceeded
+func (g *loadgen) report(w io.Writer, elapsed time.Duration) bool {
+	passed := true
+	for _, s := range []*opStats{g.create, g.redirect} {
+		ok, failed := s.ok.Load(), s.errors.Load()
+		total := ok + failed
+		if total == 0 {
+			continue
+		}
+
+		errorRate := float64(failed) / float64(total)
+		p99 := s.latency.percentile(99)
+
+		fmt.Fprintf(w, "\n%s: %d requests, %.1f rps, %d errors (%.2f%%)\n",
+			s.name, total, float64(total)/elapsed.Seconds(), failed, errorRate*100)
+		fmt.Fprintf(w, "  p50 %s  p90 %s  p99 %s  p99.9 %s  max %s\n",
+			s.latency.percentile(50), s.latency.percentile(90), p99, s.latency.percentile(99.9), s.latency.percentile(100))
+
+		s.statusMu.Lock()
+		fmt.Fprintf(w, "  status %v\n", s.statuses)
+		s.statusMu.Unlock()
+
+		s.latency.print(w)
+
+		if g.cfg.maxP99 > 0 && p99 > g.cfg.maxP99 {
+			fmt.Fprintf(w, "FAIL: %s p99 %s exceeds %s\n", s.name, p99, g.cfg.maxP99)
+			passed = false
+		}
+		if g.cfg.maxErrorRate > 0 && errorRate > g.cfg.maxErrorRate {
+			fmt.Fprintf(w, "FAIL: %s error rate %.2f%% exceeds %.2f%%\n", s.name, errorRate*100, g.cfg.maxErrorRate*100)
+			passed = false
+		}
+	}
+	return passed
+}
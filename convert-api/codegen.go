@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"math/rand"
+	"os"
+	"strconv"
+
+	"shared/env"
+)
+
+// Short codes come from CODE_GENERATOR, the counter generator unless set to
+// hash (see hashcodes.go), except where a canary is configured:
+// CODE_GENERATOR_CANARY names a candidate generator and
+// CODE_GENERATOR_CANARY_PERCENT the share of creates that use it. Every new
+// link records its generator in urls.code_generator, so the two can be
+// compared on live traffic before switching over.
+const (
+	codeGeneratorCounter  = "counter"
+	codeGeneratorPermuted = "permuted"
+)
+
+// codeGenerators turns a counter ID into a short code; each must produce a
+// different code for every ID it will see
+var codeGenerators = map[string]func(id int) string{
+	codeGeneratorCounter:  generateShortCode,
+	codeGeneratorPermuted: generatePermutedCode,
+	codeGeneratorEmoji:    generateEmojiCode,
+}
+
+var (
+	defaultCodeGenerator       = env.Get("CODE_GENERATOR", codeGeneratorCounter)
+	codeGeneratorCanary        = os.Getenv("CODE_GENERATOR_CANARY")
+	codeGeneratorCanaryPercent = 0
+)
+
+const codeGeneratorTablesQuery = `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS code_generator TEXT;
+`
+
+// validateCodeGeneratorConfig fails fast on an unknown salt source, generator,
+// canary or percentage
+func validateCodeGeneratorConfig() error {
+	if err := initSaltSource(); err != nil {
+		return err
+	}
+	if defaultCodeGenerator != codeGeneratorCounter && defaultCodeGenerator != codeGeneratorHash {
+		return fmt.Errorf("unknown CODE_GENERATOR %q, expected counter or hash", defaultCodeGenerator)
+	}
+	if codeGeneratorCanary == "" {
+		return nil
+	}
+	if _, ok := codeGenerators[codeGeneratorCanary]; !ok {
+		return fmt.Errorf("unknown CODE_GENERATOR_CANARY %q", codeGeneratorCanary)
+	}
+	if codeGeneratorCanary == codeGeneratorEmoji {
+		return fmt.Errorf("emoji codes are enabled per tenant, not as a canary")
+	}
+	if caseInsensitiveCodes && codeGeneratorCanary == codeGeneratorPermuted {
+		return fmt.Errorf("the permuted generator makes mixed-case codes, which CASE_INSENSITIVE_CODES rules out")
+	}
+	percent, err := strconv.Atoi(os.Getenv("CODE_GENERATOR_CANARY_PERCENT"))
+	if err != nil || percent < 0 || percent > 100 {
+		return fmt.Errorf("CODE_GENERATOR_CANARY_PERCENT must be between 0 and 100")
+	}
+	codeGeneratorCanaryPercent = percent
+	log.Printf("Routing %d%% of creates through the %s code generator", percent, codeGeneratorCanary)
+	return nil
+}
+
+// pickCodeGenerator chooses the generator for one create
+func pickCodeGenerator() string {
+	if codeGeneratorCanary != "" && rand.Intn(100) < codeGeneratorCanaryPercent {
+		return codeGeneratorCanary
+	}
+	return defaultCodeGenerator
+}
+
+// The permuted generator maps IDs below 62^7 one to one onto 7-character
+// codes, one character shorter than the counter generator's from idgen.Start
+// on, so the two never collide. Multiplying by a constant coprime to 62^7
+// scrambles consecutive IDs without a salt.
+const (
+	permutedCodeSpace      = 3521614606208 // 62^7
+	permutedCodeMultiplier = 1580030173    // odd and not a multiple of 31
+	permutedCodeOffset     = 917263918273
+)
+
+func generatePermutedCode(id int) string {
+	hi, lo := bits.Mul64(uint64(id)%permutedCodeSpace, permutedCodeMultiplier)
+	_, n := bits.Div64(hi, lo, permutedCodeSpace)
+	return encodeBase62(int((n + permutedCodeOffset) % permutedCodeSpace))
+}
+
+// generateCode generates id's code with generator and returns it with the
+// generator actually used. Candidates can produce codes that already exist,
+// e.g. imported ones, or offensive ones, in which case the link falls back to
+// the counter generator, whose codes are reserved for the counter.
+func (srv *server) generateCode(generator string, id int) (string, string, error) {
+	if generator != codeGeneratorCounter {
+		code := codeGenerators[generator](id)
+		if isOffensiveCode(code) {
+			log.Printf("The %s code generator produced offensive code %s, using %s", generator, code, codeGeneratorCounter)
+		} else {
+			taken, err := srv.shortCodeTaken(code)
+			if err != nil {
+				return "", "", err
+			}
+			if !taken {
+				return code, generator, nil
+			}
+			log.Printf("The %s code generator produced existing code %s, using %s", generator, code, codeGeneratorCounter)
+		}
+	}
+
+	code, err := srv.generateCounterCode(id)
+	return code, codeGeneratorCounter, err
+}
+
+// shortCodeTaken reports whether a link, archived or trashed link has code
+func (srv *server) shortCodeTaken(code string) (bool, error) {
+	var taken bool
+	err := srv.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM urls WHERE short_code = $1)
+			OR EXISTS (SELECT 1 FROM urls_archive WHERE short_code = $1)
+			OR EXISTS (SELECT 1 FROM urls_trash WHERE short_code = $1)
+	`, code).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("failed to check short code: %v", err)
+	}
+	return taken, nil
+}
+
+// generateCounterCode generates id's counter code, trying other salts while
+// the code is offensive or, with case-insensitive codes, taken in another case
+func (srv *server) generateCounterCode(id int) (string, error) {
+	start := saltRand(shortCodeSalts)
+	for i := 0; i < shortCodeSalts; i++ {
+		code := saltedShortCode(id, (start+i)%shortCodeSalts)
+		if isOffensiveCode(code) {
+			continue
+		}
+		if caseInsensitiveCodes {
+			taken, err := srv.codeTakenIgnoringCase(code)
+			if err != nil {
+				return "", err
+			}
+			if taken {
+				log.Printf("Counter code %s is taken in another case, trying another salt", code)
+				continue
+			}
+		}
+		return code, nil
+	}
+	return "", fmt.Errorf("every short code of ID %d is offensive or taken", id)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"convert-api/idgen"
+)
+
+// Tests and benchmarks of the code generators on IDs the counter actually
+// hands out. They don't touch Postgres or Redis; the benchmarks run with:
+//
+//	go test -run '^$' -bench . -benchmem
+
+// Every generator must give each ID it sees its own code
+func TestCodeGeneratorsUnique(t *testing.T) {
+	for name, generate := range codeGenerators {
+		seen := map[string]int{}
+		for id := int(idgen.Start); id < int(idgen.Start)+20000; id++ {
+			code := generate(id)
+			if code == "" {
+				t.Fatalf("%s: empty code for %d", name, id)
+			}
+			if other, ok := seen[code]; ok {
+				t.Fatalf("%s: %d and %d both get %q", name, other, id, code)
+			}
+			seen[code] = id
+		}
+	}
+}
+
+func TestHashCodeDeterministic(t *testing.T) {
+	a := generateHashCode("https://example.com/a")
+	if a != generateHashCode("https://example.com/a") {
+		t.Fatal("Same URL, different codes")
+	}
+	if a == generateHashCode("https://example.com/b") {
+		t.Fatal("Different URLs, same code")
+	}
+}
+
+func BenchmarkCodeGenerators(b *testing.B) {
+	names := make([]string, 0, len(codeGenerators))
+	for name := range codeGenerators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		generate := codeGenerators[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				generate(int(idgen.Start) + i)
+			}
+		})
+	}
+}
+
+// BenchmarkCounterCode includes screening the code against the default word
+// list. Salts only change the last two characters, so an ID whose leading
+// ones spell a word tries all of them and fails, which is counted here too.
+func BenchmarkCounterCode(b *testing.B) {
+	defer func(words []string) { profanityWords = words }(profanityWords)
+	profanityWords = defaultProfanityWords
+	// Without case-insensitive codes generating one needs no connections
+	srv := &server{}
+
+	b.ReportAllocs()
+	failed := 0
+	for i := 0; i < b.N; i++ {
+		if _, err := srv.generateCounterCode(int(idgen.Start) + i); err != nil {
+			failed++
+		}
+	}
+	b.ReportMetric(float64(failed)/float64(b.N), "failed/op")
+}
+
+func BenchmarkHashCode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		generateHashCode(fmt.Sprintf("https://example.com/articles/%d", i))
+	}
+}
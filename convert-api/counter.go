@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"convert-api/idgen"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"shared/env"
+)
+
+// IDs are issued by the idgen package, the only writer of url_counter. Its
+// high-water mark is checkpointed every COUNTER_CHECKPOINT_INTERVAL, and a lost
+// counter restarts COUNTER_RESTORE_GAP past the last checkpoint.
+var (
+	counterCheckpointInterval = env.Duration("COUNTER_CHECKPOINT_INTERVAL", time.Minute)
+	counterRestoreGap         = int64(env.Int("COUNTER_RESTORE_GAP", idgen.DefaultRestoreGap))
+)
+
+// When the Redis counter fails, creates keep going on IDs from idgen's
+// Postgres fallback sequence (COUNTER_FALLBACK=false turns this off), and
+// Redis is only tried again every COUNTER_FALLBACK_RETRY so each create doesn't
+// wait out its timeout. The first create that gets an ID from Redis again
+// reconciles: it checkpoints the counter right away and logs how much of the
+// fallback range the outage used.
+var (
+	counterFallback      = env.Get("COUNTER_FALLBACK", "true") == "true"
+	counterFallbackRetry = env.Duration("COUNTER_FALLBACK_RETRY", 5*time.Second)
+
+	fallbackIDsIssued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "counter_fallback_ids_total",
+		Help: "IDs issued from the Postgres fallback sequence while the Redis counter was unavailable.",
+	})
+)
+
+// counterOutage tracks whether IDs are coming from the fallback sequence
+var counterOutage struct {
+	sync.Mutex
+	active    bool
+	retryAt   time.Time
+	startedAt time.Time
+	issued    int64
+}
+
+// initCounter loads the last checkpoint and repairs the counter if Redis lost
+// it. The repair is a single script, so instances starting together need no
+// lock: whichever runs first sets the floor and the others see it.
+func (srv *server) initCounter() {
+	srv.ids = idgen.New(srv.rdb, srv.db, counterRestoreGap)
+	currentVal, err := srv.ids.Init(srv.ctx)
+	if err != nil {
+		log.Fatalf("Failed to initialize Redis counter: %v", err)
+	}
+	log.Printf("Redis counter at %d (checkpoint %d)", currentVal, srv.ids.Checkpoint())
+}
+
+func (srv *server) getNextID(ctx context.Context) (int, error) {
+	if !counterFallback {
+		id, err := srv.ids.Next(ctx)
+		return int(id), err
+	}
+
+	counterOutage.Lock()
+	skipRedis := counterOutage.active && clock().Before(counterOutage.retryAt)
+	counterOutage.Unlock()
+	if !skipRedis {
+		id, err := srv.ids.Next(ctx)
+		if err == nil {
+			srv.endCounterOutage()
+			return int(id), nil
+		}
+		startCounterOutage(err)
+	}
+
+	id, err := srv.ids.NextFallback(ctx)
+	if err != nil {
+		return 0, err
+	}
+	counterOutage.Lock()
+	counterOutage.issued++
+	counterOutage.Unlock()
+	fallbackIDsIssued.Inc()
+	return int(id), nil
+}
+
+// startCounterOutage switches to the fallback sequence, or pushes back the
+// next attempt at Redis while already on it
+func startCounterOutage(err error) {
+	counterOutage.Lock()
+	defer counterOutage.Unlock()
+	counterOutage.retryAt = clock().Add(counterFallbackRetry)
+	if counterOutage.active {
+		return
+	}
+	counterOutage.active = true
+	counterOutage.startedAt = clock()
+	counterOutage.issued = 0
+	log.Printf("Redis counter unavailable, issuing IDs from Postgres: %v", err)
+}
+
+// endCounterOutage reconciles after the first ID from Redis since an outage
+func (srv *server) endCounterOutage() {
+	counterOutage.Lock()
+	if !counterOutage.active {
+		counterOutage.Unlock()
+		return
+	}
+	counterOutage.active = false
+	issued, since := counterOutage.issued, clock().Sub(counterOutage.startedAt)
+	counterOutage.Unlock()
+
+	go func() {
+		if err := srv.ids.SaveCheckpoint(srv.ctx); err != nil {
+			log.Printf("Failed to checkpoint counter after the Redis outage: %v", err)
+		}
+		last, err := srv.ids.FallbackLast(srv.ctx)
+		if err != nil {
+			log.Printf("Failed to read the fallback sequence: %v", err)
+			return
+		}
+		log.Printf("Redis counter back after %s, %d IDs were issued from Postgres meanwhile, %d of the fallback range left",
+			since.Round(time.Second), issued, idgen.Start-1-max(last, idgen.FallbackStart-1))
+	}()
+}
+
+func (srv *server) startCounterCheckpointer() {
+	srv.scheduleJob("counter-checkpoint", counterCheckpointInterval, func() error {
+		if err := srv.ids.SaveCheckpoint(srv.ctx); err != nil {
+			return fmt.Errorf("failed to checkpoint counter: %v", err)
+		}
+		return nil
+	})
+}
+
+// rebaseCounter raises the checkpoint and the Redis counter to at least the
+// backed up counter
+func (srv *server) rebaseCounter(counter int64) error {
+	if counter <= 0 {
+		return nil
+	}
+	current, err := srv.ids.Raise(srv.ctx, counter)
+	if err != nil {
+		return fmt.Errorf("failed to rebase counter: %v", err)
+	}
+	log.Printf("Redis counter at %d after restore (backup had %d)", current, counter)
+	return nil
+}
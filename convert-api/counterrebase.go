@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"convert-api/idgen"
+
+	"shared/secrets"
+)
+
+// Rebasing moves url_counter to a new value, e.g. to start a longer code length
+// or to make room for a merged dataset:
+//
+//	convertapi rebase-counter -to 3521614606207 -dry-run
+//	convertapi rebase-counter -to 3521614606207
+//
+// Codes are base62(id*1000 + salt), so every ID above the new value can
+// produce any code whose value lies in [id*1000, id*1000+999]. The command
+// decodes every existing short code and refuses to switch if any of them lies
+// in the range the counter would issue from, such as imported or custom codes.
+// Archived links count too, so their old short links are never reassigned.
+const base62Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	// maxRebaseConflictsShown caps the codes listed when a rebase is refused
+	maxRebaseConflictsShown = 20
+	// maxRebaseValue keeps id*1000 + salt within an int64
+	maxRebaseValue = (1<<63-1)/1000 - 1
+)
+
+// decodeBase62 reverses encodeBase62. It returns false for codes that aren't
+// base62 or don't fit in an int64, which generateShortCode can never produce.
+func decodeBase62(code string) (int64, bool) {
+	var n int64
+	for _, r := range code {
+		i := strings.IndexRune(base62Chars, r)
+		if i < 0 || n > (1<<63-1-int64(i))/62 {
+			return 0, false
+		}
+		n = n*62 + int64(i)
+	}
+	return n, true
+}
+
+// rebaseConflicts counts the existing short codes that IDs above newValue could
+// generate again, returning the first few of them and how many codes it checked
+func (srv *server) rebaseConflicts(newValue int64) ([]string, int64, int64, error) {
+	rows, err := srv.db.Query(`SELECT short_code FROM urls UNION ALL SELECT short_code FROM urls_archive UNION ALL SELECT short_code FROM urls_trash`)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	floor := (newValue + 1) * 1000
+	examples := []string{}
+	var conflicts, scanned int64
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, 0, 0, err
+		}
+		scanned++
+		if n, ok := decodeBase62(code); ok && n >= floor {
+			conflicts++
+			if len(examples) < maxRebaseConflictsShown {
+				examples = append(examples, code)
+			}
+		}
+	}
+	return examples, conflicts, scanned, rows.Err()
+}
+
+func (srv *server) rebaseCounterCommand(args []string) error {
+	flags := flag.NewFlagSet("rebase-counter", flag.ExitOnError)
+	to := flags.Int64("to", 0, "new counter value; the next link gets ID to+1")
+	dryRun := flags.Bool("dry-run", false, "only check for colliding short codes")
+	lower := flags.Bool("lower", false, "allow moving the counter down; stop every convert-api instance first")
+	flags.Parse(args)
+
+	if *to < idgen.Start-1 || *to > maxRebaseValue {
+		return fmt.Errorf("-to must be between %d and %d", idgen.Start-1, int64(maxRebaseValue))
+	}
+
+	secrets.Init()
+	srv.initDatabase()
+	srv.initRedis()
+
+	currentValue, err := srv.ids.Current(srv.ctx)
+	if err != nil {
+		return err
+	}
+
+	if *to < currentValue && !*lower {
+		return fmt.Errorf("counter is at %d; moving it down to %d needs -lower", currentValue, *to)
+	}
+
+	examples, conflicts, scanned, err := srv.rebaseConflicts(*to)
+	if err != nil {
+		return fmt.Errorf("failed to check short codes: %v", err)
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%d of %d short codes collide with IDs above %d, e.g. %s",
+			conflicts, scanned, *to, strings.Join(examples, ", "))
+	}
+	log.Printf("None of %d short codes collide with IDs above %d", scanned, *to)
+
+	if *dryRun {
+		return nil
+	}
+
+	if err := srv.ids.Rebase(srv.ctx, currentValue, *to); err != nil {
+		return err
+	}
+
+	log.Printf("Counter rebased from %d to %d", currentValue, *to)
+	return nil
+}
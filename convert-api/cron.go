@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/robfig/cron/v3"
+	"shared/accesslog"
+	"shared/response"
+)
+
+// The periodic jobs (cleanup, rescans, health checks, reports, the counter
+// checkpoint) run on an embedded cron scheduler. Each job runs every
+// *_INTERVAL as before unless CRON_<JOB> gives it a cron expression instead: five
+// fields or a descriptor such as @hourly or @every 10m, in UTC unless it
+// starts with CRON_TZ=<zone>. CRON_<JOB>=off turns the job off.
+//
+// Scheduled runs happen only on the leader (see leader.go) and never
+// overlap: every run, scheduled or triggered by an admin, first takes the
+// job's lock in the counter Redis, so a run that comes due while the last one
+// is still going, here or on another instance, is skipped and counted.
+// Admins can list the jobs with their stats and trigger a run on the instance
+// they reach.
+const cronOff = "off"
+
+// jobLockTTL is how long a crashed instance keeps a job locked; a run renews
+// the lock every third of it
+const jobLockTTL = 30 * time.Second
+
+var errJobRunning = errors.New("job is already running")
+
+var (
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cron_job_runs_total",
+		Help: "Finished runs of each scheduled job on this instance, by result (success or failure).",
+	}, []string{"job", "result"})
+	jobSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cron_job_skipped_total",
+		Help: "Runs of each scheduled job skipped because one was already going.",
+	}, []string{"job"})
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cron_job_duration_seconds",
+		Help:    "Duration of the runs of each scheduled job on this instance.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 4, 9),
+	}, []string{"job"})
+	jobRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cron_job_running",
+		Help: "Whether a run of each scheduled job is going on this instance.",
+	}, []string{"job"})
+)
+
+// releaseJobLockScript drops a job lock only if this run still holds it
+var releaseJobLockScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+	return 0
+`)
+
+// CronJob is a scheduled job with the stats of this instance's runs
+type CronJob struct {
+	Name           string     `json:"name"`
+	Schedule       string     `json:"schedule"`
+	Running        bool       `json:"running"`
+	Runs           int64      `json:"runs"`
+	Failures       int64      `json:"failures"`
+	Skipped        int64      `json:"skipped"`
+	LastStartedAt  *time.Time `json:"lastStartedAt,omitempty"`
+	LastDurationMS int64      `json:"lastDurationMs"`
+	LastError      *string    `json:"lastError,omitempty"`
+	LastSucceeded  *time.Time `json:"lastSucceededAt,omitempty"`
+	NextRunAt      *time.Time `json:"nextRunAt,omitempty"`
+}
+
+type cronJob struct {
+	srv      *server
+	schedule cron.Schedule
+	run      func() error
+	running  atomic.Bool
+
+	mu    sync.Mutex
+	stats CronJob
+}
+
+var (
+	cronMu   sync.Mutex
+	cronJobs = map[string]*cronJob{}
+)
+
+// cronEnv is the variable overriding a job's schedule, CRON_TRASH_PURGER for trash-purger
+func cronEnv(name string) string {
+	return "CRON_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// scheduleJob runs run on the leader every interval, or on the job's
+// CRON_<JOB> schedule
+func (srv *server) scheduleJob(name string, interval time.Duration, run func() error) {
+	srv.registerJob(name, interval, run, false)
+}
+
+// scheduleJobNow is scheduleJob for jobs that also run at startup, so a
+// restart more often than their interval doesn't keep them from running
+func (srv *server) scheduleJobNow(name string, interval time.Duration, run func() error) {
+	srv.registerJob(name, interval, run, true)
+}
+
+// jobSchedule parses a job's CRON_<JOB> schedule, every interval when unset.
+// The schedule is nil when the job is off.
+func jobSchedule(name string, interval time.Duration) (string, cron.Schedule, error) {
+	spec := os.Getenv(cronEnv(name))
+	if spec == cronOff {
+		return spec, nil, nil
+	}
+	if spec == "" {
+		spec = fmt.Sprintf("@every %s", interval)
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return spec, nil, fmt.Errorf("invalid %s %q: %v", cronEnv(name), spec, err)
+	}
+	return spec, schedule, nil
+}
+
+func (srv *server) registerJob(name string, interval time.Duration, run func() error, now bool) {
+	spec, schedule, err := jobSchedule(name, interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if schedule == nil {
+		log.Printf("Job %s is off", name)
+		return
+	}
+
+	job := &cronJob{srv: srv, schedule: schedule, run: run, stats: CronJob{Name: name, Schedule: spec}}
+	cronMu.Lock()
+	cronJobs[name] = job
+	cronMu.Unlock()
+
+	go func() {
+		if now && isLeader() {
+			job.start()
+		}
+		for {
+			next := schedule.Next(time.Now().UTC())
+			job.mu.Lock()
+			job.stats.NextRunAt = &next
+			job.mu.Unlock()
+
+			time.Sleep(time.Until(next))
+			if isLeader() {
+				job.start()
+			}
+		}
+	}()
+	log.Printf("Job %s scheduled (%s)", name, spec)
+}
+
+// start runs the job in the background unless a run is already going on
+// this or another instance
+func (j *cronJob) start() error {
+	name := j.stats.Name
+	if !j.running.CompareAndSwap(false, true) {
+		j.skip()
+		return errJobRunning
+	}
+	unlock, err := j.srv.lockJob(name)
+	if err != nil {
+		j.running.Store(false)
+		if err == errJobRunning {
+			j.skip()
+		} else {
+			log.Printf("Job %s not started: %v", name, err)
+		}
+		return err
+	}
+
+	started := time.Now().UTC()
+	j.mu.Lock()
+	j.stats.LastStartedAt = &started
+	j.mu.Unlock()
+	jobRunning.WithLabelValues(name).Set(1)
+
+	go func() {
+		defer j.running.Store(false)
+		defer unlock()
+		err := j.run()
+		elapsed := time.Since(started)
+		jobRunning.WithLabelValues(name).Set(0)
+		jobDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.stats.Runs++
+		j.stats.LastDurationMS = elapsed.Milliseconds()
+		if err != nil {
+			msg := err.Error()
+			j.stats.Failures++
+			j.stats.LastError = &msg
+			jobRuns.WithLabelValues(name, "failure").Inc()
+			log.Printf("Job %s failed: %v", name, err)
+		} else {
+			j.stats.LastError = nil
+			j.stats.LastSucceeded = &started
+			jobRuns.WithLabelValues(name, "success").Inc()
+		}
+	}()
+	return nil
+}
+
+func (j *cronJob) skip() {
+	j.mu.Lock()
+	j.stats.Skipped++
+	j.mu.Unlock()
+	jobSkipped.WithLabelValues(j.stats.Name).Inc()
+	log.Printf("Job %s is still running, skipping this run", j.stats.Name)
+}
+
+// lockJob takes the job's lock in the counter Redis and keeps renewing it
+// until the returned release is called. It fails with errJobRunning while
+// another run holds it.
+func (srv *server) lockJob(name string) (func(), error) {
+	key := "job:lock:" + name
+	token := leaderID + ":" + accesslog.NewRequestID()[:8]
+	held, err := campaignScript.Run(srv.ctx, srv.rdb, []string{key}, token, jobLockTTL.Milliseconds()).Int()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock job: %v", err)
+	}
+	if held != 1 {
+		return nil, errJobRunning
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(jobLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				held, err := campaignScript.Run(srv.ctx, srv.rdb, []string{key}, token, jobLockTTL.Milliseconds()).Int()
+				if err != nil {
+					log.Printf("Failed to renew the lock of job %s: %v", name, err)
+				} else if held != 1 {
+					log.Printf("Job %s lost its lock, another run may start", name)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		if err := releaseJobLockScript.Run(srv.ctx, srv.rdb, []string{key}, token).Err(); err != nil {
+			log.Printf("Failed to release the lock of job %s: %v", name, err)
+		}
+	}, nil
+}
+
+func (j *cronJob) snapshot() CronJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stats := j.stats
+	stats.Running = j.running.Load()
+	return stats
+}
+
+func listJobsHandler(c *gin.Context) {
+	cronMu.Lock()
+	jobs := make([]CronJob, 0, len(cronJobs))
+	for _, job := range cronJobs {
+		jobs = append(jobs, job.snapshot())
+	}
+	cronMu.Unlock()
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Name < jobs[k].Name })
+
+	response.OK(c, http.StatusOK, gin.H{"jobs": jobs, "leader": isLeader()})
+}
+
+// runJobHandler starts a run on this instance, leader or not, once no other
+// instance is running the job
+func runJobHandler(c *gin.Context) {
+	cronMu.Lock()
+	job, ok := cronJobs[c.Param("name")]
+	cronMu.Unlock()
+	if !ok {
+		failCode(c, http.StatusNotFound, codeJobNotFound)
+		return
+	}
+	if err := job.start(); err != nil {
+		if err == errJobRunning {
+			response.Fail(c, http.StatusConflict, err.Error())
+			return
+		}
+		response.Fail(c, http.StatusServiceUnavailable, "failed to start job")
+		return
+	}
+	log.Printf("Job %s triggered by %s", c.Param("name"), callerID(c))
+	response.OK(c, http.StatusAccepted, job.snapshot())
+}
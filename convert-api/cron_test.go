@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronEnv(t *testing.T) {
+	if got := cronEnv("trash-purger"); got != "CRON_TRASH_PURGER" {
+		t.Errorf("cronEnv = %s", got)
+	}
+}
+
+func TestJobSchedule(t *testing.T) {
+	from := time.Date(2024, 1, 15, 10, 7, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		env      string
+		wantSpec string
+		wantNext time.Time
+	}{
+		{"", "@every 5m0s", from.Add(5 * time.Minute)},
+		{"*/15 * * * *", "*/15 * * * *", time.Date(2024, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{"30 3 * * *", "30 3 * * *", time.Date(2024, 1, 16, 3, 30, 0, 0, time.UTC)},
+		{"@hourly", "@hourly", time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"CRON_TZ=Asia/Bangkok 0 9 * * *", "CRON_TZ=Asia/Bangkok 0 9 * * *", time.Date(2024, 1, 16, 2, 0, 0, 0, time.UTC)},
+	} {
+		t.Setenv("CRON_TEST_JOB", tt.env)
+		spec, schedule, err := jobSchedule("test-job", 5*time.Minute)
+		if err != nil {
+			t.Errorf("%q: %v", tt.env, err)
+			continue
+		}
+		if spec != tt.wantSpec {
+			t.Errorf("%q: spec %q, want %q", tt.env, spec, tt.wantSpec)
+		}
+		if next := schedule.Next(from); !next.Equal(tt.wantNext) {
+			t.Errorf("%q: next run %s, want %s", tt.env, next, tt.wantNext)
+		}
+	}
+}
+
+func TestJobScheduleOff(t *testing.T) {
+	t.Setenv("CRON_TEST_JOB", cronOff)
+	if _, schedule, err := jobSchedule("test-job", time.Minute); schedule != nil || err != nil {
+		t.Fatalf("Off job scheduled: %v, %v", schedule, err)
+	}
+}
+
+func TestJobScheduleInvalid(t *testing.T) {
+	for _, env := range []string{"every minute", "* * *", "61 * * * *", "* * * * * *"} {
+		t.Setenv("CRON_TEST_JOB", env)
+		if _, _, err := jobSchedule("test-job", time.Minute); err == nil {
+			t.Errorf("Accepted %q", env)
+		}
+	}
+}
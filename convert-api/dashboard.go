@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"shared/env"
+	"shared/response"
+)
+
+// The admin dashboard reads aggregates shaped for charts from
+// /api/admin/dashboard/*: links created and clicks per day, the top tenants,
+// redirect error rates and storage growth. Each covers the last ?days UTC
+// days, oldest first with every day present. The queries scan whole tables,
+// so results are cached in Redis for DASHBOARD_CACHE_TTL under
+// dashboardCacheKeyPrefix; ?refresh=true recomputes them. Postgres only knows
+// current table sizes, so the storage-snapshot job records them daily in
+// storage_snapshots.
+const (
+	dashboardCacheKeyPrefix = "dashboard:"
+
+	defaultDashboardDays = 30
+	maxDashboardDays     = 365
+	defaultTopTenants    = 10
+	maxTopTenants        = 100
+
+	// redirectStatsKeyPrefix is the per-day hash redirect-api counts its
+	// responses in, by status code, kept as long as its cache stats
+	redirectStatsKeyPrefix = "stats:redirects:"
+)
+
+var (
+	dashboardCacheTTL       = env.Duration("DASHBOARD_CACHE_TTL", 5*time.Minute)
+	storageSnapshotInterval = env.Duration("STORAGE_SNAPSHOT_INTERVAL", time.Hour)
+)
+
+const storageSnapshotTablesQuery = `
+	CREATE TABLE IF NOT EXISTS storage_snapshots (
+		day DATE NOT NULL,
+		table_name TEXT NOT NULL,
+		live_rows BIGINT NOT NULL,
+		total_bytes BIGINT NOT NULL,
+		PRIMARY KEY (day, table_name)
+	);
+`
+
+// DashboardWindow is the period an aggregate covers
+type DashboardWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// GeneratedAt is when the aggregate was computed, up to DASHBOARD_CACHE_TTL ago
+	GeneratedAt time.Time `json:"generatedAt"`
+}
+
+type DayCount struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// DashboardCounts is a daily series with its total over the window
+type DashboardCounts struct {
+	DashboardWindow
+	Total int64      `json:"total"`
+	Days  []DayCount `json:"days"`
+}
+
+// DashboardTenant is one tenant's activity; Links counts the links it owns now
+type DashboardTenant struct {
+	Owner        string `json:"owner"`
+	Links        int64  `json:"links"`
+	LinksCreated int64  `json:"linksCreated"`
+	Clicks       int64  `json:"clicks"`
+}
+
+type DashboardTenants struct {
+	DashboardWindow
+	By      string            `json:"by"`
+	Tenants []DashboardTenant `json:"tenants"`
+}
+
+// DashboardErrorDay counts one day of redirect responses; the rates are
+// omitted on days without any
+type DashboardErrorDay struct {
+	Date            string   `json:"date"`
+	Requests        int64    `json:"requests"`
+	Redirects       int64    `json:"redirects"`
+	NotFound        int64    `json:"notFound"`
+	Gone            int64    `json:"gone"`
+	ServerErrors    int64    `json:"serverErrors"`
+	ClientErrorRate *float64 `json:"clientErrorRate,omitempty"`
+	ServerErrorRate *float64 `json:"serverErrorRate,omitempty"`
+}
+
+type DashboardErrors struct {
+	DashboardWindow
+	Days []DashboardErrorDay `json:"days"`
+}
+
+// DashboardStorageDay is the size of every table on a day with a snapshot
+type DashboardStorageDay struct {
+	Date       string `json:"date"`
+	Rows       int64  `json:"rows"`
+	TotalBytes int64  `json:"totalBytes"`
+}
+
+// DashboardStorage tracks the database's size; Tables is the current breakdown
+type DashboardStorage struct {
+	DashboardWindow
+	GrowthBytes int64                 `json:"growthBytes"`
+	Days        []DashboardStorageDay `json:"days"`
+	Tables      []TableStats          `json:"tables"`
+}
+
+// dashboardDays parses ?days, writing the error and returning false when invalid
+func dashboardDays(c *gin.Context, max int) (int, bool) {
+	days := min(defaultDashboardDays, max)
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > max {
+			response.Fail(c, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", max))
+			return 0, false
+		}
+		days = n
+	}
+	return days, true
+}
+
+// dashboardWindow returns the window of the last days UTC days and its first day
+func dashboardWindow(days int) (DashboardWindow, time.Time) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, -(days - 1))
+	return DashboardWindow{
+		From:        first.Format(time.DateOnly),
+		To:          today.Format(time.DateOnly),
+		GeneratedAt: time.Now().UTC(),
+	}, first
+}
+
+// serveDashboard answers with the aggregate cached under key, computing and
+// caching it on a miss. Cache failures only cost a recomputation.
+func (srv *server) serveDashboard(c *gin.Context, key string, compute func() (interface{}, error)) {
+	key = dashboardCacheKeyPrefix + key
+	if c.Query("refresh") != "true" {
+		cached, err := srv.rdb.Get(srv.ctx, key).Bytes()
+		if err == nil {
+			response.OK(c, http.StatusOK, json.RawMessage(cached))
+			return
+		}
+		if err != redis.Nil {
+			log.Printf("Failed to read cached %s: %v", key, err)
+		}
+	}
+
+	v, err := compute()
+	if err != nil {
+		log.Printf("Failed to compute %s: %v", key, err)
+		response.Fail(c, http.StatusInternalServerError, "failed to compute dashboard")
+		return
+	}
+	if b, err := json.Marshal(v); err == nil {
+		if err := srv.rdb.Set(srv.ctx, key, b, dashboardCacheTTL).Err(); err != nil {
+			log.Printf("Failed to cache %s: %v", key, err)
+		}
+	}
+	response.OK(c, http.StatusOK, v)
+}
+
+// dailyCounts runs query, which groups counts by UTC day (YYYY-MM-DD) from
+// the first day of the window, $1, into a series with every day of it
+func (srv *server) dailyCounts(days int, query string) (*DashboardCounts, error) {
+	window, first := dashboardWindow(days)
+	counts := &DashboardCounts{DashboardWindow: window, Days: make([]DayCount, days)}
+	index := make(map[string]int, days)
+	for i := range counts.Days {
+		counts.Days[i].Date = first.AddDate(0, 0, i).Format(time.DateOnly)
+		index[counts.Days[i].Date] = i
+	}
+
+	rows, err := srv.db.Query(query, first.Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date string
+		var count int64
+		if err := rows.Scan(&date, &count); err != nil {
+			return nil, err
+		}
+		if i, ok := index[date]; ok {
+			counts.Days[i].Count = count
+			counts.Total += count
+		}
+	}
+	return counts, rows.Err()
+}
+
+// dashboardCreationsHandler counts links created per day, deleted ones included
+func (srv *server) dashboardCreationsHandler(c *gin.Context) {
+	days, ok := dashboardDays(c, maxDashboardDays)
+	if !ok {
+		return
+	}
+	srv.serveDashboard(c, fmt.Sprintf("creations:%d", days), func() (interface{}, error) {
+		return srv.dailyCounts(days, `
+			SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD'), COUNT(*)
+			FROM (
+				SELECT created_at FROM urls WHERE created_at >= $1::date::timestamp AT TIME ZONE 'UTC'
+				UNION ALL
+				SELECT created_at FROM urls_trash WHERE created_at >= $1::date::timestamp AT TIME ZONE 'UTC'
+				UNION ALL
+				SELECT created_at FROM urls_archive WHERE created_at >= $1::date::timestamp AT TIME ZONE 'UTC'
+			) created
+			GROUP BY 1
+		`)
+	})
+}
+
+// dashboardClicksHandler counts persisted clicks per day; deleting a link drops its clicks
+func (srv *server) dashboardClicksHandler(c *gin.Context) {
+	days, ok := dashboardDays(c, maxDashboardDays)
+	if !ok {
+		return
+	}
+	srv.serveDashboard(c, fmt.Sprintf("clicks:%d", days), func() (interface{}, error) {
+		return srv.dailyCounts(days, `
+			SELECT to_char(day, 'YYYY-MM-DD'), SUM(clicks)
+			FROM link_clicks_daily
+			WHERE day >= $1::date
+			GROUP BY day
+		`)
+	})
+}
+
+// topTenantQueries rank owners by ?by, most active first
+var topTenantQueries = map[string]string{
+	"clicks": `
+		SELECT u.owner
+		FROM link_clicks_daily d
+		JOIN urls u ON u.short_code = d.short_code
+		WHERE d.day >= $1::date AND u.owner != ''
+		GROUP BY u.owner
+		ORDER BY SUM(d.clicks) DESC, u.owner
+		LIMIT $2
+	`,
+	"links": `
+		SELECT owner
+		FROM urls
+		WHERE created_at >= $1::date::timestamp AT TIME ZONE 'UTC' AND owner != ''
+		GROUP BY owner
+		ORDER BY COUNT(*) DESC, owner
+		LIMIT $2
+	`,
+}
+
+func (srv *server) topTenants(days, limit int, by string) (*DashboardTenants, error) {
+	window, first := dashboardWindow(days)
+	top := &DashboardTenants{DashboardWindow: window, By: by, Tenants: []DashboardTenant{}}
+
+	rows, err := srv.db.Query(topTenantQueries[by], first.Format(time.DateOnly), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rank tenants: %v", err)
+	}
+	owners := []string{}
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to rank tenants: %v", err)
+		}
+		owners = append(owners, owner)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to rank tenants: %v", err)
+	}
+	if len(owners) == 0 {
+		return top, nil
+	}
+
+	rows, err = srv.db.Query(`
+		SELECT u.owner, COUNT(*), COUNT(*) FILTER (WHERE u.created_at >= $2::date::timestamp AT TIME ZONE 'UTC'), COALESCE(SUM(c.clicks), 0)
+		FROM urls u
+		LEFT JOIN (
+			SELECT short_code, SUM(clicks) AS clicks FROM link_clicks_daily WHERE day >= $2::date GROUP BY short_code
+		) c ON c.short_code = u.short_code
+		WHERE u.owner = ANY($1)
+		GROUP BY u.owner
+	`, pq.Array(owners), first.Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tenant activity: %v", err)
+	}
+	defer rows.Close()
+	byOwner := make(map[string]DashboardTenant, len(owners))
+	for rows.Next() {
+		var t DashboardTenant
+		if err := rows.Scan(&t.Owner, &t.Links, &t.LinksCreated, &t.Clicks); err != nil {
+			return nil, fmt.Errorf("failed to count tenant activity: %v", err)
+		}
+		byOwner[t.Owner] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count tenant activity: %v", err)
+	}
+	for _, owner := range owners {
+		top.Tenants = append(top.Tenants, byOwner[owner])
+	}
+	return top, nil
+}
+
+// dashboardTenantsHandler ranks the ?limit most active tenants by clicks, or
+// by links created with ?by=links
+func (srv *server) dashboardTenantsHandler(c *gin.Context) {
+	days, ok := dashboardDays(c, maxDashboardDays)
+	if !ok {
+		return
+	}
+	by := c.DefaultQuery("by", "clicks")
+	if _, ok := topTenantQueries[by]; !ok {
+		response.Fail(c, http.StatusBadRequest, "by must be clicks or links")
+		return
+	}
+	limit := defaultTopTenants
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTopTenants {
+			response.Fail(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxTopTenants))
+			return
+		}
+		limit = n
+	}
+	srv.serveDashboard(c, fmt.Sprintf("tenants:%s:%d:%d", by, days, limit), func() (interface{}, error) {
+		return srv.topTenants(days, limit, by)
+	})
+}
+
+// redirectErrors reads redirect-api's per-day response counts from the
+// redirect cache Redis. Only this region's redirects are counted.
+func (srv *server) redirectErrors(days int) (*DashboardErrors, error) {
+	window, first := dashboardWindow(days)
+	errs := &DashboardErrors{DashboardWindow: window, Days: make([]DashboardErrorDay, days)}
+	cmds := make([]*redis.MapStringStringCmd, days)
+	_, err := srv.cacheRdb.Pipelined(srv.ctx, func(pipe redis.Pipeliner) error {
+		for i := range errs.Days {
+			errs.Days[i].Date = first.AddDate(0, 0, i).Format(time.DateOnly)
+			cmds[i] = pipe.HGetAll(srv.ctx, redirectStatsKeyPrefix+errs.Days[i].Date)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redirect stats: %v", err)
+	}
+
+	for i := range errs.Days {
+		day := &errs.Days[i]
+		for field, value := range cmds[i].Val() {
+			status, _ := strconv.Atoi(field)
+			n, _ := strconv.ParseInt(value, 10, 64)
+			day.Requests += n
+			switch {
+			case status == http.StatusNotFound:
+				day.NotFound += n
+			case status == http.StatusGone:
+				day.Gone += n
+			case status >= 500:
+				day.ServerErrors += n
+			case status < 400:
+				day.Redirects += n
+			}
+		}
+		if day.Requests > 0 {
+			clientRate := float64(day.NotFound+day.Gone) / float64(day.Requests)
+			serverRate := float64(day.ServerErrors) / float64(day.Requests)
+			day.ClientErrorRate, day.ServerErrorRate = &clientRate, &serverRate
+		}
+	}
+	return errs, nil
+}
+
+// dashboardErrorsHandler reports redirect error rates per day, for as long as
+// redirect-api keeps its counts
+func (srv *server) dashboardErrorsHandler(c *gin.Context) {
+	days, ok := dashboardDays(c, maxStatsDays)
+	if !ok {
+		return
+	}
+	srv.serveDashboard(c, fmt.Sprintf("errors:%d", days), func() (interface{}, error) {
+		return srv.redirectErrors(days)
+	})
+}
+
+func (srv *server) storageGrowth(days int) (*DashboardStorage, error) {
+	window, first := dashboardWindow(days)
+	storage := &DashboardStorage{DashboardWindow: window, Days: []DashboardStorageDay{}}
+	rows, err := srv.db.Query(`
+		SELECT to_char(day, 'YYYY-MM-DD'), SUM(live_rows), SUM(total_bytes)
+		FROM storage_snapshots
+		WHERE day >= $1::date
+		GROUP BY day
+		ORDER BY day
+	`, first.Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage snapshots: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DashboardStorageDay
+		if err := rows.Scan(&d.Date, &d.Rows, &d.TotalBytes); err != nil {
+			return nil, fmt.Errorf("failed to read storage snapshots: %v", err)
+		}
+		storage.Days = append(storage.Days, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read storage snapshots: %v", err)
+	}
+	if n := len(storage.Days); n > 1 {
+		storage.GrowthBytes = storage.Days[n-1].TotalBytes - storage.Days[0].TotalBytes
+	}
+
+	if storage.Tables, err = srv.tableStats(); err != nil {
+		return nil, fmt.Errorf("failed to read table sizes: %v", err)
+	}
+	return storage, nil
+}
+
+// dashboardStorageHandler reports the database's size on each snapshotted
+// day; days before the first snapshot are missing
+func (srv *server) dashboardStorageHandler(c *gin.Context) {
+	days, ok := dashboardDays(c, maxDashboardDays)
+	if !ok {
+		return
+	}
+	srv.serveDashboard(c, fmt.Sprintf("storage:%d", days), func() (interface{}, error) {
+		return srv.storageGrowth(days)
+	})
+}
+
+// recordStorageSnapshot stores today's table sizes, replacing earlier ones of
+// the day, so each day keeps its last snapshot
+func (srv *server) recordStorageSnapshot() error {
+	_, err := srv.db.Exec(`
+		INSERT INTO storage_snapshots (day, table_name, live_rows, total_bytes)
+		SELECT (CURRENT_TIMESTAMP AT TIME ZONE 'UTC')::date, relname, n_live_tup, pg_total_relation_size(relid)
+		FROM pg_stat_user_tables
+		ON CONFLICT (day, table_name) DO UPDATE
+		SET live_rows = EXCLUDED.live_rows, total_bytes = EXCLUDED.total_bytes
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to record storage snapshot: %v", err)
+	}
+	return nil
+}
+
+func (srv *server) startStorageSnapshots() {
+	srv.scheduleJobNow("storage-snapshot", storageSnapshotInterval, srv.recordStorageSnapshot)
+}
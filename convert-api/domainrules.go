@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/env"
+	"shared/response"
+)
+
+var errBlockedDomain = errors.New("destination domain is not allowed")
+
+const (
+	domainListBlock = "block"
+	domainListAllow = "allow"
+)
+
+// Rules are cached in memory and reloaded periodically so every instance
+// picks up changes made through another one
+const domainRulesRefreshInterval = 30 * time.Second
+
+// DOMAIN_ALLOWLIST_ONLY=true rejects every host that doesn't match an allow rule
+var domainAllowlistOnly = env.Get("DOMAIN_ALLOWLIST_ONLY", "false") == "true"
+
+const domainRulesTablesQuery = `
+	CREATE TABLE IF NOT EXISTS domain_rules (
+		id SERIAL PRIMARY KEY,
+		pattern TEXT NOT NULL,
+		list TEXT NOT NULL CHECK (list IN ('block', 'allow')),
+		note TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (pattern, list)
+	);
+`
+
+// DomainRule blocks or allows a destination domain. "example.com" matches the
+// host exactly, "*.example.com" matches any of its subdomains.
+type DomainRule struct {
+	ID        int       `json:"id"`
+	Pattern   string    `json:"pattern"`
+	List      string    `json:"list"`
+	Note      string    `json:"note"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type DomainRuleRequestBody struct {
+	Pattern string `json:"pattern" binding:"required"`
+	List    string `json:"list" binding:"required"`
+	Note    string `json:"note"`
+}
+
+var domainRules = struct {
+	sync.RWMutex
+	block []string
+	allow []string
+}{}
+
+const domainRuleColumns = "id, pattern, list, note, created_by, created_at"
+
+func scanDomainRule(row rowScanner) (*DomainRule, error) {
+	var r DomainRule
+	if err := row.Scan(&r.ID, &r.Pattern, &r.List, &r.Note, &r.CreatedBy, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// normalizeDomainPattern lower-cases the pattern and validates its wildcard usage
+func normalizeDomainPattern(pattern string) (string, bool) {
+	pattern = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+	host := strings.TrimPrefix(pattern, "*.")
+	if host == "" || strings.ContainsAny(host, "*/:@ ") {
+		return "", false
+	}
+	return pattern, true
+}
+
+func domainMatches(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+func matchesAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if domainMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDomainPolicy enforces the block/allow lists on a destination host.
+// Allow rules take precedence, so a subdomain can be carved out of a blocked wildcard.
+func checkDomainPolicy(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	domainRules.RLock()
+	defer domainRules.RUnlock()
+
+	if matchesAny(domainRules.allow, host) {
+		return nil
+	}
+	if domainAllowlistOnly || matchesAny(domainRules.block, host) {
+		return errBlockedDomain
+	}
+	return nil
+}
+
+func (srv *server) loadDomainRules() error {
+	rows, err := srv.db.Query(`SELECT pattern, list FROM domain_rules`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	block, allow := []string{}, []string{}
+	for rows.Next() {
+		var pattern, list string
+		if err := rows.Scan(&pattern, &list); err != nil {
+			return err
+		}
+		if list == domainListAllow {
+			allow = append(allow, pattern)
+		} else {
+			block = append(block, pattern)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	domainRules.Lock()
+	domainRules.block, domainRules.allow = block, allow
+	domainRules.Unlock()
+
+	return nil
+}
+
+// startDomainRulesRefresher loads the rules once and keeps them fresh in the background
+func (srv *server) startDomainRulesRefresher() {
+	if err := srv.loadDomainRules(); err != nil {
+		log.Fatalf("Failed to load domain rules: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(domainRulesRefreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := srv.loadDomainRules(); err != nil {
+				log.Printf("Failed to refresh domain rules: %v", err)
+			}
+		}
+	}()
+}
+
+func (srv *server) listDomainRulesHandler(c *gin.Context) {
+	query := `SELECT ` + domainRuleColumns + ` FROM domain_rules`
+	args := []interface{}{}
+	if list := c.Query("list"); list != "" {
+		query += ` WHERE list = $1`
+		args = append(args, list)
+	}
+	query += ` ORDER BY list, pattern`
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list domain rules: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list domain rules")
+		return
+	}
+	defer rows.Close()
+
+	rules := []*DomainRule{}
+	for rows.Next() {
+		rule, err := scanDomainRule(rows)
+		if err != nil {
+			log.Printf("Failed to list domain rules: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list domain rules")
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"rules": rules})
+}
+
+func (srv *server) createDomainRuleHandler(c *gin.Context) {
+	var body DomainRuleRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.List != domainListBlock && body.List != domainListAllow {
+		response.Fail(c, http.StatusBadRequest, "list must be \"block\" or \"allow\"")
+		return
+	}
+	pattern, ok := normalizeDomainPattern(body.Pattern)
+	if !ok {
+		response.Fail(c, http.StatusBadRequest, "invalid domain pattern")
+		return
+	}
+
+	query := `
+		INSERT INTO domain_rules (pattern, list, note, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + domainRuleColumns
+
+	rule, err := scanDomainRule(srv.db.QueryRow(query, pattern, body.List, body.Note, callerID(c)))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			response.Fail(c, http.StatusConflict, "domain rule already exists")
+			return
+		}
+		log.Printf("Failed to create domain rule: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to create domain rule")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditDomainRuleCreate, auditTargetDomainRule, strconv.Itoa(rule.ID), nil, rule)
+
+	if err := srv.loadDomainRules(); err != nil {
+		log.Printf("Failed to reload domain rules: %v", err)
+	}
+
+	response.OK(c, http.StatusCreated, rule)
+}
+
+func (srv *server) deleteDomainRuleHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid rule id")
+		return
+	}
+
+	rule, err := scanDomainRule(srv.db.QueryRow(`DELETE FROM domain_rules WHERE id = $1 RETURNING `+domainRuleColumns, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeDomainRuleNotFound)
+			return
+		}
+		log.Printf("Failed to delete domain rule: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to delete domain rule")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditDomainRuleDelete, auditTargetDomainRule, strconv.Itoa(rule.ID), rule, nil)
+
+	if err := srv.loadDomainRules(); err != nil {
+		log.Printf("Failed to reload domain rules: %v", err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/acme"
+	"shared/env"
+	"shared/response"
+	"shared/tracing"
+	"shared/urlcrypto"
+)
+
+// Custom domains are onboarded in three steps:
+//
+//  1. POST /api/v1/domains registers the domain and returns a TXT record to publish.
+//  2. POST /api/v1/domains/{domain}/verify looks the record up; a match marks
+//     the domain verified.
+//  3. The provisioner obtains a certificate from an ACME CA (HTTP-01, answered
+//     at /.well-known/acme-challenge/ through Kong), stores it and, with
+//     KONG_ADMIN_URL set, installs it in Kong for the domain's SNI. It renews
+//     certificates in their last 30 days.
+//
+// Provisioning is off unless ACME_DIRECTORY_URL and ACME_EMAIL are set, since
+// the CA has to reach the domain over port 80.
+const (
+	domainStatusPending  = "pending"
+	domainStatusVerified = "verified"
+	domainStatusActive   = "active"
+
+	domainChallengePrefix = "_shortener-challenge."
+	domainChallengeValue  = "shortener-verify="
+
+	acmeChallengeKeyPrefix = "acme:challenge:"
+	acmeChallengeTTL       = 10 * time.Minute
+
+	certificateRenewBefore = 30 * 24 * time.Hour
+	// provisionLease is how long a claimed domain is left alone by other instances
+	provisionLease = 10 * time.Minute
+)
+
+var (
+	acmeDirectoryURL        = os.Getenv("ACME_DIRECTORY_URL")
+	acmeEmail               = os.Getenv("ACME_EMAIL")
+	kongAdminURL            = strings.TrimSuffix(os.Getenv("KONG_ADMIN_URL"), "/")
+	domainProvisionInterval = env.Duration("DOMAIN_PROVISION_INTERVAL", time.Minute)
+)
+
+var kongAdminClient = tracing.Client(&http.Client{Timeout: 10 * time.Second})
+
+var domainLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+const domainTablesQuery = `
+	CREATE TABLE IF NOT EXISTS custom_domains (
+		id SERIAL PRIMARY KEY,
+		domain TEXT NOT NULL UNIQUE,
+		owner TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		verification_token TEXT NOT NULL,
+		verified_at TIMESTAMP WITH TIME ZONE,
+		certificate_pem TEXT,
+		private_key TEXT,
+		certificate_expires_at TIMESTAMP WITH TIME ZONE,
+		kong_certificate_id UUID,
+		provision_started_at TIMESTAMP WITH TIME ZONE,
+		last_error TEXT,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_custom_domains_owner ON custom_domains(owner);
+
+	CREATE TABLE IF NOT EXISTS acme_accounts (
+		directory_url TEXT PRIMARY KEY,
+		private_key TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+// CustomDomain is a consumer's branded domain; certificates and keys are never returned
+type CustomDomain struct {
+	ID                   int             `json:"id"`
+	Domain               string          `json:"domain"`
+	Owner                string          `json:"owner"`
+	Status               string          `json:"status"`
+	Verification         DomainTXTRecord `json:"verification"`
+	VerifiedAt           *time.Time      `json:"verifiedAt,omitempty"`
+	CertificateExpiresAt *time.Time      `json:"certificateExpiresAt,omitempty"`
+	LastError            *string         `json:"lastError,omitempty"`
+	CreatedAt            time.Time       `json:"createdAt"`
+	UpdatedAt            time.Time       `json:"updatedAt"`
+}
+
+// DomainTXTRecord is the DNS record that proves control of a domain
+type DomainTXTRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type DomainRequestBody struct {
+	Domain string `json:"domain" binding:"required"`
+}
+
+const customDomainColumns = "id, domain, owner, status, verification_token, verified_at, certificate_expires_at, last_error, created_at, updated_at"
+
+func scanCustomDomain(row rowScanner) (*CustomDomain, error) {
+	var d CustomDomain
+	var token string
+	err := row.Scan(&d.ID, &d.Domain, &d.Owner, &d.Status, &token, &d.VerifiedAt,
+		&d.CertificateExpiresAt, &d.LastError, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Verification = DomainTXTRecord{Name: domainChallengePrefix + d.Domain, Type: "TXT", Value: domainChallengeValue + token}
+	return &d, nil
+}
+
+// normalizeCustomDomain lowercases a host name and rejects IPs, single labels and the service's own host
+func normalizeCustomDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if net.ParseIP(domain) != nil {
+		return "", errors.New("domain must be a host name, not an IP address")
+	}
+	labels := strings.Split(domain, ".")
+	if len(domain) > 253 || len(labels) < 2 {
+		return "", errors.New("domain must be a fully qualified host name")
+	}
+	for _, label := range labels {
+		if !domainLabelPattern.MatchString(label) {
+			return "", fmt.Errorf("invalid domain label %q", label)
+		}
+	}
+	if domain == shortURLHost() {
+		return "", errors.New("domain is the service's own host")
+	}
+	return domain, nil
+}
+
+func customDomainParam(c *gin.Context) string {
+	return strings.TrimSuffix(strings.ToLower(c.Param("domain")), ".")
+}
+
+func (srv *server) createDomainHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body DomainRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	domain, err := normalizeCustomDomain(body.Domain)
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	query := `
+		INSERT INTO custom_domains (domain, owner, verification_token)
+		VALUES ($1, $2, $3)
+		RETURNING ` + customDomainColumns
+
+	d, err := scanCustomDomain(srv.db.QueryRow(query, domain, owner, randomHex(16)))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			response.Fail(c, http.StatusConflict, "domain is already registered")
+			return
+		}
+		log.Printf("Failed to register domain: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to register domain")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditDomainCreate, auditTargetDomain, d.Domain, nil, d)
+	response.OK(c, http.StatusCreated, d)
+}
+
+func (srv *server) listDomainsHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	rows, err := srv.db.Query(`SELECT `+customDomainColumns+` FROM custom_domains WHERE owner = $1 ORDER BY domain`, owner)
+	if err != nil {
+		log.Printf("Failed to list domains: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list domains")
+		return
+	}
+	defer rows.Close()
+
+	domains := []*CustomDomain{}
+	for rows.Next() {
+		d, err := scanCustomDomain(rows)
+		if err != nil {
+			log.Printf("Failed to list domains: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list domains")
+			return
+		}
+		domains = append(domains, d)
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"domains": domains})
+}
+
+func (srv *server) getDomainHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	query := `SELECT ` + customDomainColumns + ` FROM custom_domains WHERE domain = $1 AND owner = $2`
+	d, err := scanCustomDomain(srv.db.QueryRow(query, customDomainParam(c), owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeDomainNotFound)
+			return
+		}
+		log.Printf("Failed to get domain: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get domain")
+		return
+	}
+
+	response.OK(c, http.StatusOK, d)
+}
+
+// lookupDomainChallenge reports whether the domain publishes its verification TXT record
+func lookupDomainChallenge(ctx context.Context, domain, token string) (bool, error) {
+	records, err := net.DefaultResolver.LookupTXT(ctx, domainChallengePrefix+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == domainChallengeValue+token {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// verifyDomainHandler checks the TXT record now; verified domains are picked up by the provisioner
+func (srv *server) verifyDomainHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	query := `SELECT ` + customDomainColumns + ` FROM custom_domains WHERE domain = $1 AND owner = $2`
+	before, err := scanCustomDomain(srv.db.QueryRow(query, customDomainParam(c), owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeDomainNotFound)
+			return
+		}
+		log.Printf("Failed to verify domain: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to verify domain")
+		return
+	}
+	if before.Status != domainStatusPending {
+		response.OK(c, http.StatusOK, before)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+	token := strings.TrimPrefix(before.Verification.Value, domainChallengeValue)
+	found, err := lookupDomainChallenge(ctx, before.Domain, token)
+	if err != nil {
+		log.Printf("Failed to look up TXT record of %s: %v", before.Domain, err)
+		response.Fail(c, http.StatusBadGateway, "DNS lookup failed, try again later")
+		return
+	}
+	if !found {
+		response.FailWithDetails(c, http.StatusUnprocessableEntity, "verification record not found", gin.H{
+			"verification": before.Verification,
+		})
+		return
+	}
+
+	d, err := scanCustomDomain(srv.db.QueryRow(`
+		UPDATE custom_domains
+		SET status = $2, verified_at = CURRENT_TIMESTAMP, last_error = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+customDomainColumns, before.ID, domainStatusVerified))
+	if err != nil {
+		log.Printf("Failed to verify domain: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to verify domain")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditDomainVerify, auditTargetDomain, d.Domain, before, d)
+	response.OK(c, http.StatusOK, d)
+}
+
+func (srv *server) deleteDomainHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var kongCertificateID *string
+	query := `DELETE FROM custom_domains WHERE domain = $1 AND owner = $2 RETURNING kong_certificate_id, ` + customDomainColumns
+	row := srv.db.QueryRow(query, customDomainParam(c), owner)
+	d, err := scanCustomDomain(scanPrefix{row, []interface{}{&kongCertificateID}})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeDomainNotFound)
+			return
+		}
+		log.Printf("Failed to delete domain: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to delete domain")
+		return
+	}
+
+	if kongCertificateID != nil {
+		if err := removeKongCertificate(*kongCertificateID); err != nil {
+			log.Printf("Failed to remove Kong certificate of %s: %v", d.Domain, err)
+		}
+	}
+
+	srv.recordAudit(actorFromGin(c), auditDomainDelete, auditTargetDomain, d.Domain, d, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// scanPrefix scans extra leading columns before handing the rest to another scanner
+type scanPrefix struct {
+	row    rowScanner
+	prefix []interface{}
+}
+
+func (s scanPrefix) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(s.prefix, dest...)...)
+}
+
+// acmeChallengeHandler answers HTTP-01 challenges for any instance's orders
+func (srv *server) acmeChallengeHandler(c *gin.Context) {
+	keyAuth, err := srv.rdb.Get(srv.ctx, acmeChallengeKeyPrefix+c.Param("token")).Result()
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Data(http.StatusOK, "text/plain", []byte(keyAuth))
+}
+
+func provisioningEnabled() bool {
+	return acmeDirectoryURL != "" && acmeEmail != ""
+}
+
+// acmeClient loads the account key for the directory, creating and registering one on first use
+func (srv *server) acmeClient(ctx context.Context) (*acme.Client, error) {
+	var stored string
+	err := srv.db.QueryRow(`SELECT private_key FROM acme_accounts WHERE directory_url = $1`, acmeDirectoryURL).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var key *ecdsa.PrivateKey
+	if err == nil {
+		if key, err = decodePrivateKey(stored); err != nil {
+			return nil, fmt.Errorf("failed to load ACME account key: %v", err)
+		}
+	} else {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+		encoded, err := encodePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		// Another instance may have won the race; use whichever key was stored
+		_, err = srv.db.Exec(`INSERT INTO acme_accounts (directory_url, private_key) VALUES ($1, $2) ON CONFLICT DO NOTHING`, acmeDirectoryURL, encoded)
+		if err != nil {
+			return nil, err
+		}
+		if err := srv.db.QueryRow(`SELECT private_key FROM acme_accounts WHERE directory_url = $1`, acmeDirectoryURL).Scan(&stored); err != nil {
+			return nil, err
+		}
+		if key, err = decodePrivateKey(stored); err != nil {
+			return nil, err
+		}
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: acmeDirectoryURL}
+	_, err = client.Register(ctx, &acme.Account{Contact: []string{"mailto:" + acmeEmail}}, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %v", err)
+	}
+	return client, nil
+}
+
+// Private keys are stored encrypted with the URL encryption keys when they are configured
+func encodePrivateKey(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return urlcrypto.Encrypt(string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+}
+
+func decodePrivateKey(stored string) (*ecdsa.PrivateKey, error) {
+	plain, err := urlcrypto.Decrypt(stored)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(plain))
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// obtainCertificate runs one ACME order for domain, answering its HTTP-01
+// challenges through Redis, and returns the PEM chain, the key and the expiry
+func (srv *server) obtainCertificate(ctx context.Context, client *acme.Client, domain string) (string, *ecdsa.PrivateKey, time.Time, error) {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("failed to create order: %v", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return "", nil, time.Time{}, fmt.Errorf("failed to get authorization: %v", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, ch := range authz.Challenges {
+			if ch.Type == "http-01" {
+				challenge = ch
+				break
+			}
+		}
+		if challenge == nil {
+			return "", nil, time.Time{}, errors.New("CA offered no http-01 challenge")
+		}
+
+		keyAuth, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return "", nil, time.Time{}, err
+		}
+		key := acmeChallengeKeyPrefix + challenge.Token
+		if err := srv.rdb.Set(ctx, key, keyAuth, acmeChallengeTTL).Err(); err != nil {
+			return "", nil, time.Time{}, fmt.Errorf("failed to store challenge response: %v", err)
+		}
+		defer srv.rdb.Del(ctx, key)
+
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			return "", nil, time.Time{}, fmt.Errorf("failed to accept challenge: %v", err)
+		}
+		if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return "", nil, time.Time{}, fmt.Errorf("http-01 challenge failed, is the domain pointed at the gateway? %v", err)
+		}
+	}
+
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("order failed: %v", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, certKey)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return "", nil, time.Time{}, fmt.Errorf("failed to finalize order: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+
+	var certPEM bytes.Buffer
+	for _, der := range chain {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return certPEM.String(), certKey, leaf.NotAfter, nil
+}
+
+// installKongCertificate creates or replaces the domain's certificate in Kong
+func installKongCertificate(id, domain, certPEM string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"cert": certPEM,
+		"key":  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})),
+		"snis": []string{domain},
+	})
+
+	req, err := http.NewRequest(http.MethodPut, kongAdminURL+"/certificates/"+id, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := kongAdminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("kong returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func removeKongCertificate(id string) error {
+	if kongAdminURL == "" {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodDelete, kongAdminURL+"/certificates/"+id, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := kongAdminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("kong returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newUUID returns a random version 4 UUID, the ID Kong objects are addressed by
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// claimDomainToProvision leases one verified domain without a certificate, or
+// an active one due for renewal, so only one instance orders for it
+func (srv *server) claimDomainToProvision() (int, string, *string, error) {
+	var id int
+	var domain string
+	var kongCertificateID *string
+	err := srv.db.QueryRow(`
+		UPDATE custom_domains
+		SET provision_started_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM custom_domains
+			WHERE (status = $1 OR (status = $2 AND certificate_expires_at < $3))
+				AND (provision_started_at IS NULL OR provision_started_at < $4)
+			ORDER BY provision_started_at NULLS FIRST
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, domain, kong_certificate_id
+	`, domainStatusVerified, domainStatusActive, time.Now().Add(certificateRenewBefore), time.Now().Add(-provisionLease)).
+		Scan(&id, &domain, &kongCertificateID)
+	if err == sql.ErrNoRows {
+		return 0, "", nil, nil
+	}
+	return id, domain, kongCertificateID, err
+}
+
+// provisionDomain obtains and stores a certificate for one domain, recording the
+// error on failure so the owner can see why; the lease retries it later
+func (srv *server) provisionDomain(client *acme.Client, id int, domain string, kongCertificateID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	fail := func(err error) {
+		log.Printf("Failed to provision certificate for %s: %v", domain, err)
+		if _, err := srv.db.Exec(`UPDATE custom_domains SET last_error = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, id, err.Error()); err != nil {
+			log.Printf("Failed to record provisioning error for %s: %v", domain, err)
+		}
+	}
+
+	certPEM, key, expiresAt, err := srv.obtainCertificate(ctx, client, domain)
+	if err != nil {
+		fail(err)
+		return
+	}
+	storedKey, err := encodePrivateKey(key)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	certificateID := newUUID()
+	if kongCertificateID != nil {
+		certificateID = *kongCertificateID
+	}
+	if kongAdminURL != "" {
+		if err := installKongCertificate(certificateID, domain, certPEM, key); err != nil {
+			fail(fmt.Errorf("certificate issued but not installed in Kong: %v", err))
+			return
+		}
+	}
+
+	_, err = srv.db.Exec(`
+		UPDATE custom_domains
+		SET status = $2, certificate_pem = $3, private_key = $4, certificate_expires_at = $5,
+			kong_certificate_id = $6, provision_started_at = NULL, last_error = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, id, domainStatusActive, certPEM, storedKey, expiresAt, certificateID)
+	if err != nil {
+		fail(err)
+		return
+	}
+	log.Printf("Provisioned certificate for %s, valid until %s", domain, expiresAt.Format(time.DateOnly))
+}
+
+// provisionDomains works through every domain waiting for a certificate
+func (srv *server) provisionDomains() {
+	var client *acme.Client
+	for {
+		id, domain, kongCertificateID, err := srv.claimDomainToProvision()
+		if err != nil {
+			log.Printf("Failed to claim domain to provision: %v", err)
+			return
+		}
+		if id == 0 {
+			return
+		}
+
+		if client == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			client, err = srv.acmeClient(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to set up ACME client: %v", err)
+				return
+			}
+		}
+		srv.provisionDomain(client, id, domain, kongCertificateID)
+	}
+}
+
+func (srv *server) startDomainProvisioner() {
+	if !provisioningEnabled() {
+		return
+	}
+
+	srv.scheduleJob("domain-provisioner", domainProvisionInterval, func() error {
+		srv.provisionDomains()
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tenants with the emoji code alphabet (see tenants.go) get codes spelled in
+// emoji instead of base62, such as 🐶🍋🚀🌵🐙🍇⚡🦊. Every emoji is a single code
+// point shown as emoji without a variation selector, so the code stored,
+// cached and routed is exactly what people paste; redirect-api strips the
+// U+FE0F selectors some keyboards add anyway. Codes are 8 emoji, which fits
+// urls.short_code, and never collide with base62 codes.
+const codeGeneratorEmoji = "emoji"
+
+var emojiAlphabet = []rune(
+	"🐶🐱🐭🐹🐰🦊🐻🐼🐨🐯🦁🐮🐷🐸🐵🐔" +
+		"🐧🐤🦆🦉🐴🦄🐝🦋🐌🐞🐢🐙🦀🐠🐬🐳" +
+		"🍏🍎🍐🍊🍋🍌🍉🍇🍓🍒🍍🥝🥥🥑🥕🌽" +
+		"🌵🌲🌴🍀🍁🌻🌷🌈🌙⭐⚡🔥🎈🎁🚀🎲")
+
+func init() {
+	seen := map[rune]bool{}
+	for _, r := range emojiAlphabet {
+		if seen[r] || r < utf8.RuneSelf {
+			panic(fmt.Sprintf("invalid emoji alphabet character %q", r))
+		}
+		seen[r] = true
+	}
+}
+
+// generateEmojiCode encodes id with a random salt, like the counter generator,
+// in base len(emojiAlphabet)
+func generateEmojiCode(id int) string {
+	num := id*shortCodeSalts + saltRand(shortCodeSalts)
+	base := len(emojiAlphabet)
+
+	digits := []rune{}
+	for num > 0 {
+		digits = append(digits, emojiAlphabet[num%base])
+		num /= base
+	}
+	var b strings.Builder
+	for i := len(digits) - 1; i >= 0; i-- {
+		b.WriteRune(digits[i])
+	}
+	return b.String()
+}
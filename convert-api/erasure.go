@@ -0,0 +1,416 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/response"
+)
+
+const (
+	auditSubjectErase     = "subject.erase"
+	auditTargetErasureJob = "erasure_job"
+	erasedActor           = "[erased]"
+	erasurePollInterval   = 30 * time.Second
+	erasureStaleAfter     = time.Hour
+	erasureAPIKeysNote    = "API keys belong to the Kong consumer; remove it from api-gateway/kong.yml"
+)
+
+// The subject and email are cleared once the job completes so the job row
+// itself doesn't keep the identifiers it erased
+const erasureTablesQuery = `
+	CREATE TABLE IF NOT EXISTS erasure_jobs (
+		id SERIAL PRIMARY KEY,
+		subject TEXT,
+		email TEXT,
+		status TEXT NOT NULL DEFAULT 'queued',
+		requested_by TEXT NOT NULL DEFAULT '',
+		report JSONB,
+		error TEXT,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		started_at TIMESTAMP WITH TIME ZONE,
+		completed_at TIMESTAMP WITH TIME ZONE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_erasure_jobs_status ON erasure_jobs(status, id);
+`
+
+// ErasureJob is an asynchronous request to erase everything tied to a consumer
+type ErasureJob struct {
+	ID          int            `json:"id"`
+	Status      string         `json:"status"`
+	RequestedBy string         `json:"requestedBy"`
+	Report      *ErasureReport `json:"report,omitempty"`
+	Error       *string        `json:"error,omitempty"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	StartedAt   *time.Time     `json:"startedAt,omitempty"`
+	CompletedAt *time.Time     `json:"completedAt,omitempty"`
+}
+
+// ErasureReport is the completion report of an erasure job
+type ErasureReport struct {
+	LinksDeleted            int64    `json:"linksDeleted"`
+	WebhooksDeleted         int64    `json:"webhooksDeleted"`
+	AbuseReportsAnonymized  int64    `json:"abuseReportsAnonymized"`
+	AuditEntriesAnonymized  int64    `json:"auditEntriesAnonymized"`
+	PagesDeleted            int64    `json:"pagesDeleted"`
+	DomainsDeleted          int64    `json:"domainsDeleted"`
+	CacheEntriesInvalidated int      `json:"cacheEntriesInvalidated"`
+	Notes                   []string `json:"notes"`
+}
+
+type ErasureRequestBody struct {
+	// Subject is the Kong consumer whose data is erased
+	Subject string `json:"subject" binding:"required"`
+	// Email optionally anonymizes abuse reports filed with this address
+	Email string `json:"email"`
+}
+
+// erasureWake nudges the worker when a job is queued instead of waiting for the next poll
+var erasureWake = make(chan struct{}, 1)
+
+const erasureJobColumns = "id, status, requested_by, report, error, created_at, started_at, completed_at"
+
+func scanErasureJob(row rowScanner) (*ErasureJob, error) {
+	var job ErasureJob
+	var report []byte
+	err := row.Scan(&job.ID, &job.Status, &job.RequestedBy, &report, &job.Error,
+		&job.CreatedAt, &job.StartedAt, &job.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	if report != nil {
+		job.Report = &ErasureReport{}
+		if err := json.Unmarshal(report, job.Report); err != nil {
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+func (srv *server) createErasureHandler(c *gin.Context) {
+	var body ErasureRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var email *string
+	if body.Email != "" {
+		email = &body.Email
+	}
+
+	query := `
+		INSERT INTO erasure_jobs (subject, email, requested_by)
+		VALUES ($1, $2, $3)
+		RETURNING ` + erasureJobColumns
+
+	job, err := scanErasureJob(srv.db.QueryRow(query, body.Subject, email, callerID(c)))
+	if err != nil {
+		log.Printf("Failed to queue erasure job: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to queue erasure")
+		return
+	}
+
+	// The subject is deliberately left out of the audit entry
+	srv.recordAudit(actorFromGin(c), auditSubjectErase, auditTargetErasureJob, strconv.Itoa(job.ID), nil, job)
+
+	select {
+	case erasureWake <- struct{}{}:
+	default:
+	}
+
+	c.Header("Location", fmt.Sprintf("/api/admin/erasures/%d", job.ID))
+	response.OK(c, http.StatusAccepted, job)
+}
+
+func (srv *server) getErasureHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid erasure job id")
+		return
+	}
+
+	job, err := scanErasureJob(srv.db.QueryRow(`SELECT `+erasureJobColumns+` FROM erasure_jobs WHERE id = $1`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeErasureJobNotFound)
+			return
+		}
+		log.Printf("Failed to get erasure job: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get erasure job")
+		return
+	}
+
+	response.OK(c, http.StatusOK, job)
+}
+
+// claimErasureJob takes the oldest queued job, or one whose worker died mid-run
+func (srv *server) claimErasureJob() (id int, subject string, email *string, err error) {
+	query := `
+		UPDATE erasure_jobs SET status = 'running', started_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM erasure_jobs
+			WHERE status = 'queued' OR (status = 'running' AND started_at < $1)
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, subject, email
+	`
+	err = srv.db.QueryRow(query, time.Now().Add(-erasureStaleAfter)).Scan(&id, &subject, &email)
+	return id, subject, email, err
+}
+
+// deleteReturning runs a DELETE of the subject's rows in tx and returns the
+// one column it returns of each
+func deleteReturning(tx *sql.Tx, query, subject string) ([]string, error) {
+	rows, err := tx.Query(query, subject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// eraseSubject deletes the subject's links (live, trashed and archived),
+// webhooks (deliveries cascade), pages and custom domains, anonymizes abuse
+// reports filed with their email and scrubs them from the audit log, all in
+// one transaction
+func (srv *server) eraseSubject(subject string, email *string) (*ErasureReport, error) {
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	report := &ErasureReport{Notes: []string{erasureAPIKeysNote}}
+
+	shortCodes, err := deleteReturning(tx, `DELETE FROM urls WHERE owner = $1 RETURNING short_code`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete links: %v", err)
+	}
+	// Trashed and archived links are erased and scrubbed from the audit log like live ones
+	trashed, err := deleteReturning(tx, `DELETE FROM urls_trash WHERE owner = $1 RETURNING short_code`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete trashed links: %v", err)
+	}
+	archived, err := deleteReturning(tx, `DELETE FROM urls_archive WHERE owner = $1 RETURNING short_code`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete archived links: %v", err)
+	}
+	shortCodes = append(append(shortCodes, trashed...), archived...)
+	report.LinksDeleted = int64(len(shortCodes))
+
+	// Buttons on other owners' pages went with the links, page_links cascades
+	pageSlugs, err := deleteReturning(tx, `DELETE FROM pages WHERE owner = $1 RETURNING slug`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete pages: %v", err)
+	}
+	report.PagesDeleted = int64(len(pageSlugs))
+
+	// Certificates and their private keys go with the domains
+	domainRows, err := deleteReturning(tx, `
+		DELETE FROM custom_domains WHERE owner = $1
+		RETURNING domain || ' ' || COALESCE(kong_certificate_id::text, '')
+	`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete custom domains: %v", err)
+	}
+	domains := make([]string, len(domainRows))
+	kongCertificateIDs := []string{}
+	for i, row := range domainRows {
+		domain, certificateID, _ := strings.Cut(row, " ")
+		domains[i] = domain
+		if certificateID != "" {
+			kongCertificateIDs = append(kongCertificateIDs, certificateID)
+		}
+	}
+	report.DomainsDeleted = int64(len(domains))
+
+	webhookIDs, err := deleteReturning(tx, `DELETE FROM webhooks WHERE owner = $1 RETURNING id::text`, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete webhooks: %v", err)
+	}
+	report.WebhooksDeleted = int64(len(webhookIDs))
+
+	// The notification address and every email sent to it go with the subject
+	if _, err := tx.Exec(`DELETE FROM notification_settings WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete notification settings: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM email_outbox WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete emails: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM link_event_outbox WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete queued link events: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM tenant_settings WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete tenant settings: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM error_pages WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete error pages: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM error_page_translations WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete error page translations: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM folders WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete folders: %v", err)
+	}
+	// History and versions of the erased links go; on other links the subject's changes keep only the action
+	if _, err := tx.Exec(`DELETE FROM link_history WHERE short_code = ANY($1)`, pq.Array(shortCodes)); err != nil {
+		return nil, fmt.Errorf("failed to delete link history: %v", err)
+	}
+	if _, err := tx.Exec(`UPDATE link_history SET actor = $2, changes = '{}' WHERE actor = $1`, subject, erasedActor); err != nil {
+		return nil, fmt.Errorf("failed to anonymize link history: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM link_destinations WHERE short_code = ANY($1)`, pq.Array(shortCodes)); err != nil {
+		return nil, fmt.Errorf("failed to delete link versions: %v", err)
+	}
+	if _, err := tx.Exec(`UPDATE link_destinations SET actor = $2 WHERE actor = $1`, subject, erasedActor); err != nil {
+		return nil, fmt.Errorf("failed to anonymize link versions: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM scheduled_changes WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete scheduled changes: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM bulk_jobs WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete bulk jobs: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM link_favorites WHERE owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete favorites: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM link_transfers WHERE from_owner = $1 OR to_owner = $1`, subject); err != nil {
+		return nil, fmt.Errorf("failed to delete transfers: %v", err)
+	}
+
+	if email != nil {
+		result, err := tx.Exec(`
+			UPDATE abuse_reports SET reporter_email = NULL, reporter_ip = ''
+			WHERE reporter_email = $1
+		`, *email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to anonymize abuse reports: %v", err)
+		}
+		report.AbuseReportsAnonymized, _ = result.RowsAffected()
+	}
+
+	if _, err := tx.Exec(`SET LOCAL audit_log.erasure = 'on'`); err != nil {
+		return nil, fmt.Errorf("failed to unlock audit log: %v", err)
+	}
+	// Snapshots of the erased links and webhooks, and of reports carrying the
+	// email, are dropped; entries the subject made keep only the action
+	scrubSnapshot := `(target_type = 'link' AND target_id = ANY($3))
+		OR (target_type = 'webhook' AND target_id = ANY($4))
+		OR (target_type = 'page' AND target_id = ANY($6))
+		OR (target_type = 'domain' AND target_id = ANY($7))
+		OR (target_type = 'abuse_report' AND $5::text IS NOT NULL
+			AND (before->>'reporterEmail' = $5 OR after->>'reporterEmail' = $5))`
+	result, err := tx.Exec(`
+		UPDATE audit_log
+		SET actor = CASE WHEN actor = $1 THEN $2 ELSE actor END,
+			ip = CASE WHEN actor = $1 THEN '' ELSE ip END,
+			before = CASE WHEN `+scrubSnapshot+` THEN NULL ELSE before END,
+			after = CASE WHEN `+scrubSnapshot+` THEN NULL ELSE after END
+		WHERE actor = $1 OR `+scrubSnapshot,
+		subject, erasedActor, pq.Array(shortCodes), pq.Array(webhookIDs), email, pq.Array(pageSlugs), pq.Array(domains))
+	if err != nil {
+		return nil, fmt.Errorf("failed to anonymize audit log: %v", err)
+	}
+	report.AuditEntriesAnonymized, _ = result.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// Deleted links must stop redirecting right away
+	srv.invalidateURLCaches(shortCodes)
+	report.CacheEntriesInvalidated = len(shortCodes)
+	// So does whatever else of theirs is cached: previews, pages, error pages
+	if _, err := srv.flushTenantCache(subject); err != nil {
+		log.Printf("Failed to flush the cache of erased %s: %v", subject, err)
+	}
+	for _, id := range kongCertificateIDs {
+		if err := removeKongCertificate(id); err != nil {
+			log.Printf("Failed to remove Kong certificate %s of erased %s: %v", id, subject, err)
+		}
+	}
+
+	return report, nil
+}
+
+// failErasureJob marks a job failed so it isn't left running
+func (srv *server) failErasureJob(id int, err error) {
+	log.Printf("Erasure job %d failed: %v", id, err)
+	if _, err := srv.db.Exec(`
+		UPDATE erasure_jobs SET status = 'failed', error = $2, completed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, id, err.Error()); err != nil {
+		log.Printf("Failed to record erasure job %d failure: %v", id, err)
+	}
+}
+
+func (srv *server) runErasureJob() bool {
+	id, subject, email, err := srv.claimErasureJob()
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to claim erasure job: %v", err)
+		return false
+	}
+
+	report, err := srv.eraseSubject(subject, email)
+	if err != nil {
+		srv.failErasureJob(id, err)
+		return true
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		srv.failErasureJob(id, fmt.Errorf("failed to encode report: %v", err))
+		return true
+	}
+	if _, err := srv.db.Exec(`
+		UPDATE erasure_jobs
+		SET status = 'completed', report = $2, subject = NULL, email = NULL, completed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, id, string(reportJSON)); err != nil {
+		log.Printf("Failed to complete erasure job %d: %v", id, err)
+		return true
+	}
+
+	log.Printf("Erasure job %d completed: %d links, %d webhooks", id, report.LinksDeleted, report.WebhooksDeleted)
+	return true
+}
+
+// startErasureWorker processes erasure jobs in the background. Jobs are
+// claimed with SKIP LOCKED, so every instance can run a worker.
+func (srv *server) startErasureWorker() {
+	go func() {
+		ticker := time.NewTicker(erasurePollInterval)
+		defer ticker.Stop()
+		for {
+			for srv.runErasureJob() {
+			}
+			select {
+			case <-ticker.C:
+			case <-erasureWake:
+			}
+		}
+	}()
+}
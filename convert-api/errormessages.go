@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"shared/i18n"
+	"shared/response"
+)
+
+// Validation and not-found errors are answered in the language the caller's
+// Accept-Language asks for, with a stable code next to the message:
+//
+//	{"code": "short_code_not_found", "message": "Kurzcode nicht gefunden"}
+//
+// The access log records the code (errorCode), so logs read the same whatever
+// the language. Other errors are only in English for now.
+const (
+	codeInvalidRequest          = "invalid_request"
+	codeInvalidURL              = "invalid_url"
+	codeInvalidLimit            = "invalid_limit"
+	codeInvalidCursor           = "invalid_cursor"
+	codeShortCodeNotFound       = "short_code_not_found"
+	codeTrashedLinkNotFound     = "trashed_link_not_found"
+	codeFolderNotFound          = "folder_not_found"
+	codeVersionNotFound         = "version_not_found"
+	codeBulkJobNotFound         = "bulk_job_not_found"
+	codeJobNotFound             = "job_not_found"
+	codeDomainNotFound          = "domain_not_found"
+	codeDomainRuleNotFound      = "domain_rule_not_found"
+	codeErasureJobNotFound      = "erasure_job_not_found"
+	codeErrorPageNotFound       = "error_page_not_found"
+	codeNotificationEmailNotSet = "notification_email_not_set"
+	codePageNotFound            = "page_not_found"
+	codeReviewLinkNotFound      = "review_link_not_found"
+	codeReportNotFound          = "report_not_found"
+	codeScheduledChangeNotFound = "scheduled_change_not_found"
+	codeScreenshotNotFound      = "screenshot_not_found"
+	codeTransferNotFound        = "transfer_not_found"
+	codeWebhookNotFound         = "webhook_not_found"
+	fieldMessagePrefix          = "field."
+	fieldMessageInvalidType     = fieldMessagePrefix + "invalid_type"
+)
+
+var errorMessages = i18n.New(i18n.Catalog{
+	codeInvalidRequest: {
+		"en": "invalid request",
+		"de": "ungültige Anfrage",
+		"es": "solicitud no válida",
+		"fr": "requête invalide",
+		"th": "คำขอไม่ถูกต้อง",
+	},
+	codeInvalidURL: {
+		"en": "invalid url",
+		"de": "ungültige URL",
+		"es": "URL no válida",
+		"fr": "URL invalide",
+		"th": "URL ไม่ถูกต้อง",
+	},
+	codeInvalidLimit: {
+		"en": "invalid limit",
+		"de": "ungültiges Limit",
+		"es": "límite no válido",
+		"fr": "limite invalide",
+		"th": "ค่า limit ไม่ถูกต้อง",
+	},
+	codeInvalidCursor: {
+		"en": "invalid cursor",
+		"de": "ungültiger Cursor",
+		"es": "cursor no válido",
+		"fr": "curseur invalide",
+		"th": "ค่า cursor ไม่ถูกต้อง",
+	},
+	codeShortCodeNotFound: {
+		"en": "short code not found",
+		"de": "Kurzcode nicht gefunden",
+		"es": "código corto no encontrado",
+		"fr": "code court introuvable",
+		"th": "ไม่พบรหัสลิงก์สั้น",
+	},
+	codeTrashedLinkNotFound: {
+		"en": "short code not found in trash",
+		"de": "Kurzcode nicht im Papierkorb gefunden",
+		"es": "código corto no encontrado en la papelera",
+		"fr": "code court introuvable dans la corbeille",
+		"th": "ไม่พบรหัสลิงก์สั้นในถังขยะ",
+	},
+	codeFolderNotFound: {
+		"en": "folder not found",
+		"de": "Ordner nicht gefunden",
+		"es": "carpeta no encontrada",
+		"fr": "dossier introuvable",
+		"th": "ไม่พบโฟลเดอร์",
+	},
+	codeVersionNotFound: {
+		"en": "version not found",
+		"de": "Version nicht gefunden",
+		"es": "versión no encontrada",
+		"fr": "version introuvable",
+		"th": "ไม่พบเวอร์ชัน",
+	},
+	codeBulkJobNotFound: {
+		"en": "bulk job not found",
+		"de": "Massenauftrag nicht gefunden",
+		"es": "trabajo masivo no encontrado",
+		"fr": "tâche groupée introuvable",
+		"th": "ไม่พบงานแบบกลุ่ม",
+	},
+	codeJobNotFound: {
+		"en": "job not found",
+		"de": "Job nicht gefunden",
+		"es": "trabajo no encontrado",
+		"fr": "tâche introuvable",
+		"th": "ไม่พบงาน",
+	},
+	codeDomainNotFound: {
+		"en": "domain not found",
+		"de": "Domain nicht gefunden",
+		"es": "dominio no encontrado",
+		"fr": "domaine introuvable",
+		"th": "ไม่พบโดเมน",
+	},
+	codeDomainRuleNotFound: {
+		"en": "domain rule not found",
+		"de": "Domainregel nicht gefunden",
+		"es": "regla de dominio no encontrada",
+		"fr": "règle de domaine introuvable",
+		"th": "ไม่พบกฎของโดเมน",
+	},
+	codeErasureJobNotFound: {
+		"en": "erasure job not found",
+		"de": "Löschauftrag nicht gefunden",
+		"es": "trabajo de borrado no encontrado",
+		"fr": "tâche d'effacement introuvable",
+		"th": "ไม่พบงานลบข้อมูล",
+	},
+	codeErrorPageNotFound: {
+		"en": "error page not found",
+		"de": "Fehlerseite nicht gefunden",
+		"es": "página de error no encontrada",
+		"fr": "page d'erreur introuvable",
+		"th": "ไม่พบหน้าแสดงข้อผิดพลาด",
+	},
+	codeNotificationEmailNotSet: {
+		"en": "no notification email set",
+		"de": "keine Benachrichtigungs-E-Mail festgelegt",
+		"es": "no hay correo de notificaciones configurado",
+		"fr": "aucune adresse e-mail de notification définie",
+		"th": "ยังไม่ได้ตั้งค่าอีเมลสำหรับการแจ้งเตือน",
+	},
+	codePageNotFound: {
+		"en": "page not found",
+		"de": "Seite nicht gefunden",
+		"es": "página no encontrada",
+		"fr": "page introuvable",
+		"th": "ไม่พบหน้า",
+	},
+	codeReviewLinkNotFound: {
+		"en": "no link pending review with this short code",
+		"de": "kein Link mit diesem Kurzcode wartet auf Prüfung",
+		"es": "no hay ningún enlace pendiente de revisión con este código corto",
+		"fr": "aucun lien en attente de vérification avec ce code court",
+		"th": "ไม่มีลิงก์ที่รอการตรวจสอบด้วยรหัสนี้",
+	},
+	codeReportNotFound: {
+		"en": "report not found",
+		"de": "Meldung nicht gefunden",
+		"es": "denuncia no encontrada",
+		"fr": "signalement introuvable",
+		"th": "ไม่พบรายงาน",
+	},
+	codeScheduledChangeNotFound: {
+		"en": "scheduled change not found",
+		"de": "geplante Änderung nicht gefunden",
+		"es": "cambio programado no encontrado",
+		"fr": "modification planifiée introuvable",
+		"th": "ไม่พบการเปลี่ยนแปลงที่ตั้งเวลาไว้",
+	},
+	codeScreenshotNotFound: {
+		"en": "no screenshot yet",
+		"de": "noch kein Screenshot vorhanden",
+		"es": "todavía no hay captura de pantalla",
+		"fr": "pas encore de capture d'écran",
+		"th": "ยังไม่มีภาพหน้าจอ",
+	},
+	codeTransferNotFound: {
+		"en": "transfer not found",
+		"de": "Übertragung nicht gefunden",
+		"es": "transferencia no encontrada",
+		"fr": "transfert introuvable",
+		"th": "ไม่พบการโอนลิงก์",
+	},
+	codeWebhookNotFound: {
+		"en": "webhook not found",
+		"de": "Webhook nicht gefunden",
+		"es": "webhook no encontrado",
+		"fr": "webhook introuvable",
+		"th": "ไม่พบเว็บฮุก",
+	},
+
+	// Messages of FieldError codes, see validation.go
+	fieldMessagePrefix + fieldRequired: {
+		"en": "is required",
+		"de": "ist erforderlich",
+		"es": "es obligatorio",
+		"fr": "est obligatoire",
+		"th": "จำเป็นต้องระบุ",
+	},
+	fieldMessagePrefix + fieldTooLong: {
+		"en": "must be at most %d bytes",
+		"de": "darf höchstens %d Bytes lang sein",
+		"es": "debe tener como máximo %d bytes",
+		"fr": "doit faire au plus %d octets",
+		"th": "ต้องยาวไม่เกิน %d ไบต์",
+	},
+	fieldMessagePrefix + fieldControlCharacter: {
+		"en": "must not contain control characters",
+		"de": "darf keine Steuerzeichen enthalten",
+		"es": "no debe contener caracteres de control",
+		"fr": "ne doit pas contenir de caractères de contrôle",
+		"th": "ต้องไม่มีอักขระควบคุม",
+	},
+	fieldMessagePrefix + fieldWhitespace: {
+		"en": "must not contain unescaped whitespace, use %20",
+		"de": "darf keine unkodierten Leerzeichen enthalten, verwende %20",
+		"es": "no debe contener espacios sin codificar, usa %20",
+		"fr": "ne doit pas contenir d'espaces non encodés, utilisez %20",
+		"th": "ต้องไม่มีช่องว่างที่ไม่ได้เข้ารหัส ให้ใช้ %20",
+	},
+	fieldMessagePrefix + fieldInvalid: {
+		"en": "is invalid",
+		"de": "ist ungültig",
+		"es": "no es válido",
+		"fr": "est invalide",
+		"th": "ไม่ถูกต้อง",
+	},
+	fieldMessageInvalidType: {
+		"en": "must be a %s",
+		"de": "muss vom Typ %s sein",
+		"es": "debe ser de tipo %s",
+		"fr": "doit être de type %s",
+		"th": "ต้องเป็นชนิด %s",
+	},
+	fieldMessagePrefix + fieldInPast: {
+		"en": "must be in the future",
+		"de": "muss in der Zukunft liegen",
+		"es": "debe ser una fecha futura",
+		"fr": "doit être dans le futur",
+		"th": "ต้องเป็นเวลาในอนาคต",
+	},
+}, "en", "de", "es", "fr", "th")
+
+// notFoundCodes are the codes of the not-found errors handlers pass on as is
+var notFoundCodes = []struct {
+	err  error
+	code string
+}{
+	{errShortCodeNotFound, codeShortCodeNotFound},
+	{errFolderNotFound, codeFolderNotFound},
+	{errVersionNotFound, codeVersionNotFound},
+}
+
+// requestLanguage is the language of c's error messages. It is announced in
+// Content-Language, and Vary keeps shared caches from mixing languages up.
+func requestLanguage(c *gin.Context) string {
+	lang := errorMessages.Negotiate(c.GetHeader("Accept-Language"))
+	c.Header("Content-Language", lang)
+	c.Writer.Header().Add("Vary", "Accept-Language")
+	return lang
+}
+
+// failCode answers with the message of code in the caller's language
+func failCode(c *gin.Context, status int, code string, args ...interface{}) {
+	lang := requestLanguage(c)
+	response.FailWith(c, status, response.Error{Code: code, Message: errorMessages.Message(lang, code, args...)})
+}
+
+// failNotFound answers 404 with the code of err
+func failNotFound(c *gin.Context, err error) {
+	for _, nf := range notFoundCodes {
+		if errors.Is(err, nf.err) {
+			failCode(c, http.StatusNotFound, nf.code)
+			return
+		}
+	}
+	response.Fail(c, http.StatusNotFound, err.Error())
+}
+
+// failValidation answers 400 with the field errors of a request in the
+// caller's language
+func failValidation(c *gin.Context, fields []FieldError) {
+	lang := requestLanguage(c)
+	localized := make([]FieldError, len(fields))
+	for i, f := range fields {
+		f.Message = errorMessages.Message(lang, f.messageCode, f.args...)
+		localized[i] = f
+	}
+	response.FailWith(c, http.StatusBadRequest, response.Error{
+		Code:    codeInvalidRequest,
+		Message: errorMessages.Message(lang, codeInvalidRequest),
+		Details: localized,
+	})
+}
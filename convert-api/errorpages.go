@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+	"shared/response"
+	"shared/tenantcache"
+)
+
+// Tenants can brand the pages browsers get from redirect-api when one of their
+// links is missing, expired or disabled. Templates are html/template sources
+// rendered with errorPageData, and are served with a CSP that blocks scripts.
+// Missing links are attributed to the owner of the custom domain they were
+// requested on. Each kind has a default template and optional translations
+// (?language=de), of which redirect-api serves the one matching the visitor's
+// Accept-Language, falling back to the default. redirect-api caches the
+// templates of each kind under errorPageCacheKeyPrefix in the owner's
+// keyspace (see the tenantcache package), which is dropped on every change.
+const (
+	errorPageNotFound = "not_found"
+	errorPageExpired  = "expired"
+	errorPageDisabled = "disabled"
+
+	maxErrorPageSize        = 64 << 10
+	errorPageCacheKeyPrefix = "error-pages:"
+)
+
+var errorPageKinds = []string{errorPageNotFound, errorPageExpired, errorPageDisabled}
+
+const errorPageTablesQuery = `
+	CREATE TABLE IF NOT EXISTS error_pages (
+		owner TEXT NOT NULL,
+		kind TEXT NOT NULL CHECK (kind IN ('not_found', 'expired', 'disabled')),
+		html TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (owner, kind)
+	);
+	CREATE TABLE IF NOT EXISTS error_page_translations (
+		owner TEXT NOT NULL,
+		kind TEXT NOT NULL CHECK (kind IN ('not_found', 'expired', 'disabled')),
+		language TEXT NOT NULL,
+		html TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (owner, kind, language)
+	);
+`
+
+// errorPageData is what templates can use; keep in sync with redirect-api
+type errorPageData struct {
+	ShortCode string
+	ShortURL  string
+	Host      string
+	Status    int
+	ExpiredAt string
+}
+
+// ErrorPage is a tenant's template for one kind of page, in Language when it
+// is a translation
+type ErrorPage struct {
+	Kind      string    `json:"kind"`
+	Language  string    `json:"language,omitempty"`
+	HTML      string    `json:"html"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ErrorPageRequestBody struct {
+	HTML string `json:"html" binding:"required"`
+}
+
+// Default templates are scanned with an empty language, like translations
+const (
+	errorPageColumns            = "kind, '' AS language, html, created_at, updated_at"
+	errorPageTranslationColumns = "kind, language, html, created_at, updated_at"
+)
+
+func scanErrorPage(row rowScanner) (*ErrorPage, error) {
+	var p ErrorPage
+	if err := row.Scan(&p.Kind, &p.Language, &p.HTML, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func validErrorPageKind(kind string) bool {
+	for _, k := range errorPageKinds {
+		if kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+// validateErrorPage parses the template and renders it once with sample data,
+// so mistakes surface here rather than on redirect-api
+func validateErrorPage(src string) error {
+	if len(src) > maxErrorPageSize {
+		return fmt.Errorf("html must be at most %d bytes", maxErrorPageSize)
+	}
+	tmpl, err := template.New("page").Parse(src)
+	if err != nil {
+		return fmt.Errorf("invalid template: %v", err)
+	}
+	sample := errorPageData{
+		ShortCode: "abc123",
+		ShortURL:  shortURL("abc123"),
+		Host:      shortURLHost(),
+		Status:    http.StatusNotFound,
+		ExpiredAt: time.Now().UTC().Format(time.RFC1123),
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return fmt.Errorf("invalid template: %v", err)
+	}
+	return nil
+}
+
+func (srv *server) invalidateErrorPageCache(owner, kind string) {
+	if _, err := tenantcache.Del(srv.ctx, srv.cacheRdb, tenantcache.Key(owner, errorPageCacheKeyPrefix+kind)); err != nil {
+		log.Printf("Failed to invalidate %s page of %s: %v", kind, owner, err)
+	}
+}
+
+// errorPageAuditTarget identifies a template in the audit log, owner:kind or
+// owner:kind:language for translations
+func errorPageAuditTarget(owner, kind, lang string) string {
+	if lang == "" {
+		return owner + ":" + kind
+	}
+	return owner + ":" + kind + ":" + lang
+}
+
+// errorPageKindParam validates the :kind parameter
+func errorPageKindParam(c *gin.Context) (string, bool) {
+	kind := c.Param("kind")
+	if !validErrorPageKind(kind) {
+		response.Fail(c, http.StatusNotFound, "kind must be not_found, expired or disabled")
+		return "", false
+	}
+	return kind, true
+}
+
+// errorPageLanguageParam validates the optional language parameter, a BCP 47
+// tag, and returns it canonicalized; "" addresses the default template
+func errorPageLanguageParam(c *gin.Context) (string, bool) {
+	lang := c.Query("language")
+	if lang == "" {
+		return "", true
+	}
+	tag, err := language.Parse(lang)
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "language must be a BCP 47 tag such as de or pt-BR")
+		return "", false
+	}
+	return tag.String(), true
+}
+
+func (srv *server) listErrorPagesHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT `+errorPageColumns+` FROM error_pages WHERE owner = $1
+		UNION ALL
+		SELECT `+errorPageTranslationColumns+` FROM error_page_translations WHERE owner = $1
+		ORDER BY kind, language
+	`, owner)
+	if err != nil {
+		log.Printf("Failed to list error pages: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list error pages")
+		return
+	}
+	defer rows.Close()
+
+	pages := []ErrorPage{}
+	for rows.Next() {
+		p, err := scanErrorPage(rows)
+		if err != nil {
+			log.Printf("Failed to scan error page: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list error pages")
+			return
+		}
+		pages = append(pages, *p)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list error pages: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list error pages")
+		return
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"errorPages": pages})
+}
+
+func (srv *server) getErrorPageHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	kind, ok := errorPageKindParam(c)
+	if !ok {
+		return
+	}
+	lang, ok := errorPageLanguageParam(c)
+	if !ok {
+		return
+	}
+
+	row := srv.db.QueryRow(`SELECT `+errorPageColumns+` FROM error_pages WHERE owner = $1 AND kind = $2`, owner, kind)
+	if lang != "" {
+		row = srv.db.QueryRow(`
+			SELECT `+errorPageTranslationColumns+` FROM error_page_translations
+			WHERE owner = $1 AND kind = $2 AND language = $3
+		`, owner, kind, lang)
+	}
+	p, err := scanErrorPage(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeErrorPageNotFound)
+			return
+		}
+		log.Printf("Failed to get error page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get error page")
+		return
+	}
+
+	response.OK(c, http.StatusOK, p)
+}
+
+func (srv *server) putErrorPageHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	kind, ok := errorPageKindParam(c)
+	if !ok {
+		return
+	}
+	lang, ok := errorPageLanguageParam(c)
+	if !ok {
+		return
+	}
+
+	var body ErrorPageRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateErrorPage(body.HTML); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	row := srv.db.QueryRow(`
+		INSERT INTO error_pages (owner, kind, html) VALUES ($1, $2, $3)
+		ON CONFLICT (owner, kind) DO UPDATE SET html = EXCLUDED.html, updated_at = CURRENT_TIMESTAMP
+		RETURNING `+errorPageColumns, owner, kind, body.HTML)
+	if lang != "" {
+		row = srv.db.QueryRow(`
+			INSERT INTO error_page_translations (owner, kind, language, html) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (owner, kind, language) DO UPDATE SET html = EXCLUDED.html, updated_at = CURRENT_TIMESTAMP
+			RETURNING `+errorPageTranslationColumns, owner, kind, lang, body.HTML)
+	}
+	p, err := scanErrorPage(row)
+	if err != nil {
+		log.Printf("Failed to save error page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to save error page")
+		return
+	}
+
+	srv.invalidateErrorPageCache(owner, kind)
+	srv.recordAudit(actorFromGin(c), auditErrorPageUpdate, auditTargetErrorPage, errorPageAuditTarget(owner, kind, lang), nil, gin.H{"kind": kind, "language": lang, "size": len(body.HTML)})
+	response.OK(c, http.StatusOK, p)
+}
+
+func (srv *server) deleteErrorPageHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	kind, ok := errorPageKindParam(c)
+	if !ok {
+		return
+	}
+	lang, ok := errorPageLanguageParam(c)
+	if !ok {
+		return
+	}
+
+	var result sql.Result
+	var err error
+	if lang == "" {
+		result, err = srv.db.Exec(`DELETE FROM error_pages WHERE owner = $1 AND kind = $2`, owner, kind)
+	} else {
+		result, err = srv.db.Exec(`DELETE FROM error_page_translations WHERE owner = $1 AND kind = $2 AND language = $3`, owner, kind, lang)
+	}
+	if err != nil {
+		log.Printf("Failed to delete error page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to delete error page")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		failCode(c, http.StatusNotFound, codeErrorPageNotFound)
+		return
+	}
+
+	srv.invalidateErrorPageCache(owner, kind)
+	srv.recordAudit(actorFromGin(c), auditErrorPageDelete, auditTargetErrorPage, errorPageAuditTarget(owner, kind, lang), gin.H{"kind": kind, "language": lang}, nil)
+	c.Status(http.StatusNoContent)
+}
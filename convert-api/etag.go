@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+)
+
+// urlETag versions a single link by its id and last modification time
+func urlETag(u *URL) string {
+	return fmt.Sprintf(`W/"%d-%d"`, u.ID, u.UpdatedAt.UnixNano())
+}
+
+// urlsETag versions a page of links; any added, removed or modified row changes it
+func urlsETag(urls []URL, extra string) string {
+	h := sha256.New()
+	for i := range urls {
+		fmt.Fprintf(h, "%d-%d;", urls[i].ID, urls[i].UpdatedAt.UnixNano())
+	}
+	h.Write([]byte(extra))
+	return `W/"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+// etagMatches reports whether If-None-Match contains the given ETag (weak comparison)
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	target := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == target {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonWithETag writes data and meta, or 304 Not Modified when the client
+// already has this version
+func jsonWithETag(c *gin.Context, etag string, data, meta interface{}) {
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	response.WithMeta(c, http.StatusOK, data, meta)
+}
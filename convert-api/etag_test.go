@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestURLETag(t *testing.T) {
+	u := &URL{ID: 7, UpdatedAt: time.Unix(1700000000, 5)}
+	if got, want := urlETag(u), `W/"7-1700000000000000005"`; got != want {
+		t.Errorf("urlETag = %s, want %s", got, want)
+	}
+}
+
+func TestURLsETag(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	page := []URL{{ID: 1, UpdatedAt: at}, {ID: 2, UpdatedAt: at}}
+	etag := urlsETag(page, "")
+	if etag != urlsETag([]URL{{ID: 1, UpdatedAt: at}, {ID: 2, UpdatedAt: at}}, "") {
+		t.Error("Same page, different ETags")
+	}
+	for name, other := range map[string]string{
+		"row removed":  urlsETag(page[:1], ""),
+		"row modified": urlsETag([]URL{{ID: 1, UpdatedAt: at}, {ID: 2, UpdatedAt: at.Add(time.Nanosecond)}}, ""),
+		"extra":        urlsETag(page, "next"),
+	} {
+		if other == etag {
+			t.Errorf("%s: ETag unchanged", name)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `W/"7-100"`
+	for _, tt := range []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{"*", true},
+		{` * `, true},
+		{`W/"7-100"`, true},
+		{`"7-100"`, true},
+		{`"1-1", W/"7-100"`, true},
+		{`"1-1",W/"2-2"`, false},
+		{`W/"7-101"`, false},
+	} {
+		if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+}
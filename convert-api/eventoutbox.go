@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Link events go through a Postgres outbox: emitLinkEvent queues the event,
+// and writeLinkEvent queues it inside the caller's transaction, so a link
+// saved with its events is never committed without them. A relay on every
+// instance claims queued events with SKIP LOCKED, hands them to the owner's
+// webhooks and deletes them in the same transaction. An instance that dies
+// between the two leaves its events to be relayed again, so receivers may see
+// an event twice and can tell by its X-Webhook-Id.
+const eventOutboxTablesQuery = `
+	CREATE TABLE IF NOT EXISTS link_event_outbox (
+		id BIGSERIAL PRIMARY KEY,
+		owner TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+const (
+	linkEventPollInterval = 5 * time.Second
+	linkEventBatch        = 100
+)
+
+// linkEventWake nudges the relay when this instance queues an event
+var linkEventWake = make(chan struct{}, 1)
+
+func wakeLinkEventRelay() {
+	select {
+	case linkEventWake <- struct{}{}:
+	default:
+	}
+}
+
+func newLinkEvent(event string, u *URL) linkEventPayload {
+	return linkEventPayload{
+		ID:        "evt_" + randomHex(12),
+		Type:      event,
+		CreatedAt: time.Now().UTC(),
+		Data: linkEventData{
+			ShortCode:   u.ShortCode,
+			ShortURL:    shortURL(u.ShortCode),
+			OriginalURL: u.OriginalURL,
+			CreatedAt:   u.CreatedAt,
+			UpdatedAt:   u.UpdatedAt,
+		},
+	}
+}
+
+// writeLinkEvent queues an event about one of u's owner's links through
+// exec. Call wakeLinkEventRelay once it has committed.
+func writeLinkEvent(exec execer, event string, u *URL) error {
+	if u.Owner == "" {
+		return nil
+	}
+	payload, err := json.Marshal(newLinkEvent(event, u))
+	if err != nil {
+		return fmt.Errorf("failed to encode link event: %v", err)
+	}
+	if _, err := exec.Exec(`INSERT INTO link_event_outbox (owner, payload) VALUES ($1, $2)`, u.Owner, payload); err != nil {
+		return fmt.Errorf("failed to queue link event: %v", err)
+	}
+	return nil
+}
+
+// relayLinkEvents dispatches a batch of queued events, returning how many
+func (srv *server) relayLinkEvents() (int, error) {
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, owner, payload FROM link_event_outbox
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, linkEventBatch)
+	if err != nil {
+		return 0, err
+	}
+	type queued struct {
+		owner   string
+		payload linkEventPayload
+	}
+	ids := []int64{}
+	events := []queued{}
+	for rows.Next() {
+		var id int64
+		var e queued
+		var payload []byte
+		if err := rows.Scan(&id, &e.owner, &payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		// A payload that no longer decodes is dropped with the batch
+		if err := json.Unmarshal(payload, &e.payload); err != nil {
+			log.Printf("Dropping undecodable link event %d: %v", id, err)
+			continue
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	for _, e := range events {
+		srv.dispatchLinkEvent(e.owner, e.payload)
+	}
+	if _, err := tx.Exec(`DELETE FROM link_event_outbox WHERE id = ANY($1)`, pq.Array(ids)); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
+
+// startLinkEventRelay relays queued events in the background
+func (srv *server) startLinkEventRelay() {
+	go func() {
+		ticker := time.NewTicker(linkEventPollInterval)
+		defer ticker.Stop()
+		for {
+			for {
+				n, err := srv.relayLinkEvents()
+				if err != nil {
+					log.Printf("Failed to relay link events: %v", err)
+				}
+				if err != nil || n < linkEventBatch {
+					break
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-linkEventWake:
+			}
+		}
+	}()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/response"
+)
+
+// GET /api/v1/expand follows a short URL, ours or another shortener's, hop by
+// hop up to EXPAND_MAX_HOPS redirects and reports where it ends up. Our own
+// short URLs are resolved from the database instead of over the network. Every
+// other hop goes through the SSRF-guarded outbound client, which re-checks the
+// address of each connection.
+var (
+	expandMaxHops = env.Int("EXPAND_MAX_HOPS", 10)
+	expandTimeout = env.Duration("EXPAND_TIMEOUT", 5*time.Second)
+)
+
+// expandClient never follows redirects itself so that each hop is recorded
+var expandClient = func() *http.Client {
+	client := newOutboundClient(expandTimeout)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}()
+
+// ExpandHop is one request of the chain. Location is set on redirects.
+type ExpandHop struct {
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	Location string `json:"location,omitempty"`
+}
+
+// ExpandResult is where a URL leads. Error says why the chain stopped before
+// reaching a destination that doesn't redirect; FinalURL is then the last URL reached.
+type ExpandResult struct {
+	URL      string      `json:"url"`
+	FinalURL string      `json:"finalUrl"`
+	Hops     []ExpandHop `json:"hops"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// parseExpandURL accepts absolute http(s) URLs only
+func parseExpandURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL")
+	}
+	return u, nil
+}
+
+// ownShortCode returns the short code of u when it is one of our short URLs
+func ownShortCode(u *url.URL) (string, bool) {
+	if !strings.EqualFold(u.Hostname(), shortURLHost()) {
+		return "", false
+	}
+	code := strings.TrimPrefix(u.Path, "/")
+	if code == "" || strings.Contains(code, "/") {
+		return "", false
+	}
+	return code, true
+}
+
+// expandHop resolves one hop, returning the next URL when it redirects
+func (srv *server) expandHop(u *url.URL) (ExpandHop, *url.URL, error) {
+	hop := ExpandHop{URL: u.String()}
+
+	if code, ok := ownShortCode(u); ok {
+		results, err := srv.resolveShortCodes([]string{code})
+		if err != nil {
+			return hop, nil, err
+		}
+		if results[0].Error != "" {
+			hop.Status = http.StatusNotFound
+			return hop, nil, errors.New(results[0].Error)
+		}
+		hop.Status = http.StatusFound
+		hop.Location = results[0].OriginalURL
+		next, err := parseExpandURL(hop.Location)
+		return hop, next, err
+	}
+
+	resp, err := srv.expandRequest(http.MethodHead, u)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		// Some servers only answer GET; the body is never read
+		resp.Body.Close()
+		resp, err = srv.expandRequest(http.MethodGet, u)
+	}
+	if err != nil {
+		return hop, nil, err
+	}
+	resp.Body.Close()
+
+	hop.Status = resp.StatusCode
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return hop, nil, nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		// A 3xx without a Location, such as 304, ends the chain
+		return hop, nil, nil
+	}
+	hop.Location = location.String()
+	next, err := parseExpandURL(hop.Location)
+	return hop, next, err
+}
+
+func (srv *server) expandRequest(method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(srv.ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "scalable-url-shortener-expander/1.0")
+	return expandClient.Do(req)
+}
+
+// expandURL follows u until it stops redirecting, loops, fails or runs out of hops
+func (srv *server) expandURL(u *url.URL) *ExpandResult {
+	result := &ExpandResult{URL: u.String(), FinalURL: u.String(), Hops: []ExpandHop{}}
+	seen := map[string]bool{}
+	for {
+		if seen[u.String()] {
+			result.Error = "redirect loop"
+			return result
+		}
+		seen[u.String()] = true
+
+		hop, next, err := srv.expandHop(u)
+		result.Hops = append(result.Hops, hop)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if next == nil {
+			return result
+		}
+
+		result.FinalURL = next.String()
+		if len(result.Hops) >= expandMaxHops {
+			result.Error = fmt.Sprintf("stopped after %d redirects", expandMaxHops)
+			return result
+		}
+		u = next
+	}
+}
+
+// expandHandler unshortens a URL, answering 200 with the chain even when it
+// stops early so callers can see how far it got
+func (srv *server) expandHandler(c *gin.Context) {
+	u, err := parseExpandURL(c.Query("url"))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, own := ownShortCode(u); !own {
+		if err := srv.validateOutboundHost(u.Hostname()); err != nil {
+			response.Fail(c, http.StatusBadRequest, fmt.Sprintf("url is not allowed: %v", err))
+			return
+		}
+	}
+
+	response.OK(c, http.StatusOK, srv.expandURL(u))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/secrets"
+	"shared/slowquery"
+)
+
+// Owners with a notification address are emailed once about links expiring
+// within their reminder window (EXPIRY_REMINDER_DAYS unless they set their own).
+// Each link in the email carries a one-click extend URL signed with
+// EXPIRY_EXTEND_SECRET over the link's current expiry, so it works once and
+// stops working as soon as the expiry changes. The reminded-for expiry is kept
+// in urls.expiry_reminder_sent_for: a changed expiry is reminded about again.
+const (
+	emailTemplateLinksExpiring = "links_expiring"
+	expiryReminderBatchSize    = 500
+)
+
+var (
+	expiryReminderDays     = env.Int("EXPIRY_REMINDER_DAYS", 3)
+	expiryReminderInterval = env.Duration("EXPIRY_REMINDER_INTERVAL", time.Hour)
+	expiryExtendBy         = env.Duration("EXPIRY_EXTEND_BY", 30*24*time.Hour)
+)
+
+const expiryReminderTablesQuery = `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS expiry_reminder_sent_for TIMESTAMP WITH TIME ZONE;
+	ALTER TABLE notification_settings ADD COLUMN IF NOT EXISTS expiry_reminder_days INTEGER;
+`
+
+func init() {
+	registerEmailTemplate(emailTemplateLinksExpiring,
+		`{{if eq (len .links) 1}}Your short link {{(index .links 0).shortUrl}} expires soon{{else}}{{len .links}} of your short links expire soon{{end}}`,
+		`Hello {{.owner}},
+
+The following short {{if eq (len .links) 1}}link expires{{else}}links expire{{end}} soon and will stop redirecting:
+{{range .links}}
+  {{.shortUrl}} on {{.expiresAt}}
+  Extend by {{$.extendBy}}: {{.extendUrl}}
+{{end}}
+If you no longer need these links, you can ignore this email.
+`)
+}
+
+// linksExpiringEmail is the data of emailTemplateLinksExpiring
+type linksExpiringEmail struct {
+	Owner    string              `json:"owner"`
+	ExtendBy string              `json:"extendBy"`
+	Links    []expiringLinkEmail `json:"links"`
+}
+
+type expiringLinkEmail struct {
+	ShortURL  string `json:"shortUrl"`
+	ExpiresAt string `json:"expiresAt"`
+	ExtendURL string `json:"extendUrl"`
+}
+
+func expiryExtendSecret() string {
+	return secrets.Value("EXPIRY_EXTEND_SECRET")
+}
+
+// signExpiryExtension authenticates extending shortCode while it expires at expiresAt
+func signExpiryExtension(shortCode string, expiresAt time.Time) string {
+	mac := hmac.New(sha256.New, []byte(expiryExtendSecret()))
+	mac.Write([]byte(shortCode + ":" + strconv.FormatInt(expiresAt.UnixMicro(), 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func expiryExtendURL(shortCode string, expiresAt time.Time) string {
+	return fmt.Sprintf("%sapi/v1/urls/%s/extend?expires=%d&sig=%s",
+		shortURLBase, shortCode, expiresAt.UnixMicro(), signExpiryExtension(shortCode, expiresAt))
+}
+
+// formatExtendBy renders EXPIRY_EXTEND_BY for people, in days when it is whole days
+func formatExtendBy(d time.Duration) string {
+	if d%(24*time.Hour) != 0 {
+		return d.String()
+	}
+	if days := int(d / (24 * time.Hour)); days != 1 {
+		return fmt.Sprintf("%d days", days)
+	}
+	return "1 day"
+}
+
+// claimExpiringLinks marks up to limit links due a reminder as reminded and returns them
+func (srv *server) claimExpiringLinks(limit int) ([]*URL, error) {
+	rows, err := srv.db.Query(`
+		WITH due AS (
+			SELECT u.id FROM urls u
+			JOIN notification_settings ns ON ns.owner = u.owner
+			WHERE u.expires_at > CURRENT_TIMESTAMP
+				AND u.expires_at <= CURRENT_TIMESTAMP + make_interval(days => COALESCE(ns.expiry_reminder_days, $1))
+				AND u.disabled_at IS NULL
+				AND u.expiry_reminder_sent_for IS DISTINCT FROM u.expires_at
+			ORDER BY u.expires_at
+			LIMIT $2
+			FOR UPDATE OF u SKIP LOCKED
+		)
+		UPDATE urls SET expiry_reminder_sent_for = urls.expires_at
+		FROM due WHERE urls.id = due.id
+		RETURNING urls.short_code, urls.owner, urls.expires_at
+	`, expiryReminderDays, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*URL{}
+	for rows.Next() {
+		var u URL
+		if err := rows.Scan(&u.ShortCode, &u.Owner, &u.ExpiresAt); err != nil {
+			return nil, err
+		}
+		links = append(links, &u)
+	}
+	return links, rows.Err()
+}
+
+// sendExpiryReminders queues one email per owner for every batch of links due a reminder
+func (srv *server) sendExpiryReminders() {
+	extendBy := formatExtendBy(expiryExtendBy)
+	for {
+		links, err := srv.claimExpiringLinks(expiryReminderBatchSize)
+		if err != nil {
+			log.Printf("Failed to claim expiring links: %v", err)
+			return
+		}
+
+		byOwner := map[string]*linksExpiringEmail{}
+		owners := []string{}
+		for _, u := range links {
+			data, ok := byOwner[u.Owner]
+			if !ok {
+				data = &linksExpiringEmail{Owner: u.Owner, ExtendBy: extendBy}
+				byOwner[u.Owner] = data
+				owners = append(owners, u.Owner)
+			}
+			data.Links = append(data.Links, expiringLinkEmail{
+				ShortURL:  shortURL(u.ShortCode),
+				ExpiresAt: u.ExpiresAt.UTC().Format("Mon, 02 Jan 2006 15:04 MST"),
+				ExtendURL: expiryExtendURL(u.ShortCode, *u.ExpiresAt),
+			})
+		}
+		for _, owner := range owners {
+			srv.notifyOwner(owner, emailTemplateLinksExpiring, byOwner[owner])
+		}
+		if len(links) > 0 {
+			log.Printf("Queued expiry reminders for %d links of %d owners", len(links), len(owners))
+		}
+
+		if len(links) < expiryReminderBatchSize {
+			return
+		}
+	}
+}
+
+// startExpiryReminders runs the reminder job on every instance; SKIP LOCKED
+// keeps two instances from reminding about the same link
+func (srv *server) startExpiryReminders() {
+	if emailSenderImpl == nil {
+		return
+	}
+	if expiryExtendSecret() == "" {
+		log.Printf("Expiry reminders are off: EXPIRY_EXTEND_SECRET is not set")
+		return
+	}
+
+	srv.scheduleJobNow("expiry-reminders", expiryReminderInterval, func() error {
+		srv.sendExpiryReminders()
+		return nil
+	})
+}
+
+// extendURLExpiry pushes the expiry of a link back by EXPIRY_EXTEND_BY, provided
+// it still expires at signedExpiry. Links that already lapsed but weren't reaped
+// yet get EXPIRY_EXTEND_BY from now.
+func (srv *server) extendURLExpiry(actor auditActor, shortCode string, signedExpiry time.Time) (*URL, error) {
+	before, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := srv.queries.ExtendURLExpiry(slowquery.Tag(srv.ctx, "", shortCode), dbq.ExtendURLExpiryParams{
+		ShortCode:       shortCode,
+		SignedExpiry:    signedExpiry,
+		ExtendBySeconds: expiryExtendBy.Seconds(),
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShortCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to extend URL: %v", err)
+	}
+	u, err := urlFromRow(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extend URL: %v", err)
+	}
+
+	srv.invalidateURLCache(shortCode)
+	srv.recordAudit(actor, auditLinkUpdate, auditTargetLink, shortCode, linkAuditState(before), linkAuditState(u))
+	srv.emitLinkEvent(eventLinkUpdated, u)
+
+	return u, nil
+}
+
+// extendLinkHandler is the one-click extend URL of reminder emails. It is
+// opened in a browser without credentials, so it is authenticated by its
+// signature alone and answers in plain text.
+func (srv *server) extendLinkHandler(c *gin.Context) {
+	shortCode := c.Param("shortCode")
+	micros, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || expiryExtendSecret() == "" {
+		c.String(http.StatusBadRequest, "This extend link is invalid.\n")
+		return
+	}
+	signedExpiry := time.UnixMicro(micros)
+	if !hmac.Equal([]byte(c.Query("sig")), []byte(signExpiryExtension(shortCode, signedExpiry))) {
+		c.String(http.StatusForbidden, "This extend link is invalid.\n")
+		return
+	}
+
+	actor := systemActor("expiry-reminder")
+	actor.IP = c.ClientIP()
+	u, err := srv.extendURLExpiry(actor, shortCode, signedExpiry)
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			// Either the link is gone or this extend link was already used
+			c.String(http.StatusGone, "This extend link has expired or was already used.\n")
+			return
+		}
+		log.Printf("Failed to extend %s: %v", shortCode, err)
+		c.String(http.StatusInternalServerError, "Failed to extend the link, please try again later.\n")
+		return
+	}
+
+	c.String(http.StatusOK, "%s now expires on %s.\n", shortURL(u.ShortCode), u.ExpiresAt.UTC().Format("Mon, 02 Jan 2006 15:04 MST"))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+	"shared/slowquery"
+	"shared/urlcrypto"
+)
+
+// A link can have a fallback destination, which redirect-api serves instead of
+// its own while the destination health checker has that marked down, until it
+// recovers. Like targets, fallbacks can't be flagged or held for review. The
+// health of each link's destination is kept in destination_health; a link
+// without a row there counts as healthy.
+const auditLinkFallback = "link.fallback"
+
+const fallbackTablesQuery = `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS fallback_url TEXT;
+	ALTER TABLE urls_trash ADD COLUMN IF NOT EXISTS fallback_url TEXT;
+
+	CREATE TABLE IF NOT EXISTS destination_health (
+		short_code VARCHAR(10) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+		healthy BOOLEAN NOT NULL,
+		status TEXT NOT NULL,
+		checked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		unhealthy_since TIMESTAMP WITH TIME ZONE
+	);
+`
+
+// servedURLColumn selects the stored destination redirect-api serves for the
+// urls row of a query: the fallback while the destination is down
+const servedURLColumn = `CASE WHEN urls.fallback_url IS NOT NULL AND EXISTS (
+		SELECT 1 FROM destination_health h WHERE h.short_code = urls.short_code AND NOT h.healthy
+	) THEN urls.fallback_url ELSE urls.original_url END`
+
+type FallbackRequestBody struct {
+	OriginalURL string `json:"originalUrl" binding:"required"`
+}
+
+// setURLFallback sets or, with a nil fallback, removes the fallback of one of owner's links
+func (srv *server) setURLFallback(actor auditActor, owner, shortCode string, fallback *string) (*URL, error) {
+	var storedURL *string
+	if fallback != nil {
+		if err := srv.screenTarget(*fallback); err != nil {
+			return nil, err
+		}
+		stored, err := urlcrypto.Encrypt(*fallback)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt URL: %v", err)
+		}
+		storedURL = &stored
+	}
+
+	before, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, err
+	}
+	if before.Owner != owner {
+		return nil, errShortCodeNotFound
+	}
+
+	row, err := srv.queries.SetURLFallback(slowquery.Tag(srv.ctx, "", shortCode), dbq.SetURLFallbackParams{
+		ShortCode:   shortCode,
+		Owner:       owner,
+		FallbackUrl: toNullString(storedURL),
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShortCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to update URL: %v", err)
+	}
+	u, err := urlFromRow(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update URL: %v", err)
+	}
+
+	srv.invalidateURLCache(shortCode)
+	srv.recordAudit(actor, auditLinkFallback, auditTargetLink, shortCode, linkAuditState(before), linkAuditState(u))
+	srv.emitLinkEvent(eventLinkUpdated, u)
+
+	return u, nil
+}
+
+// fallbackHandler sets the fallback of one of the caller's links, or removes it
+func (srv *server) fallbackHandler(set bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+
+		var fallback *string
+		if set {
+			var body FallbackRequestBody
+			if err := c.ShouldBindJSON(&body); err != nil {
+				response.Fail(c, http.StatusBadRequest, err.Error())
+				return
+			}
+			fallback = &body.OriginalURL
+		}
+
+		u, err := srv.setURLFallback(actorFromGin(c), owner, c.Param("shortCode"), fallback)
+		if err != nil {
+			switch {
+			case errors.Is(err, errShortCodeNotFound):
+				failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+			case isValidationError(err):
+				response.Fail(c, http.StatusUnprocessableEntity, err.Error())
+			default:
+				log.Printf("Failed to update fallback: %v", err)
+				response.Fail(c, http.StatusInternalServerError, "failed to update URL")
+			}
+			return
+		}
+
+		response.OK(c, http.StatusOK, toLinkResponse(u))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/response"
+)
+
+// Owners can mark their links as favorites so clients can show those first.
+// The flag belongs to the user who set it, so a link transferred to someone
+// else isn't a favorite of theirs until they mark it too.
+const favoriteTablesQuery = `
+	CREATE TABLE IF NOT EXISTS link_favorites (
+		owner TEXT NOT NULL,
+		short_code VARCHAR(10) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (owner, short_code)
+	);
+`
+
+// favoriteShortCodes returns which of codes owner marked as favorite
+func (srv *server) favoriteShortCodes(owner string, codes []string) (map[string]bool, error) {
+	rows, err := srv.db.Query(`SELECT short_code FROM link_favorites WHERE owner = $1 AND short_code = ANY($2)`, owner, pq.Array(codes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get favorites: %v", err)
+	}
+	defer rows.Close()
+
+	favorites := map[string]bool{}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, fmt.Errorf("failed to get favorites: %v", err)
+		}
+		favorites[code] = true
+	}
+	return favorites, rows.Err()
+}
+
+// setFavorite marks or unmarks one of owner's links
+func (srv *server) setFavorite(owner, shortCode string, favorite bool) error {
+	u, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return err
+	}
+	if u.Owner != owner {
+		return errShortCodeNotFound
+	}
+
+	if favorite {
+		_, err = srv.db.Exec(`INSERT INTO link_favorites (owner, short_code) VALUES ($1, $2) ON CONFLICT DO NOTHING`, owner, shortCode)
+	} else {
+		_, err = srv.db.Exec(`DELETE FROM link_favorites WHERE owner = $1 AND short_code = $2`, owner, shortCode)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update favorite: %v", err)
+	}
+	return nil
+}
+
+// favoriteHandler returns the handler marking (PUT) or unmarking (DELETE) a favorite
+func (srv *server) favoriteHandler(favorite bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+
+		if err := srv.setFavorite(owner, c.Param("shortCode"), favorite); err != nil {
+			if errors.Is(err, errShortCodeNotFound) {
+				failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+				return
+			}
+			log.Printf("Failed to update favorite: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to update favorite")
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// listMyLinksHandler lists the caller's links, newest first, with their
+// favorite flag; ?favorite=true|false keeps only favorites or the others
+func (srv *server) listMyLinksHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	filter, ok := urlFilterParams(c)
+	if !ok {
+		return
+	}
+	filter.Owner = owner
+	if v := c.Query("favorite"); v != "" {
+		favorite, err := strconv.ParseBool(v)
+		if err != nil {
+			response.Fail(c, http.StatusBadRequest, "invalid favorite, expected true or false")
+			return
+		}
+		filter.Favorite = &favorite
+	}
+
+	urls, nextCursor, err := srv.listURLs(filter)
+	if err != nil {
+		if errors.Is(err, errEncryptedSearch) {
+			response.Fail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Failed to list URLs: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list URLs")
+		return
+	}
+
+	codes := make([]string, len(urls))
+	for i := range urls {
+		codes[i] = urls[i].ShortCode
+	}
+	favorites, err := srv.favoriteShortCodes(owner, codes)
+	if err != nil {
+		log.Printf("Failed to list URLs: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list URLs")
+		return
+	}
+
+	links := make([]LinkResponse, len(urls))
+	marked := []string{}
+	for i := range urls {
+		links[i] = toLinkResponse(&urls[i])
+		favorite := favorites[urls[i].ShortCode]
+		links[i].Favorite = &favorite
+		if favorite {
+			marked = append(marked, urls[i].ShortCode)
+		}
+	}
+
+	// Favorites don't touch the links, so they are part of the version too
+	setPageLinks(c, nextCursor)
+	jsonWithETag(c, urlsETag(urls, c.Request.URL.RawQuery+"|"+strings.Join(marked, ",")), gin.H{"urls": links}, response.Page{NextCursor: nextCursor})
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/response"
+	"shared/slowquery"
+)
+
+// Owners can file their links into nested folders. A link is in at most one
+// folder (urls.folder_id), and folders nest through parent_id. Deleting a
+// folder deletes its subfolders and moves their links back to the top level.
+// Folders belong to their owner, so transferred links leave them.
+const maxFolderNameLength = 100
+
+var (
+	errFolderNotFound    = errors.New("folder not found")
+	errFolderNameTaken   = errors.New("a folder with this name already exists here")
+	errFolderCycle       = errors.New("a folder can't be moved into itself or one of its subfolders")
+	errInvalidFolderName = fmt.Errorf("name must be 1 to %d characters without a slash", maxFolderNameLength)
+)
+
+const folderTablesQuery = `
+	CREATE TABLE IF NOT EXISTS folders (
+		id SERIAL PRIMARY KEY,
+		owner TEXT NOT NULL,
+		name TEXT NOT NULL,
+		parent_id INTEGER REFERENCES folders(id) ON DELETE CASCADE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_owner_parent_name ON folders(owner, COALESCE(parent_id, 0), lower(name));
+	CREATE INDEX IF NOT EXISTS idx_folders_parent_id ON folders(parent_id);
+
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS folder_id INTEGER REFERENCES folders(id) ON DELETE SET NULL;
+	CREATE INDEX IF NOT EXISTS idx_urls_folder_id ON urls(folder_id) WHERE folder_id IS NOT NULL;
+`
+
+// Folder is one of an owner's folders; Links counts the links directly in it
+type Folder struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	ParentID  *int64    `json:"parentId"`
+	Links     int64     `json:"links"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type FolderRequestBody struct {
+	Name     string `json:"name" binding:"required"`
+	ParentID *int64 `json:"parentId"`
+}
+
+type RenameFolderRequestBody struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// MoveFolderRequestBody moves a folder under ParentID, or to the top level when it is null
+type MoveFolderRequestBody struct {
+	ParentID *int64 `json:"parentId"`
+}
+
+// LinkFolderRequestBody files a link into FolderID, or takes it out of its folder when it is null
+type LinkFolderRequestBody struct {
+	FolderID *int64 `json:"folderId"`
+}
+
+const folderColumns = "id, name, parent_id, (SELECT count(*) FROM urls WHERE folder_id = folders.id), created_at, updated_at"
+
+func scanFolder(row rowScanner) (*Folder, error) {
+	var f Folder
+	if err := row.Scan(&f.ID, &f.Name, &f.ParentID, &f.Links, &f.CreatedAt, &f.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func normalizeFolderName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > maxFolderNameLength || strings.Contains(name, "/") {
+		return "", errInvalidFolderName
+	}
+	return name, nil
+}
+
+// folderError maps a failed write to the folder errors callers know about
+func folderError(err error, action string) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return errFolderNameTaken
+	}
+	if err == sql.ErrNoRows {
+		return errFolderNotFound
+	}
+	return fmt.Errorf("failed to %s folder: %v", action, err)
+}
+
+// rowQuerier is what checkFolderOwner needs of *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkFolderOwner fails with errFolderNotFound unless owner has the folder; nil is the top level
+func checkFolderOwner(q rowQuerier, owner string, id *int64) error {
+	if id == nil {
+		return nil
+	}
+	var exists bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM folders WHERE id = $1 AND owner = $2)`, *id, owner).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to get folder: %v", err)
+	}
+	if !exists {
+		return errFolderNotFound
+	}
+	return nil
+}
+
+func (srv *server) getFolder(owner string, id int64) (*Folder, error) {
+	f, err := scanFolder(srv.db.QueryRow(`SELECT `+folderColumns+` FROM folders WHERE id = $1 AND owner = $2`, id, owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errFolderNotFound
+		}
+		return nil, fmt.Errorf("failed to get folder: %v", err)
+	}
+	return f, nil
+}
+
+func (srv *server) createFolder(actor auditActor, owner, name string, parentID *int64) (*Folder, error) {
+	name, err := normalizeFolderName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFolderOwner(srv.db, owner, parentID); err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO folders (owner, name, parent_id) VALUES ($1, $2, $3) RETURNING ` + folderColumns
+	f, err := scanFolder(srv.db.QueryRow(query, owner, name, parentID))
+	if err != nil {
+		return nil, folderError(err, "create")
+	}
+
+	srv.recordAudit(actor, auditFolderCreate, auditTargetFolder, strconv.FormatInt(f.ID, 10), nil, f)
+	return f, nil
+}
+
+func (srv *server) renameFolder(actor auditActor, owner string, id int64, name string) (*Folder, error) {
+	name, err := normalizeFolderName(name)
+	if err != nil {
+		return nil, err
+	}
+	before, err := srv.getFolder(owner, id)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		UPDATE folders SET name = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND owner = $2
+		RETURNING ` + folderColumns
+	f, err := scanFolder(srv.db.QueryRow(query, id, owner, name))
+	if err != nil {
+		return nil, folderError(err, "rename")
+	}
+
+	srv.recordAudit(actor, auditFolderUpdate, auditTargetFolder, strconv.FormatInt(id, 10), before, f)
+	return f, nil
+}
+
+// moveFolder reparents a folder. The owner's folders are locked while the new
+// parent is checked, so concurrent moves can't build a cycle.
+func (srv *server) moveFolder(actor auditActor, owner string, id int64, parentID *int64) (*Folder, error) {
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT id FROM folders WHERE owner = $1 FOR UPDATE`, owner); err != nil {
+		return nil, fmt.Errorf("failed to lock folders: %v", err)
+	}
+	before, err := scanFolder(tx.QueryRow(`SELECT `+folderColumns+` FROM folders WHERE id = $1 AND owner = $2`, id, owner))
+	if err != nil {
+		return nil, folderError(err, "move")
+	}
+	if err := checkFolderOwner(tx, owner, parentID); err != nil {
+		return nil, err
+	}
+	if parentID != nil {
+		var cycle bool
+		err := tx.QueryRow(`
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM folders WHERE id = $1
+				UNION ALL
+				SELECT f.id FROM folders f JOIN subtree s ON f.parent_id = s.id
+			)
+			SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)
+		`, id, *parentID).Scan(&cycle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check folder tree: %v", err)
+		}
+		if cycle {
+			return nil, errFolderCycle
+		}
+	}
+
+	query := `
+		UPDATE folders SET parent_id = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND owner = $2
+		RETURNING ` + folderColumns
+	f, err := scanFolder(tx.QueryRow(query, id, owner, parentID))
+	if err != nil {
+		return nil, folderError(err, "move")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	srv.recordAudit(actor, auditFolderUpdate, auditTargetFolder, strconv.FormatInt(id, 10), before, f)
+	return f, nil
+}
+
+// subfolderIDs returns the folder and every folder nested in it
+func (srv *server) subfolderIDs(id int64) ([]int64, error) {
+	rows, err := srv.db.Query(`
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM folders WHERE id = $1
+			UNION ALL
+			SELECT f.id FROM folders f JOIN subtree s ON f.parent_id = s.id
+		)
+		SELECT id FROM subtree
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subfolders: %v", err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to get subfolders: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// deleteFolder deletes a folder with its subfolders; their links move to the
+// top level and count as updated
+func (srv *server) deleteFolder(actor auditActor, owner string, id int64) error {
+	before, err := srv.getFolder(owner, id)
+	if err != nil {
+		return err
+	}
+	ids, err := srv.subfolderIDs(id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE urls SET folder_id = NULL, updated_at = CURRENT_TIMESTAMP WHERE folder_id = ANY($1)`, pq.Array(ids)); err != nil {
+		return fmt.Errorf("failed to empty folder: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM folders WHERE id = $1 AND owner = $2`, id, owner); err != nil {
+		return fmt.Errorf("failed to delete folder: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	srv.recordAudit(actor, auditFolderDelete, auditTargetFolder, strconv.FormatInt(id, 10), before, nil)
+	return nil
+}
+
+// moveURLToFolder files one of owner's links into a folder, nil for none
+func (srv *server) moveURLToFolder(actor auditActor, owner, shortCode string, folderID *int64) (*URL, error) {
+	before, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, err
+	}
+	if before.Owner != owner {
+		return nil, errShortCodeNotFound
+	}
+	if err := checkFolderOwner(srv.db, owner, folderID); err != nil {
+		return nil, err
+	}
+
+	var folder sql.NullInt32
+	if folderID != nil {
+		folder = sql.NullInt32{Int32: int32(*folderID), Valid: true}
+	}
+	row, err := srv.queries.MoveURLToFolder(slowquery.Tag(srv.ctx, "", shortCode), dbq.MoveURLToFolderParams{ShortCode: shortCode, FolderID: folder})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShortCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to move URL: %v", err)
+	}
+	u, err := urlFromRow(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move URL: %v", err)
+	}
+
+	srv.recordAudit(actor, auditLinkUpdate, auditTargetLink, shortCode, linkAuditState(before), linkAuditState(u))
+	srv.emitLinkEvent(eventLinkUpdated, u)
+	return u, nil
+}
+
+// respondFolderError writes the response for a failed folder operation
+func respondFolderError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, errFolderNotFound):
+		failNotFound(c, err)
+	case errors.Is(err, errShortCodeNotFound):
+		failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+	case errors.Is(err, errInvalidFolderName):
+		response.Fail(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errFolderNameTaken), errors.Is(err, errFolderCycle):
+		response.Fail(c, http.StatusConflict, err.Error())
+	default:
+		log.Printf("Failed to %s folder: %v", action, err)
+		response.Fail(c, http.StatusInternalServerError, "failed to "+action+" folder")
+	}
+}
+
+func folderIDParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid folder id")
+		return 0, false
+	}
+	return id, true
+}
+
+func (srv *server) createFolderHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	var body FolderRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f, err := srv.createFolder(actorFromGin(c), owner, body.Name, body.ParentID)
+	if err != nil {
+		respondFolderError(c, err, "create")
+		return
+	}
+	response.OK(c, http.StatusCreated, f)
+}
+
+// listFoldersHandler lists all of the caller's folders, flat and by name;
+// clients build the tree from parentId
+func (srv *server) listFoldersHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	rows, err := srv.db.Query(`SELECT `+folderColumns+` FROM folders WHERE owner = $1 ORDER BY lower(name), id`, owner)
+	if err != nil {
+		log.Printf("Failed to list folders: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list folders")
+		return
+	}
+	defer rows.Close()
+
+	folders := []Folder{}
+	for rows.Next() {
+		f, err := scanFolder(rows)
+		if err != nil {
+			log.Printf("Failed to scan folder: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list folders")
+			return
+		}
+		folders = append(folders, *f)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list folders: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list folders")
+		return
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"folders": folders})
+}
+
+func (srv *server) getFolderHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := folderIDParam(c)
+	if !ok {
+		return
+	}
+
+	f, err := srv.getFolder(owner, id)
+	if err != nil {
+		respondFolderError(c, err, "get")
+		return
+	}
+	response.OK(c, http.StatusOK, f)
+}
+
+func (srv *server) renameFolderHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := folderIDParam(c)
+	if !ok {
+		return
+	}
+	var body RenameFolderRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f, err := srv.renameFolder(actorFromGin(c), owner, id, body.Name)
+	if err != nil {
+		respondFolderError(c, err, "rename")
+		return
+	}
+	response.OK(c, http.StatusOK, f)
+}
+
+func (srv *server) moveFolderHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := folderIDParam(c)
+	if !ok {
+		return
+	}
+	var body MoveFolderRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f, err := srv.moveFolder(actorFromGin(c), owner, id, body.ParentID)
+	if err != nil {
+		respondFolderError(c, err, "move")
+		return
+	}
+	response.OK(c, http.StatusOK, f)
+}
+
+func (srv *server) deleteFolderHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := folderIDParam(c)
+	if !ok {
+		return
+	}
+
+	if err := srv.deleteFolder(actorFromGin(c), owner, id); err != nil {
+		respondFolderError(c, err, "delete")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listFolderLinksHandler lists the links in a folder, newest first, and with
+// ?recursive=true those in its subfolders too
+func (srv *server) listFolderLinksHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := folderIDParam(c)
+	if !ok {
+		return
+	}
+	filter, ok := urlFilterParams(c)
+	if !ok {
+		return
+	}
+	if _, err := srv.getFolder(owner, id); err != nil {
+		respondFolderError(c, err, "get")
+		return
+	}
+
+	filter.Owner = owner
+	filter.FolderIDs = []int64{id}
+	if c.Query("recursive") == "true" {
+		ids, err := srv.subfolderIDs(id)
+		if err != nil {
+			respondFolderError(c, err, "get")
+			return
+		}
+		filter.FolderIDs = ids
+	}
+
+	urls, nextCursor, err := srv.listURLs(filter)
+	if err != nil {
+		if errors.Is(err, errEncryptedSearch) {
+			response.Fail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Failed to list URLs: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list URLs")
+		return
+	}
+
+	links := make([]LinkResponse, len(urls))
+	for i := range urls {
+		links[i] = toLinkResponse(&urls[i])
+	}
+
+	setPageLinks(c, nextCursor)
+	jsonWithETag(c, urlsETag(urls, c.Request.URL.RawQuery), gin.H{"urls": links}, response.Page{NextCursor: nextCursor})
+}
+
+// setLinkFolderHandler files one of the caller's links into a folder
+func (srv *server) setLinkFolderHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	var body LinkFolderRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u, err := srv.moveURLToFolder(actorFromGin(c), owner, c.Param("shortCode"), body.FolderID)
+	if err != nil {
+		respondFolderError(c, err, "move link to")
+		return
+	}
+	response.OK(c, http.StatusOK, toLinkResponse(u))
+}
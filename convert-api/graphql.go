@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+)
+
+const graphQLSchema = `
+	scalar Time
+
+	schema {
+		query: Query
+		mutation: Mutation
+	}
+
+	type Query {
+		link(shortCode: String!): Link
+		links(filter: LinkFilter, limit: Int = 20, after: String): LinkPage!
+	}
+
+	type Mutation {
+		createLink(originalUrl: String!, expiresAt: Time): Link!
+		updateLink(shortCode: String!, originalUrl: String!): Link!
+		deleteLink(shortCode: String!): Boolean!
+	}
+
+	input LinkFilter {
+		originalUrlContains: String
+		createdAfter: Time
+		createdBefore: Time
+	}
+
+	type LinkPage {
+		items: [Link!]!
+		nextCursor: String
+	}
+
+	type Link {
+		id: Int!
+		shortCode: String!
+		shortUrl: String!
+		originalUrl: String!
+		createdAt: Time!
+		updatedAt: Time!
+		expiresAt: Time
+		clicks: Int!
+		dailyClicks(days: Int = 30): [DailyClicks!]!
+	}
+
+	type DailyClicks {
+		date: String!
+		clicks: Int!
+	}
+`
+
+// publicError keeps internal failure details out of GraphQL responses
+func publicError(err error) error {
+	if errors.Is(err, errShortCodeNotFound) || errors.Is(err, errCallerRequired) || isValidationError(err) {
+		return err
+	}
+	log.Printf("GraphQL operation failed: %v", err)
+	return errors.New("internal error")
+}
+
+type graphQLResolver struct {
+	srv *server
+}
+
+type linkResolver struct {
+	srv *server
+	url *URL
+}
+
+func (r *linkResolver) ID() int32 {
+	return int32(r.url.ID)
+}
+
+func (r *linkResolver) ShortCode() string {
+	return r.url.ShortCode
+}
+
+func (r *linkResolver) ShortUrl() string {
+	return shortURL(r.url.ShortCode)
+}
+
+func (r *linkResolver) OriginalUrl() string {
+	return r.url.OriginalURL
+}
+
+func (r *linkResolver) CreatedAt() graphql.Time {
+	return graphql.Time{Time: r.url.CreatedAt}
+}
+
+func (r *linkResolver) UpdatedAt() graphql.Time {
+	return graphql.Time{Time: r.url.UpdatedAt}
+}
+
+func (r *linkResolver) ExpiresAt() *graphql.Time {
+	if r.url.ExpiresAt == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *r.url.ExpiresAt}
+}
+
+// graphQLInt fits a count into GraphQL's 32-bit Int, saturating
+func graphQLInt(n int64) int32 {
+	return int32(min(n, math.MaxInt32))
+}
+
+// Clicks includes the ones still pending in Redis, like gRPC's Stats
+func (r *linkResolver) Clicks() (int32, error) {
+	clicks, _, err := r.srv.linkClickTotal(r.url)
+	if err != nil {
+		return 0, publicError(err)
+	}
+	return graphQLInt(clicks), nil
+}
+
+type dailyClicksResolver struct {
+	day DayCount
+}
+
+func (r *dailyClicksResolver) Date() string {
+	return r.day.Date
+}
+
+func (r *dailyClicksResolver) Clicks() int32 {
+	return graphQLInt(r.day.Count)
+}
+
+// DailyClicks returns the clicks on each of the last days UTC days, oldest first
+func (r *linkResolver) DailyClicks(args struct{ Days int32 }) ([]*dailyClicksResolver, error) {
+	if args.Days < 1 || args.Days > maxLinkStatsDays {
+		return nil, fmt.Errorf("days must be between 1 and %d", maxLinkStatsDays)
+	}
+	daily, err := r.srv.linkDailyClicks(r.url.ShortCode, int(args.Days))
+	if err != nil {
+		return nil, publicError(err)
+	}
+	days := make([]*dailyClicksResolver, len(daily))
+	for i, day := range daily {
+		days[i] = &dailyClicksResolver{day}
+	}
+	return days, nil
+}
+
+// Link and Links only see the caller's own links
+func (r *graphQLResolver) Link(ctx context.Context, args struct{ ShortCode string }) (*linkResolver, error) {
+	u, err := r.srv.ownedURL(ownerFromContext(ctx), args.ShortCode)
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			return nil, nil
+		}
+		return nil, publicError(err)
+	}
+	return &linkResolver{r.srv, u}, nil
+}
+
+type linkFilterInput struct {
+	OriginalUrlContains *string
+	CreatedAfter        *graphql.Time
+	CreatedBefore       *graphql.Time
+}
+
+type linkPageResolver struct {
+	items      []*linkResolver
+	nextCursor string
+}
+
+func (r *linkPageResolver) Items() []*linkResolver {
+	return r.items
+}
+
+func (r *linkPageResolver) NextCursor() *string {
+	if r.nextCursor == "" {
+		return nil
+	}
+	return &r.nextCursor
+}
+
+func (r *graphQLResolver) Links(ctx context.Context, args struct {
+	Filter *linkFilterInput
+	Limit  int32
+	After  *string
+}) (*linkPageResolver, error) {
+	owner := ownerFromContext(ctx)
+	if owner == "" {
+		return nil, errCallerRequired
+	}
+	filter := URLFilter{Owner: owner, Limit: int(args.Limit)}
+	if filter.Limit <= 0 || filter.Limit > maxPageSize {
+		filter.Limit = maxPageSize
+	}
+	if args.After != nil && *args.After != "" {
+		cursor, err := decodeCursor(*args.After)
+		if err != nil {
+			return nil, err
+		}
+		filter.After = cursor
+	}
+	if args.Filter != nil {
+		if args.Filter.OriginalUrlContains != nil {
+			filter.OriginalURLContains = *args.Filter.OriginalUrlContains
+		}
+		if args.Filter.CreatedAfter != nil {
+			filter.CreatedAfter = &args.Filter.CreatedAfter.Time
+		}
+		if args.Filter.CreatedBefore != nil {
+			filter.CreatedBefore = &args.Filter.CreatedBefore.Time
+		}
+	}
+
+	urls, nextCursor, err := r.srv.listURLs(filter)
+	if err != nil {
+		return nil, publicError(err)
+	}
+
+	page := &linkPageResolver{items: make([]*linkResolver, len(urls)), nextCursor: nextCursor}
+	for i := range urls {
+		page.items[i] = &linkResolver{r.srv, &urls[i]}
+	}
+	return page, nil
+}
+
+func (r *graphQLResolver) CreateLink(ctx context.Context, args struct {
+	OriginalUrl string
+	ExpiresAt   *graphql.Time
+}) (*linkResolver, error) {
+	actor := actorFromContext(ctx)
+	if err := verifyCaptchaFromContext(ctx, actor.ID); err != nil {
+		return nil, err
+	}
+
+	var expiresAt *time.Time
+	if args.ExpiresAt != nil {
+		expiresAt = &args.ExpiresAt.Time
+	}
+	u, err := r.srv.createShortURL(ctx, args.OriginalUrl, expiresAt, actor)
+	if err != nil {
+		return nil, publicError(err)
+	}
+	return &linkResolver{r.srv, u}, nil
+}
+
+func (r *graphQLResolver) UpdateLink(ctx context.Context, args struct {
+	ShortCode   string
+	OriginalUrl string
+}) (*linkResolver, error) {
+	u, err := r.srv.updateURL(actorFromContext(ctx), ownerFromContext(ctx), args.ShortCode, args.OriginalUrl)
+	if err != nil {
+		return nil, publicError(err)
+	}
+	return &linkResolver{r.srv, u}, nil
+}
+
+func (r *graphQLResolver) DeleteLink(ctx context.Context, args struct{ ShortCode string }) (bool, error) {
+	if err := r.srv.deleteURL(actorFromContext(ctx), ownerFromContext(ctx), args.ShortCode); err != nil {
+		return false, publicError(err)
+	}
+	return true, nil
+}
+
+func (srv *server) graphQLHandler() gin.HandlerFunc {
+	schema := graphql.MustParseSchema(graphQLSchema, &graphQLResolver{srv: srv})
+	handler := &relay.Handler{Schema: schema}
+
+	return func(c *gin.Context) {
+		reqCtx := withOwner(c.Request.Context(), callerID(c))
+		reqCtx = withClientIP(reqCtx, c.ClientIP())
+		reqCtx = withCaptchaChallenge(reqCtx, c)
+		req := c.Request.WithContext(reqCtx)
+		handler.ServeHTTP(c.Writer, req)
+	}
+}
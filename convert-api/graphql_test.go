@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// The schema only parses when every field has a resolver of a matching type
+func TestGraphQLSchemaResolvers(t *testing.T) {
+	if _, err := graphql.ParseSchema(graphQLSchema, &graphQLResolver{srv: &server{}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraphQLCreateLinkExpiresAt(t *testing.T) {
+	schema := graphql.MustParseSchema(graphQLSchema, &graphQLResolver{srv: &server{}})
+	// Validation rejects the past expiry before anything is stored
+	result := schema.Exec(context.Background(), `mutation {
+		createLink(originalUrl: "https://example.com/", expiresAt: "2000-01-01T00:00:00Z") { shortCode }
+	}`, "", nil)
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Message, "expiresAt") {
+		t.Fatalf("Answered %v, want an expiresAt error", result.Errors)
+	}
+}
+
+func TestGraphQLDailyClicksDays(t *testing.T) {
+	link := &linkResolver{srv: &server{}, url: &URL{ShortCode: "abc1234"}}
+	for _, days := range []int32{0, -1, maxLinkStatsDays + 1} {
+		if _, err := link.DailyClicks(struct{ Days int32 }{days}); err == nil {
+			t.Errorf("Accepted %d days", days)
+		}
+	}
+}
+
+func TestGraphQLInt(t *testing.T) {
+	for _, tt := range []struct {
+		n    int64
+		want int32
+	}{
+		{0, 0},
+		{42, 42},
+		{math.MaxInt32, math.MaxInt32},
+		{math.MaxInt32 + 1, math.MaxInt32},
+		{math.MaxInt64, math.MaxInt32},
+	} {
+		if got := graphQLInt(tt.n); got != tt.want {
+			t.Errorf("graphQLInt(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"convert-api/shortenerpb"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"shared/env"
+	"shared/secrets"
+)
+
+// Stats returns daily clicks for the last StatsRequest.days days
+const (
+	defaultLinkStatsDays = 30
+	maxLinkStatsDays     = 365
+)
+
+// grpcSecretMetadata carries GRPC_SHARED_SECRET on every gRPC call
+const grpcSecretMetadata = "x-grpc-secret"
+
+// grpcSharedSecret authenticates gRPC callers, which are trusted to name the
+// consumer a call acts as
+func grpcSharedSecret() string {
+	return secrets.Value("GRPC_SHARED_SECRET")
+}
+
+// grpcMetadata is the first value of key in the call's metadata
+func grpcMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcAuth rejects calls that don't carry GRPC_SHARED_SECRET, except health
+// checks, and moves the consumer, CAPTCHA token and peer address of the rest
+// into the context the same way graphQLHandler does for GraphQL
+func grpcAuth(ctx context.Context, fullMethod string) (context.Context, error) {
+	if strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	want := grpcSharedSecret()
+	if want == "" || subtle.ConstantTimeCompare([]byte(grpcMetadata(md, grpcSecretMetadata)), []byte(want)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid or missing "+grpcSecretMetadata)
+	}
+
+	var ip string
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			ip = host
+		}
+	}
+	ctx = withOwner(ctx, strings.TrimSpace(grpcMetadata(md, strings.ToLower(consumerHeader))))
+	ctx = withClientIP(ctx, ip)
+	return withCaptchaToken(ctx, grpcMetadata(md, strings.ToLower(captchaHeader)), ip), nil
+}
+
+func grpcAuthUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := grpcAuth(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcAuthStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := grpcAuth(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// shortenerServer serves the gRPC API on top of the same service layer as REST and GraphQL
+type shortenerServer struct {
+	shortenerpb.UnimplementedShortenerServiceServer
+	srv *server
+}
+
+func toProtoLink(u *URL) *shortenerpb.Link {
+	return &shortenerpb.Link{
+		Id:          int64(u.ID),
+		ShortCode:   u.ShortCode,
+		ShortUrl:    shortURL(u.ShortCode),
+		OriginalUrl: u.OriginalURL,
+		CreatedAt:   timestamppb.New(u.CreatedAt),
+		UpdatedAt:   timestamppb.New(u.UpdatedAt),
+	}
+}
+
+// grpcError maps service errors onto gRPC status codes
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, errShortCodeNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errCallerRequired):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, errCaptchaUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, errCaptchaRequired), errors.Is(err, errCaptchaFailed):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case isValidationError(err):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		log.Printf("gRPC call failed: %v", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+}
+
+func (s *shortenerServer) Shorten(ctx context.Context, req *shortenerpb.ShortenRequest) (*shortenerpb.ShortenResponse, error) {
+	if req.GetOriginalUrl() == "" {
+		return nil, status.Error(codes.InvalidArgument, "original_url is required")
+	}
+
+	// Anonymous callers pass the CAPTCHA in x-captcha-token, as over HTTP
+	actor := actorFromContext(ctx)
+	if err := verifyCaptchaFromContext(ctx, actor.ID); err != nil {
+		return nil, grpcError(err)
+	}
+
+	u, err := s.srv.createShortURL(ctx, req.GetOriginalUrl(), nil, actor)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &shortenerpb.ShortenResponse{Link: toProtoLink(u)}, nil
+}
+
+// Resolve, Delete and Stats only reach the caller's own links
+func (s *shortenerServer) Resolve(ctx context.Context, req *shortenerpb.ResolveRequest) (*shortenerpb.ResolveResponse, error) {
+	u, err := s.srv.ownedURL(ownerFromContext(ctx), req.GetShortCode())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &shortenerpb.ResolveResponse{Link: toProtoLink(u)}, nil
+}
+
+func (s *shortenerServer) Delete(ctx context.Context, req *shortenerpb.DeleteRequest) (*shortenerpb.DeleteResponse, error) {
+	if err := s.srv.deleteURL(actorFromContext(ctx), ownerFromContext(ctx), req.GetShortCode()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &shortenerpb.DeleteResponse{}, nil
+}
+
+// Stats reads at least the 30 days of daily clicks its period totals need
+func (s *shortenerServer) Stats(ctx context.Context, req *shortenerpb.StatsRequest) (*shortenerpb.StatsResponse, error) {
+	days := int(req.GetDays())
+	if days < 0 || days > maxLinkStatsDays {
+		return nil, status.Errorf(codes.InvalidArgument, "days must be between 1 and %d", maxLinkStatsDays)
+	}
+	if days == 0 {
+		days = defaultLinkStatsDays
+	}
+
+	u, err := s.srv.ownedURL(ownerFromContext(ctx), req.GetShortCode())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &shortenerpb.StatsResponse{Link: toProtoLink(u)}
+
+	var lastClickedAt *time.Time
+	if resp.TotalClicks, lastClickedAt, err = s.srv.linkClickTotal(u); err != nil {
+		return nil, grpcError(err)
+	}
+	if lastClickedAt != nil {
+		resp.LastClickedAt = timestamppb.New(*lastClickedAt)
+	}
+
+	daily, err := s.srv.linkDailyClicks(u.ShortCode, max(days, 30))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	for i, day := range daily {
+		if i >= len(daily)-30 {
+			resp.ClicksPastMonth += day.Count
+		}
+		if i >= len(daily)-7 {
+			resp.ClicksPastWeek += day.Count
+		}
+	}
+	for _, day := range daily[len(daily)-days:] {
+		resp.Daily = append(resp.Daily, &shortenerpb.DailyClicks{Date: day.Date, Clicks: day.Count})
+	}
+	return resp, nil
+}
+
+// startGRPCServer serves the gRPC API in the background when GRPC_PORT is set
+func (srv *server) startGRPCServer() {
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		return
+	}
+	if grpcSharedSecret() == "" {
+		log.Fatalf("GRPC_PORT needs GRPC_SHARED_SECRET")
+	}
+
+	lis, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		log.Fatalf("Failed to listen on gRPC port %s: %v", grpcPort, err)
+	}
+
+	// Incoming trace context continues the same way as over HTTP, see shared/tracing
+	server := grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.UnaryInterceptor(grpcAuthUnary),
+		grpc.StreamInterceptor(grpcAuthStream),
+	)
+	shortenerpb.RegisterShortenerServiceServer(server, &shortenerServer{srv: srv})
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	srv.startGRPCHealthChecks(healthServer)
+
+	go func() {
+		log.Printf("gRPC server starting on port %s", grpcPort)
+		if err := server.Serve(lis); err != nil {
+			log.Fatalf("gRPC server stopped: %v", err)
+		}
+	}()
+}
+
+// grpcHealthInterval is how often the gRPC health status is rechecked
+var grpcHealthInterval = env.Duration("GRPC_HEALTH_INTERVAL", 5*time.Second)
+
+// grpcHealthServices are reported through grpc.health.v1, "" being the
+// server as a whole. Every service needs Postgres and both Redis instances.
+var grpcHealthServices = []string{"", shortenerpb.ShortenerService_ServiceDesc.ServiceName}
+
+// startGRPCHealthChecks drives the grpc.health.v1 status of every service from
+// the same dependency checks as /readyz, so load balancers route around an
+// instance that lost one. The first check runs before the server starts.
+func (srv *server) startGRPCHealthChecks(healthServer *health.Server) {
+	update := func(last healthpb.HealthCheckResponse_ServingStatus) healthpb.HealthCheckResponse_ServingStatus {
+		status := healthpb.HealthCheckResponse_SERVING
+		if name, err := srv.checkDependencies(srv.ctx); err != nil {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			if last != status {
+				log.Printf("gRPC not serving, %s is unreachable: %v", name, err)
+			}
+		} else if last == healthpb.HealthCheckResponse_NOT_SERVING {
+			log.Printf("gRPC serving again")
+		}
+		for _, service := range grpcHealthServices {
+			healthServer.SetServingStatus(service, status)
+		}
+		return status
+	}
+
+	status := update(healthpb.HealthCheckResponse_UNKNOWN)
+	go func() {
+		ticker := time.NewTicker(grpcHealthInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			status = update(status)
+		}
+	}()
+}
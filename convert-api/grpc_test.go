@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCAuth(t *testing.T) {
+	t.Setenv("GRPC_SHARED_SECRET", "s3cret")
+	const shorten = "/shortener.v1.ShortenerService/Shorten"
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		md     metadata.MD
+		code   codes.Code
+		owner  string
+	}{
+		{"no secret", shorten, metadata.Pairs("x-consumer-username", "alice"), codes.Unauthenticated, ""},
+		{"wrong secret", shorten, metadata.Pairs("x-grpc-secret", "guess", "x-consumer-username", "alice"), codes.Unauthenticated, ""},
+		{"secret", shorten, metadata.Pairs("x-grpc-secret", "s3cret", "x-consumer-username", " alice "), codes.OK, "alice"},
+		{"anonymous", shorten, metadata.Pairs("x-grpc-secret", "s3cret"), codes.OK, ""},
+		{"health check", "/grpc.health.v1.Health/Check", nil, codes.OK, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 4242}})
+			ctx, err := grpcAuth(ctx, tt.method)
+			if status.Code(err) != tt.code {
+				t.Fatalf("Answered %v, want %v", status.Code(err), tt.code)
+			}
+			if err != nil {
+				return
+			}
+			if owner := ownerFromContext(ctx); owner != tt.owner {
+				t.Fatalf("Acts as %q, want %q", owner, tt.owner)
+			}
+		})
+	}
+}
+
+func TestGRPCAuthWithoutConfiguredSecret(t *testing.T) {
+	t.Setenv("GRPC_SHARED_SECRET", "")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-grpc-secret", ""))
+	if _, err := grpcAuth(ctx, "/shortener.v1.ShortenerService/Resolve"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Answered %v without a configured secret", status.Code(err))
+	}
+}
+
+func TestGRPCAuthKeepsCaptchaToken(t *testing.T) {
+	t.Setenv("GRPC_SHARED_SECRET", "s3cret")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-grpc-secret", "s3cret", "x-captcha-token", "tok"))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 4242}})
+	ctx, err := grpcAuth(ctx, "/shortener.v1.ShortenerService/Shorten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, _ := ctx.Value(captchaContextKey{}).(captchaChallenge)
+	if challenge.token != "tok" || challenge.remoteIP != "10.0.0.7" {
+		t.Fatalf("Kept challenge %+v", challenge)
+	}
+	if actor := actorFromContext(ctx); actor.IP != "10.0.0.7" {
+		t.Fatalf("Actor IP %q, want the peer's", actor.IP)
+	}
+}
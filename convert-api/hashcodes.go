@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// With CODE_GENERATOR=hash a link's code is a truncated SHA-256 of its
+// canonical destination instead of a counter ID, so shortening the same URL
+// twice returns the same link, and the code a URL will get can be worked out
+// without asking. Hash codes are hashCodeLength characters, longer than any
+// code the counter will reach, so the two never collide. A code already taken
+// by another destination, owner or expiry, or by a link that no longer
+// redirects, falls back to the counter generator.
+const (
+	codeGeneratorHash = "hash"
+	hashCodeLength    = 10
+)
+
+// hashCodeSpace is how many hash codes there are: 62^10, or 36^10 with
+// case-insensitive codes
+var hashCodeSpace = map[bool]uint64{false: 839299365868340224, true: 3656158440062976}
+
+// generateHashCode derives the code of a destination in its canonical form,
+// see urlnormalize.go
+func generateHashCode(originalURL string) string {
+	sum := sha256.Sum256([]byte(originalURL))
+	n := int(binary.BigEndian.Uint64(sum[:8]) % hashCodeSpace[caseInsensitiveCodes])
+	if caseInsensitiveCodes {
+		return fmt.Sprintf("%0*s", hashCodeLength, encodeBase36(n))
+	}
+	return fmt.Sprintf("%0*s", hashCodeLength, encodeBase62(n))
+}
+
+// hashedLink returns owner's live link to originalURL expiring at expiresAt
+// under its hash code, or the code to create it under, or neither when the
+// code is taken otherwise
+func (srv *server) hashedLink(originalURL, owner string, expiresAt *time.Time) (*URL, string, error) {
+	code := generateHashCode(originalURL)
+	existing, err := srv.getURLByShortCode(code)
+	if errors.Is(err, errShortCodeNotFound) {
+		taken, err := srv.shortCodeTaken(code)
+		if err != nil {
+			return nil, "", err
+		}
+		if taken {
+			log.Printf("Hash code %s is archived or in the trash, using %s", code, codeGeneratorCounter)
+			return nil, "", nil
+		}
+		return nil, code, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	live := existing.DisabledAt == nil && existing.RotatedTo == nil && (existing.ExpiresAt == nil || existing.ExpiresAt.After(clock()))
+	// Links saved before destinations were normalized may be spelled differently
+	stored, err := normalizeURL(existing.OriginalURL)
+	if err != nil {
+		stored = existing.OriginalURL
+	}
+	if live && existing.Owner == owner && stored == originalURL && sameExpiry(existing.ExpiresAt, expiresAt) {
+		return existing, "", nil
+	}
+	log.Printf("Hash code %s is taken, using %s", code, codeGeneratorCounter)
+	return nil, "", nil
+}
+
+// sameExpiry compares expiries as Postgres stores them, to the microsecond
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Truncate(time.Microsecond).Equal(b.Truncate(time.Microsecond))
+}
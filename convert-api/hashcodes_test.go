@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSameExpiry(t *testing.T) {
+	at := time.Date(2030, 1, 1, 0, 0, 0, 123456000, time.UTC)
+	later := at.Add(time.Hour)
+	for _, tt := range []struct {
+		name string
+		a, b *time.Time
+		want bool
+	}{
+		{"neither", nil, nil, true},
+		{"only stored", &at, nil, false},
+		{"only requested", nil, &at, false},
+		{"same", &at, &at, true},
+		{"other zone", &at, func() *time.Time { t := at.In(time.FixedZone("ICT", 7*3600)); return &t }(), true},
+		{"below a microsecond", &at, func() *time.Time { t := at.Add(789 * time.Nanosecond); return &t }(), true},
+		{"different", &at, &later, false},
+	} {
+		if got := sameExpiry(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: sameExpiry = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
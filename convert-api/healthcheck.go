@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"convert-api/safehttp"
+
+	"shared/env"
+	"shared/urlcrypto"
+)
+
+// The health checker HEAD-requests link destinations every
+// HEALTH_CHECK_MIN_AGE, a batch per HEALTH_CHECK_INTERVAL with
+// HEALTH_CHECK_REQUEST_INTERVAL between requests, through the SSRF-guarded
+// outbound client. The outcome is kept in destination_health. A destination
+// is marked down after HEALTH_CHECK_FAILURES failed checks in a row and up
+// again after one good one; both drop the cached redirect so fallbacks take
+// over or step back at once. Batches are claimed with SKIP LOCKED, so any
+// number of instances can run the checker.
+const (
+	healthAlive           = "alive"
+	healthClientError     = "client_error"
+	healthNotFound        = "not_found"
+	healthServerError     = "server_error"
+	healthTimeout         = "timeout"
+	healthSSLError        = "ssl_error"
+	healthDNSError        = "dns_error"
+	healthConnectionError = "connection_error"
+	healthBlocked         = "blocked"
+	healthUnknown         = "unknown"
+)
+
+var (
+	healthCheckInterval        = env.Duration("HEALTH_CHECK_INTERVAL", 5*time.Minute)
+	healthCheckMinAge          = env.Duration("HEALTH_CHECK_MIN_AGE", time.Hour)
+	healthCheckRequestInterval = env.Duration("HEALTH_CHECK_REQUEST_INTERVAL", 200*time.Millisecond)
+	healthCheckTimeout         = env.Duration("HEALTH_CHECK_TIMEOUT", 10*time.Second)
+	healthCheckBatchSize       = env.Int("HEALTH_CHECK_BATCH_SIZE", 100)
+	healthCheckFailures        = env.Int("HEALTH_CHECK_FAILURES", 2)
+)
+
+var healthCheckClient = newOutboundClient(healthCheckTimeout)
+
+const healthCheckTablesQuery = `
+	ALTER TABLE destination_health ADD COLUMN IF NOT EXISTS http_status INTEGER;
+	ALTER TABLE destination_health ADD COLUMN IF NOT EXISTS failures INTEGER NOT NULL DEFAULT 0;
+
+	CREATE INDEX IF NOT EXISTS idx_destination_health_checked_at ON destination_health(checked_at);
+`
+
+// DestinationHealth is the latest health check of a link's destination
+type DestinationHealth struct {
+	Healthy        bool       `json:"healthy"`
+	Status         string     `json:"status"`
+	HTTPStatus     *int       `json:"httpStatus,omitempty"`
+	CheckedAt      time.Time  `json:"checkedAt"`
+	UnhealthySince *time.Time `json:"unhealthySince,omitempty"`
+	CertExpiresAt  *time.Time `json:"certExpiresAt,omitempty"`
+	CertError      *string    `json:"certError,omitempty"`
+	// Warnings flag what is about to break, see certmonitor.go
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// linkHealth returns the latest health check of a link, nil before its first one
+func (srv *server) linkHealth(shortCode string) (*DestinationHealth, error) {
+	var h DestinationHealth
+	err := srv.db.QueryRow(`
+		SELECT healthy, status, http_status, checked_at, unhealthy_since, cert_expires_at, cert_error
+		FROM destination_health
+		WHERE short_code = $1 AND status <> $2
+	`, shortCode, healthUnknown).Scan(&h.Healthy, &h.Status, &h.HTTPStatus, &h.CheckedAt, &h.UnhealthySince,
+		&h.CertExpiresAt, &h.CertError)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get destination health: %v", err)
+	}
+	h.Warnings = certWarnings(&h)
+	return &h, nil
+}
+
+// healthETag extends the ETag of a link with its health, which changes without touching the link
+func healthETag(etag string, h *DestinationHealth) string {
+	if h == nil {
+		return etag
+	}
+	return fmt.Sprintf(`%s-%d"`, etag[:len(etag)-1], h.CheckedAt.UnixNano())
+}
+
+// claimHealthCheckBatch stamps the links that are due for a check and returns
+// their destinations. Links checked for the first time start out healthy.
+func (srv *server) claimHealthCheckBatch(limit int) ([]scanTarget, error) {
+	rows, err := srv.db.Query(`
+		WITH due AS (
+			SELECT u.short_code, u.original_url FROM urls u
+			LEFT JOIN destination_health h ON h.short_code = u.short_code
+			WHERE u.disabled_at IS NULL
+				AND (u.expires_at IS NULL OR u.expires_at > CURRENT_TIMESTAMP)
+				AND (h.checked_at IS NULL OR h.checked_at < $1)
+			ORDER BY h.checked_at NULLS FIRST, u.id
+			LIMIT $2
+			FOR UPDATE OF u SKIP LOCKED
+		),
+		claimed AS (
+			INSERT INTO destination_health (short_code, healthy, status)
+			SELECT short_code, true, $3 FROM due
+			ON CONFLICT (short_code) DO UPDATE SET checked_at = CURRENT_TIMESTAMP
+		)
+		SELECT short_code, original_url FROM due
+	`, time.Now().Add(-healthCheckMinAge), limit, healthUnknown)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := []scanTarget{}
+	for rows.Next() {
+		var t scanTarget
+		if err := rows.Scan(&t.ShortCode, &t.OriginalURL); err != nil {
+			return nil, err
+		}
+		if t.OriginalURL, err = urlcrypto.Decrypt(t.OriginalURL); err != nil {
+			log.Printf("Skipping %s during health check: %v", t.ShortCode, err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// healthCheckResult is the outcome of one check
+type healthCheckResult struct {
+	Status     string
+	HTTPStatus *int
+	// CertExpiresAt and CertError describe the TLS certificate, see certmonitor.go
+	CertExpiresAt *time.Time
+	CertError     *string
+}
+
+// checkDestination requests a destination and classifies the outcome. Servers
+// that don't support HEAD are asked again with GET, without reading the body.
+func checkDestination(rawURL string) healthCheckResult {
+	status, tlsState, err := requestStatus(http.MethodHead, rawURL)
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		status, tlsState, err = requestStatus(http.MethodGet, rawURL)
+	}
+	if err != nil {
+		return healthCheckResult{Status: healthErrorStatus(err), CertError: certErrorDetail(err)}
+	}
+
+	result := healthCheckResult{HTTPStatus: &status, CertExpiresAt: certExpiry(tlsState)}
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		result.Status = healthNotFound
+	case status >= 500:
+		result.Status = healthServerError
+	case status >= 400:
+		// The site is up but turned the checker away, e.g. bot protection
+		result.Status = healthClientError
+	default:
+		result.Status = healthAlive
+	}
+	return result
+}
+
+// requestStatus returns the status and TLS state of the final response
+func requestStatus(method, rawURL string) (int, *tls.ConnectionState, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("User-Agent", "url-shortener-health-check/1.0")
+
+	resp, err := healthCheckClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.TLS, nil
+}
+
+// healthErrorStatus classifies a failed request
+func healthErrorStatus(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, safehttp.ErrBlockedAddress):
+		return healthBlocked
+	case errors.As(err, &dnsErr):
+		return healthDNSError
+	case certErrorDetail(err) != nil:
+		return healthSSLError
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return healthTimeout
+	default:
+		return healthConnectionError
+	}
+}
+
+// healthyStatus reports whether a check outcome counts as the destination being up
+func healthyStatus(status string) bool {
+	return status == healthAlive || status == healthClientError
+}
+
+// recordHealthCheck stores the outcome of a check and reports whether the
+// destination went down or came back up with it
+func (srv *server) recordHealthCheck(shortCode string, result healthCheckResult) (bool, error) {
+	var healthy, wasHealthy bool
+	err := srv.db.QueryRow(`
+		UPDATE destination_health h
+		SET status = $2, http_status = $3, checked_at = CURRENT_TIMESTAMP,
+			cert_expires_at = $6, cert_error = $7,
+			failures = CASE WHEN $4 THEN 0 ELSE h.failures + 1 END,
+			healthy = $4 OR h.failures + 1 < $5,
+			unhealthy_since = CASE WHEN $4 OR h.failures + 1 < $5 THEN NULL
+				ELSE COALESCE(h.unhealthy_since, CURRENT_TIMESTAMP) END
+		FROM destination_health old
+		WHERE h.short_code = $1 AND old.short_code = h.short_code
+		RETURNING h.healthy, old.healthy
+	`, shortCode, result.Status, result.HTTPStatus, healthyStatus(result.Status), healthCheckFailures,
+		result.CertExpiresAt, result.CertError).Scan(&healthy, &wasHealthy)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The link was deleted during the check
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record health check: %v", err)
+	}
+	return healthy != wasHealthy, nil
+}
+
+// checkLinkHealth checks one batch and returns the number of links checked
+func (srv *server) checkLinkHealth() (int, error) {
+	targets, err := srv.claimHealthCheckBatch(healthCheckBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim health check batch: %v", err)
+	}
+
+	for i, t := range targets {
+		if i > 0 {
+			time.Sleep(healthCheckRequestInterval)
+		}
+
+		result := checkDestination(t.OriginalURL)
+		changed, err := srv.recordHealthCheck(t.ShortCode, result)
+		if err != nil {
+			return i, err
+		}
+		if changed {
+			srv.invalidateURLCache(t.ShortCode)
+			if healthyStatus(result.Status) {
+				log.Printf("Destination of %s is back up", t.ShortCode)
+			} else {
+				log.Printf("Destination of %s is down (%s)", t.ShortCode, result.Status)
+				srv.reportBrokenLink(t.ShortCode, result.Status)
+			}
+		}
+	}
+	return len(targets), nil
+}
+
+// startHealthChecker periodically checks link destinations; HEALTH_CHECK_INTERVAL=0 turns it off
+func (srv *server) startHealthChecker() {
+	if os.Getenv("HEALTH_CHECK_INTERVAL") == "0" {
+		return
+	}
+
+	srv.scheduleJob("health-checker", healthCheckInterval, func() error {
+		_, err := srv.checkLinkHealth()
+		return err
+	})
+
+	log.Printf("Destination health checker started (every %s, batches of %d)", healthCheckInterval, healthCheckBatchSize)
+}
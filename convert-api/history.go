@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+	"shared/urlcrypto"
+)
+
+// Every audited change to a link is also kept in link_history, which its
+// owner can read: who did what and which fields changed from what to what.
+// Unlike the audit log it leaves out IPs and unchanged fields. Destinations
+// are stored as the audit snapshot has them, encrypted when encryption at rest
+// is on, and decrypted when read.
+const linkHistoryTablesQuery = `
+	CREATE TABLE IF NOT EXISTS link_history (
+		id BIGSERIAL PRIMARY KEY,
+		short_code VARCHAR(10) NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		changes JSONB NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_link_history_short_code ON link_history(short_code, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_link_history_actor ON link_history(actor);
+`
+
+// linkHistoryFields are the fields of LinkResponse whose changes are kept
+var linkHistoryFields = []string{
+	"originalUrl", "expiresAt", "disabledAt", "disabledReason", "flagReason",
+	"publicStats", "folderId", "rotatedTo", "retireAt", "targets", "fallbackUrl",
+}
+
+// LinkChange is the value of one field before and after a change, null when unset
+type LinkChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+// LinkHistoryEntry is one change to a link
+type LinkHistoryEntry struct {
+	ID        int64                 `json:"id"`
+	Actor     string                `json:"actor"`
+	Action    string                `json:"action"`
+	Changes   map[string]LinkChange `json:"changes"`
+	CreatedAt time.Time             `json:"createdAt"`
+}
+
+// linkStateFields flattens an audit snapshot into its JSON fields
+func linkStateFields(state interface{}) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if state == nil {
+		return fields, nil
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return fields, json.Unmarshal(b, &fields)
+}
+
+// sameLinkField compares one field of two snapshots. Encrypted destinations
+// differ on every write, so they are compared decrypted.
+func sameLinkField(field string, a, b json.RawMessage) bool {
+	if a != nil && b != nil {
+		switch field {
+		case "originalUrl", "fallbackUrl":
+			return historyDestination(a) == historyDestination(b)
+		case "targets":
+			return bytes.Equal(historyTargetsValue(a), historyTargetsValue(b))
+		}
+	}
+	return bytes.Equal(a, b)
+}
+
+// historyDestination decrypts a destination kept in history
+func historyDestination(raw json.RawMessage) string {
+	var stored string
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return ""
+	}
+	return historyStoredURL(stored)
+}
+
+// historyStoredURL decrypts a stored destination kept in history
+func historyStoredURL(stored string) string {
+	originalURL, err := urlcrypto.Decrypt(stored)
+	if err != nil {
+		log.Printf("Failed to decrypt destination in link history: %v", err)
+		return ""
+	}
+	return originalURL
+}
+
+// linkChanges lists the fields that differ between two audit snapshots
+func linkChanges(before, after interface{}) (map[string]LinkChange, error) {
+	from, err := linkStateFields(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := linkStateFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]LinkChange{}
+	for _, field := range linkHistoryFields {
+		if !sameLinkField(field, from[field], to[field]) {
+			changes[field] = LinkChange{From: from[field], To: to[field]}
+		}
+	}
+	return changes, nil
+}
+
+// writeLinkHistory keeps a change to a link next to its audit entry
+func writeLinkHistory(exec execer, actor auditActor, action, shortCode string, before, after interface{}) error {
+	changes, err := linkChanges(before, after)
+	if err != nil {
+		return fmt.Errorf("failed to encode link history: %v", err)
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode link history: %v", err)
+	}
+
+	if _, err := exec.Exec(`
+		INSERT INTO link_history (short_code, actor, action, changes) VALUES ($1, $2, $3, $4)
+	`, shortCode, actor.ID, action, string(changesJSON)); err != nil {
+		return fmt.Errorf("failed to record link history: %v", err)
+	}
+
+	if change, ok := changes["originalUrl"]; ok {
+		return writeLinkVersion(exec, actor, shortCode, change)
+	}
+	return nil
+}
+
+// getLinkHistoryHandler lists the changes to one of the caller's links, newest first
+func (srv *server) getLinkHistoryHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	u, ok := srv.ownedLinkParam(c, owner, "link history")
+	if !ok {
+		return
+	}
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{u.ShortCode}
+	query := `SELECT id, actor, action, changes, created_at FROM link_history WHERE short_code = $1`
+	if after != nil {
+		var cond string
+		cond, args = keysetCondition("created_at", "id", after, args)
+		query += " AND " + cond
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to get link history: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get link history")
+		return
+	}
+	defer rows.Close()
+
+	entries := []LinkHistoryEntry{}
+	for rows.Next() {
+		var e LinkHistoryEntry
+		var changes []byte
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &changes, &e.CreatedAt); err != nil {
+			log.Printf("Failed to get link history: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to get link history")
+			return
+		}
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			log.Printf("Failed to get link history: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to get link history")
+			return
+		}
+		if change, ok := e.Changes["originalUrl"]; ok {
+			e.Changes["originalUrl"] = LinkChange{From: historyURLValue(change.From), To: historyURLValue(change.To)}
+		}
+		if change, ok := e.Changes["fallbackUrl"]; ok {
+			e.Changes["fallbackUrl"] = LinkChange{From: historyURLValue(change.From), To: historyURLValue(change.To)}
+		}
+		if change, ok := e.Changes["targets"]; ok {
+			e.Changes["targets"] = LinkChange{From: historyTargetsValue(change.From), To: historyTargetsValue(change.To)}
+		}
+		entries = append(entries, e)
+	}
+
+	nextCursor := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[len(entries)-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: last.ID}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"history": entries}, nextCursor)
+}
+
+// historyURLValue decrypts a destination of a history change for the response
+func historyURLValue(raw json.RawMessage) json.RawMessage {
+	if raw == nil || string(raw) == "null" {
+		return raw
+	}
+	b, _ := json.Marshal(historyDestination(raw))
+	return b
+}
+
+// historyTargetsValue decrypts the destinations of a targets change, for the
+// response and for comparing snapshots
+func historyTargetsValue(raw json.RawMessage) json.RawMessage {
+	if raw == nil || string(raw) == "null" {
+		return raw
+	}
+	var targets []LinkTarget
+	if err := json.Unmarshal(raw, &targets); err != nil {
+		return raw
+	}
+	for i := range targets {
+		targets[i].OriginalURL = historyStoredURL(targets[i].OriginalURL)
+	}
+	b, _ := json.Marshal(targets)
+	return b
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/response"
+)
+
+// consumerHeader is set by Kong's authentication plugins (key-auth, jwt, ...)
+// to the authenticated consumer. It identifies the owner of links and webhooks.
+// The gateway drops any the client sent, see api-gateway/kong.yml.
+const consumerHeader = "X-Consumer-Username"
+
+// anonymousConsumerHeader marks requests Kong let through without credentials
+// as its anonymous consumer
+const anonymousConsumerHeader = "X-Anonymous-Consumer"
+
+// consumerGroupsHeader is set by Kong's ACL plugin to the consumer's comma-separated groups
+const consumerGroupsHeader = "X-Consumer-Groups"
+
+// adminGroup is the ACL group allowed to call /api/admin endpoints
+var adminGroup = env.Get("ADMIN_GROUP", "admin")
+
+type ownerContextKey struct{}
+
+// callerID returns the authenticated consumer of the request, or "" for anonymous callers
+func callerID(c *gin.Context) string {
+	if c.GetHeader(anonymousConsumerHeader) == "true" {
+		return ""
+	}
+	return strings.TrimSpace(c.GetHeader(consumerHeader))
+}
+
+// isAdmin reports whether the caller is an authenticated consumer in the admin ACL group
+func isAdmin(c *gin.Context) bool {
+	if callerID(c) == "" {
+		return false
+	}
+	for _, group := range strings.Split(c.GetHeader(consumerGroupsHeader), ",") {
+		if strings.TrimSpace(group) == adminGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin rejects callers that are not in the admin ACL group
+func requireAdmin(c *gin.Context) {
+	if !isAdmin(c) {
+		response.Abort(c, http.StatusForbidden, "admin access required")
+		return
+	}
+	c.Next()
+}
+
+func withOwner(parent context.Context, owner string) context.Context {
+	return context.WithValue(parent, ownerContextKey{}, owner)
+}
+
+// ownerFromContext resolves the caller for GraphQL and gRPC calls, from the
+// request context set by graphQLHandler or grpcAuth
+func ownerFromContext(c context.Context) string {
+	owner, _ := c.Value(ownerContextKey{}).(string)
+	return owner
+}
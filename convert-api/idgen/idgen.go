@@ -0,0 +1,306 @@
+// Package idgen issues the numeric IDs that short codes are generated from.
+//
+// IDs come from the url_counter key in Redis, whose high-water mark is
+// checkpointed to Postgres so a wiped or rolled-back Redis restarts above every
+// issued ID. An Issuer is the only writer of the counter: convert-api creates
+// and rotates links through it, and its tools (backup restore, rebase-counter,
+// the seeder) move the counter through it. redirect-api never touches it.
+//
+// While Redis is unreachable, NextFallback issues IDs from a Postgres sequence
+// instead. Its range lies just below Start, which the counter never goes
+// under, so the two can't hand out the same ID.
+package idgen
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CounterKey holds the last issued ID. IDs start at Start (62^6), the first
+// value with a 7-character base62 code.
+const (
+	CounterKey = "url_counter"
+	Start      = int64(56800235584)
+)
+
+// FallbackSequence issues IDs from FallbackStart up to Start - 1
+const (
+	FallbackSequence = "url_fallback_ids"
+	FallbackStart    = Start - 1000000000
+)
+
+// DefaultRestoreGap is how many IDs a restore skips past the last checkpoint,
+// since IDs issued after it aren't known
+const DefaultRestoreGap = 1000000
+
+// TablesQuery creates the checkpoint table and the fallback sequence
+const TablesQuery = `
+	CREATE TABLE IF NOT EXISTS counter_checkpoints (
+		name TEXT PRIMARY KEY,
+		value BIGINT NOT NULL,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE SEQUENCE IF NOT EXISTS url_fallback_ids
+		MINVALUE 55800235584 MAXVALUE 56800235583 START WITH 55800235584 NO CYCLE;
+`
+
+// floorLua repairs the counter before it is used: a missing counter, or one
+// behind the last checkpoint (ARGV[2]), restarts at the restore value
+// (ARGV[3]); one below the starting floor (ARGV[1]) is raised to it. Running it
+// inside the same script as the read or increment keeps instances that start
+// together from resetting IDs another instance has already issued, without a
+// lock.
+const floorLua = `
+	local current = tonumber(redis.call('GET', KEYS[1]))
+	if current == nil or current < tonumber(ARGV[2]) then
+		local restore = ARGV[1]
+		if tonumber(ARGV[3]) > tonumber(ARGV[1]) then
+			restore = ARGV[3]
+		end
+		redis.call('SET', KEYS[1], restore)
+		redis.log(redis.LOG_WARNING, KEYS[1] .. ' missing or behind its checkpoint, set to ' .. restore)
+	elseif current < tonumber(ARGV[1]) then
+		redis.call('SET', KEYS[1], ARGV[1])
+	end
+`
+
+var (
+	floorScript   = redis.NewScript(floorLua + `return redis.call('GET', KEYS[1])`)
+	nextScript    = redis.NewScript(floorLua + `return redis.call('INCR', KEYS[1])`)
+	reserveScript = redis.NewScript(floorLua + `return redis.call('INCRBY', KEYS[1], ARGV[4])`)
+)
+
+// raiseScript moves the counter up to ARGV[1], never down
+var raiseScript = redis.NewScript(`
+	local current = tonumber(redis.call('GET', KEYS[1]))
+	if current == nil or current < tonumber(ARGV[1]) then
+		redis.call('SET', KEYS[1], ARGV[1])
+	end
+	return redis.call('GET', KEYS[1])
+`)
+
+// lowerScript moves the counter down only if it still holds the value the
+// caller checked (ARGV[1]), so no ID issued in between is reused
+var lowerScript = redis.NewScript(`
+	local current = redis.call('GET', KEYS[1]) or ''
+	if current ~= ARGV[1] then
+		return redis.error_reply('counter moved from ' .. ARGV[1] .. ' to ' .. current .. ' during the rebase')
+	end
+	redis.call('SET', KEYS[1], ARGV[2])
+	return ARGV[2]
+`)
+
+// Issuer hands out IDs from the counter
+type Issuer struct {
+	rdb        redis.Cmdable
+	db         *sql.DB
+	restoreGap int64
+	// checkpoint is the last checkpoint seen, 0 before the first
+	checkpoint atomic.Int64
+}
+
+// New returns an Issuer for the counter in rdb, checkpointed to db
+func New(rdb redis.Cmdable, db *sql.DB, restoreGap int64) *Issuer {
+	return &Issuer{rdb: rdb, db: db, restoreGap: restoreGap}
+}
+
+func (g *Issuer) scriptArgs(extra ...interface{}) []interface{} {
+	checkpoint := g.checkpoint.Load()
+	restore := int64(0)
+	if checkpoint > 0 {
+		restore = checkpoint + g.restoreGap
+	}
+	return append([]interface{}{Start - 1, checkpoint, restore}, extra...)
+}
+
+// Init loads the last checkpoint and repairs the counter if Redis lost it,
+// returning its value
+func (g *Issuer) Init(ctx context.Context) (int64, error) {
+	checkpoint, err := g.StoredCheckpoint(ctx)
+	if err != nil {
+		return 0, err
+	}
+	g.checkpoint.Store(checkpoint)
+	return g.Floor(ctx)
+}
+
+// Next issues one ID
+func (g *Issuer) Next(ctx context.Context) (int64, error) {
+	id, err := nextScript.Run(ctx, g.rdb, []string{CounterKey}, g.scriptArgs()...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get next ID from Redis: %v", err)
+	}
+	return id, nil
+}
+
+// NextFallback issues one ID from the Postgres sequence, for when Next fails
+func (g *Issuer) NextFallback(ctx context.Context) (int64, error) {
+	var id int64
+	if err := g.db.QueryRowContext(ctx, `SELECT nextval('`+FallbackSequence+`')`).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to get next ID from Postgres: %v", err)
+	}
+	return id, nil
+}
+
+// FallbackLast returns the last ID NextFallback issued, 0 before the first
+func (g *Issuer) FallbackLast(ctx context.Context) (int64, error) {
+	var last int64
+	var called bool
+	err := g.db.QueryRowContext(ctx, `SELECT last_value, is_called FROM `+FallbackSequence).Scan(&last, &called)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read fallback sequence: %v", err)
+	}
+	if !called {
+		return 0, nil
+	}
+	return last, nil
+}
+
+// RaiseFallback moves the fallback sequence past to, e.g. after a restore of
+// links created while Redis was down; it never moves it back
+func (g *Issuer) RaiseFallback(ctx context.Context, to int64) error {
+	if to < FallbackStart {
+		return nil
+	}
+	last, err := g.FallbackLast(ctx)
+	if err != nil {
+		return err
+	}
+	if last >= to {
+		return nil
+	}
+	if _, err := g.db.ExecContext(ctx, `SELECT setval('`+FallbackSequence+`', $1)`, to); err != nil {
+		return fmt.Errorf("failed to raise fallback sequence: %v", err)
+	}
+	return nil
+}
+
+// Reserve issues n consecutive IDs and returns the first
+func (g *Issuer) Reserve(ctx context.Context, n int64) (int64, error) {
+	last, err := reserveScript.Run(ctx, g.rdb, []string{CounterKey}, g.scriptArgs(n)...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve IDs from Redis: %v", err)
+	}
+	return last - n + 1, nil
+}
+
+// Floor returns the last issued ID, repairing the counter first, so every ID
+// above it is still to be issued
+func (g *Issuer) Floor(ctx context.Context) (int64, error) {
+	current, err := floorScript.Run(ctx, g.rdb, []string{CounterKey}, g.scriptArgs()...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read counter: %v", err)
+	}
+	return current, nil
+}
+
+// Current returns the counter as it is, 0 when it is unset
+func (g *Issuer) Current(ctx context.Context) (int64, error) {
+	current, err := g.rdb.Get(ctx, CounterKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read counter: %v", err)
+	}
+	return current, nil
+}
+
+// Checkpoint returns the last checkpoint this Issuer saw
+func (g *Issuer) Checkpoint() int64 {
+	return g.checkpoint.Load()
+}
+
+// StoredCheckpoint reads the checkpoint from Postgres, 0 when there is none
+func (g *Issuer) StoredCheckpoint(ctx context.Context) (int64, error) {
+	var checkpoint int64
+	err := g.db.QueryRowContext(ctx, `SELECT value FROM counter_checkpoints WHERE name = $1`, CounterKey).Scan(&checkpoint)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to load counter checkpoint: %v", err)
+	}
+	return checkpoint, nil
+}
+
+// SaveCheckpoint stores the counter's current value. GREATEST keeps the
+// checkpoint monotonic when several instances write it.
+func (g *Issuer) SaveCheckpoint(ctx context.Context) error {
+	current, err := g.Current(ctx)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		// Restored by the next Next; checkpointing now would only lose information
+		return nil
+	}
+
+	var checkpoint int64
+	err = g.db.QueryRowContext(ctx, `
+		INSERT INTO counter_checkpoints (name, value) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE
+		SET value = GREATEST(counter_checkpoints.value, EXCLUDED.value), updated_at = CURRENT_TIMESTAMP
+		RETURNING value
+	`, CounterKey, current).Scan(&checkpoint)
+	if err != nil {
+		return err
+	}
+	if checkpoint > current {
+		log.Printf("Redis counter %d is behind its checkpoint %d, it will be restored on the next create", current, checkpoint)
+	}
+	g.checkpoint.Store(checkpoint)
+	return nil
+}
+
+// Raise moves the checkpoint and the counter up to at least to, e.g. after a
+// restore, and returns the counter. Both only ever move up, so IDs issued in
+// the meantime (or by instances still running) are never handed out again.
+func (g *Issuer) Raise(ctx context.Context, to int64) (int64, error) {
+	if err := g.saveCheckpointValue(ctx, to, false); err != nil {
+		return 0, err
+	}
+	current, err := raiseScript.Run(ctx, g.rdb, []string{CounterKey}, to).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to raise counter: %v", err)
+	}
+	return current, nil
+}
+
+// Rebase moves the counter from the value the caller checked to another one.
+// Moving down overwrites the checkpoint too, or the counter would be restored
+// above it again; moving up never lowers either.
+func (g *Issuer) Rebase(ctx context.Context, from, to int64) error {
+	var err error
+	if to < from {
+		err = lowerScript.Run(ctx, g.rdb, []string{CounterKey}, strconv.FormatInt(from, 10), to).Err()
+	} else {
+		err = raiseScript.Run(ctx, g.rdb, []string{CounterKey}, to).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rebase counter: %v", err)
+	}
+
+	if err := g.saveCheckpointValue(ctx, to, to < from); err != nil {
+		return fmt.Errorf("counter rebased to %d but its checkpoint wasn't updated: %v", to, err)
+	}
+	return nil
+}
+
+// saveCheckpointValue raises the stored checkpoint to value, or with
+// overwrite sets it
+func (g *Issuer) saveCheckpointValue(ctx context.Context, value int64, overwrite bool) error {
+	_, err := g.db.ExecContext(ctx, `
+		INSERT INTO counter_checkpoints (name, value) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE
+		SET value = CASE WHEN $3 THEN EXCLUDED.value ELSE GREATEST(counter_checkpoints.value, EXCLUDED.value) END,
+			updated_at = CURRENT_TIMESTAMP
+	`, CounterKey, value, overwrite)
+	if err != nil {
+		return fmt.Errorf("failed to checkpoint counter: %v", err)
+	}
+	return nil
+}
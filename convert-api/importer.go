@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"convert-api/idgen"
+
+	"shared/secrets"
+	"shared/urlcrypto"
+)
+
+// The importer loads CSV exports of other shorteners, keeping their short
+// codes so links already shared keep working once the domain points here:
+//
+//	convertapi import -source bitly -file bitly_export.csv [-owner alice] [-dry-run]
+//
+// Columns are matched by header name, so Bitly ("long_url", "link") and
+// TinyURL ("url", "tinyurl") exports work as they are. Imported links get
+// urls.source set to -source. Safe Browsing isn't queried per row; the
+// rescanner picks imported links up first since they were never scanned.
+const importBatchSize = 500
+
+var (
+	importDestinationColumns = []string{"long_url", "original_url", "destination", "url", "target"}
+	importShortColumns       = []string{"bitlink", "link", "short_url", "short_link", "tinyurl", "alias", "short_code", "code"}
+	importCreatedColumns     = []string{"created_at", "created", "date_created", "created_date"}
+)
+
+// importCodePattern matches the codes redirect-api routes (see kong.yml) and that fit urls.short_code
+var importCodePattern = regexp.MustCompile(`^[a-zA-Z0-9]{1,10}$`)
+
+var importTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02", "01/02/2006"}
+
+const auditLinkImport = "link.import"
+
+// ImportReport summarizes one import run
+type ImportReport struct {
+	Source   string         `json:"source"`
+	File     string         `json:"file"`
+	Rows     int            `json:"rows"`
+	Imported int            `json:"imported"`
+	Existing int            `json:"existing"`
+	Skipped  map[string]int `json:"skipped"`
+}
+
+func (r *ImportReport) skip(line int, reason, detail string) {
+	r.Skipped[reason]++
+	log.Printf("Skipping line %d (%s): %s", line, reason, detail)
+}
+
+// importRow is one link ready to insert
+type importRow struct {
+	URL
+	line int
+}
+
+// normalizeImportHeader turns "Long URL" and "long_url" into the same key
+func normalizeImportHeader(h string) string {
+	h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(h)
+}
+
+func findImportColumn(header []string, names []string) int {
+	for _, name := range names {
+		for i, h := range header {
+			if normalizeImportHeader(h) == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// importShortCode takes the code from a short link ("https://bit.ly/3xYz",
+// "tinyurl.com/abc") or a bare code
+func importShortCode(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, "://"); i >= 0 {
+		value = value[i+3:]
+	}
+	if i := strings.IndexAny(value, "?#"); i >= 0 {
+		value = value[:i]
+	}
+	value = strings.TrimSuffix(value, "/")
+	if i := strings.LastIndex(value, "/"); i >= 0 {
+		value = value[i+1:]
+	}
+	return value
+}
+
+func parseImportTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range importTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (srv *server) importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	source := flags.String("source", "", "shortener the export comes from, stored on every link (e.g. bitly, tinyurl)")
+	file := flags.String("file", "", "CSV export to import")
+	owner := flags.String("owner", "", "consumer that owns the imported links")
+	dryRun := flags.Bool("dry-run", false, "validate the file without importing")
+	flags.Parse(args)
+	if *source == "" || *file == "" {
+		return errors.New("-source and -file are required")
+	}
+
+	if err := urlcrypto.Init(); err != nil {
+		return fmt.Errorf("invalid URL encryption configuration: %v", err)
+	}
+	secrets.Init()
+	srv.initDatabase()
+	srv.initRedis()
+	if err := srv.loadDomainRules(); err != nil {
+		return fmt.Errorf("failed to load domain rules: %v", err)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, err := srv.importLinks(f, *source, *file, *owner, *dryRun)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d of %d rows from %s (%d already existed, skipped %v)",
+		report.Imported, report.Rows, *file, report.Existing, report.Skipped)
+	if !*dryRun {
+		srv.recordAudit(auditActor{ID: "[import]"}, auditLinkImport, auditTargetLink, *source, nil, report)
+	}
+	return nil
+}
+
+// importLinks validates every row like a create would, except for Safe
+// Browsing, and inserts them in batches. Codes that already exist, or that the
+// counter could issue later, are skipped rather than overwritten.
+func (srv *server) importLinks(r io.Reader, source, file, owner string, dryRun bool) (*ImportReport, error) {
+	report := &ImportReport{Source: source, File: file, Skipped: map[string]int{}}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	destCol := findImportColumn(header, importDestinationColumns)
+	codeCol := findImportColumn(header, importShortColumns)
+	createdCol := findImportColumn(header, importCreatedColumns)
+	if destCol < 0 || codeCol < 0 {
+		return nil, fmt.Errorf("CSV header %v needs a destination column (%s) and a short link column (%s)",
+			header, strings.Join(importDestinationColumns, ", "), strings.Join(importShortColumns, ", "))
+	}
+
+	// Generated codes decode to id*shortCodeSalts + salt; anything at or above
+	// the next ID's range, or in the fallback sequence's, would collide with a
+	// future create
+	counter, err := srv.ids.Floor(srv.ctx)
+	if err != nil {
+		return nil, err
+	}
+	generatedFloor := (counter + 1) * shortCodeSalts
+	fallbackFloor, fallbackEnd := idgen.FallbackStart*shortCodeSalts, idgen.Start*shortCodeSalts
+
+	seen := map[string]bool{}
+	batch := []importRow{}
+	flush := func() error {
+		if len(batch) == 0 || dryRun {
+			batch = batch[:0]
+			return nil
+		}
+		inserted, err := srv.insertImportBatch(batch, source)
+		if err != nil {
+			return err
+		}
+		report.Imported += inserted
+		report.Existing += len(batch) - inserted
+		batch = batch[:0]
+		return nil
+	}
+
+	line := 1
+	for {
+		record, err := reader.Read()
+		line++
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.Rows++
+			report.skip(line, "malformed", err.Error())
+			continue
+		}
+		report.Rows++
+		if destCol >= len(record) || codeCol >= len(record) {
+			report.skip(line, "malformed", "missing columns")
+			continue
+		}
+
+		code := importShortCode(record[codeCol])
+		if !importCodePattern.MatchString(code) {
+			report.skip(line, "invalid_code", code)
+			continue
+		}
+		if n, ok := decodeBase62(code); ok && (n >= generatedFloor || (n >= fallbackFloor && n < fallbackEnd)) {
+			report.skip(line, "reserved_code", code)
+			continue
+		}
+		if seen[cacheShortCode(code)] {
+			report.skip(line, "duplicate_code", code)
+			continue
+		}
+		seen[cacheShortCode(code)] = true
+
+		destination := strings.TrimSpace(record[destCol])
+		parsed, err := url.Parse(destination)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			report.skip(line, "invalid_url", destination)
+			continue
+		}
+		if err := checkDomainPolicy(parsed.Hostname()); err != nil {
+			report.skip(line, "blocked_domain", destination)
+			continue
+		}
+		holdReason, err := checkPhishing(parsed)
+		if err != nil {
+			report.skip(line, "phishing", destination)
+			continue
+		}
+
+		row := importRow{URL: URL{OriginalURL: destination, ShortCode: code, Owner: owner, DisabledReason: holdReason}, line: line}
+		row.CreatedAt = time.Now()
+		if createdCol >= 0 && createdCol < len(record) {
+			if t, ok := parseImportTime(record[createdCol]); ok {
+				row.CreatedAt = t
+			}
+		}
+
+		batch = append(batch, row)
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return report, err
+	}
+	if dryRun {
+		report.Imported = report.Rows - sumSkipped(report.Skipped)
+	}
+	return report, nil
+}
+
+func sumSkipped(skipped map[string]int) int {
+	total := 0
+	for _, n := range skipped {
+		total += n
+	}
+	return total
+}
+
+// insertImportBatch inserts one batch, leaving codes that already exist
+// untouched, and returns how many rows were inserted
+func (srv *server) insertImportBatch(rows []importRow, source string) (int, error) {
+	values := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*6+1)
+	args = append(args, source)
+	for i, row := range rows {
+		storedURL, err := urlcrypto.Encrypt(row.OriginalURL)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encrypt URL on line %d: %v", row.line, err)
+		}
+		n := len(args)
+		values[i] = fmt.Sprintf("($%d, $%d, $%d, CASE WHEN $%d::text IS NULL THEN NULL ELSE CURRENT_TIMESTAMP END, $%d, $%d, $%d, $1)",
+			n+1, n+2, n+3, n+4, n+4, n+5, n+5)
+		args = append(args, storedURL, row.ShortCode, row.Owner, row.DisabledReason, row.CreatedAt)
+	}
+
+	result, err := srv.db.Exec(`
+		INSERT INTO urls (original_url, short_code, owner, disabled_at, disabled_reason, created_at, updated_at, source)
+		VALUES `+strings.Join(values, ", ")+`
+		ON CONFLICT DO NOTHING
+	`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to import batch ending on line %d: %v", rows[len(rows)-1].line, err)
+	}
+	inserted, _ := result.RowsAffected()
+	return int(inserted), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"shared/accesslog"
+	"shared/env"
+)
+
+// Background jobs that sweep the whole database (cleanup, rescans, health
+// checks, reports, the counter checkpoint) run only on the elected leader,
+// so adding instances doesn't multiply their load. Queue workers (email,
+// erasure, bulk jobs) keep running everywhere.
+//
+// LEADER_ELECTION=redis (the default) holds a lease in the counter Redis,
+// renewed every third of LEADER_LEASE_TTL; postgres holds a session advisory
+// lock on a connection of its own, which needs DATABASE_URL to reach Postgres
+// directly or through session pooling, never transaction pooling; off makes
+// every instance a leader. A leader that can't renew steps down at once, and
+// another instance takes over once the lease expires or the session ends.
+const (
+	leaderElectionRedis    = "redis"
+	leaderElectionPostgres = "postgres"
+	leaderElectionOff      = "off"
+	leaderKey              = "leader:convert-api"
+)
+
+var (
+	leaderElection = env.Get("LEADER_ELECTION", leaderElectionRedis)
+	leaderLeaseTTL = env.Duration("LEADER_LEASE_TTL", 15*time.Second)
+)
+
+// leaderID tells instances' leases apart, and leader holds whether this one leads
+var (
+	leaderID = fmt.Sprintf("%s:%s", env.Get("HOSTNAME", "convert-api"), accesslog.NewRequestID()[:8])
+	leader   atomic.Bool
+)
+
+// campaignScript takes the lease when it is free and renews it when this
+// instance holds it, returning 1 either way
+var campaignScript = redis.NewScript(`
+	local holder = redis.call("GET", KEYS[1])
+	if holder == false then
+		redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+		return 1
+	end
+	if holder == ARGV[1] then
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		return 1
+	end
+	return 0
+`)
+
+func initLeaderElection() error {
+	switch leaderElection {
+	case leaderElectionRedis, leaderElectionPostgres, leaderElectionOff:
+	default:
+		return fmt.Errorf("unknown LEADER_ELECTION %q, expected redis, postgres or off", leaderElection)
+	}
+	if leaderLeaseTTL < 3*time.Second {
+		return fmt.Errorf("LEADER_LEASE_TTL must be at least 3s")
+	}
+	return nil
+}
+
+// isLeader reports whether this instance should run singleton jobs
+func isLeader() bool {
+	return leader.Load()
+}
+
+func setLeader(leading bool) {
+	if leader.Swap(leading) != leading {
+		if leading {
+			log.Printf("Instance %s is now the leader", leaderID)
+		} else {
+			log.Printf("Instance %s is no longer the leader", leaderID)
+		}
+	}
+}
+
+func (srv *server) campaignRedis() error {
+	held, err := campaignScript.Run(srv.ctx, srv.rdb, []string{leaderKey}, leaderID, leaderLeaseTTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	setLeader(held == 1)
+	return nil
+}
+
+// leaderConn is the session holding the advisory lock in postgres mode
+var leaderConn *sql.Conn
+
+// campaignPostgres tries the advisory lock, and while leading checks that
+// the session holding it is still alive
+func (srv *server) campaignPostgres() error {
+	if leaderConn == nil {
+		conn, err := srv.db.Conn(srv.ctx)
+		if err != nil {
+			return err
+		}
+		leaderConn = conn
+	}
+
+	held := isLeader()
+	var err error
+	if held {
+		// The lock lasts as long as the session
+		_, err = leaderConn.ExecContext(srv.ctx, `SELECT 1`)
+	} else {
+		err = leaderConn.QueryRowContext(srv.ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, leaderKey).Scan(&held)
+	}
+	if err != nil {
+		// Discard the session rather than return it to the pool, so a lock it
+		// may hold is released with it
+		leaderConn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		leaderConn.Close()
+		leaderConn = nil
+		return err
+	}
+	setLeader(held)
+	return nil
+}
+
+// startLeaderElection campaigns once before the jobs start, then keeps
+// campaigning in the background
+func (srv *server) startLeaderElection() {
+	if leaderElection == leaderElectionOff {
+		setLeader(true)
+		return
+	}
+	campaign := srv.campaignRedis
+	if leaderElection == leaderElectionPostgres {
+		campaign = srv.campaignPostgres
+	}
+
+	run := func() {
+		if err := campaign(); err != nil {
+			log.Printf("Leader election failed: %v", err)
+			setLeader(false)
+		}
+	}
+	run()
+	go func() {
+		ticker := time.NewTicker(leaderLeaseTTL / 3)
+		defer ticker.Stop()
+		for range ticker.C {
+			run()
+		}
+	}()
+	log.Printf("Leader election through %s started", leaderElection)
+}
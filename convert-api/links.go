@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/idn"
+	"shared/response"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// LinkResponse is the REST representation of a link
+type LinkResponse struct {
+	ID          int    `json:"id"`
+	ShortCode   string `json:"shortCode"`
+	ShortURL    string `json:"shortUrl"`
+	OriginalURL string `json:"originalUrl"`
+	// DisplayURL is OriginalURL with its punycode hostname in Unicode, and
+	// HostWarnings what makes that hostname look like another, see shared/idn
+	DisplayURL     string     `json:"displayUrl,omitempty"`
+	HostWarnings   []string   `json:"hostWarnings,omitempty"`
+	FlagReason     *string    `json:"flagReason,omitempty"`
+	DisabledAt     *time.Time `json:"disabledAt,omitempty"`
+	DisabledReason *string    `json:"disabledReason,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+	Source         *string    `json:"source,omitempty"`
+	CodeGenerator  *string    `json:"codeGenerator,omitempty"`
+	PublicStats    bool       `json:"publicStats"`
+	RotatedTo      *string    `json:"rotatedTo,omitempty"`
+	RetireAt       *time.Time `json:"retireAt,omitempty"`
+	FolderID       *int64     `json:"folderId,omitempty"`
+	FallbackURL    *string    `json:"fallbackUrl,omitempty"`
+	// Favorite is only set on the caller's own lists
+	Favorite *bool `json:"favorite,omitempty"`
+	// Health is only set on single link lookups, once the destination was checked
+	Health *DestinationHealth `json:"health,omitempty"`
+}
+
+func toLinkResponse(u *URL) LinkResponse {
+	r := LinkResponse{
+		ID:             u.ID,
+		ShortCode:      u.ShortCode,
+		ShortURL:       shortURL(u.ShortCode),
+		OriginalURL:    u.OriginalURL,
+		FlagReason:     u.FlagReason,
+		DisabledAt:     u.DisabledAt,
+		DisabledReason: u.DisabledReason,
+		CreatedAt:      u.CreatedAt,
+		UpdatedAt:      u.UpdatedAt,
+		ExpiresAt:      u.ExpiresAt,
+		Source:         u.Source,
+		CodeGenerator:  u.CodeGenerator,
+		PublicStats:    u.PublicStats,
+		RotatedTo:      u.RotatedTo,
+		RetireAt:       u.RetireAt,
+		FolderID:       u.FolderID,
+		FallbackURL:    u.FallbackURL,
+	}
+	r.DisplayURL, r.HostWarnings, _ = idn.DisplayURL(u.OriginalURL)
+	return r
+}
+
+// visibleLink loads the :shortCode link if the caller owns it or is an admin,
+// writing the error response otherwise
+func (srv *server) visibleLink(c *gin.Context, what string) (*URL, bool) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return nil, false
+	}
+	if !isAdmin(c) {
+		return srv.ownedLinkParam(c, owner, what)
+	}
+
+	u, err := srv.getURLByShortCode(c.Param("shortCode"))
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+			return nil, false
+		}
+		log.Printf("Failed to get %s: %v", what, err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get "+what)
+		return nil, false
+	}
+	return u, true
+}
+
+// getLinkHandler returns one of the caller's links; admins see every tenant's
+func (srv *server) getLinkHandler(c *gin.Context) {
+	u, ok := srv.visibleLink(c, "URL")
+	if !ok {
+		return
+	}
+
+	health, err := srv.linkHealth(u.ShortCode)
+	if err != nil {
+		log.Printf("Failed to get destination health: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to retrieve URL")
+		return
+	}
+
+	resp := toLinkResponse(u)
+	resp.Health = health
+	jsonWithETag(c, healthETag(urlETag(u), health), resp, nil)
+}
+
+// urlFilterParams reads the search and paging parameters of link lists,
+// writing a 400 response when they are invalid
+func urlFilterParams(c *gin.Context) (URLFilter, bool) {
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return URLFilter{}, false
+	}
+
+	filter := URLFilter{
+		OriginalURLContains: c.Query("q"),
+		Limit:               limit,
+		After:               after,
+	}
+	for param, dest := range map[string]**time.Time{
+		"created_after":  &filter.CreatedAfter,
+		"created_before": &filter.CreatedBefore,
+	} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				response.Fail(c, http.StatusBadRequest, "invalid "+param+", expected RFC 3339")
+				return URLFilter{}, false
+			}
+			*dest = &t
+		}
+	}
+	return filter, true
+}
+
+// listLinksHandler lists the caller's links. Admins list every tenant's, or
+// one tenant's with ?owner.
+func (srv *server) listLinksHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	filter, ok := urlFilterParams(c)
+	if !ok {
+		return
+	}
+	filter.Owner = owner
+	if isAdmin(c) {
+		filter.Owner = c.Query("owner")
+	}
+
+	urls, nextCursor, err := srv.listURLs(filter)
+	if err != nil {
+		if errors.Is(err, errEncryptedSearch) {
+			response.Fail(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Failed to list URLs: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list URLs")
+		return
+	}
+
+	links := make([]LinkResponse, len(urls))
+	for i := range urls {
+		links[i] = toLinkResponse(&urls[i])
+	}
+
+	setPageLinks(c, nextCursor)
+	jsonWithETag(c, urlsETag(urls, c.Request.URL.RawQuery), gin.H{"urls": links}, response.Page{NextCursor: nextCursor})
+}
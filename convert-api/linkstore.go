@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"convert-api/linkstore"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"shared/env"
+	"shared/secrets"
+	"shared/tracing"
+	"shared/urlcrypto"
+)
+
+// LINK_STORE=dynamodb keeps every link's redirect mapping in the DynamoDB
+// table LINK_STORE_TABLE as well, for redirect-api to resolve from instead of
+// Postgres (see the linkstore package). New codes are claimed in the table
+// before they are saved, and every change that drops a link from the redirect
+// cache writes it through first. Links that reach Postgres another way
+// (import, restore, seeding) are copied by the sync-link-store command, which
+// also fills the table when the store is first turned on.
+var (
+	linkStoreBackend = os.Getenv("LINK_STORE")
+	linkStoreTable   = env.Get("LINK_STORE_TABLE", "links")
+)
+
+// linkStore is nil unless LINK_STORE is set
+var linkStore linkstore.Store
+
+var errShortCodeTaken = errors.New("short code is already taken in the link store")
+
+func initLinkStore() error {
+	switch linkStoreBackend {
+	case "":
+		return nil
+	case "dynamodb":
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config: %v", err)
+		}
+		if cfg.Region == "" {
+			return errors.New("AWS_REGION is required for the DynamoDB link store")
+		}
+		client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			o.HTTPClient = tracing.Client(&http.Client{Timeout: 5 * time.Second})
+		})
+		linkStore = linkstore.NewDynamoDB(client, linkStoreTable)
+		return nil
+	default:
+		return fmt.Errorf("unknown LINK_STORE %q, expected dynamodb", linkStoreBackend)
+	}
+}
+
+// claimShortCode stores a new link's mapping before the link is saved. The
+// write only succeeds while the code is free, so no two links can get it.
+func claimShortCode(ctx context.Context, u *URL) error {
+	if linkStore == nil {
+		return nil
+	}
+	storedURL, err := urlcrypto.Encrypt(u.OriginalURL)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt URL: %v", err)
+	}
+	// Version 0 gives way to the first sync from Postgres
+	err = linkStore.Create(ctx, linkstore.Link{
+		ShortCode: cacheShortCode(u.ShortCode),
+		Value:     storedURL,
+		Disabled:  u.DisabledReason != nil,
+		ExpiresAt: u.ExpiresAt,
+		Owner:     u.Owner,
+	})
+	if errors.Is(err, linkstore.ErrExists) {
+		return errShortCodeTaken
+	}
+	return err
+}
+
+// releaseShortCode drops the claim of a link that wasn't saved. Deleting
+// below version 1 only ever removes the claim itself, never a synced mapping.
+func (srv *server) releaseShortCode(shortCode string) {
+	if linkStore == nil {
+		return
+	}
+	if err := linkStore.Delete(srv.ctx, cacheShortCode(shortCode), 1); err != nil {
+		log.Printf("Failed to release %s in the link store: %v", shortCode, err)
+	}
+}
+
+// linkStoreQuery reads a link's redirect mapping the way redirect-api does,
+// with the statement's start as its version: a sync that starts after a
+// change has committed always sees it and always wins. The LEFT JOIN still
+// returns the version when the link is gone.
+const linkStoreQuery = `
+	SELECT ` + servedURLColumn + `, ` + linkTargetsColumn + `, urls.disabled_at IS NOT NULL, urls.expires_at, urls.owner,
+		(extract(epoch FROM v.at) * 1000000)::bigint
+	FROM (SELECT statement_timestamp() AS at) v
+	LEFT JOIN urls ON urls.short_code = $1
+`
+
+// syncLinkStore writes a link's current mapping through to the link store,
+// or removes it once the link is gone. Failures are logged; sync-link-store
+// repairs what they left behind.
+func (srv *server) syncLinkStore(shortCode string) {
+	if linkStore == nil {
+		return
+	}
+	if err := srv.writeLinkStore(shortCode); err != nil {
+		log.Printf("Failed to sync %s to the link store: %v", shortCode, err)
+	}
+}
+
+func (srv *server) writeLinkStore(shortCode string) error {
+	var storedURL, targets *string
+	var disabled sql.NullBool
+	var expiresAt *time.Time
+	var owner sql.NullString
+	var version int64
+	err := srv.db.QueryRow(linkStoreQuery, shortCode).Scan(&storedURL, &targets, &disabled, &expiresAt, &owner, &version)
+	if err != nil {
+		return fmt.Errorf("failed to read link: %v", err)
+	}
+
+	key := cacheShortCode(shortCode)
+	if storedURL == nil {
+		return linkStore.Delete(srv.ctx, key, version)
+	}
+	return linkStore.Put(srv.ctx, linkstore.Link{
+		ShortCode: key,
+		Value:     weightedCacheValue(*storedURL, targets),
+		Disabled:  disabled.Bool,
+		ExpiresAt: expiresAt,
+		Owner:     owner.String,
+		Version:   version,
+	})
+}
+
+// syncLinkStoreBatch is how many links sync-link-store reads at a time
+const syncLinkStoreBatch = 1000
+
+// syncLinkStoreCommand copies every link to the link store:
+//
+//	convert-api sync-link-store
+func (srv *server) syncLinkStoreCommand(args []string) error {
+	flags := flag.NewFlagSet("sync-link-store", flag.ExitOnError)
+	flags.Parse(args)
+
+	if err := initLinkStore(); err != nil {
+		return err
+	}
+	if linkStore == nil {
+		return errors.New("LINK_STORE is not set")
+	}
+	secrets.Init()
+	srv.initDatabase()
+	srv.initRedis()
+
+	var lastID, synced, failed int64
+	for {
+		rows, err := srv.db.Query(`SELECT id, short_code FROM urls WHERE id > $1 ORDER BY id LIMIT $2`, lastID, syncLinkStoreBatch)
+		if err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		codes := []string{}
+		for rows.Next() {
+			var code string
+			if err := rows.Scan(&lastID, &code); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to list links: %v", err)
+			}
+			codes = append(codes, code)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		if len(codes) == 0 {
+			break
+		}
+
+		for _, code := range codes {
+			if err := srv.writeLinkStore(code); err != nil {
+				log.Printf("Failed to sync %s: %v", code, err)
+				failed++
+				continue
+			}
+			synced++
+		}
+		log.Printf("Synced %d links", synced)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d links failed to sync, run it again", failed)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package linkstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDB stores mappings in a table with the string partition key
+// short_code. Point the table's TTL at expires_at to have expired links
+// removed.
+type DynamoDB struct {
+	client *dynamodb.Client
+	table  string
+}
+
+// NewDynamoDB returns a Store backed by table
+func NewDynamoDB(client *dynamodb.Client, table string) *DynamoDB {
+	return &DynamoDB{client: client, table: table}
+}
+
+// notNewer only lets a write through when the stored version is older
+const notNewer = "attribute_not_exists(short_code) OR #version < :version"
+
+// versionName keeps notNewer clear of DynamoDB's reserved words
+var versionName = map[string]string{"#version": "version"}
+
+func (d *DynamoDB) item(l Link) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"short_code": &types.AttributeValueMemberS{Value: l.ShortCode},
+		"value":      &types.AttributeValueMemberS{Value: l.Value},
+		"disabled":   &types.AttributeValueMemberBOOL{Value: l.Disabled},
+		"version":    &types.AttributeValueMemberN{Value: strconv.FormatInt(l.Version, 10)},
+		"owner":      &types.AttributeValueMemberS{Value: l.Owner},
+	}
+	if l.ExpiresAt != nil {
+		item["expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(l.ExpiresAt.Unix(), 10)}
+	}
+	return item
+}
+
+func isConditionFailed(err error) bool {
+	var failed *types.ConditionalCheckFailedException
+	return errors.As(err, &failed)
+}
+
+func (d *DynamoDB) Create(ctx context.Context, l Link) error {
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.table),
+		Item:                d.item(l),
+		ConditionExpression: aws.String("attribute_not_exists(short_code)"),
+	})
+	if isConditionFailed(err) {
+		return ErrExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s in DynamoDB: %v", l.ShortCode, err)
+	}
+	return nil
+}
+
+func (d *DynamoDB) Put(ctx context.Context, l Link) error {
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(d.table),
+		Item:                     d.item(l),
+		ConditionExpression:      aws.String(notNewer),
+		ExpressionAttributeNames: versionName,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(l.Version, 10)},
+		},
+	})
+	if err != nil && !isConditionFailed(err) {
+		return fmt.Errorf("failed to store %s in DynamoDB: %v", l.ShortCode, err)
+	}
+	return nil
+}
+
+func (d *DynamoDB) Get(ctx context.Context, shortCode string) (*Link, error) {
+	// Strongly consistent, or a redirect right after a change could cache
+	// the old mapping again
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]types.AttributeValue{"short_code": &types.AttributeValueMemberS{Value: shortCode}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s from DynamoDB: %v", shortCode, err)
+	}
+	if out.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	l := Link{ShortCode: shortCode}
+	if v, ok := out.Item["value"].(*types.AttributeValueMemberS); ok {
+		l.Value = v.Value
+	}
+	if v, ok := out.Item["disabled"].(*types.AttributeValueMemberBOOL); ok {
+		l.Disabled = v.Value
+	}
+	if v, ok := out.Item["owner"].(*types.AttributeValueMemberS); ok {
+		l.Owner = v.Value
+	}
+	if v, ok := out.Item["version"].(*types.AttributeValueMemberN); ok {
+		l.Version, _ = strconv.ParseInt(v.Value, 10, 64)
+	}
+	if v, ok := out.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		if unix, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+			expiresAt := time.Unix(unix, 0)
+			l.ExpiresAt = &expiresAt
+		}
+	}
+	return &l, nil
+}
+
+func (d *DynamoDB) Delete(ctx context.Context, shortCode string, version int64) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(d.table),
+		Key:                      map[string]types.AttributeValue{"short_code": &types.AttributeValueMemberS{Value: shortCode}},
+		ConditionExpression:      aws.String(notNewer),
+		ExpressionAttributeNames: versionName,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)},
+		},
+	})
+	if err != nil && !isConditionFailed(err) {
+		return fmt.Errorf("failed to delete %s from DynamoDB: %v", shortCode, err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Package linkstore keeps the redirect mapping of every short code in a
+// key-value store, for deployments whose redirect traffic outgrows Postgres.
+//
+// Postgres stays the system of record: convert-api claims each new short code
+// in the store with a conditional write, so a code can only ever be issued
+// once across instances and regions, and writes every later change to the
+// mapping through. redirect-api then resolves cache misses from the store
+// instead of Postgres. Items are keyed by short code alone, so every lookup is
+// a single-partition read.
+package linkstore
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrExists is returned by Create when the short code is already taken
+	ErrExists = errors.New("short code already exists")
+	// ErrNotFound is returned by Get for unknown short codes
+	ErrNotFound = errors.New("short code not found")
+)
+
+// Link is a short code's redirect mapping, as redirect-api serves it
+type Link struct {
+	ShortCode string
+	// Value is the stored destination, with any weighted targets, in the
+	// form redirect-api caches in Redis
+	Value     string
+	Disabled  bool
+	ExpiresAt *time.Time
+	// Owner is the tenant redirect-api attributes the cached mapping to
+	Owner string
+	// Version orders writes of the same code: a write never replaces a newer
+	// version, so syncs that race each other can't leave an old mapping behind
+	Version int64
+}
+
+// Expired reports whether the link has expired by now. Expired items may
+// linger in the store until its TTL removes them.
+func (l *Link) Expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !l.ExpiresAt.After(now)
+}
+
+// Store is a key-value backend for redirect mappings
+type Store interface {
+	// Create stores a new mapping, failing with ErrExists when the code is taken
+	Create(ctx context.Context, l Link) error
+	// Put stores a mapping unless a newer version is already stored
+	Put(ctx context.Context, l Link) error
+	// Get reads a mapping, failing with ErrNotFound when there is none
+	Get(ctx context.Context, shortCode string) (*Link, error)
+	// Delete removes a mapping unless a newer version is stored
+	Delete(ctx context.Context, shortCode string, version int64) error
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/response"
+	"shared/tracing"
+)
+
+// Emails to link owners go through a Postgres outbox: features call
+// notifyOwner, which queues a template name and its data for the owner's
+// address, and rendering waits until the message is sent. The worker claims messages with SKIP
+// LOCKED, renders and sends them, and retries failures with backoff until
+// EMAIL_MAX_ATTEMPTS. Owners opt in by setting an address with
+// PUT /api/v1/notifications; nothing is queued for owners without one, or when
+// EMAIL_PROVIDER is unset.
+const (
+	emailProviderSMTP = "smtp"
+	emailProviderSES  = "ses"
+	emailProviderLog  = "log"
+
+	emailStatusQueued = "queued"
+	emailStatusSent   = "sent"
+	emailStatusFailed = "failed"
+
+	emailPollInterval = 15 * time.Second
+	// emailSendLease keeps other workers off a claimed message while it is sent
+	emailSendLease  = 5 * time.Minute
+	emailRetryFirst = time.Minute
+	emailRetryMax   = 6 * time.Hour
+)
+
+var (
+	emailProvider    = os.Getenv("EMAIL_PROVIDER")
+	emailFrom        = os.Getenv("EMAIL_FROM")
+	emailMaxAttempts = env.Int("EMAIL_MAX_ATTEMPTS", 6)
+	smtpAddr         = os.Getenv("SMTP_ADDR")
+	smtpUsername     = os.Getenv("SMTP_USERNAME")
+	smtpPassword     = os.Getenv("SMTP_PASSWORD")
+	sesRegion        = os.Getenv("SES_REGION")
+)
+
+// emailSenderImpl is the configured sender, nil when email is disabled
+var emailSenderImpl emailSender
+
+// emailWake nudges the worker when a message is queued instead of waiting for the next poll
+var emailWake = make(chan struct{}, 1)
+
+const notificationTablesQuery = `
+	CREATE TABLE IF NOT EXISTS notification_settings (
+		owner TEXT PRIMARY KEY,
+		email TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS email_outbox (
+		id BIGSERIAL PRIMARY KEY,
+		owner TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		template TEXT NOT NULL,
+		data JSONB NOT NULL,
+		status TEXT NOT NULL DEFAULT 'queued',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		last_error TEXT,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		sent_at TIMESTAMP WITH TIME ZONE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_email_outbox_queued ON email_outbox(next_attempt_at) WHERE status = 'queued';
+	CREATE INDEX IF NOT EXISTS idx_email_outbox_status ON email_outbox(status, created_at DESC, id DESC);
+`
+
+// emailMessage is a rendered email
+type emailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// emailSender delivers one rendered email; an error means it may be retried
+type emailSender interface {
+	Send(ctx context.Context, msg emailMessage) error
+}
+
+// emailTemplate renders a subject and a plain-text body from the queued data,
+// decoded from JSON, so templates refer to fields by their JSON names
+type emailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// emailTemplates holds every template notifyOwner accepts, by name
+var emailTemplates = map[string]emailTemplate{}
+
+func registerEmailTemplate(name, subject, body string) {
+	emailTemplates[name] = emailTemplate{
+		subject: template.Must(template.New(name + ".subject").Parse(subject)),
+		body:    template.Must(template.New(name + ".body").Parse(body)),
+	}
+}
+
+const emailTemplateLinksDisabled = "links_disabled"
+
+func init() {
+	registerEmailTemplate(emailTemplateLinksDisabled,
+		`{{if eq (len .links) 1}}Your short link {{(index .links 0).shortUrl}} has been disabled{{else}}{{len .links}} of your short links have been disabled{{end}}`,
+		`Hello {{.owner}},
+
+The following short {{if eq (len .links) 1}}link has been disabled and no longer redirects{{else}}links have been disabled and no longer redirect{{end}}:
+{{range .links}}
+  {{.shortUrl}} ({{.reason}})
+{{- end}}
+
+Links are disabled after abuse reports, failed safety scans or an operator
+takedown. If you believe this is a mistake, reply to this email with the
+short links concerned.
+`)
+}
+
+// linksDisabledEmail is the data of emailTemplateLinksDisabled
+type linksDisabledEmail struct {
+	Owner string              `json:"owner"`
+	Links []disabledLinkEmail `json:"links"`
+}
+
+type disabledLinkEmail struct {
+	ShortURL string `json:"shortUrl"`
+	Reason   string `json:"reason"`
+}
+
+func renderEmail(name, recipient string, data []byte) (emailMessage, error) {
+	tmpl, ok := emailTemplates[name]
+	if !ok {
+		return emailMessage{}, fmt.Errorf("unknown email template %q", name)
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return emailMessage{}, fmt.Errorf("invalid data for template %s: %v", name, err)
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, values); err != nil {
+		return emailMessage{}, fmt.Errorf("failed to render subject of %s: %v", name, err)
+	}
+	if err := tmpl.body.Execute(&body, values); err != nil {
+		return emailMessage{}, fmt.Errorf("failed to render body of %s: %v", name, err)
+	}
+	return emailMessage{To: recipient, Subject: strings.TrimSpace(subject.String()), Body: body.String()}, nil
+}
+
+// initEmail sets up the EMAIL_PROVIDER sender, failing fast on incomplete settings
+func initEmail() error {
+	if emailProvider == "" {
+		return nil
+	}
+	if _, err := mail.ParseAddress(emailFrom); err != nil {
+		return fmt.Errorf("EMAIL_FROM must be an email address: %v", err)
+	}
+
+	switch emailProvider {
+	case emailProviderSMTP:
+		if smtpAddr == "" {
+			return errors.New("SMTP_ADDR is required for the smtp provider")
+		}
+		emailSenderImpl = smtpSender{}
+	case emailProviderSES:
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config: %v", err)
+		}
+		region := sesRegion
+		if region == "" {
+			region = cfg.Region
+		}
+		if region == "" {
+			return errors.New("SES_REGION or AWS_REGION is required for the ses provider")
+		}
+		emailSenderImpl = &sesSender{creds: cfg.Credentials, region: region, signer: v4.NewSigner(), client: tracing.Client(&http.Client{Timeout: 15 * time.Second})}
+	case emailProviderLog:
+		emailSenderImpl = logSender{}
+	default:
+		return fmt.Errorf("unknown EMAIL_PROVIDER %q, expected smtp, ses or log", emailProvider)
+	}
+
+	log.Printf("Sending notification emails through %s", emailProvider)
+	return nil
+}
+
+// formatEmail builds an RFC 5322 message with a quoted-printable text body
+func formatEmail(msg emailMessage) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", emailFrom)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", randomHex(16), shortURLHost())
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n")))
+	w.Close()
+	return buf.Bytes()
+}
+
+// smtpSender relays through SMTP_ADDR, upgrading to TLS when the server offers STARTTLS
+type smtpSender struct{}
+
+func (smtpSender) Send(ctx context.Context, msg emailMessage) error {
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		host := smtpAddr
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+	}
+	from, _ := mail.ParseAddress(emailFrom)
+	return smtp.SendMail(smtpAddr, auth, from.Address, []string{msg.To}, formatEmail(msg))
+}
+
+// sesSender calls the SES v2 SendEmail API, signed with the default AWS credentials
+type sesSender struct {
+	creds  aws.CredentialsProvider
+	region string
+	signer *v4.Signer
+	client *http.Client
+}
+
+func (s *sesSender) Send(ctx context.Context, msg emailMessage) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"FromEmailAddress": emailFrom,
+		"Destination":      map[string]interface{}{"ToAddresses": []string{msg.To}},
+		"Content": map[string]interface{}{
+			"Raw": map[string]interface{}{"Data": formatEmail(msg)},
+		},
+	})
+
+	endpoint := fmt.Sprintf("https://email.%s.amazonaws.com/v2/email/outbound-emails", s.region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	creds, err := s.creds.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get AWS credentials: %v", err)
+	}
+	hash := sha256.Sum256(body)
+	if err := s.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), "ses", s.region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign SES request: %v", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("SES returned %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// logSender writes emails to the log instead of sending them, for local development
+type logSender struct{}
+
+func (logSender) Send(ctx context.Context, msg emailMessage) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// ownerEmail returns the owner's notification address, or "" when they have none
+func (srv *server) ownerEmail(owner string) (string, error) {
+	var email string
+	err := srv.db.QueryRow(`SELECT email FROM notification_settings WHERE owner = $1`, owner).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return email, err
+}
+
+// notifyOwner queues a templated email to the owner. Owners without an address,
+// and every owner while email is disabled, are skipped.
+func (srv *server) notifyOwner(owner, name string, data interface{}) {
+	if emailSenderImpl == nil || owner == "" {
+		return
+	}
+	if _, ok := emailTemplates[name]; !ok {
+		log.Printf("Failed to queue email to %s: unknown template %q", owner, name)
+		return
+	}
+
+	recipient, err := srv.ownerEmail(owner)
+	if err != nil {
+		log.Printf("Failed to look up email of %s: %v", owner, err)
+		return
+	}
+	if recipient == "" {
+		return
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s email: %v", name, err)
+		return
+	}
+	_, err = srv.db.Exec(`INSERT INTO email_outbox (owner, recipient, template, data) VALUES ($1, $2, $3, $4)`,
+		owner, recipient, name, encoded)
+	if err != nil {
+		log.Printf("Failed to queue %s email to %s: %v", name, owner, err)
+		return
+	}
+
+	select {
+	case emailWake <- struct{}{}:
+	default:
+	}
+}
+
+// notifyLinksDisabled sends each owner one notice covering all of their disabled links
+func (srv *server) notifyLinksDisabled(disabled []*URL) {
+	byOwner := map[string]*linksDisabledEmail{}
+	owners := []string{}
+	for _, u := range disabled {
+		if u.Owner == "" {
+			continue
+		}
+		data, ok := byOwner[u.Owner]
+		if !ok {
+			data = &linksDisabledEmail{Owner: u.Owner}
+			byOwner[u.Owner] = data
+			owners = append(owners, u.Owner)
+		}
+		reason := ""
+		if u.DisabledReason != nil {
+			reason = *u.DisabledReason
+		}
+		data.Links = append(data.Links, disabledLinkEmail{ShortURL: shortURL(u.ShortCode), Reason: reason})
+	}
+
+	for _, owner := range owners {
+		srv.notifyOwner(owner, emailTemplateLinksDisabled, byOwner[owner])
+	}
+}
+
+// emailRetryDelay backs off exponentially from emailRetryFirst up to emailRetryMax
+func emailRetryDelay(attempt int) time.Duration {
+	delay := emailRetryFirst
+	for i := 1; i < attempt && delay < emailRetryMax; i++ {
+		delay *= 4
+	}
+	return min(delay, emailRetryMax)
+}
+
+// sendNextEmail claims, renders and sends one due message, reporting whether there was one
+func (srv *server) sendNextEmail() bool {
+	var id int64
+	var recipient, name string
+	var data []byte
+	var attempts int
+	err := srv.db.QueryRow(`
+		UPDATE email_outbox
+		SET attempts = attempts + 1, next_attempt_at = $1
+		WHERE id = (
+			SELECT id FROM email_outbox
+			WHERE status = 'queued' AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, template, data, attempts
+	`, time.Now().Add(emailSendLease)).Scan(&id, &recipient, &name, &data, &attempts)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to claim email: %v", err)
+		}
+		return false
+	}
+
+	msg, err := renderEmail(name, recipient, data)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = emailSenderImpl.Send(ctx, msg)
+		cancel()
+	}
+
+	if err == nil {
+		_, err = srv.db.Exec(`UPDATE email_outbox SET status = $2, sent_at = CURRENT_TIMESTAMP, last_error = NULL WHERE id = $1`, id, emailStatusSent)
+		if err != nil {
+			log.Printf("Failed to mark email %d sent: %v", id, err)
+		}
+		return true
+	}
+
+	status := emailStatusQueued
+	if attempts >= emailMaxAttempts {
+		status = emailStatusFailed
+		log.Printf("Gave up sending email %d after %d attempts: %v", id, attempts, err)
+	} else {
+		log.Printf("Failed to send email %d (attempt %d): %v", id, attempts, err)
+	}
+	_, dbErr := srv.db.Exec(`UPDATE email_outbox SET status = $2, last_error = $3, next_attempt_at = $4 WHERE id = $1`,
+		id, status, err.Error(), time.Now().Add(emailRetryDelay(attempts)))
+	if dbErr != nil {
+		log.Printf("Failed to reschedule email %d: %v", id, dbErr)
+	}
+	return true
+}
+
+// startEmailWorker sends queued emails in the background. Messages are claimed
+// with SKIP LOCKED, so every instance can run a worker.
+func (srv *server) startEmailWorker() {
+	if emailSenderImpl == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(emailPollInterval)
+		defer ticker.Stop()
+		for {
+			for srv.sendNextEmail() {
+			}
+			select {
+			case <-ticker.C:
+			case <-emailWake:
+			}
+		}
+	}()
+}
+
+// NotificationSettings is where and whether an owner is emailed
+type NotificationSettings struct {
+	Email string `json:"email"`
+	// ExpiryReminderDays is how long before expiry links are reminded about, 0 for never
+	ExpiryReminderDays int `json:"expiryReminderDays"`
+	// SummaryReport is off, daily or weekly
+	SummaryReport string    `json:"summaryReport"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type NotificationSettingsRequestBody struct {
+	Email string `json:"email" binding:"required"`
+	// ExpiryReminderDays defaults to EXPIRY_REMINDER_DAYS when omitted
+	ExpiryReminderDays *int `json:"expiryReminderDays"`
+	// SummaryReport defaults to off when omitted
+	SummaryReport string `json:"summaryReport"`
+}
+
+// maxExpiryReminderDays bounds how early owners can ask to be reminded
+const maxExpiryReminderDays = 90
+
+// notificationSettingsColumns resolves defaults, so it takes EXPIRY_REMINDER_DAYS as $1
+const notificationSettingsColumns = "email, COALESCE(expiry_reminder_days, $1), COALESCE(summary_report, 'off'), updated_at"
+
+func scanNotificationSettings(row rowScanner) (*NotificationSettings, error) {
+	var s NotificationSettings
+	if err := row.Scan(&s.Email, &s.ExpiryReminderDays, &s.SummaryReport, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (srv *server) getNotificationSettingsHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	query := `SELECT ` + notificationSettingsColumns + ` FROM notification_settings WHERE owner = $2`
+	s, err := scanNotificationSettings(srv.db.QueryRow(query, expiryReminderDays, owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeNotificationEmailNotSet)
+			return
+		}
+		log.Printf("Failed to get notification settings: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get notification settings")
+		return
+	}
+
+	response.OK(c, http.StatusOK, s)
+}
+
+func (srv *server) updateNotificationSettingsHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body NotificationSettingsRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	addr, err := mail.ParseAddress(body.Email)
+	if err != nil || addr.Name != "" {
+		response.Fail(c, http.StatusBadRequest, "email must be a plain email address")
+		return
+	}
+	if days := body.ExpiryReminderDays; days != nil && (*days < 0 || *days > maxExpiryReminderDays) {
+		response.Fail(c, http.StatusBadRequest, fmt.Sprintf("expiryReminderDays must be between 0 and %d", maxExpiryReminderDays))
+		return
+	}
+	var summaryReport *string
+	if body.SummaryReport != "" && body.SummaryReport != summaryReportOff {
+		if !validSummaryReport(body.SummaryReport) {
+			response.Fail(c, http.StatusBadRequest, "summaryReport must be off, daily or weekly")
+			return
+		}
+		summaryReport = &body.SummaryReport
+	}
+
+	query := `
+		INSERT INTO notification_settings (owner, email, expiry_reminder_days, summary_report) VALUES ($2, $3, $4, $5)
+		ON CONFLICT (owner) DO UPDATE
+		SET email = EXCLUDED.email, expiry_reminder_days = EXCLUDED.expiry_reminder_days,
+			summary_report = EXCLUDED.summary_report, updated_at = CURRENT_TIMESTAMP
+		RETURNING ` + notificationSettingsColumns
+	s, err := scanNotificationSettings(srv.db.QueryRow(query, expiryReminderDays, owner, addr.Address, body.ExpiryReminderDays, summaryReport))
+	if err != nil {
+		log.Printf("Failed to update notification settings: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update notification settings")
+		return
+	}
+
+	response.OK(c, http.StatusOK, s)
+}
+
+// deleteNotificationSettingsHandler opts the owner out; queued emails are dropped too
+func (srv *server) deleteNotificationSettingsHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	if _, err := srv.db.Exec(`DELETE FROM notification_settings WHERE owner = $1`, owner); err != nil {
+		log.Printf("Failed to delete notification settings: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to delete notification settings")
+		return
+	}
+	if _, err := srv.db.Exec(`DELETE FROM email_outbox WHERE owner = $1 AND status = 'queued'`, owner); err != nil {
+		log.Printf("Failed to drop queued emails of %s: %v", owner, err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// OutboxEmail is a queued, sent or failed email as shown to operators
+type OutboxEmail struct {
+	ID            int64      `json:"id"`
+	Owner         string     `json:"owner"`
+	Recipient     string     `json:"recipient"`
+	Template      string     `json:"template"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+	LastError     *string    `json:"lastError,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	SentAt        *time.Time `json:"sentAt,omitempty"`
+}
+
+// listEmailsHandler lists the outbox newest first, optionally filtered by ?status=
+func (srv *server) listEmailsHandler(c *gin.Context) {
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	conditions := []string{}
+	args := []interface{}{}
+	if status := c.Query("status"); status != "" {
+		if status != emailStatusQueued && status != emailStatusSent && status != emailStatusFailed {
+			response.Fail(c, http.StatusBadRequest, "status must be queued, sent or failed")
+			return
+		}
+		args = append(args, status)
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+	}
+	if after != nil {
+		var cond string
+		cond, args = keysetCondition("created_at", "id", after, args)
+		conditions = append(conditions, cond)
+	}
+
+	query := `SELECT id, owner, recipient, template, status, attempts, next_attempt_at, last_error, created_at, sent_at FROM email_outbox`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list emails: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list emails")
+		return
+	}
+	defer rows.Close()
+
+	emails := []*OutboxEmail{}
+	for rows.Next() {
+		var e OutboxEmail
+		err := rows.Scan(&e.ID, &e.Owner, &e.Recipient, &e.Template, &e.Status, &e.Attempts,
+			&e.NextAttemptAt, &e.LastError, &e.CreatedAt, &e.SentAt)
+		if err != nil {
+			log.Printf("Failed to list emails: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list emails")
+			return
+		}
+		if e.Status != emailStatusQueued {
+			e.NextAttemptAt = nil
+		}
+		emails = append(emails, &e)
+	}
+
+	nextCursor := ""
+	if len(emails) > limit {
+		emails = emails[:limit]
+		last := emails[limit-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: last.ID}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"emails": emails}, nextCursor)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"convert-api/objstore"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"shared/env"
+	"shared/tracing"
+)
+
+// Backups and archive exports are written to a local directory, or straight
+// to a bucket when given as s3://bucket/prefix or gs://bucket/prefix. S3 uses
+// the default AWS credentials and region (OBJECT_STORAGE_ENDPOINT points it at
+// an S3-compatible store such as MinIO instead); GCS uses its XML API with the
+// HMAC key in GCS_HMAC_ACCESS_KEY and GCS_HMAC_SECRET. Files are streamed in
+// OBJECT_STORAGE_PART_SIZE_MB parts, and S3 objects are encrypted with
+// OBJECT_STORAGE_SSE (AES256 or aws:kms, with OBJECT_STORAGE_KMS_KEY_ID)
+// when set.
+var (
+	objectStorageEndpoint = os.Getenv("OBJECT_STORAGE_ENDPOINT")
+	objectStoragePartSize = env.Int("OBJECT_STORAGE_PART_SIZE_MB", 16)
+	objectStorageSSE      = os.Getenv("OBJECT_STORAGE_SSE")
+	objectStorageKMSKeyID = os.Getenv("OBJECT_STORAGE_KMS_KEY_ID")
+	gcsHMACAccessKey      = os.Getenv("GCS_HMAC_ACCESS_KEY")
+	gcsHMACSecret         = os.Getenv("GCS_HMAC_SECRET")
+)
+
+// openObjectStore returns the store for a location given on the command line
+func openObjectStore(location string) (objstore.Store, error) {
+	scheme, rest, found := strings.Cut(location, "://")
+	if !found {
+		return objstore.NewDir(location), nil
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("%s has no bucket", location)
+	}
+	if objectStoragePartSize < 5 {
+		return nil, errors.New("OBJECT_STORAGE_PART_SIZE_MB must be at least 5")
+	}
+	opts := objstore.S3Options{
+		PartSize: int64(objectStoragePartSize) << 20,
+		SSE:      objectStorageSSE,
+		KMSKeyID: objectStorageKMSKeyID,
+	}
+	switch opts.SSE {
+	case "", "AES256":
+		if opts.KMSKeyID != "" {
+			return nil, errors.New("OBJECT_STORAGE_KMS_KEY_ID needs OBJECT_STORAGE_SSE=aws:kms")
+		}
+	case "aws:kms":
+	default:
+		return nil, fmt.Errorf("unknown OBJECT_STORAGE_SSE %q, expected AES256 or aws:kms", opts.SSE)
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	cfg.HTTPClient = tracing.Client(&http.Client{})
+
+	switch scheme {
+	case "s3":
+		if cfg.Region == "" {
+			return nil, errors.New("AWS_REGION is required for S3 storage")
+		}
+		client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+			if objectStorageEndpoint != "" {
+				o.BaseEndpoint = aws.String(objectStorageEndpoint)
+				o.UsePathStyle = true
+			}
+		})
+		return objstore.NewS3(client, bucket, prefix, opts), nil
+	case "gs":
+		if opts.SSE != "" {
+			return nil, errors.New("OBJECT_STORAGE_SSE is not supported for GCS, set a default key on the bucket instead")
+		}
+		if (gcsHMACAccessKey == "") != (gcsHMACSecret == "") {
+			return nil, errors.New("GCS_HMAC_ACCESS_KEY and GCS_HMAC_SECRET must be set together")
+		}
+		if gcsHMACAccessKey != "" {
+			cfg.Credentials = credentials.NewStaticCredentialsProvider(gcsHMACAccessKey, gcsHMACSecret, "")
+		}
+		// GCS ignores the region, but SigV4 needs one
+		cfg.Region = "auto"
+		return objstore.NewS3(s3.NewFromConfig(cfg, objstore.ForGCS), bucket, prefix, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown storage scheme %s://, expected s3:// or gs://", scheme)
+	}
+}
@@ -0,0 +1,69 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Dir keeps objects as files under a local directory. Files are never
+// overwritten: Put fails if the file already exists.
+type Dir struct {
+	path string
+}
+
+// NewDir returns a Store for the directory path, created on the first Put
+func NewDir(path string) *Dir {
+	return &Dir{path: path}
+}
+
+func (d *Dir) file(key string) string {
+	return filepath.Join(d.path, filepath.FromSlash(key))
+}
+
+func (d *Dir) Put(ctx context.Context, key string, body io.Reader) error {
+	path := d.file(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+func (d *Dir) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.file(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (d *Dir) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(d.file(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Dir) String() string {
+	return d.path
+}
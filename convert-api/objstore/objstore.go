@@ -0,0 +1,29 @@
+// Package objstore writes the files of backups and archive exports to a local
+// directory or straight to an S3 or GCS bucket.
+//
+// Objects are streamed: bucket uploads are split into multipart uploads as
+// they grow, so a file never has to fit in memory or on local disk first.
+// Keys are relative to the store's location, with forward slashes.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by Get for missing objects
+var ErrNotFound = errors.New("object not found")
+
+// Store is a directory-like place to keep files
+type Store interface {
+	// Put streams body into the object key, replacing it if the store allows
+	// overwrites. A failed upload leaves no partial object behind.
+	Put(ctx context.Context, key string, body io.Reader) error
+	// Get opens the object key, failing with ErrNotFound when there is none
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Exists reports whether the object key exists
+	Exists(ctx context.Context, key string) (bool, error)
+	// String returns the store's location for logs
+	String() string
+}
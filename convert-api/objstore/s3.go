@@ -0,0 +1,152 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// S3Options tunes uploads to a bucket
+type S3Options struct {
+	// PartSize is the size of each part of a multipart upload, at least
+	// 5 MiB. Objects smaller than one part are sent with a single PUT.
+	PartSize int64
+	// SSE is the server-side encryption to request: AES256, aws:kms, or
+	// empty for the bucket's default
+	SSE string
+	// KMSKeyID is the key for aws:kms, the account's S3 key when empty
+	KMSKeyID string
+}
+
+// S3 keeps objects under a prefix of an S3 bucket, or of any bucket that
+// speaks the S3 API, GCS included (see ForGCS)
+type S3 struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+	opts     S3Options
+}
+
+// NewS3 returns a Store for the objects under prefix in bucket
+func NewS3(client *s3.Client, bucket, prefix string, opts S3Options) *S3 {
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = max(opts.PartSize, manager.MinUploadPartSize)
+	})
+	return &S3{client: client, uploader: uploader, bucket: bucket, prefix: prefix, opts: opts}
+}
+
+func (s *S3) key(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+// isNotFound also matches stores that answer a missing key with a bare 404
+func isNotFound(err error) bool {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var resp *awshttp.ResponseError
+	return errors.As(err, &noKey) || errors.As(err, &notFound) ||
+		(errors.As(err, &resp) && resp.HTTPStatusCode() == http.StatusNotFound)
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   body,
+	}
+	if s.opts.SSE != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(s.opts.SSE)
+	}
+	if s.opts.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.opts.KMSKeyID)
+	}
+	// A failed multipart upload is aborted, so its parts don't linger
+	if _, err := s.uploader.Upload(ctx, input); err != nil {
+		return fmt.Errorf("failed to upload %s: %v", s.key(key), err)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if isNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", s.key(key), err)
+	}
+	return out.Body, nil
+}
+
+func (s *S3) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up %s: %v", s.key(key), err)
+	}
+	return true, nil
+}
+
+func (s *S3) String() string {
+	if aws.ToString(s.client.Options().BaseEndpoint) == GCSEndpoint {
+		return "gs://" + path.Join(s.bucket, s.prefix)
+	}
+	return "s3://" + path.Join(s.bucket, s.prefix)
+}
+
+// GCSEndpoint is Cloud Storage's S3-compatible XML API. It takes HMAC keys
+// as the access key and secret, and supports multipart uploads.
+const GCSEndpoint = "https://storage.googleapis.com"
+
+// ForGCS points an S3 client at Cloud Storage. GCS encrypts every object
+// and doesn't take the S3 encryption headers: to use a customer-managed key,
+// set it as the bucket's default key instead.
+func ForGCS(o *s3.Options) {
+	o.BaseEndpoint = aws.String(GCSEndpoint)
+	o.UsePathStyle = true
+	o.APIOptions = append(o.APIOptions, unsignedAcceptEncoding)
+}
+
+// unsignedAcceptEncoding leaves Accept-Encoding out of the signature. GCS
+// rewrites the header on its way in, so a signature over it never matches.
+func unsignedAcceptEncoding(stack *middleware.Stack) error {
+	var acceptEncoding string
+	err := stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("UnsignAcceptEncoding",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			if req, ok := in.Request.(*smithyhttp.Request); ok {
+				acceptEncoding = req.Header.Get("Accept-Encoding")
+				req.Header.Del("Accept-Encoding")
+			}
+			return next.HandleFinalize(ctx, in)
+		}), "Signing", middleware.Before)
+	if err != nil {
+		return err
+	}
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("RestoreAcceptEncoding",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			if req, ok := in.Request.(*smithyhttp.Request); ok && acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+			}
+			return next.HandleFinalize(ctx, in)
+		}), "Signing", middleware.After)
+}
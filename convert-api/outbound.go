@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"convert-api/safehttp"
+
+	"shared/env"
+	"shared/tracing"
+)
+
+// SSRF_ALLOW_PRIVATE=true lets outbound requests reach private networks, for local development only
+var ssrfAllowPrivate = env.Get("SSRF_ALLOW_PRIVATE", "false") == "true"
+
+// newOutboundClient returns the client used for every request to a user-supplied URL
+func newOutboundClient(timeout time.Duration) *http.Client {
+	if ssrfAllowPrivate {
+		return tracing.DestinationClient(&http.Client{Timeout: timeout})
+	}
+	return tracing.DestinationClient(safehttp.NewClient(timeout))
+}
+
+// validateOutboundHost rejects hosts that resolve to private or metadata addresses
+func (srv *server) validateOutboundHost(host string) error {
+	if ssrfAllowPrivate {
+		return nil
+	}
+	lookupCtx, cancel := context.WithTimeout(srv.ctx, 3*time.Second)
+	defer cancel()
+	return safehttp.ValidateHost(lookupCtx, host)
+}
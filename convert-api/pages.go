@@ -0,0 +1,517 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/response"
+	"shared/tenantcache"
+	"shared/urlcrypto"
+)
+
+// Link-in-bio pages list some of a consumer's short links under one slug.
+// redirect-api serves them at /<slug>, on the same route as short codes, so a
+// slug must never look like a short code: it needs a hyphen or more than 10
+// characters (short codes are at most 10 alphanumerics).
+const (
+	maxPageLinks       = 50
+	maxPageTitle       = 100
+	maxPageDescription = 300
+	maxPageLabel       = 80
+	pageCacheKeyPrefix = "page:"
+)
+
+var pageSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Button clicks are counted by redirect-api into page_links, see its clicks.go
+const pageTablesQuery = `
+	CREATE TABLE IF NOT EXISTS pages (
+		id SERIAL PRIMARY KEY,
+		slug VARCHAR(40) NOT NULL UNIQUE,
+		owner TEXT NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_pages_owner ON pages(owner);
+
+	CREATE TABLE IF NOT EXISTS page_links (
+		page_id INTEGER NOT NULL REFERENCES pages(id) ON DELETE CASCADE,
+		short_code VARCHAR(10) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		label TEXT NOT NULL,
+		clicks BIGINT NOT NULL DEFAULT 0,
+		last_clicked_at TIMESTAMP WITH TIME ZONE,
+		PRIMARY KEY (page_id, short_code)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_page_links_short_code ON page_links(short_code);
+`
+
+// Page is a link-in-bio page with its buttons in display order
+type Page struct {
+	ID          int        `json:"id"`
+	Slug        string     `json:"slug"`
+	URL         string     `json:"url"`
+	Owner       string     `json:"owner"`
+	Title       string     `json:"title"`
+	Description *string    `json:"description,omitempty"`
+	Links       []PageLink `json:"links"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+type PageLink struct {
+	ShortCode     string     `json:"shortCode"`
+	ShortURL      string     `json:"shortUrl"`
+	Label         string     `json:"label"`
+	Clicks        int64      `json:"clicks"`
+	LastClickedAt *time.Time `json:"lastClickedAt,omitempty"`
+}
+
+type PageRequestBody struct {
+	Slug        string                `json:"slug"`
+	Title       string                `json:"title" binding:"required"`
+	Description *string               `json:"description"`
+	Links       []PageLinkRequestBody `json:"links"`
+}
+
+// PageLinkRequestBody is one button; Label defaults to the destination's host name
+type PageLinkRequestBody struct {
+	ShortCode string `json:"shortCode" binding:"required"`
+	Label     string `json:"label"`
+}
+
+const pageColumns = "id, slug, owner, title, description, created_at, updated_at"
+
+func scanPage(row rowScanner) (*Page, error) {
+	var p Page
+	if err := row.Scan(&p.ID, &p.Slug, &p.Owner, &p.Title, &p.Description, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.URL = shortURL(p.Slug)
+	p.Links = []PageLink{}
+	return &p, nil
+}
+
+// pageRequestError is a page request the caller has to fix
+type pageRequestError struct {
+	status  int
+	message string
+}
+
+func (e pageRequestError) Error() string {
+	return e.message
+}
+
+func invalidPage(format string, args ...interface{}) error {
+	return pageRequestError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// respondPageError answers a failed validatePageRequest
+func respondPageError(c *gin.Context, err error) {
+	var reqErr pageRequestError
+	if errors.As(err, &reqErr) {
+		response.Fail(c, reqErr.status, reqErr.message)
+		return
+	}
+	log.Printf("Failed to validate page: %v", err)
+	response.Fail(c, http.StatusInternalServerError, "failed to save page")
+}
+
+// validatePageSlug keeps slugs apart from short codes, see the comment on pageTablesQuery
+func validatePageSlug(slug string) error {
+	if len(slug) < 3 || len(slug) > 40 || !pageSlugPattern.MatchString(slug) {
+		return invalidPage("slug must be 3 to 40 lowercase letters, digits and single hyphens")
+	}
+	if !strings.Contains(slug, "-") && len(slug) <= 10 {
+		return invalidPage("slug must contain a hyphen or be longer than 10 characters")
+	}
+	return nil
+}
+
+// validatePageRequest checks the text fields and resolves every button against
+// the owner's links, filling in default labels
+func (srv *server) validatePageRequest(body *PageRequestBody, owner string) error {
+	body.Title = strings.TrimSpace(body.Title)
+	if body.Title == "" || len(body.Title) > maxPageTitle {
+		return invalidPage("title must be 1 to %d characters", maxPageTitle)
+	}
+	if body.Description != nil && len(*body.Description) > maxPageDescription {
+		return invalidPage("description must be at most %d characters", maxPageDescription)
+	}
+	if len(body.Links) > maxPageLinks {
+		return invalidPage("a page has at most %d links", maxPageLinks)
+	}
+
+	codes := make([]string, len(body.Links))
+	seen := map[string]bool{}
+	for i, link := range body.Links {
+		if seen[link.ShortCode] {
+			return invalidPage("short code %s is listed twice", link.ShortCode)
+		}
+		if len(link.Label) > maxPageLabel {
+			return invalidPage("label of %s must be at most %d characters", link.ShortCode, maxPageLabel)
+		}
+		seen[link.ShortCode] = true
+		codes[i] = link.ShortCode
+	}
+	if len(codes) == 0 {
+		return nil
+	}
+
+	rows, err := srv.db.Query(`SELECT short_code, original_url FROM urls WHERE short_code = ANY($1) AND owner = $2`, pq.Array(codes), owner)
+	if err != nil {
+		return fmt.Errorf("failed to look up links: %v", err)
+	}
+	defer rows.Close()
+	destinations := map[string]string{}
+	for rows.Next() {
+		var code, stored string
+		if err := rows.Scan(&code, &stored); err != nil {
+			return fmt.Errorf("failed to look up links: %v", err)
+		}
+		if destinations[code], err = urlcrypto.Decrypt(stored); err != nil {
+			return fmt.Errorf("failed to decrypt %s: %v", code, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to look up links: %v", err)
+	}
+
+	for i, link := range body.Links {
+		destination, ok := destinations[link.ShortCode]
+		if !ok {
+			// Someone else's link is reported like a missing one
+			return pageRequestError{http.StatusUnprocessableEntity, fmt.Sprintf("short code %s not found", link.ShortCode)}
+		}
+		if strings.TrimSpace(link.Label) == "" {
+			if u, err := url.Parse(destination); err == nil {
+				body.Links[i].Label = u.Hostname()
+			}
+		}
+	}
+	return nil
+}
+
+// savePageLinks replaces the page's buttons, keeping the click counts of those that stay
+func savePageLinks(tx *sql.Tx, pageID int, links []PageLinkRequestBody) error {
+	codes := make([]string, len(links))
+	labels := make([]string, len(links))
+	for i, link := range links {
+		codes[i], labels[i] = link.ShortCode, link.Label
+	}
+
+	if _, err := tx.Exec(`DELETE FROM page_links WHERE page_id = $1 AND NOT (short_code = ANY($2))`, pageID, pq.Array(codes)); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO page_links (page_id, short_code, position, label)
+		SELECT $1, l.short_code, l.position, l.label
+		FROM unnest($2::text[], $3::text[]) WITH ORDINALITY AS l(short_code, label, position)
+		ON CONFLICT (page_id, short_code) DO UPDATE
+		SET position = EXCLUDED.position, label = EXCLUDED.label
+	`, pageID, pq.Array(codes), pq.Array(labels))
+	return err
+}
+
+// loadPageLinks fills in the buttons of pages, in display order
+func (srv *server) loadPageLinks(pages ...*Page) error {
+	if len(pages) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Page, len(pages))
+	ids := make([]int64, len(pages))
+	for i, p := range pages {
+		p.Links = []PageLink{}
+		byID[p.ID] = p
+		ids[i] = int64(p.ID)
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT page_id, short_code, label, clicks, last_clicked_at
+		FROM page_links
+		WHERE page_id = ANY($1)
+		ORDER BY page_id, position
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pageID int
+		var link PageLink
+		if err := rows.Scan(&pageID, &link.ShortCode, &link.Label, &link.Clicks, &link.LastClickedAt); err != nil {
+			return err
+		}
+		link.ShortURL = shortURL(link.ShortCode)
+		byID[pageID].Links = append(byID[pageID].Links, link)
+	}
+	return rows.Err()
+}
+
+// getOwnedPage loads a page of owner's with its buttons, or sql.ErrNoRows
+func (srv *server) getOwnedPage(slug, owner string) (*Page, error) {
+	p, err := scanPage(srv.db.QueryRow(`SELECT `+pageColumns+` FROM pages WHERE slug = $1 AND owner = $2`, slug, owner))
+	if err != nil {
+		return nil, err
+	}
+	return p, srv.loadPageLinks(p)
+}
+
+// invalidatePageCache drops redirect-api's cached copy of a page
+func (srv *server) invalidatePageCache(slug string) {
+	if _, err := tenantcache.Del(srv.ctx, srv.cacheRdb, pageCacheKeyPrefix+slug); err != nil {
+		log.Printf("Failed to invalidate cached page %s: %v", slug, err)
+	}
+}
+
+func (srv *server) createPageHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body PageRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validatePageSlug(body.Slug); err != nil {
+		respondPageError(c, err)
+		return
+	}
+	if err := srv.validatePageRequest(&body, owner); err != nil {
+		respondPageError(c, err)
+		return
+	}
+
+	tx, err := srv.db.Begin()
+	if err != nil {
+		log.Printf("Failed to create page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to create page")
+		return
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO pages (slug, owner, title, description)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + pageColumns
+
+	p, err := scanPage(tx.QueryRow(query, body.Slug, owner, body.Title, body.Description))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			response.Fail(c, http.StatusConflict, "slug is already taken")
+			return
+		}
+		log.Printf("Failed to create page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to create page")
+		return
+	}
+	if err := savePageLinks(tx, p.ID, body.Links); err != nil {
+		log.Printf("Failed to create page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to create page")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to create page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to create page")
+		return
+	}
+
+	if err := srv.loadPageLinks(p); err != nil {
+		log.Printf("Failed to load links of page %s: %v", p.Slug, err)
+	}
+	srv.recordAudit(actorFromGin(c), auditPageCreate, auditTargetPage, p.Slug, nil, p)
+	response.OK(c, http.StatusCreated, p)
+}
+
+func (srv *server) listPagesHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{owner}
+	query := `SELECT ` + pageColumns + ` FROM pages WHERE owner = $1`
+	if after != nil {
+		var condition string
+		condition, args = keysetCondition("created_at", "id", after, args)
+		query += " AND " + condition
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list pages: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list pages")
+		return
+	}
+	defer rows.Close()
+
+	pages := []*Page{}
+	for rows.Next() {
+		p, err := scanPage(rows)
+		if err != nil {
+			log.Printf("Failed to list pages: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list pages")
+			return
+		}
+		pages = append(pages, p)
+	}
+
+	nextCursor := ""
+	if len(pages) > limit {
+		pages = pages[:limit]
+		last := pages[len(pages)-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: int64(last.ID)}.encode()
+	}
+
+	if err := srv.loadPageLinks(pages...); err != nil {
+		log.Printf("Failed to list pages: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list pages")
+		return
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"pages": pages}, nextCursor)
+}
+
+func (srv *server) getPageHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	p, err := srv.getOwnedPage(c.Param("slug"), owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codePageNotFound)
+			return
+		}
+		log.Printf("Failed to get page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get page")
+		return
+	}
+
+	response.OK(c, http.StatusOK, p)
+}
+
+// updatePageHandler replaces the title, description and buttons; the slug can't change
+func (srv *server) updatePageHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	slug := c.Param("slug")
+
+	var body PageRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Slug != "" && body.Slug != slug {
+		response.Fail(c, http.StatusBadRequest, "slug can't be changed")
+		return
+	}
+	if err := srv.validatePageRequest(&body, owner); err != nil {
+		respondPageError(c, err)
+		return
+	}
+
+	before, err := srv.getOwnedPage(slug, owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codePageNotFound)
+			return
+		}
+		log.Printf("Failed to update page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update page")
+		return
+	}
+
+	tx, err := srv.db.Begin()
+	if err != nil {
+		log.Printf("Failed to update page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update page")
+		return
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE pages
+		SET title = $3, description = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND owner = $2
+		RETURNING ` + pageColumns
+
+	p, err := scanPage(tx.QueryRow(query, before.ID, owner, body.Title, body.Description))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codePageNotFound)
+			return
+		}
+		log.Printf("Failed to update page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update page")
+		return
+	}
+	if err := savePageLinks(tx, p.ID, body.Links); err != nil {
+		log.Printf("Failed to update page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update page")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to update page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update page")
+		return
+	}
+
+	srv.invalidatePageCache(slug)
+	if err := srv.loadPageLinks(p); err != nil {
+		log.Printf("Failed to load links of page %s: %v", p.Slug, err)
+	}
+	srv.recordAudit(actorFromGin(c), auditPageUpdate, auditTargetPage, p.Slug, before, p)
+	response.OK(c, http.StatusOK, p)
+}
+
+func (srv *server) deletePageHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	slug := c.Param("slug")
+
+	query := `DELETE FROM pages WHERE slug = $1 AND owner = $2 RETURNING ` + pageColumns
+	p, err := scanPage(srv.db.QueryRow(query, slug, owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codePageNotFound)
+			return
+		}
+		log.Printf("Failed to delete page: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to delete page")
+		return
+	}
+
+	srv.invalidatePageCache(slug)
+	srv.recordAudit(actorFromGin(c), auditPageDelete, auditTargetPage, slug, p, nil)
+	c.Status(http.StatusNoContent)
+}
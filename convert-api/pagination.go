@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// pageCursor is the keyset position of the last row of a page. Lists are
+// ordered by (timestamp, id), so the next page starts strictly past it.
+type pageCursor struct {
+	Time time.Time
+	ID   int64
+}
+
+func (pc pageCursor) encode() string {
+	raw := strconv.FormatInt(pc.Time.UnixNano(), 10) + ":" + strconv.FormatInt(pc.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	return &pageCursor{Time: time.Unix(0, nanos), ID: id}, nil
+}
+
+// keysetCondition renders "(timeCol, idCol) < (cursor)" for lists sorted newest first
+func keysetCondition(timeCol, idCol string, after *pageCursor, args []interface{}) (string, []interface{}) {
+	args = append(args, after.Time, after.ID)
+	return fmt.Sprintf("(%s, %s) < ($%d, $%d)", timeCol, idCol, len(args)-1, len(args)), args
+}
+
+// pageParams reads ?limit= and ?cursor=, writing a 400 response when they are invalid
+func pageParams(c *gin.Context) (int, *pageCursor, bool) {
+	limit := defaultPageSize
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			failCode(c, http.StatusBadRequest, codeInvalidLimit)
+			return 0, nil, false
+		}
+		limit = n
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	var after *pageCursor
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			failCode(c, http.StatusBadRequest, codeInvalidCursor)
+			return 0, nil, false
+		}
+		after = cursor
+	}
+
+	return limit, after, true
+}
+
+// setPageLinks emits an RFC 5988 Link header pointing at the first and next pages
+func setPageLinks(c *gin.Context, nextCursor string) {
+	query := c.Request.URL.Query()
+	query.Del("cursor")
+
+	links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(c.Request.URL.Path, query.Encode()))}
+
+	if nextCursor != "" {
+		query.Set("cursor", nextCursor)
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(c.Request.URL.Path, query.Encode())))
+	}
+
+	c.Header("Link", strings.Join(links, ", "))
+}
+
+func pageURL(path, rawQuery string) string {
+	if rawQuery == "" {
+		return path
+	}
+	return path + "?" + rawQuery
+}
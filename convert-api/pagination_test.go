@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPageCursorRoundTrip(t *testing.T) {
+	for _, pc := range []pageCursor{
+		{Time: time.Unix(1700000000, 123456789), ID: 42},
+		{Time: time.Unix(0, 0), ID: 0},
+		{Time: time.Unix(-1, 0), ID: 1 << 62},
+	} {
+		got, err := decodeCursor(pc.encode())
+		if err != nil {
+			t.Fatalf("decodeCursor(%q): %v", pc.encode(), err)
+		}
+		if !got.Time.Equal(pc.Time) || got.ID != pc.ID {
+			t.Errorf("Decoded %+v, want %+v", *got, pc)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"not base64!",
+		"MTIz",        // "123"
+		"YWJjOjQy",    // "abc:42"
+		"MTIzOmFiYw",  // "123:abc"
+		"MTIzOjQyOjc", // "123:42:7"
+	} {
+		if got, err := decodeCursor(s); err != errInvalidCursor {
+			t.Errorf("decodeCursor(%q) = %v, %v, want errInvalidCursor", s, got, err)
+		}
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	after := &pageCursor{Time: time.Unix(1700000000, 0), ID: 42}
+	cond, args := keysetCondition("created_at", "id", after, []interface{}{"alice"})
+	if want := "(created_at, id) < ($2, $3)"; cond != want {
+		t.Errorf("Condition %q, want %q", cond, want)
+	}
+	if want := []interface{}{"alice", after.Time, int64(42)}; !reflect.DeepEqual(args, want) {
+		t.Errorf("Args %v, want %v", args, want)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"shared/env"
+	"shared/response"
+	"shared/slowquery"
+)
+
+var errPhishingSuspected = errors.New("url looks like phishing")
+
+// Scores at or above PHISHING_REVIEW_THRESHOLD hold the link for admin review,
+// at or above PHISHING_REJECT_THRESHOLD the link is refused. 0 disables a threshold.
+var (
+	phishingReviewThreshold = parseThresholdEnv("PHISHING_REVIEW_THRESHOLD", 50)
+	phishingRejectThreshold = parseThresholdEnv("PHISHING_REJECT_THRESHOLD", 80)
+)
+
+// pendingReviewPrefix marks links disabled until an admin approves them
+const pendingReviewPrefix = "pending_review:"
+
+const (
+	scoreIPLiteral       = 40
+	scorePunycode        = 20
+	scoreBrandLookalike  = 50
+	scoreShortenerChain  = 30
+	scoreUserinfo        = 30
+	scoreNonStandardPort = 10
+	scoreDeepSubdomain   = 10
+	scoreBaitKeyword     = 10
+	maxBaitKeywordScore  = 20
+	deepSubdomainLabels  = 4
+)
+
+// phishingBrands maps commonly impersonated brands to their registrable domains
+var phishingBrands = map[string][]string{
+	"paypal":     {"paypal.com", "paypal.me"},
+	"apple":      {"apple.com", "icloud.com"},
+	"icloud":     {"icloud.com", "apple.com"},
+	"google":     {"google.com", "youtube.com", "goo.gl"},
+	"microsoft":  {"microsoft.com", "live.com", "office.com"},
+	"outlook":    {"outlook.com", "live.com", "microsoft.com"},
+	"amazon":     {"amazon.com", "amazon.co.uk", "amazon.de", "amazon.co.jp"},
+	"facebook":   {"facebook.com", "fb.com"},
+	"instagram":  {"instagram.com"},
+	"whatsapp":   {"whatsapp.com"},
+	"netflix":    {"netflix.com"},
+	"linkedin":   {"linkedin.com"},
+	"dropbox":    {"dropbox.com"},
+	"docusign":   {"docusign.com", "docusign.net"},
+	"coinbase":   {"coinbase.com"},
+	"binance":    {"binance.com"},
+	"chase":      {"chase.com"},
+	"wellsfargo": {"wellsfargo.com"},
+}
+
+// knownShorteners are third-party shorteners; pointing a short link at another
+// one hides the real destination from screening
+var knownShorteners = map[string]bool{
+	"bit.ly":      true,
+	"tinyurl.com": true,
+	"t.co":        true,
+	"goo.gl":      true,
+	"ow.ly":       true,
+	"is.gd":       true,
+	"buff.ly":     true,
+	"rebrand.ly":  true,
+	"cutt.ly":     true,
+	"shorturl.at": true,
+	"tiny.cc":     true,
+	"rb.gy":       true,
+}
+
+var baitKeywords = []string{"login", "signin", "verify", "account", "secure", "update", "wallet", "password", "billing"}
+
+// homoglyphs folds look-alike characters (digits, Cyrillic, Greek) to the Latin letter they imitate
+var homoglyphs = strings.NewReplacer(
+	"0", "o", "1", "l", "3", "e", "4", "a", "5", "s", "7", "t", "rn", "m", "vv", "w",
+	"а", "a", "е", "e", "о", "o", "р", "p", "с", "c", "у", "y", "х", "x", "і", "i", "ј", "j", "ѕ", "s", "ԁ", "d", "һ", "h",
+	"α", "a", "ο", "o", "ρ", "p", "ν", "v", "τ", "t", "ι", "i", "κ", "k",
+)
+
+// phishingScore is the sum of the heuristic signals that fired
+type phishingScore struct {
+	Score   int
+	Signals []string
+}
+
+func (s *phishingScore) add(points int, signal string) {
+	s.Score += points
+	s.Signals = append(s.Signals, signal)
+}
+
+func (s phishingScore) reason() string {
+	return fmt.Sprintf("phishing_score:%d:%s", s.Score, strings.Join(s.Signals, ","))
+}
+
+// scorePhishing rates how much a destination looks like a phishing page
+func scorePhishing(u *url.URL) phishingScore {
+	var score phishingScore
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+	if _, err := netip.ParseAddr(host); err == nil {
+		score.add(scoreIPLiteral, "ip_literal")
+	} else {
+		scoreHostname(host, &score)
+	}
+
+	if u.User != nil {
+		score.add(scoreUserinfo, "userinfo")
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		score.add(scoreNonStandardPort, "port")
+	}
+
+	keywordScore := 0
+	target := strings.ToLower(u.Host + u.Path)
+	for _, keyword := range baitKeywords {
+		if keywordScore < maxBaitKeywordScore && strings.Contains(target, keyword) {
+			keywordScore += scoreBaitKeyword
+			score.add(scoreBaitKeyword, "keyword_"+keyword)
+		}
+	}
+
+	return score
+}
+
+func scoreHostname(host string, score *phishingScore) {
+	unicodeHost := host
+	if strings.Contains(host, "xn--") {
+		score.add(scorePunycode, "punycode")
+		if decoded, err := idna.ToUnicode(host); err == nil {
+			unicodeHost = decoded
+		}
+	}
+
+	if strings.Count(host, ".")+1 > deepSubdomainLabels {
+		score.add(scoreDeepSubdomain, "deep_subdomain")
+	}
+
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		registrable = host
+	}
+
+	if knownShorteners[registrable] || registrable == shortURLHost() {
+		score.add(scoreShortenerChain, "shortener_chain")
+	}
+
+	// Compare whole labels and hyphenated words so "purchase" doesn't read as "chase"
+	tokens := strings.FieldsFunc(homoglyphs.Replace(unicodeHost), func(r rune) bool {
+		return r == '.' || r == '-'
+	})
+
+	for _, token := range tokens {
+		domains, ok := phishingBrands[token]
+		if !ok || isBrandDomain(registrable, domains) {
+			continue
+		}
+		score.add(scoreBrandLookalike, "brand_"+token)
+		return
+	}
+}
+
+func isBrandDomain(registrable string, domains []string) bool {
+	for _, domain := range domains {
+		if registrable == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// shortURLHost is our own short link host, so links to other short links count as chains
+func shortURLHost() string {
+	if u, err := url.Parse(shortURLBase); err == nil {
+		return strings.ToLower(u.Hostname())
+	}
+	return ""
+}
+
+// checkPhishing applies the thresholds, returning the reason to hold the link for review
+func checkPhishing(u *url.URL) (*string, error) {
+	score := scorePhishing(u)
+	if score.Score == 0 {
+		return nil, nil
+	}
+
+	if phishingRejectThreshold > 0 && score.Score >= phishingRejectThreshold {
+		log.Printf("Rejected suspected phishing URL %s (%s)", u, score.reason())
+		return nil, errPhishingSuspected
+	}
+	if phishingReviewThreshold > 0 && score.Score >= phishingReviewThreshold {
+		log.Printf("Holding suspected phishing URL %s for review (%s)", u, score.reason())
+		reason := pendingReviewPrefix + score.reason()
+		return &reason, nil
+	}
+	return nil, nil
+}
+
+func parseThresholdEnv(key string, fallback int) int {
+	if env.Get(key, "") == "0" {
+		return 0
+	}
+	return env.Int(key, fallback)
+}
+
+// listPendingReviewHandler is the admin queue of links held by phishing scoring, oldest first
+func (srv *server) listPendingReviewHandler(c *gin.Context) {
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{pendingReviewPrefix + "%"}
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE disabled_reason LIKE $1`
+	if after != nil {
+		args = append(args, after.Time, after.ID)
+		query += fmt.Sprintf(" AND (created_at, id) > ($%d, $%d)", len(args)-1, len(args))
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at, id LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list links pending review: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list links")
+		return
+	}
+	defer rows.Close()
+
+	held := []*URL{}
+	for rows.Next() {
+		u, err := scanURL(rows)
+		if err != nil {
+			log.Printf("Failed to list links pending review: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list links")
+			return
+		}
+		held = append(held, u)
+	}
+
+	nextCursor := ""
+	if len(held) > limit {
+		held = held[:limit]
+		last := held[len(held)-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: int64(last.ID)}.encode()
+	}
+
+	links := make([]LinkResponse, 0, len(held))
+	for _, u := range held {
+		links = append(links, toLinkResponse(u))
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"urls": links}, nextCursor)
+}
+
+// approveLinkHandler releases a link held for review. Rejecting one is a regular takedown.
+func (srv *server) approveLinkHandler(c *gin.Context) {
+	shortCode := c.Param("shortCode")
+
+	before, err := srv.getURLByShortCode(shortCode)
+	if err != nil && !errors.Is(err, errShortCodeNotFound) {
+		log.Printf("Failed to approve URL: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to approve URL")
+		return
+	}
+
+	row, err := srv.queries.ApproveHeldURL(slowquery.Tag(srv.ctx, "", shortCode), dbq.ApproveHeldURLParams{
+		ShortCode:         shortCode,
+		HeldReasonPattern: pendingReviewPrefix + "%",
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeReviewLinkNotFound)
+			return
+		}
+		log.Printf("Failed to approve URL: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to approve URL")
+		return
+	}
+	u, err := urlFromRow(row)
+	if err != nil {
+		log.Printf("Failed to approve URL: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to approve URL")
+		return
+	}
+
+	srv.invalidateURLCache(shortCode)
+	srv.recordAudit(actorFromGin(c), auditLinkApprove, auditTargetLink, shortCode, linkAuditState(before), linkAuditState(u))
+	srv.emitLinkEvent(eventLinkUpdated, u)
+
+	log.Printf("Link %s approved by %s", shortCode, callerID(c))
+	response.OK(c, http.StatusOK, toLinkResponse(u))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"shared/env"
+)
+
+// Generated codes are screened against a word list so random codes never
+// spell something offensive. Matching is case-insensitive on substrings, after
+// reading common look-alike digits as letters (0 as o, 1 as i, and so on).
+// PROFANITY_WORDS_FILE replaces the built-in list with one word per line
+// (# starts a comment), and PROFANITY_FILTER=false turns screening off.
+var defaultProfanityWords = []string{
+	"anal", "anus", "arse", "ass", "bitch", "boob", "butt", "cock", "coon", "crap",
+	"cum", "cunt", "dick", "dyke", "fag", "fuck", "gook", "homo", "jizz", "kike",
+	"kkk", "nazi", "nigg", "paki", "penis", "piss", "poo", "porn", "pussy", "rape",
+	"retard", "sex", "shit", "slut", "spic", "tit", "twat", "vagina", "wank", "whore",
+}
+
+var profanityWords []string
+
+// profanityLookalikes reads digits that stand in for letters in codes
+var profanityLookalikes = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b")
+
+// initProfanityFilter loads the word list, failing fast on an unreadable file
+func initProfanityFilter() error {
+	if env.Get("PROFANITY_FILTER", "true") == "false" {
+		return nil
+	}
+
+	path := os.Getenv("PROFANITY_WORDS_FILE")
+	if path == "" {
+		profanityWords = defaultProfanityWords
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open PROFANITY_WORDS_FILE: %v", err)
+	}
+	defer f.Close()
+
+	words := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if word := strings.ToLower(strings.TrimSpace(line)); word != "" {
+			words = append(words, word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read PROFANITY_WORDS_FILE: %v", err)
+	}
+	profanityWords = words
+	log.Printf("Loaded %d words from PROFANITY_WORDS_FILE", len(words))
+	return nil
+}
+
+// isOffensiveCode reports whether a short code contains a listed word
+func isOffensiveCode(code string) bool {
+	if len(profanityWords) == 0 {
+		return false
+	}
+	lower := strings.ToLower(code)
+	normalized := profanityLookalikes.Replace(lower)
+	for _, word := range profanityWords {
+		if strings.Contains(lower, word) || strings.Contains(normalized, word) {
+			return true
+		}
+	}
+	return false
+}
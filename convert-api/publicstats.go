@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+	"shared/slowquery"
+	"shared/tenantcache"
+)
+
+// Owners can make a link's click stats public. redirect-api then serves them
+// read-only at /<shortCode>+ and /<shortCode>/stats, caching each for a minute
+// under publicStatsCacheKeyPrefix.
+const publicStatsCacheKeyPrefix = "stats:public:"
+
+const publicStatsTablesQuery = `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS public_stats BOOLEAN NOT NULL DEFAULT false;
+`
+
+type PublicStatsRequestBody struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// setURLPublicStats turns the public stats page of one of owner's links on or off
+func (srv *server) setURLPublicStats(actor auditActor, owner, shortCode string, enabled bool) (*URL, error) {
+	before, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, err
+	}
+	if before.Owner != owner {
+		return nil, errShortCodeNotFound
+	}
+
+	row, err := srv.queries.SetURLPublicStats(slowquery.Tag(srv.ctx, "", shortCode), dbq.SetURLPublicStatsParams{ShortCode: shortCode, PublicStats: enabled})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShortCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to update URL: %v", err)
+	}
+	u, err := urlFromRow(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update URL: %v", err)
+	}
+
+	if _, err := tenantcache.Del(srv.ctx, srv.cacheRdb, publicStatsCacheKeyPrefix+cacheShortCode(shortCode)); err != nil {
+		log.Printf("Failed to invalidate public stats of %s: %v", shortCode, err)
+	}
+	srv.recordAudit(actor, auditLinkUpdate, auditTargetLink, shortCode, linkAuditState(before), linkAuditState(u))
+	srv.emitLinkEvent(eventLinkUpdated, u)
+
+	return u, nil
+}
+
+// setPublicStatsHandler lets the owner of a link publish or hide its stats page
+func (srv *server) setPublicStatsHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body PublicStatsRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u, err := srv.setURLPublicStats(actorFromGin(c), owner, c.Param("shortCode"), *body.Enabled)
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+			return
+		}
+		log.Printf("Failed to update public stats: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update URL")
+		return
+	}
+
+	response.OK(c, http.StatusOK, toLinkResponse(u))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"convert-api/dbq"
+
+	"shared/urlcrypto"
+)
+
+// urlFromRow converts a urls row to a URL, decrypting its destinations
+func urlFromRow(row dbq.Url) (*URL, error) {
+	u := &URL{
+		ID:             int(row.ID),
+		ShortCode:      row.ShortCode,
+		Owner:          row.Owner,
+		FlagReason:     nullableString(row.FlagReason),
+		DisabledAt:     nullableTime(row.DisabledAt),
+		DisabledReason: nullableString(row.DisabledReason),
+		CreatedAt:      row.CreatedAt.Time,
+		UpdatedAt:      row.UpdatedAt.Time,
+		ExpiresAt:      nullableTime(row.ExpiresAt),
+		Source:         nullableString(row.Source),
+		CodeGenerator:  nullableString(row.CodeGenerator),
+		PublicStats:    row.PublicStats,
+		RotatedTo:      nullableString(row.RotatedTo),
+		RetireAt:       nullableTime(row.RetireAt),
+	}
+	if row.FolderID.Valid {
+		folderID := int64(row.FolderID.Int32)
+		u.FolderID = &folderID
+	}
+
+	var err error
+	if u.OriginalURL, err = urlcrypto.Decrypt(row.OriginalUrl); err != nil {
+		return nil, err
+	}
+	if row.FallbackUrl.Valid {
+		fallback, err := urlcrypto.Decrypt(row.FallbackUrl.String)
+		if err != nil {
+			return nil, err
+		}
+		u.FallbackURL = &fallback
+	}
+	return u, nil
+}
+
+// urlsFromRows converts rows of urls with urlFromRow
+func urlsFromRows(rows []dbq.Url) ([]*URL, error) {
+	urls := make([]*URL, 0, len(rows))
+	for _, row := range rows {
+		u, err := urlFromRow(row)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+func nullableString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullableTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func toNullString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
+
+func toNullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
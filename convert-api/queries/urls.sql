@@ -0,0 +1,186 @@
+-- name: GetURLByShortCode :one
+SELECT * FROM urls
+WHERE short_code = $1;
+
+-- name: InsertURL :one
+INSERT INTO urls (original_url, short_code, owner, flag_reason, disabled_at, disabled_reason, expires_at, code_generator)
+VALUES (
+    @original_url, @short_code, @owner, @flag_reason,
+    CASE WHEN sqlc.narg(disabled_reason)::text IS NULL THEN NULL ELSE CURRENT_TIMESTAMP END,
+    sqlc.narg(disabled_reason), @expires_at, @code_generator
+)
+RETURNING *;
+
+-- Multi-row InsertURL for the write buffer. Arrays can't carry NULLs here, so
+-- empty strings stand for them.
+-- name: InsertURLs :many
+INSERT INTO urls (original_url, short_code, owner, flag_reason, disabled_at, disabled_reason, expires_at, code_generator)
+SELECT u.original_url, u.short_code, u.owner, NULLIF(u.flag_reason, ''),
+    CASE WHEN u.disabled_reason = '' THEN NULL ELSE CURRENT_TIMESTAMP END,
+    NULLIF(u.disabled_reason, ''), NULLIF(u.expires_at, '')::timestamptz, NULLIF(u.code_generator, '')
+FROM (
+    SELECT unnest(@original_urls::text[]) AS original_url, unnest(@short_codes::text[]) AS short_code,
+        unnest(@owners::text[]) AS owner, unnest(@flag_reasons::text[]) AS flag_reason,
+        unnest(@disabled_reasons::text[]) AS disabled_reason, unnest(@expires_at::text[]) AS expires_at,
+        unnest(@code_generators::text[]) AS code_generator
+) AS u
+RETURNING *;
+
+-- name: ListOwnedURLs :many
+SELECT * FROM urls
+WHERE short_code = ANY(@short_codes::text[]) AND owner = @owner
+ORDER BY id;
+
+-- A held destination takes the link down until reviewed. A link that is
+-- already disabled keeps its reason, so a hold never replaces a takedown.
+-- name: UpdateURLDestination :one
+UPDATE urls
+SET original_url = @original_url, flag_reason = @flag_reason, updated_at = CURRENT_TIMESTAMP,
+    disabled_at = CASE WHEN sqlc.narg(hold_reason)::text IS NULL THEN disabled_at ELSE COALESCE(disabled_at, CURRENT_TIMESTAMP) END,
+    disabled_reason = CASE WHEN disabled_at IS NULL THEN COALESCE(sqlc.narg(hold_reason), disabled_reason) ELSE disabled_reason END
+WHERE short_code = @short_code AND owner = @owner
+RETURNING *;
+
+-- Same as UpdateURLDestination, unless the link changed since it was read
+-- name: RewriteURLDestination :one
+UPDATE urls
+SET original_url = @original_url, flag_reason = @flag_reason, updated_at = CURRENT_TIMESTAMP,
+    disabled_at = CASE WHEN sqlc.narg(hold_reason)::text IS NULL THEN disabled_at ELSE COALESCE(disabled_at, CURRENT_TIMESTAMP) END,
+    disabled_reason = CASE WHEN disabled_at IS NULL THEN COALESCE(sqlc.narg(hold_reason), disabled_reason) ELSE disabled_reason END
+WHERE short_code = @short_code AND owner = @owner AND updated_at = @updated_at
+RETURNING *;
+
+-- name: DisableURL :one
+UPDATE urls
+SET disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP), disabled_reason = @disabled_reason::text, updated_at = CURRENT_TIMESTAMP
+WHERE short_code = @short_code
+RETURNING *;
+
+-- name: DisableOwnedURLs :many
+UPDATE urls
+SET disabled_at = CURRENT_TIMESTAMP, disabled_reason = sqlc.narg(disabled_reason), updated_at = CURRENT_TIMESTAMP
+WHERE short_code = ANY(@short_codes::text[]) AND owner = @owner AND disabled_at IS NULL
+RETURNING *;
+
+-- name: ApproveHeldURL :one
+UPDATE urls
+SET disabled_at = NULL, disabled_reason = NULL, updated_at = CURRENT_TIMESTAMP
+WHERE short_code = @short_code AND disabled_reason LIKE @held_reason_pattern::text
+RETURNING *;
+
+-- name: SetURLPublicStats :one
+UPDATE urls SET public_stats = @public_stats, updated_at = CURRENT_TIMESTAMP
+WHERE short_code = @short_code
+RETURNING *;
+
+-- name: SetURLFallback :one
+UPDATE urls SET fallback_url = sqlc.narg(fallback_url), updated_at = CURRENT_TIMESTAMP
+WHERE short_code = @short_code AND owner = @owner
+RETURNING *;
+
+-- name: MoveURLToFolder :one
+UPDATE urls SET folder_id = sqlc.narg(folder_id), updated_at = CURRENT_TIMESTAMP
+WHERE short_code = @short_code
+RETURNING *;
+
+-- Extends from the later of the expiry and now, only while the link still
+-- expires when the reminder said it would
+-- name: ExtendURLExpiry :one
+UPDATE urls
+SET expires_at = GREATEST(expires_at, CURRENT_TIMESTAMP) + make_interval(secs => @extend_by_seconds::float8),
+    updated_at = CURRENT_TIMESTAMP
+WHERE short_code = @short_code AND expires_at = @signed_expiry::timestamptz
+RETURNING *;
+
+-- name: RetireRotatedURLs :many
+UPDATE urls
+SET disabled_at = CURRENT_TIMESTAMP, disabled_reason = @disabled_reason::text, updated_at = CURRENT_TIMESTAMP
+WHERE retire_at <= CURRENT_TIMESTAMP AND disabled_at IS NULL
+RETURNING *;
+
+-- name: TransferURLs :many
+UPDATE urls SET owner = @new_owner::text, folder_id = NULL, updated_at = CURRENT_TIMESTAMP
+WHERE short_code = ANY(@short_codes::text[]) AND owner = @owner
+RETURNING *;
+
+-- name: DeleteOwnedURLs :many
+DELETE FROM urls
+WHERE short_code = ANY(@short_codes::text[]) AND owner = @owner
+RETURNING *;
+
+-- Deletes like DeleteOwnedURLs and moves the links to urls_trash in the same
+-- statement. The click total and targets are read before the delete cascades.
+-- name: TrashOwnedURLs :many
+WITH deleted AS (
+    DELETE FROM urls
+    WHERE short_code = ANY(@short_codes::text[]) AND owner = @owner::text
+    RETURNING *
+),
+trashed AS (
+    INSERT INTO urls_trash (id, original_url, short_code, owner, flag_reason, disabled_at, disabled_reason,
+        created_at, updated_at, expires_at, source, code_generator, public_stats, rotated_to, retire_at,
+        folder_id, fallback_url, clicks, last_clicked_at, targets, purge_at)
+    SELECT d.id, d.original_url, d.short_code, d.owner, d.flag_reason, d.disabled_at, d.disabled_reason,
+        d.created_at, d.updated_at, d.expires_at, d.source, d.code_generator, d.public_stats, d.rotated_to, d.retire_at,
+        d.folder_id, d.fallback_url, lc.clicks, lc.last_clicked_at,
+        (SELECT jsonb_agg(jsonb_build_object('originalUrl', t.original_url, 'weight', t.weight) ORDER BY t.position)
+            FROM link_targets t WHERE t.short_code = d.short_code),
+        CURRENT_TIMESTAMP + make_interval(secs => @retention_seconds::float8)
+    FROM deleted d
+    LEFT JOIN link_clicks lc ON lc.short_code = d.short_code
+)
+SELECT * FROM deleted;
+
+-- Moves a trashed link back. Its folder is kept when it still exists, and its
+-- click total and targets come back with it.
+-- name: RestoreTrashedURL :one
+WITH restored AS (
+    DELETE FROM urls_trash WHERE short_code = @short_code::text AND owner = @owner::text
+    RETURNING *
+),
+inserted AS (
+    INSERT INTO urls (id, original_url, short_code, owner, flag_reason, disabled_at, disabled_reason,
+        created_at, updated_at, expires_at, source, code_generator, public_stats, rotated_to, retire_at,
+        folder_id, fallback_url)
+    SELECT r.id, r.original_url, r.short_code, r.owner, r.flag_reason, r.disabled_at, r.disabled_reason,
+        r.created_at, CURRENT_TIMESTAMP, r.expires_at, r.source, r.code_generator, r.public_stats,
+        r.rotated_to, r.retire_at, (SELECT f.id FROM folders f WHERE f.id = r.folder_id AND f.owner = r.owner),
+        r.fallback_url
+    FROM restored r
+    RETURNING *
+),
+clicks AS (
+    INSERT INTO link_clicks (short_code, clicks, last_clicked_at)
+    SELECT short_code, clicks, last_clicked_at FROM restored WHERE clicks IS NOT NULL
+),
+targets AS (
+    INSERT INTO link_targets (short_code, position, original_url, weight)
+    SELECT r.short_code, t.position, t.target->>'originalUrl', (t.target->>'weight')::int
+    FROM restored r, jsonb_array_elements(r.targets) WITH ORDINALITY AS t(target, position)
+)
+SELECT * FROM inserted;
+
+-- Hands the link's code over to a new one: the old link keeps redirecting
+-- until retire_at, or is disabled at once without a grace period. The
+-- destination is copied as stored, neither decrypted nor screened again.
+-- name: RotateURL :one
+WITH old AS (
+    UPDATE urls
+    SET rotated_to = @new_code::text, retire_at = CURRENT_TIMESTAMP + make_interval(secs => @grace_seconds::float8),
+        disabled_at = CASE WHEN @grace_seconds::float8 = 0 THEN CURRENT_TIMESTAMP END,
+        disabled_reason = CASE WHEN @grace_seconds::float8 = 0 THEN @rotated_reason::text END,
+        updated_at = CURRENT_TIMESTAMP
+    WHERE short_code = @short_code::text AND rotated_to IS NULL AND disabled_at IS NULL
+    RETURNING original_url, owner, flag_reason, expires_at, public_stats, folder_id, fallback_url
+),
+inserted AS (
+    INSERT INTO urls (original_url, short_code, owner, flag_reason, expires_at, code_generator, public_stats, folder_id, fallback_url)
+    SELECT original_url, @new_code::text, owner, flag_reason, expires_at, @code_generator::text, public_stats, folder_id, fallback_url FROM old
+    RETURNING *
+),
+targets AS (
+    INSERT INTO link_targets (short_code, position, original_url, weight)
+    SELECT @new_code::text, position, original_url, weight FROM link_targets
+    WHERE short_code = @short_code AND EXISTS (SELECT 1 FROM inserted)
+)
+SELECT * FROM inserted;
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/response"
+)
+
+// The reaper removes links whose expires_at has passed, in batches claimed with
+// SKIP LOCKED so every instance can run it. EXPIRED_LINK_ACTION=archive (the
+// default) moves them to urls_archive with their click count; delete drops them.
+const (
+	reaperActionArchive = "archive"
+	reaperActionDelete  = "delete"
+)
+
+var (
+	reaperInterval  = env.Duration("REAPER_INTERVAL", time.Minute)
+	reaperBatchSize = env.Int("REAPER_BATCH_SIZE", 500)
+	reaperAction    = env.Get("EXPIRED_LINK_ACTION", reaperActionArchive)
+)
+
+// reaper_runs records what every run removed, as the metric operators check
+const reaperTablesQuery = `
+	CREATE TABLE IF NOT EXISTS urls_archive (
+		id INTEGER PRIMARY KEY,
+		original_url TEXT NOT NULL,
+		short_code VARCHAR(10) NOT NULL,
+		owner TEXT NOT NULL DEFAULT '',
+		flag_reason TEXT,
+		disabled_at TIMESTAMP WITH TIME ZONE,
+		disabled_reason TEXT,
+		clicks BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE,
+		updated_at TIMESTAMP WITH TIME ZONE,
+		expires_at TIMESTAMP WITH TIME ZONE,
+		archived_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	ALTER TABLE urls_archive ADD COLUMN IF NOT EXISTS source TEXT;
+
+	CREATE INDEX IF NOT EXISTS idx_urls_archive_short_code ON urls_archive(short_code);
+
+	CREATE TABLE IF NOT EXISTS reaper_runs (
+		id SERIAL PRIMARY KEY,
+		action TEXT NOT NULL,
+		reaped INTEGER NOT NULL,
+		cache_keys_removed INTEGER NOT NULL,
+		error TEXT,
+		started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		duration_ms INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_reaper_runs_started_at ON reaper_runs(started_at, id);
+`
+
+// ReaperRun is the outcome of one reaper run
+type ReaperRun struct {
+	ID               int64     `json:"id"`
+	Action           string    `json:"action"`
+	Reaped           int       `json:"reaped"`
+	CacheKeysRemoved int       `json:"cacheKeysRemoved"`
+	Error            *string   `json:"error,omitempty"`
+	StartedAt        time.Time `json:"startedAt"`
+	DurationMS       int       `json:"durationMs"`
+}
+
+// reapExpiredBatch removes up to limit expired links in one statement and
+// returns them. When archiving, the copy and the delete commit together, and
+// the click count is read before the delete cascades to link_clicks.
+func (srv *server) reapExpiredBatch(limit int) ([]*URL, error) {
+	archive := ""
+	if reaperAction == reaperActionArchive {
+		archive = `,
+		archived AS (
+			INSERT INTO urls_archive (id, original_url, short_code, owner, flag_reason, disabled_at,
+				disabled_reason, clicks, created_at, updated_at, expires_at, source)
+			SELECT r.id, r.original_url, r.short_code, r.owner, r.flag_reason, r.disabled_at,
+				r.disabled_reason, COALESCE(lc.clicks, 0), r.created_at, r.updated_at, r.expires_at, r.source
+			FROM reaped r
+			LEFT JOIN link_clicks lc ON lc.short_code = r.short_code
+			ON CONFLICT (id) DO NOTHING
+		)`
+	}
+
+	query := `
+		WITH reaped AS (
+			DELETE FROM urls
+			WHERE id IN (
+				SELECT id FROM urls
+				WHERE expires_at <= CURRENT_TIMESTAMP
+				ORDER BY expires_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING ` + urlColumns + `
+		)` + archive + `
+		SELECT ` + urlColumns + ` FROM reaped
+	`
+	rows, err := srv.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reaped := []*URL{}
+	for rows.Next() {
+		u, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		reaped = append(reaped, u)
+	}
+	return reaped, rows.Err()
+}
+
+// reapExpiredLinks drains every expired link, batch by batch, and records the run
+func (srv *server) reapExpiredLinks() ReaperRun {
+	run := ReaperRun{Action: reaperAction, StartedAt: time.Now()}
+	for {
+		reaped, err := srv.reapExpiredBatch(reaperBatchSize)
+		if err != nil {
+			msg := err.Error()
+			run.Error = &msg
+			break
+		}
+		if len(reaped) == 0 {
+			break
+		}
+
+		codes := make([]string, len(reaped))
+		for i, u := range reaped {
+			codes[i] = u.ShortCode
+			srv.emitLinkEvent(eventLinkExpired, u)
+		}
+		srv.invalidateURLCaches(codes)
+
+		run.Reaped += len(reaped)
+		run.CacheKeysRemoved += len(codes)
+		if len(reaped) < reaperBatchSize {
+			break
+		}
+	}
+	run.DurationMS = int(time.Since(run.StartedAt) / time.Millisecond)
+
+	// Runs that found nothing are only logged, so the table holds the interesting ones
+	if run.Reaped > 0 || run.Error != nil {
+		err := srv.db.QueryRow(`
+			INSERT INTO reaper_runs (action, reaped, cache_keys_removed, error, started_at, duration_ms)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id
+		`, run.Action, run.Reaped, run.CacheKeysRemoved, run.Error, run.StartedAt, run.DurationMS).Scan(&run.ID)
+		if err != nil {
+			log.Printf("Failed to record reaper run: %v", err)
+		}
+	}
+	return run
+}
+
+func (srv *server) startReaper() {
+	if reaperAction != reaperActionArchive && reaperAction != reaperActionDelete {
+		log.Fatalf("Invalid EXPIRED_LINK_ACTION %q, expected archive or delete", reaperAction)
+	}
+	if os.Getenv("REAPER_INTERVAL") == "0" {
+		return
+	}
+
+	srv.scheduleJob("reaper", reaperInterval, func() error {
+		run := srv.reapExpiredLinks()
+		if run.Error != nil {
+			return fmt.Errorf("failed after %d expired links: %s", run.Reaped, *run.Error)
+		}
+		if run.Reaped > 0 {
+			log.Printf("Reaper %sd %d expired links in %dms", run.Action, run.Reaped, run.DurationMS)
+		}
+		return nil
+	})
+}
+
+// listReaperRunsHandler lists reaper runs, newest first
+func (srv *server) listReaperRunsHandler(c *gin.Context) {
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{}
+	query := `SELECT id, action, reaped, cache_keys_removed, error, started_at, duration_ms FROM reaper_runs`
+	if after != nil {
+		args = append(args, after.Time, after.ID)
+		query += " WHERE (started_at, id) < ($1, $2)"
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY started_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list reaper runs: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list reaper runs")
+		return
+	}
+	defer rows.Close()
+
+	runs := []ReaperRun{}
+	for rows.Next() {
+		var run ReaperRun
+		if err := rows.Scan(&run.ID, &run.Action, &run.Reaped, &run.CacheKeysRemoved, &run.Error, &run.StartedAt, &run.DurationMS); err != nil {
+			log.Printf("Failed to list reaper runs: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list reaper runs")
+			return
+		}
+		runs = append(runs, run)
+	}
+
+	nextCursor := ""
+	if len(runs) > limit {
+		runs = runs[:limit]
+		last := runs[len(runs)-1]
+		nextCursor = pageCursor{Time: last.StartedAt, ID: last.ID}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"runs": runs}, nextCursor)
+}
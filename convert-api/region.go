@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"shared/accesslog"
+	"shared/env"
+	"shared/response"
+	"shared/secrets"
+	"shared/shardcache"
+	"shared/tenantcache"
+	"shared/tracing"
+)
+
+// With redirect-api active-active in several regions, each region has its own
+// redirect cache Redis. REGION names this instance's region, and
+// REGION_REDIS_URLS maps every region to its redirect cache Redis as
+// region=address pairs separated by commas, the same setting redirect-api
+// reads. This region's entry replaces CACHE_REDIS_URL, and cache
+// invalidations (DEL and PUBLISH on the cache Redis and the url:* shards) are
+// replayed to the other regions' caches in the background, so a change reaches
+// every region at once. Regions whose url:* entries are sharded list their
+// shards in REGION_URL_CACHE_SHARDS as region=host:port|host:port pairs
+// separated by commas; this region's entry replaces URL_CACHE_SHARDS, and
+// replayed url:* deletes go to the shard holding each key in its region.
+//
+// Short codes come from the Redis counter, which only one region may own.
+// FORWARD_WRITES=true sends link creations (POST /api/v1/urls) received
+// outside PRIMARY_REGION to the primary's convert-api at its REGION_API_URLS
+// entry, keeping a single counter and a single writable database. Forwarded
+// requests carry REGION_FORWARD_SECRET, which every region shares; a region
+// header without it is a client's and is dropped.
+var (
+	region          = os.Getenv("REGION")
+	primaryRegion   = env.Get("PRIMARY_REGION", region)
+	regionRedisURLs = os.Getenv("REGION_REDIS_URLS")
+	// Also read by redirect-api
+	regionURLCacheShards = os.Getenv("REGION_URL_CACHE_SHARDS")
+	regionAPIURLs        = os.Getenv("REGION_API_URLS")
+	forwardWrites        = env.Get("FORWARD_WRITES", "false") == "true"
+)
+
+const (
+	// forwardedRegionHeader names the region a request was forwarded from;
+	// forwarded requests are never forwarded again
+	forwardedRegionHeader = "X-Forwarded-Region"
+	forwardSecretHeader   = "X-Region-Forward-Secret"
+	regionReplayTimeout   = 5 * time.Second
+)
+
+// primaryProxy forwards creations to the primary region, nil when they are handled here
+var primaryProxy *httputil.ReverseProxy
+
+// parseRegionMap parses region=endpoint pairs
+func parseRegionMap(key, value string) (map[string]string, error) {
+	endpoints := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, endpoint, ok := strings.Cut(pair, "=")
+		name, endpoint = strings.TrimSpace(name), strings.TrimSpace(endpoint)
+		if !ok || name == "" || endpoint == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected region=endpoint", key, pair)
+		}
+		endpoints[name] = endpoint
+	}
+	return endpoints, nil
+}
+
+// initRegion checks the region configuration and sets up write forwarding
+func initRegion() error {
+	if (regionRedisURLs != "" || forwardWrites) && region == "" {
+		return fmt.Errorf("REGION_REDIS_URLS and FORWARD_WRITES need REGION")
+	}
+	if regionURLCacheShards != "" && region == "" {
+		return fmt.Errorf("REGION_URL_CACHE_SHARDS needs REGION")
+	}
+	if _, err := parseRegionMap("REGION_REDIS_URLS", regionRedisURLs); err != nil {
+		return err
+	}
+	if _, err := parseRegionMap("REGION_URL_CACHE_SHARDS", regionURLCacheShards); err != nil {
+		return err
+	}
+	if !forwardWrites || region == primaryRegion {
+		return nil
+	}
+
+	if regionForwardSecret() == "" {
+		return fmt.Errorf("FORWARD_WRITES needs REGION_FORWARD_SECRET")
+	}
+	apiURLs, err := parseRegionMap("REGION_API_URLS", regionAPIURLs)
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse(apiURLs[primaryRegion])
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return fmt.Errorf("FORWARD_WRITES needs the URL of %s in REGION_API_URLS", primaryRegion)
+	}
+	primaryProxy = httputil.NewSingleHostReverseProxy(target)
+	primaryProxy.Transport = tracing.Client(&http.Client{}).Transport
+	primaryProxy.ModifyResponse = func(resp *http.Response) error {
+		// The primary answers with the request ID it was sent, already set here
+		resp.Header.Del(accesslog.RequestIDHeader)
+		return nil
+	}
+	primaryProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Failed to forward %s %s to %s: %v", r.Method, r.URL.Path, primaryRegion, err)
+		response.WriteError(w, http.StatusBadGateway, "primary region is unreachable")
+	}
+	return nil
+}
+
+// regionForwardSecret authenticates requests forwarded between regions
+func regionForwardSecret() string {
+	return secrets.Value("REGION_FORWARD_SECRET")
+}
+
+// forwardedFromRegion reports whether another region forwarded the request,
+// dropping the region headers when they don't carry the shared secret
+func forwardedFromRegion(r *http.Request) bool {
+	if r.Header.Get(forwardedRegionHeader) == "" {
+		r.Header.Del(forwardSecretHeader)
+		return false
+	}
+	want := regionForwardSecret()
+	got := r.Header.Get(forwardSecretHeader)
+	r.Header.Del(forwardSecretHeader)
+	if want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1 {
+		return true
+	}
+	log.Printf("Ignoring %s without a valid forward secret on %s %s", forwardedRegionHeader, r.Method, r.URL.Path)
+	r.Header.Del(forwardedRegionHeader)
+	return false
+}
+
+// forwardToPrimary hands the request to the primary region when creations are forwarded
+func forwardToPrimary(c *gin.Context) {
+	if forwardedFromRegion(c.Request) || primaryProxy == nil {
+		c.Next()
+		return
+	}
+	c.Abort()
+	c.Request.Header.Set(forwardedRegionHeader, region)
+	c.Request.Header.Set(forwardSecretHeader, regionForwardSecret())
+	primaryProxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// cacheRedisAddr is this region's entry of REGION_REDIS_URLS, else CACHE_REDIS_URL
+func cacheRedisAddr() string {
+	addrs, _ := parseRegionMap("REGION_REDIS_URLS", regionRedisURLs)
+	if addr := addrs[region]; addr != "" {
+		return addr
+	}
+	return os.Getenv("CACHE_REDIS_URL")
+}
+
+// urlCacheShardAddrs is this region's entry of REGION_URL_CACHE_SHARDS, else
+// URL_CACHE_SHARDS, as a list of addresses
+func urlCacheShardAddrs() []string {
+	shards, _ := parseRegionMap("REGION_URL_CACHE_SHARDS", regionURLCacheShards)
+	if list := shards[region]; list != "" {
+		return splitAddrs(list, "|")
+	}
+	return splitAddrs(urlCacheShards, ",")
+}
+
+// splitAddrs splits a list of addresses, skipping empty entries
+func splitAddrs(list, sep string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, sep) {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// regionCache is another region's redirect cache: its cache Redis, and the
+// ring of shards holding its url:* entries, that Redis alone when it has none
+type regionCache struct {
+	name  string
+	cache *redis.Client
+	urls  *shardcache.Ring
+}
+
+var (
+	otherRegionsOnce  sync.Once
+	otherRegionCaches []regionCache
+)
+
+// otherRegions connects to the other regions' caches, once for every hook.
+// Their clients connect on first use, so a region that is down doesn't hold
+// up startup.
+func otherRegions() []regionCache {
+	otherRegionsOnce.Do(func() {
+		addrs, _ := parseRegionMap("REGION_REDIS_URLS", regionRedisURLs)
+		shards, _ := parseRegionMap("REGION_URL_CACHE_SHARDS", regionURLCacheShards)
+		for name, addr := range addrs {
+			if name == region {
+				continue
+			}
+			remote := regionCache{name: name, cache: newRegionClient(name, addr)}
+			if list := splitAddrs(shards[name], "|"); len(list) > 0 {
+				var nodes []shardcache.Node
+				for _, shard := range list {
+					nodes = append(nodes, shardcache.Node{Addr: shard, Client: newRegionClient(name, shard)})
+				}
+				remote.urls = shardcache.New(nodes...)
+			} else {
+				remote.urls = shardcache.New(shardcache.Node{Addr: addr, Client: remote.cache})
+			}
+			otherRegionCaches = append(otherRegionCaches, remote)
+		}
+	})
+	return otherRegionCaches
+}
+
+func newRegionClient(name, addr string) *redis.Client {
+	client := redis.NewClient(&redis.Options{Addr: addr, CredentialsProvider: secrets.RedisCredentials})
+	if err := tracing.Redis(client); err != nil {
+		log.Printf("Failed to trace the cache Redis %s of %s: %v", addr, name, err)
+	}
+	return client
+}
+
+// addRegionReplayHook replays client's invalidations to the other regions'
+// caches. Failed replays are logged and left to the TTLs.
+func addRegionReplayHook(client *redis.Client) {
+	if remotes := otherRegions(); len(remotes) > 0 {
+		client.AddHook(regionReplayHook{remotes: remotes})
+	}
+}
+
+type regionReplayHook struct {
+	remotes []regionCache
+}
+
+// replayed reports whether cmd invalidates the cache: a delete, an eviction
+// message or dropping deleted keys from a tenant's index
+func replayed(cmd redis.Cmder) bool {
+	switch cmd.Name() {
+	case "del", "unlink", "publish":
+		return true
+	case "zrem":
+		return tenantcache.IsIndexKey(fmt.Sprint(cmd.Args()[1]))
+	}
+	return false
+}
+
+func (h regionReplayHook) replay(cmds []redis.Cmder) {
+	var replays []redis.Cmder
+	for _, cmd := range cmds {
+		if replayed(cmd) {
+			replays = append(replays, cmd)
+		}
+	}
+	if len(replays) == 0 {
+		return
+	}
+	for _, remote := range h.remotes {
+		batches := remote.route(replays)
+		go func(remote regionCache) {
+			replayCtx, cancel := context.WithTimeout(context.Background(), regionReplayTimeout)
+			defer cancel()
+			for client, batch := range batches {
+				_, err := client.Pipelined(replayCtx, func(pipe redis.Pipeliner) error {
+					for _, args := range batch {
+						pipe.Do(replayCtx, args...)
+					}
+					return nil
+				})
+				if err != nil {
+					log.Printf("Failed to replay %d cache invalidations to %s (%s): %v", len(batch), remote.name, client.Options().Addr, err)
+				}
+			}
+		}(remote)
+	}
+}
+
+// route splits invalidations by the instance of the region they go to:
+// deletes of url:* entries and their pointers, and their removal from tenant
+// indexes, to the shard holding each key, everything else to the cache Redis
+func (r regionCache) route(cmds []redis.Cmder) map[*redis.Client][][]interface{} {
+	batches := map[*redis.Client][][]interface{}{}
+	for _, cmd := range cmds {
+		args := cmd.Args()
+		if cmd.Name() == "publish" {
+			batches[r.cache] = append(batches[r.cache], args)
+			continue
+		}
+		// ZREM removes keys from the index named first; DEL takes keys only
+		head := args[:1]
+		if cmd.Name() == "zrem" {
+			head = args[:2]
+		}
+		keys := map[*redis.Client][]interface{}{}
+		for _, key := range args[len(head):] {
+			client := r.cache
+			if k := tenantcache.Name(fmt.Sprint(key)); isURLCacheKey(k) {
+				client = r.urls.Client(k)
+			}
+			keys[client] = append(keys[client], key)
+		}
+		for client, clientKeys := range keys {
+			batches[client] = append(batches[client], append(append([]interface{}{}, head...), clientKeys...))
+		}
+	}
+	return batches
+}
+
+func (h regionReplayHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h regionReplayHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		h.replay([]redis.Cmder{cmd})
+		return err
+	}
+}
+
+func (h regionReplayHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		h.replay(cmds)
+		return err
+	}
+}
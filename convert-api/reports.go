@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+)
+
+const (
+	reportStatusOpen      = "open"
+	reportStatusDismissed = "dismissed"
+	reportStatusActioned  = "actioned"
+)
+
+var reportReasons = map[string]bool{
+	"phishing": true,
+	"malware":  true,
+	"spam":     true,
+	"illegal":  true,
+	"other":    true,
+}
+
+const maxReportDetailsLength = 2000
+
+// REPORT_NOTIFY_WEBHOOK_URL receives a JSON notification whenever a report is resolved,
+// so the outcome can be forwarded to the reporter
+var reportNotifyWebhookURL = os.Getenv("REPORT_NOTIFY_WEBHOOK_URL")
+
+const reportTablesQuery = `
+	CREATE TABLE IF NOT EXISTS abuse_reports (
+		id SERIAL PRIMARY KEY,
+		short_code VARCHAR(10) NOT NULL,
+		reason TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		reporter_email TEXT,
+		reporter_ip TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open',
+		reviewed_by TEXT,
+		reviewed_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_abuse_reports_status ON abuse_reports(status, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_abuse_reports_short_code ON abuse_reports(short_code);
+`
+
+// AbuseReport is a public report against a short code
+type AbuseReport struct {
+	ID            int        `json:"id"`
+	ShortCode     string     `json:"shortCode"`
+	Reason        string     `json:"reason"`
+	Details       string     `json:"details"`
+	ReporterEmail *string    `json:"reporterEmail,omitempty"`
+	ReporterIP    string     `json:"reporterIp"`
+	Status        string     `json:"status"`
+	ReviewedBy    *string    `json:"reviewedBy,omitempty"`
+	ReviewedAt    *time.Time `json:"reviewedAt,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+type ReportRequestBody struct {
+	ShortCode     string `json:"shortCode" binding:"required"`
+	Reason        string `json:"reason" binding:"required"`
+	Details       string `json:"details"`
+	ReporterEmail string `json:"reporterEmail"`
+}
+
+const reportColumns = "id, short_code, reason, details, reporter_email, reporter_ip, status, reviewed_by, reviewed_at, created_at"
+
+func scanReport(row rowScanner) (*AbuseReport, error) {
+	var r AbuseReport
+	err := row.Scan(&r.ID, &r.ShortCode, &r.Reason, &r.Details, &r.ReporterEmail, &r.ReporterIP,
+		&r.Status, &r.ReviewedBy, &r.ReviewedAt, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// createReportHandler is the public endpoint for reporting an abusive short link
+func (srv *server) createReportHandler(c *gin.Context) {
+	var body ReportRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !reportReasons[body.Reason] {
+		response.Fail(c, http.StatusBadRequest, "reason must be one of phishing, malware, spam, illegal, other")
+		return
+	}
+	if len(body.Details) > maxReportDetailsLength {
+		response.Fail(c, http.StatusBadRequest, fmt.Sprintf("details must be at most %d characters", maxReportDetailsLength))
+		return
+	}
+
+	if _, err := srv.getURLByShortCode(body.ShortCode); err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+			return
+		}
+		log.Printf("Failed to get URL from database: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to submit report")
+		return
+	}
+
+	var reporterEmail *string
+	if body.ReporterEmail != "" {
+		reporterEmail = &body.ReporterEmail
+	}
+
+	query := `
+		INSERT INTO abuse_reports (short_code, reason, details, reporter_email, reporter_ip)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + reportColumns
+
+	report, err := scanReport(srv.db.QueryRow(query, body.ShortCode, body.Reason, body.Details, reporterEmail, c.ClientIP()))
+	if err != nil {
+		log.Printf("Failed to save abuse report: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to submit report")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditReportCreate, auditTargetAbuseReport, strconv.Itoa(report.ID), nil, report)
+
+	response.OK(c, http.StatusAccepted, gin.H{"id": report.ID, "status": reportStatusOpen})
+}
+
+// listReportsHandler is the admin review queue, oldest first
+func (srv *server) listReportsHandler(c *gin.Context) {
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	status := c.DefaultQuery("status", reportStatusOpen)
+	args := []interface{}{status}
+	query := `SELECT ` + reportColumns + ` FROM abuse_reports WHERE status = $1`
+	if after != nil {
+		args = append(args, after.Time, after.ID)
+		query += fmt.Sprintf(" AND (created_at, id) > ($%d, $%d)", len(args)-1, len(args))
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at, id LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list abuse reports: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list reports")
+		return
+	}
+	defer rows.Close()
+
+	reports := []*AbuseReport{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			log.Printf("Failed to list abuse reports: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list reports")
+			return
+		}
+		reports = append(reports, report)
+	}
+
+	nextCursor := ""
+	if len(reports) > limit {
+		reports = reports[:limit]
+		last := reports[len(reports)-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: int64(last.ID)}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"reports": reports}, nextCursor)
+}
+
+// resolveReports closes every open report of a short code with the given outcome
+func (srv *server) resolveReports(actor auditActor, shortCode, status string) ([]*AbuseReport, error) {
+	query := `
+		UPDATE abuse_reports
+		SET status = $2, reviewed_by = $3, reviewed_at = CURRENT_TIMESTAMP
+		WHERE short_code = $1 AND status = 'open'
+		RETURNING ` + reportColumns
+
+	rows, err := srv.db.Query(query, shortCode, status, actor.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []*AbuseReport{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, report := range reports {
+		srv.recordAudit(actor, auditReportResolve, auditTargetAbuseReport, strconv.Itoa(report.ID), gin.H{"status": reportStatusOpen}, report)
+	}
+	return reports, nil
+}
+
+func (srv *server) getReport(c *gin.Context) (*AbuseReport, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid report id")
+		return nil, false
+	}
+
+	report, err := scanReport(srv.db.QueryRow(`SELECT `+reportColumns+` FROM abuse_reports WHERE id = $1`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeReportNotFound)
+			return nil, false
+		}
+		log.Printf("Failed to get abuse report: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get report")
+		return nil, false
+	}
+	return report, true
+}
+
+// disableReportedLinkHandler is the one-click takedown: disable the link and close its reports
+func (srv *server) disableReportedLinkHandler(c *gin.Context) {
+	report, ok := srv.getReport(c)
+	if !ok {
+		return
+	}
+
+	u, err := srv.disableURL(actorFromGin(c), report.ShortCode, "abuse_report:"+report.Reason)
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+			return
+		}
+		log.Printf("Failed to disable reported URL: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to disable URL")
+		return
+	}
+
+	resolved, err := srv.resolveReports(actorFromGin(c), report.ShortCode, reportStatusActioned)
+	if err != nil {
+		log.Printf("Failed to resolve abuse reports for %s: %v", report.ShortCode, err)
+	}
+	for _, r := range resolved {
+		go notifyReporter(r)
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"link": toLinkResponse(u), "resolvedReports": len(resolved)})
+}
+
+func (srv *server) dismissReportHandler(c *gin.Context) {
+	report, ok := srv.getReport(c)
+	if !ok {
+		return
+	}
+
+	query := `
+		UPDATE abuse_reports
+		SET status = $2, reviewed_by = $3, reviewed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING ` + reportColumns
+
+	updated, err := scanReport(srv.db.QueryRow(query, report.ID, reportStatusDismissed, callerID(c)))
+	if err != nil {
+		log.Printf("Failed to dismiss abuse report: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to dismiss report")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditReportResolve, auditTargetAbuseReport, strconv.Itoa(report.ID), report, updated)
+
+	go notifyReporter(updated)
+
+	response.OK(c, http.StatusOK, updated)
+}
+
+// notifyReporter is the hook fired when a report is resolved. Reports without
+// a reporter email are skipped since there is nobody to tell.
+func notifyReporter(report *AbuseReport) {
+	if report.ReporterEmail == nil || reportNotifyWebhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(gin.H{
+		"type":          "report.resolved",
+		"reportId":      report.ID,
+		"shortCode":     report.ShortCode,
+		"status":        report.Status,
+		"reporterEmail": *report.ReporterEmail,
+	})
+	if err != nil {
+		log.Printf("Failed to encode reporter notification: %v", err)
+		return
+	}
+
+	resp, err := webhookClient.Post(reportNotifyWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to notify reporter of report %d: %v", report.ID, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("Reporter notification for report %d returned status %d", report.ID, resp.StatusCode)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"shared/env"
+	"shared/tracing"
+	"shared/urlcrypto"
+)
+
+// threatFeed checks a batch of destinations, returning the threats found per URL.
+// URLs missing from the result are considered clean.
+type threatFeed interface {
+	name() string
+	check(ctx context.Context, rawURLs []string) (map[string][]string, error)
+}
+
+var (
+	rescanInterval  = env.Duration("RESCAN_INTERVAL", time.Hour)
+	rescanBatchSize = env.Int("RESCAN_BATCH_SIZE", safeBrowsingBatchLimit)
+)
+
+// RESCAN_MIN_AGE is how long a link goes between scans
+var rescanMinAge = env.Duration("RESCAN_MIN_AGE", 24*time.Hour)
+
+type safeBrowsingFeed struct{}
+
+func (safeBrowsingFeed) name() string { return "safe_browsing" }
+
+func (safeBrowsingFeed) check(ctx context.Context, rawURLs []string) (map[string][]string, error) {
+	matches := map[string][]string{}
+	for start := 0; start < len(rawURLs); start += safeBrowsingBatchLimit {
+		end := min(start+safeBrowsingBatchLimit, len(rawURLs))
+		batch, err := lookupSafeBrowsingBatch(ctx, rawURLs[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for rawURL, threats := range batch {
+			matches[rawURL] = threats
+		}
+	}
+	return matches, nil
+}
+
+const virusTotalEndpoint = "https://www.virustotal.com/api/v3/urls/"
+
+var virusTotalAPIKey = os.Getenv("VIRUSTOTAL_API_KEY")
+
+// VIRUSTOTAL_REQUEST_INTERVAL spaces out lookups; the public API allows 4 requests per minute
+var virusTotalRequestInterval = env.Duration("VIRUSTOTAL_REQUEST_INTERVAL", 15*time.Second)
+
+var virusTotalClient = tracing.Client(&http.Client{Timeout: 10 * time.Second})
+
+type virusTotalResponse struct {
+	Data struct {
+		Attributes struct {
+			LastAnalysisStats struct {
+				Malicious  int `json:"malicious"`
+				Suspicious int `json:"suspicious"`
+			} `json:"last_analysis_stats"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// virusTotalFeed looks URLs up one at a time. URLs VirusTotal has never seen
+// are treated as clean rather than submitted for analysis.
+type virusTotalFeed struct{}
+
+func (virusTotalFeed) name() string { return "virustotal" }
+
+func (virusTotalFeed) check(ctx context.Context, rawURLs []string) (map[string][]string, error) {
+	matches := map[string][]string{}
+	for i, rawURL := range rawURLs {
+		if i > 0 {
+			time.Sleep(virusTotalRequestInterval)
+		}
+
+		threats, err := lookupVirusTotal(rawURL)
+		if err != nil {
+			return matches, err
+		}
+		if len(threats) > 0 {
+			matches[rawURL] = threats
+		}
+	}
+	return matches, nil
+}
+
+func lookupVirusTotal(rawURL string) ([]string, error) {
+	id := base64.RawURLEncoding.EncodeToString([]byte(rawURL))
+	req, err := http.NewRequest(http.MethodGet, virusTotalEndpoint+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-apikey", virusTotalAPIKey)
+
+	resp, err := virusTotalClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("virustotal request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("virustotal returned status %d", resp.StatusCode)
+	}
+
+	var result virusTotalResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode virustotal response: %v", err)
+	}
+
+	stats := result.Data.Attributes.LastAnalysisStats
+	if stats.Malicious > 0 {
+		return []string{fmt.Sprintf("MALICIOUS_%d", stats.Malicious)}, nil
+	}
+	return nil, nil
+}
+
+// configuredThreatFeeds returns every feed that has credentials
+func configuredThreatFeeds() []threatFeed {
+	feeds := []threatFeed{}
+	if safeBrowsingAPIKey != "" {
+		feeds = append(feeds, safeBrowsingFeed{})
+	}
+	if virusTotalAPIKey != "" {
+		feeds = append(feeds, virusTotalFeed{})
+	}
+	return feeds
+}
+
+type scanTarget struct {
+	ShortCode   string
+	OriginalURL string
+}
+
+// claimRescanBatch marks the links that are due for a scan and returns them.
+// SKIP LOCKED lets several instances run the scanner without overlapping.
+func (srv *server) claimRescanBatch(limit int) ([]scanTarget, error) {
+	query := `
+		UPDATE urls SET last_scanned_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM urls
+			WHERE disabled_at IS NULL
+				AND (last_scanned_at IS NULL OR last_scanned_at < $1)
+			ORDER BY last_scanned_at NULLS FIRST, id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING short_code, original_url
+	`
+	rows, err := srv.db.Query(query, time.Now().Add(-rescanMinAge), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := []scanTarget{}
+	for rows.Next() {
+		var t scanTarget
+		if err := rows.Scan(&t.ShortCode, &t.OriginalURL); err != nil {
+			return nil, err
+		}
+		if t.OriginalURL, err = urlcrypto.Decrypt(t.OriginalURL); err != nil {
+			log.Printf("Skipping %s during rescan: %v", t.ShortCode, err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// rescanLinks runs one batch through every feed and disables the links that
+// have turned malicious. It returns the number of links scanned.
+func (srv *server) rescanLinks(feeds []threatFeed) (int, error) {
+	targets, err := srv.claimRescanBatch(rescanBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim rescan batch: %v", err)
+	}
+	if len(targets) == 0 {
+		return 0, nil
+	}
+
+	rawURLs := make([]string, 0, len(targets))
+	for _, t := range targets {
+		rawURLs = append(rawURLs, t.OriginalURL)
+	}
+
+	// URL -> "feed:THREATS" for every feed that matched it
+	verdicts := map[string][]string{}
+	for _, feed := range feeds {
+		matches, err := feed.check(srv.ctx, rawURLs)
+		if err != nil {
+			log.Printf("Rescan with %s failed: %v", feed.name(), err)
+		}
+		for rawURL, threats := range matches {
+			verdicts[rawURL] = append(verdicts[rawURL], feed.name()+":"+strings.Join(threats, ","))
+		}
+	}
+
+	for _, t := range targets {
+		reasons, ok := verdicts[t.OriginalURL]
+		if !ok {
+			continue
+		}
+		sort.Strings(reasons)
+
+		reason := "rescan:" + strings.Join(reasons, ";")
+		if _, err := srv.disableURL(systemActor("rescanner"), t.ShortCode, reason); err != nil {
+			if !errors.Is(err, errShortCodeNotFound) {
+				log.Printf("Failed to disable malicious URL %s: %v", t.ShortCode, err)
+			}
+			continue
+		}
+		log.Printf("Disabled %s after rescan (%s)", t.ShortCode, reason)
+	}
+
+	return len(targets), nil
+}
+
+// startRescanner periodically re-checks stored destinations against the
+// configured threat feeds. It is a no-op when no feed has credentials.
+func (srv *server) startRescanner() {
+	feeds := configuredThreatFeeds()
+	if len(feeds) == 0 {
+		return
+	}
+
+	srv.scheduleJob("rescanner", rescanInterval, func() error {
+		// Keep draining full batches so a backlog clears within one run
+		for {
+			scanned, err := srv.rescanLinks(feeds)
+			if err != nil {
+				return err
+			}
+			if scanned < rescanBatchSize {
+				return nil
+			}
+		}
+	})
+
+	log.Printf("Malware rescanner started (every %s, batches of %d)", rescanInterval, rescanBatchSize)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"shared/response"
+	"shared/tenantcache"
+	"shared/urlcrypto"
+)
+
+// maxResolveCodes caps one batch resolve request
+const maxResolveCodes = 100
+
+// resolveCacheTTL matches the TTL redirect-api caches destinations with
+const resolveCacheTTL = 30 * time.Minute
+
+type ResolveRequestBody struct {
+	ShortCodes []string `json:"shortCodes" binding:"required"`
+}
+
+// ResolvedLink is one entry of a batch resolve; Error is set instead of
+// OriginalURL for unknown and disabled codes
+type ResolvedLink struct {
+	ShortCode   string `json:"shortCode"`
+	OriginalURL string `json:"originalUrl,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// resolveShortCodes looks the codes up in the redirect cache with one MGET and
+// the misses in Postgres with one query, caching what it found there. Results
+// are in request order.
+func (srv *server) resolveShortCodes(shortCodes []string) ([]ResolvedLink, error) {
+	stored := make(map[string]string, len(shortCodes))
+
+	// Codes are matched in the form redirect-api caches them, see caseinsensitive.go
+	lookups := make([]string, len(shortCodes))
+	keys := make([]string, len(shortCodes))
+	for i, code := range shortCodes {
+		lookups[i] = cacheShortCode(code)
+		keys[i] = urlCacheKey(code)
+	}
+	values, err := srv.urlCache.Read(srv.ctx, tenantcache.MGet, keys...)
+	if err != nil {
+		// The database still answers for everything
+		log.Printf("Failed to read cached URLs: %v", err)
+		values = make([]interface{}, len(shortCodes))
+	}
+
+	missing := []string{}
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			// Links with weighted targets resolve to their own destination
+			stored[lookups[i]] = cachedDestination(s)
+		} else {
+			missing = append(missing, lookups[i])
+		}
+	}
+
+	disabled := map[string]bool{}
+	if len(missing) > 0 {
+		column := "short_code"
+		if caseInsensitiveCodes {
+			column = "lower(short_code)"
+		}
+		rows, err := srv.db.Query(`
+			SELECT `+column+`, `+servedURLColumn+`, `+linkTargetsColumn+`, disabled_at IS NOT NULL, expires_at, owner
+			FROM urls
+			WHERE `+column+` = ANY($1) AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+		`, pq.Array(missing))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get URLs: %v", err)
+		}
+		defer rows.Close()
+
+		found := map[string]string{}
+		ttls := map[string]time.Duration{}
+		owners := map[string]string{}
+		for rows.Next() {
+			var code, originalURL, owner string
+			var targets *string
+			var isDisabled bool
+			var expiresAt *time.Time
+			if err := rows.Scan(&code, &originalURL, &targets, &isDisabled, &expiresAt, &owner); err != nil {
+				return nil, fmt.Errorf("failed to scan URL: %v", err)
+			}
+			if isDisabled {
+				// Disabled links are never cached
+				disabled[code] = true
+				continue
+			}
+			stored[code] = originalURL
+			// Cache entries of expiring links never outlive the link
+			ttls[code] = resolveCacheTTL
+			if expiresAt != nil {
+				ttls[code] = min(resolveCacheTTL, time.Until(*expiresAt))
+			}
+			if ttls[code] > 0 {
+				found[code] = weightedCacheValue(originalURL, targets)
+				owners[code] = owner
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to get URLs: %v", err)
+		}
+
+		if len(found) > 0 {
+			codes := make([]string, 0, len(found))
+			for code := range found {
+				codes = append(codes, urlCacheKeyPrefix+code)
+			}
+			for client, keys := range srv.urlCache.Partition(codes) {
+				_, err := client.Pipelined(srv.ctx, func(pipe redis.Pipeliner) error {
+					for _, key := range keys {
+						code := strings.TrimPrefix(key, urlCacheKeyPrefix)
+						srv.setTenantCache(pipe, owners[code], key, found[code], ttls[code])
+					}
+					return nil
+				})
+				if err != nil {
+					log.Printf("Failed to cache resolved URLs: %v", err)
+				}
+			}
+		}
+	}
+
+	results := make([]ResolvedLink, len(shortCodes))
+	for i, code := range shortCodes {
+		results[i].ShortCode = code
+		s, ok := stored[lookups[i]]
+		switch {
+		case ok:
+			originalURL, err := urlcrypto.Decrypt(s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt URL for %s: %v", code, err)
+			}
+			results[i].OriginalURL = originalURL
+		case disabled[lookups[i]]:
+			results[i].Error = "link has been disabled"
+		default:
+			results[i].Error = "short code not found"
+		}
+	}
+	return results, nil
+}
+
+// resolveLinksHandler expands up to maxResolveCodes short codes in one request,
+// for clients such as chat apps previewing many links at once
+func (srv *server) resolveLinksHandler(c *gin.Context) {
+	var body ResolveRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body.ShortCodes) == 0 || len(body.ShortCodes) > maxResolveCodes {
+		response.Fail(c, http.StatusBadRequest, fmt.Sprintf("shortCodes must contain between 1 and %d codes", maxResolveCodes))
+		return
+	}
+
+	results, err := srv.resolveShortCodes(body.ShortCodes)
+	if err != nil {
+		log.Printf("Failed to resolve short codes: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to resolve short codes")
+		return
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"results": results})
+}
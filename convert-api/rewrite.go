@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+	"shared/slowquery"
+	"shared/urlcrypto"
+)
+
+// Owners can move many links to another destination host at once, e.g. after
+// a domain migration: https://old.com/a?b becomes https://new.com/a?b. The
+// rewrite runs as a bulk job, see bulk.go; with dryRun the changes are only
+// previewed. Every new destination is screened like an edited link, and a
+// link edited after it was matched is left alone.
+const maxRewritePreview = 100
+
+type RewriteRequestBody struct {
+	// From and To are host names; the scheme, port, path and query are kept
+	From       string      `json:"from" binding:"required"`
+	To         string      `json:"to" binding:"required"`
+	ShortCodes []string    `json:"shortCodes"`
+	Filter     *BulkFilter `json:"filter"`
+	DryRun     bool        `json:"dryRun"`
+}
+
+// RewritePreview is one change a rewrite would make
+type RewritePreview struct {
+	ShortCode string `json:"shortCode"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+// rewriteHost moves originalURL to the host to when it points at from
+func rewriteHost(originalURL, from, to string) (string, bool) {
+	parsed, err := url.Parse(originalURL)
+	if err != nil || strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".") != from {
+		return "", false
+	}
+	if port := parsed.Port(); port != "" {
+		parsed.Host = net.JoinHostPort(to, port)
+	} else {
+		parsed.Host = to
+	}
+	return parsed.String(), true
+}
+
+// normalizeHost validates a host name given to a rewrite
+func normalizeHost(host string) (string, bool) {
+	host, ok := normalizeDomainPattern(host)
+	if !ok || strings.HasPrefix(host, "*.") {
+		return "", false
+	}
+	return host, true
+}
+
+// ownedURLs returns the owner's links among codes, oldest first
+func (srv *server) ownedURLs(owner string, codes []string) ([]*URL, error) {
+	rows, err := srv.queries.ListOwnedURLs(srv.ctx, dbq.ListOwnedURLsParams{ShortCodes: codes, Owner: owner})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get URLs: %v", err)
+	}
+	urls, err := urlsFromRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get URLs: %v", err)
+	}
+	return urls, nil
+}
+
+// rewriteURL points one link at its rewritten destination, unless it was
+// changed or handed over since before was read. It returns nil when the link
+// was left alone.
+func (srv *server) rewriteURL(before *URL, originalURL string) (*URL, error) {
+	verdict, err := validateDestination(srv.ctx, originalURL)
+	if err != nil {
+		return nil, err
+	}
+	storedURL, err := urlcrypto.Encrypt(originalURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt URL: %v", err)
+	}
+
+	// Same as updateURL: a held destination takes the link down until reviewed
+	row, err := srv.queries.RewriteURLDestination(slowquery.Tag(srv.ctx, "", before.ShortCode), dbq.RewriteURLDestinationParams{
+		ShortCode:   before.ShortCode,
+		Owner:       before.Owner,
+		UpdatedAt:   sql.NullTime{Time: before.UpdatedAt, Valid: true},
+		OriginalUrl: storedURL,
+		FlagReason:  toNullString(verdict.FlagReason),
+		HoldReason:  toNullString(verdict.HoldReason),
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update URL: %v", err)
+	}
+	u, err := urlFromRow(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update URL: %v", err)
+	}
+	return u, nil
+}
+
+// rewriteBulkBatch rewrites the destinations of one batch of a rewrite job
+// and returns how many changed. A destination rejected by screening leaves
+// its link unchanged.
+func (srv *server) rewriteBulkBatch(t *bulkTask, codes []string) (int, error) {
+	urls, err := srv.ownedURLs(t.owner, codes)
+	if err != nil {
+		return 0, err
+	}
+
+	actor := auditActor{ID: t.owner}
+	changed := []string{}
+	for _, before := range urls {
+		originalURL, ok := rewriteHost(before.OriginalURL, *t.fromHost, *t.toHost)
+		if !ok {
+			continue
+		}
+		u, err := srv.rewriteURL(before, originalURL)
+		if err != nil {
+			if isValidationError(err) {
+				log.Printf("Bulk job %d skipped %s: %v", t.id, before.ShortCode, err)
+				continue
+			}
+			srv.invalidateURLCaches(changed)
+			return 0, err
+		}
+		if u == nil {
+			continue
+		}
+
+		changed = append(changed, u.ShortCode)
+		srv.recordAudit(actor, auditLinkUpdate, auditTargetLink, u.ShortCode, linkAuditState(before), linkAuditState(u))
+		srv.emitLinkEvent(eventLinkUpdated, u)
+	}
+
+	srv.invalidateURLCaches(changed)
+	return len(changed), nil
+}
+
+// previewRewrite lists the first changes a rewrite of codes would make
+func (srv *server) previewRewrite(owner string, codes []string, from, to string) ([]RewritePreview, error) {
+	urls, err := srv.ownedURLs(owner, codes[:min(maxRewritePreview, len(codes))])
+	if err != nil {
+		return nil, err
+	}
+
+	preview := []RewritePreview{}
+	for _, u := range urls {
+		if rewritten, ok := rewriteHost(u.OriginalURL, from, to); ok {
+			preview = append(preview, RewritePreview{ShortCode: u.ShortCode, From: u.OriginalURL, To: rewritten})
+		}
+	}
+	return preview, nil
+}
+
+// rewriteLinksHandler queues a destination host rewrite of the caller's
+// links, or previews it with dryRun
+func (srv *server) rewriteLinksHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body RewriteRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, okFrom := normalizeHost(body.From)
+	to, okTo := normalizeHost(body.To)
+	if !okFrom || !okTo {
+		response.Fail(c, http.StatusBadRequest, "from and to must be host names, e.g. old.example.com")
+		return
+	}
+	if from == to {
+		response.Fail(c, http.StatusBadRequest, "from and to must differ")
+		return
+	}
+	if body.Filter != nil && body.Filter.Domain != "" {
+		response.Fail(c, http.StatusBadRequest, "filter.domain can't be used with a rewrite, from selects the links")
+		return
+	}
+	if len(body.ShortCodes) > maxBulkLinks {
+		response.Fail(c, http.StatusBadRequest, fmt.Sprintf("shortCodes must contain at most %d codes", maxBulkLinks))
+		return
+	}
+	if err := checkDomainPolicy(to); err != nil {
+		response.Fail(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	codes, err := srv.matchRewriteLinks(owner, from, &body)
+	if err != nil {
+		switch {
+		case errors.Is(err, errShortCodeNotFound), errors.Is(err, errFolderNotFound):
+			failNotFound(c, err)
+		default:
+			log.Printf("Failed to match links for rewrite: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to rewrite links")
+		}
+		return
+	}
+	if len(codes) > maxBulkLinks {
+		response.Fail(c, http.StatusUnprocessableEntity, fmt.Sprintf("%d links point at %s, at most %d can be changed at once", len(codes), from, maxBulkLinks))
+		return
+	}
+
+	if body.DryRun {
+		preview, err := srv.previewRewrite(owner, codes, from, to)
+		if err != nil {
+			log.Printf("Failed to preview rewrite: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to rewrite links")
+			return
+		}
+		response.OK(c, http.StatusOK, gin.H{"matched": len(codes), "changes": preview})
+		return
+	}
+
+	srv.queueBulkJob(c, bulkTask{owner: owner, action: bulkActionRewrite, fromHost: &from, toHost: &to, codes: codes})
+}
+
+// matchRewriteLinks returns the caller's links pointing at from, narrowed
+// down by the request's short codes and filter
+func (srv *server) matchRewriteLinks(owner, from string, body *RewriteRequestBody) ([]string, error) {
+	filter := BulkDisableFilter{Owner: owner, Domain: from, IncludeDisabled: true}
+	if len(body.ShortCodes) > 0 {
+		codes, err := srv.ownedShortCodes(owner, body.ShortCodes)
+		if err != nil {
+			return nil, err
+		}
+		filter.ShortCodes = codes
+	}
+	if f := body.Filter; f != nil {
+		filter.CreatedAfter, filter.CreatedBefore = f.CreatedAfter, f.CreatedBefore
+		if f.FolderID != nil {
+			if err := checkFolderOwner(srv.db, owner, f.FolderID); err != nil {
+				return nil, err
+			}
+			filter.FolderIDs = []int64{*f.FolderID}
+		}
+	}
+	return srv.matchBulkDisable(filter)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/response"
+	"shared/slowquery"
+)
+
+// Owners can rotate a leaked short code: the link is copied to a new code with
+// the same destination, expiry, folder and settings, and the old code keeps serving
+// for an optional grace period. The old link records the new code in
+// rotated_to and when it retires in retire_at; the retirer then disables it,
+// so redirect-api answers 410 for it. Clicks stay with the old code.
+const rotatedReason = "rotated"
+
+var (
+	rotationMaxGrace       = env.Duration("ROTATION_MAX_GRACE", 30*24*time.Hour)
+	rotationRetireInterval = env.Duration("ROTATION_RETIRE_INTERVAL", time.Minute)
+)
+
+var errAlreadyRotated = errors.New("link was already rotated")
+var errRotateDisabled = errors.New("disabled links can't be rotated")
+
+const rotationTablesQuery = `
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS rotated_to VARCHAR(10);
+	ALTER TABLE urls ADD COLUMN IF NOT EXISTS retire_at TIMESTAMP WITH TIME ZONE;
+
+	CREATE INDEX IF NOT EXISTS idx_urls_retire_at ON urls(retire_at) WHERE retire_at IS NOT NULL AND disabled_at IS NULL;
+`
+
+type RotateRequestBody struct {
+	// GraceSeconds keeps the old code serving this long; 0 retires it at once
+	GraceSeconds int `json:"graceSeconds" binding:"min=0"`
+}
+
+// rotateURL moves one of owner's links to a new short code. The new link is
+// inserted and the old one retired in a single statement, so a code can't be
+// rotated twice.
+func (srv *server) rotateURL(actor auditActor, owner, shortCode string, grace time.Duration) (*URL, *URL, error) {
+	before, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, nil, err
+	}
+	if before.Owner != owner {
+		return nil, nil, errShortCodeNotFound
+	}
+	if before.RotatedTo != nil {
+		return nil, nil, errAlreadyRotated
+	}
+	if before.DisabledAt != nil {
+		return nil, nil, errRotateDisabled
+	}
+
+	id, err := srv.getNextID(srv.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	generator, err := srv.codeGeneratorFor(owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The destination's hash would give the old code back
+	if generator == codeGeneratorHash {
+		generator = codeGeneratorCounter
+	}
+	newCode, generator, err := srv.generateCode(generator, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The destination, targets and fallback are copied as stored, so they are
+	// neither decrypted nor screened again
+	row, err := srv.queries.RotateURL(slowquery.Tag(srv.ctx, "", shortCode), dbq.RotateURLParams{
+		ShortCode:     shortCode,
+		NewCode:       newCode,
+		GraceSeconds:  grace.Seconds(),
+		CodeGenerator: generator,
+		RotatedReason: rotatedReason,
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Rotated or disabled since it was read
+			return nil, nil, errAlreadyRotated
+		}
+		return nil, nil, fmt.Errorf("failed to rotate URL: %v", err)
+	}
+	u, err := urlFromRow(dbq.Url(row))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to rotate URL: %v", err)
+	}
+
+	old, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srv.syncLinkStore(u.ShortCode)
+	srv.invalidateURLCache(shortCode)
+	srv.recordAudit(actor, auditLinkRotate, auditTargetLink, shortCode, linkAuditState(before), linkAuditState(old))
+	srv.recordAudit(actor, auditLinkCreate, auditTargetLink, u.ShortCode, nil, linkAuditState(u))
+	srv.emitLinkEvent(eventLinkCreated, u)
+	if old.DisabledAt != nil {
+		srv.emitLinkEvent(eventLinkDisabled, old)
+	} else {
+		srv.emitLinkEvent(eventLinkUpdated, old)
+	}
+
+	return u, old, nil
+}
+
+// retireRotatedLinks disables the rotated links whose grace period is over
+func (srv *server) retireRotatedLinks() ([]*URL, error) {
+	rows, err := srv.queries.RetireRotatedURLs(srv.ctx, rotatedReason)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retire rotated links: %v", err)
+	}
+	retired, err := urlsFromRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retire rotated links: %v", err)
+	}
+
+	codes := make([]string, len(retired))
+	for i, u := range retired {
+		codes[i] = u.ShortCode
+		before := *u
+		before.DisabledAt, before.DisabledReason = nil, nil
+		srv.recordAudit(systemActor("rotation"), auditLinkDisable, auditTargetLink, u.ShortCode, linkAuditState(&before), linkAuditState(u))
+		srv.emitLinkEvent(eventLinkDisabled, u)
+	}
+	srv.invalidateURLCaches(codes)
+	return retired, nil
+}
+
+func (srv *server) startRotationRetirer() {
+	if os.Getenv("ROTATION_RETIRE_INTERVAL") == "0" {
+		return
+	}
+
+	srv.scheduleJob("rotation-retirer", rotationRetireInterval, func() error {
+		retired, err := srv.retireRotatedLinks()
+		if err != nil {
+			return err
+		}
+		if len(retired) > 0 {
+			log.Printf("Retired %d rotated links", len(retired))
+		}
+		return nil
+	})
+}
+
+// rotateLinkHandler issues a new short code for one of the caller's links
+func (srv *server) rotateLinkHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	// The body is optional; without one the old code retires at once
+	var body RotateRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	grace := time.Duration(body.GraceSeconds) * time.Second
+	if grace > rotationMaxGrace {
+		response.Fail(c, http.StatusBadRequest, fmt.Sprintf("graceSeconds must be at most %d", int(rotationMaxGrace.Seconds())))
+		return
+	}
+
+	u, old, err := srv.rotateURL(actorFromGin(c), owner, c.Param("shortCode"), grace)
+	if err != nil {
+		switch {
+		case errors.Is(err, errShortCodeNotFound):
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+		case errors.Is(err, errAlreadyRotated), errors.Is(err, errRotateDisabled):
+			response.Fail(c, http.StatusConflict, err.Error())
+		default:
+			log.Printf("Failed to rotate short code: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to rotate URL")
+		}
+		return
+	}
+
+	response.OK(c, http.StatusCreated, gin.H{"link": toLinkResponse(u), "previous": toLinkResponse(old)})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"shared/tracing"
+)
+
+var errUnsafeURL = errors.New("url is flagged as unsafe")
+
+const (
+	safeBrowsingEndpoint   = "https://safebrowsing.googleapis.com/v4/threatMatches:find"
+	safeBrowsingSafeTTL    = 30 * time.Minute
+	safeBrowsingUnsafeTTL  = 6 * time.Hour
+	safeBrowsingCacheLimit = 100000
+)
+
+var safeBrowsingAPIKey = os.Getenv("SAFE_BROWSING_API_KEY")
+
+// SAFE_BROWSING_MODE: "reject" (default) refuses unsafe URLs, "flag" stores them with a flag
+var safeBrowsingMode = os.Getenv("SAFE_BROWSING_MODE")
+
+var safeBrowsingClient = tracing.Client(&http.Client{Timeout: 3 * time.Second})
+
+type safeBrowsingVerdict struct {
+	threats   []string
+	expiresAt time.Time
+}
+
+// In-process verdict cache so repeated submissions of the same URL skip the API
+var safeBrowsingCache = struct {
+	sync.Mutex
+	entries map[string]safeBrowsingVerdict
+}{entries: map[string]safeBrowsingVerdict{}}
+
+type safeBrowsingRequest struct {
+	Client struct {
+		ClientID      string `json:"clientId"`
+		ClientVersion string `json:"clientVersion"`
+	} `json:"client"`
+	ThreatInfo struct {
+		ThreatTypes      []string `json:"threatTypes"`
+		PlatformTypes    []string `json:"platformTypes"`
+		ThreatEntryTypes []string `json:"threatEntryTypes"`
+		ThreatEntries    []struct {
+			URL string `json:"url"`
+		} `json:"threatEntries"`
+	} `json:"threatInfo"`
+}
+
+type safeBrowsingResponse struct {
+	Matches []struct {
+		ThreatType string `json:"threatType"`
+		Threat     struct {
+			URL string `json:"url"`
+		} `json:"threat"`
+	} `json:"matches"`
+}
+
+// Safe Browsing accepts at most this many threat entries per lookup
+const safeBrowsingBatchLimit = 500
+
+// lookupSafeBrowsing returns the threat types Google Safe Browsing reports for rawURL
+func lookupSafeBrowsing(ctx context.Context, rawURL string) ([]string, error) {
+	matches, err := lookupSafeBrowsingBatch(ctx, []string{rawURL})
+	if err != nil {
+		return nil, err
+	}
+
+	threats := matches[rawURL]
+	if threats == nil {
+		threats = []string{}
+	}
+	return threats, nil
+}
+
+// lookupSafeBrowsingBatch checks up to safeBrowsingBatchLimit URLs in one call,
+// returning the threat types of the URLs that matched
+func lookupSafeBrowsingBatch(ctx context.Context, rawURLs []string) (map[string][]string, error) {
+	var reqBody safeBrowsingRequest
+	reqBody.Client.ClientID = "scalable-url-shortener"
+	reqBody.Client.ClientVersion = "1.0.0"
+	reqBody.ThreatInfo.ThreatTypes = []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"}
+	reqBody.ThreatInfo.PlatformTypes = []string{"ANY_PLATFORM"}
+	reqBody.ThreatInfo.ThreatEntryTypes = []string{"URL"}
+	for _, rawURL := range rawURLs {
+		reqBody.ThreatInfo.ThreatEntries = append(reqBody.ThreatInfo.ThreatEntries, struct {
+			URL string `json:"url"`
+		}{URL: rawURL})
+	}
+
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, safeBrowsingEndpoint+"?key="+safeBrowsingAPIKey, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := safeBrowsingClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("safe browsing request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("safe browsing returned status %d", resp.StatusCode)
+	}
+
+	var result safeBrowsingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode safe browsing response: %v", err)
+	}
+
+	matches := map[string][]string{}
+	for _, match := range result.Matches {
+		matches[match.Threat.URL] = append(matches[match.Threat.URL], match.ThreatType)
+	}
+	return matches, nil
+}
+
+// screenURL checks rawURL against Safe Browsing. It returns the threat types
+// found (empty when safe). Lookup failures fail open so an API outage never
+// blocks link creation.
+func screenURL(ctx context.Context, rawURL string) []string {
+	if safeBrowsingAPIKey == "" {
+		return nil
+	}
+
+	now := time.Now()
+
+	safeBrowsingCache.Lock()
+	verdict, ok := safeBrowsingCache.entries[rawURL]
+	safeBrowsingCache.Unlock()
+	if ok && now.Before(verdict.expiresAt) {
+		return verdict.threats
+	}
+
+	threats, err := lookupSafeBrowsing(ctx, rawURL)
+	if err != nil {
+		log.Printf("Safe Browsing lookup failed, allowing URL: %v", err)
+		return nil
+	}
+
+	ttl := safeBrowsingSafeTTL
+	if len(threats) > 0 {
+		ttl = safeBrowsingUnsafeTTL
+	}
+
+	safeBrowsingCache.Lock()
+	if len(safeBrowsingCache.entries) >= safeBrowsingCacheLimit {
+		safeBrowsingCache.entries = map[string]safeBrowsingVerdict{}
+	}
+	safeBrowsingCache.entries[rawURL] = safeBrowsingVerdict{threats: threats, expiresAt: now.Add(ttl)}
+	safeBrowsingCache.Unlock()
+
+	return threats
+}
+
+// checkURLSafety applies SAFE_BROWSING_MODE to the verdict, returning the flag
+// reason to store with the link (nil when the URL is clean)
+func checkURLSafety(ctx context.Context, rawURL string) (*string, error) {
+	threats := screenURL(ctx, rawURL)
+	if len(threats) == 0 {
+		return nil, nil
+	}
+
+	reason := "safe_browsing:" + strings.Join(threats, ",")
+	if safeBrowsingMode == "flag" {
+		log.Printf("Flagged unsafe URL %s (%s)", rawURL, reason)
+		return &reason, nil
+	}
+
+	log.Printf("Rejected unsafe URL %s (%s)", rawURL, reason)
+	return nil, errUnsafeURL
+}
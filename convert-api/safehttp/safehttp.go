@@ -0,0 +1,122 @@
+// Package safehttp provides an HTTP client for fetching user-supplied URLs
+// (destination pages, webhooks) without exposing internal services.
+//
+// Every connection is checked after DNS resolution, on the exact IP being
+// dialed, so redirects and DNS rebinding cannot reach private, loopback,
+// link-local or cloud metadata addresses.
+package safehttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when a host resolves to a disallowed IP
+var ErrBlockedAddress = errors.New("destination resolves to a blocked address")
+
+const maxRedirects = 5
+
+// blockedPrefixes are special-purpose ranges not covered by the netip helpers
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // TEST-NET-1
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // TEST-NET-3
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, includes broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, can embed private IPv4
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+}
+
+// IsBlocked reports whether ip is private, loopback, link-local (which
+// includes the 169.254.169.254 metadata endpoint) or otherwise not public
+func IsBlocked(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateHost resolves host and fails if any of its addresses is blocked.
+// It is meant for rejecting bad input early; the client re-checks on every dial.
+func ValidateHost(ctx context.Context, host string) error {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if IsBlocked(ip) {
+			return ErrBlockedAddress
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if IsBlocked(addr) {
+			return ErrBlockedAddress
+		}
+	}
+	return nil
+}
+
+// checkDial runs after DNS resolution with the literal address being connected to
+func checkDial(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("unexpected dial address %q: %v", address, err)
+	}
+	if IsBlocked(addrPort.Addr()) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+// NewClient returns an http.Client that refuses to connect to blocked addresses.
+// Proxies are ignored since they would dial on the client's behalf.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   checkDial,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
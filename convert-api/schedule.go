@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/response"
+	"shared/urlcrypto"
+)
+
+// Owners can schedule a link to switch destination at a given time, e.g. to
+// the live stream when it starts. The scheduler applies due changes on any
+// instance, claiming them with SKIP LOCKED, as an edit by system:scheduler:
+// the destination is screened again and the redirect cache dropped. A change
+// is dropped when the link was deleted or handed to another owner meanwhile.
+const (
+	scheduleStatusPending   = "pending"
+	scheduleStatusApplied   = "applied"
+	scheduleStatusFailed    = "failed"
+	scheduleStatusCancelled = "cancelled"
+
+	// maxPendingSchedules caps the pending changes of one link
+	maxPendingSchedules = 50
+)
+
+var scheduleInterval = env.Duration("SCHEDULE_INTERVAL", 10*time.Second)
+
+var errScheduleNotPending = errors.New("the change is no longer pending")
+
+const scheduleTablesQuery = `
+	CREATE TABLE IF NOT EXISTS scheduled_changes (
+		id SERIAL PRIMARY KEY,
+		short_code VARCHAR(10) NOT NULL,
+		owner TEXT NOT NULL,
+		original_url TEXT NOT NULL,
+		run_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		error TEXT,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		applied_at TIMESTAMP WITH TIME ZONE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_scheduled_changes_due ON scheduled_changes(run_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS idx_scheduled_changes_short_code ON scheduled_changes(short_code, run_at);
+`
+
+// ScheduledChange is a destination switch planned for one link
+type ScheduledChange struct {
+	ID          int        `json:"id"`
+	ShortCode   string     `json:"shortCode"`
+	OriginalURL string     `json:"originalUrl"`
+	RunAt       time.Time  `json:"runAt"`
+	Status      string     `json:"status"`
+	Error       *string    `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	AppliedAt   *time.Time `json:"appliedAt,omitempty"`
+}
+
+type ScheduleRequestBody struct {
+	OriginalURL string    `json:"originalUrl" binding:"required"`
+	RunAt       time.Time `json:"runAt" binding:"required"`
+}
+
+const scheduledChangeColumns = "id, short_code, original_url, run_at, status, error, created_at, applied_at"
+
+func scanScheduledChange(row rowScanner) (*ScheduledChange, error) {
+	var s ScheduledChange
+	err := row.Scan(&s.ID, &s.ShortCode, &s.OriginalURL, &s.RunAt, &s.Status, &s.Error, &s.CreatedAt, &s.AppliedAt)
+	if err != nil {
+		return nil, err
+	}
+	if s.OriginalURL, err = urlcrypto.Decrypt(s.OriginalURL); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// applyScheduledChange applies one due change in tx, which holds its row lock
+func (srv *server) applyScheduledChange(tx *sql.Tx, id int, shortCode, owner, storedURL string) error {
+	status, failure := scheduleStatusApplied, ""
+
+	u, err := srv.getURLByShortCode(shortCode)
+	switch {
+	case errors.Is(err, errShortCodeNotFound):
+		status, failure = scheduleStatusFailed, "the link no longer exists"
+	case err != nil:
+		return err
+	case u.Owner != owner:
+		status, failure = scheduleStatusFailed, "the link changed owner"
+	default:
+		originalURL, err := urlcrypto.Decrypt(storedURL)
+		if err != nil {
+			return err
+		}
+		if _, err := srv.setURLDestination(systemActor("scheduler"), auditLinkUpdate, owner, shortCode, originalURL); err != nil {
+			if !isValidationError(err) {
+				return err
+			}
+			status, failure = scheduleStatusFailed, err.Error()
+		}
+	}
+
+	var errorValue *string
+	if failure != "" {
+		errorValue = &failure
+		log.Printf("Scheduled change %d of %s failed: %s", id, shortCode, failure)
+	}
+	_, err = tx.Exec(`
+		UPDATE scheduled_changes SET status = $2, error = $3, applied_at = CURRENT_TIMESTAMP WHERE id = $1
+	`, id, status, errorValue)
+	return err
+}
+
+// runScheduledChanges applies the changes that are due, oldest first, and
+// returns how many it handled
+func (srv *server) runScheduledChanges() (int, error) {
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, short_code, owner, original_url FROM scheduled_changes
+		WHERE status = 'pending' AND run_at <= CURRENT_TIMESTAMP
+		ORDER BY run_at, id
+		LIMIT 100
+		FOR UPDATE SKIP LOCKED
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim scheduled changes: %v", err)
+	}
+	type due struct {
+		id                    int
+		shortCode, owner, url string
+	}
+	changes := []due{}
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.shortCode, &d.owner, &d.url); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to claim scheduled changes: %v", err)
+		}
+		changes = append(changes, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to claim scheduled changes: %v", err)
+	}
+
+	for _, d := range changes {
+		if err := srv.applyScheduledChange(tx, d.id, d.shortCode, d.owner, d.url); err != nil {
+			return 0, fmt.Errorf("failed to apply scheduled change %d: %v", d.id, err)
+		}
+	}
+	return len(changes), tx.Commit()
+}
+
+func (srv *server) startScheduler() {
+	if os.Getenv("SCHEDULE_INTERVAL") == "0" {
+		return
+	}
+
+	srv.scheduleJob("scheduled-changes", scheduleInterval, func() error {
+		applied, err := srv.runScheduledChanges()
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			log.Printf("Applied %d scheduled destination changes", applied)
+		}
+		return nil
+	})
+}
+
+// scheduleChangeHandler plans a destination switch for one of the caller's links
+func (srv *server) scheduleChangeHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	u, ok := srv.ownedLinkParam(c, owner, "link")
+	if !ok {
+		return
+	}
+
+	var body ScheduleRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !body.RunAt.After(clock()) {
+		response.Fail(c, http.StatusBadRequest, "runAt must be in the future")
+		return
+	}
+	if err := validateDestinationInput(body.OriginalURL); err != nil {
+		fields, _ := fieldErrors(err)
+		failValidation(c, fields)
+		return
+	}
+	// Screened now to fail early, and again when applied
+	if _, err := validateDestination(c.Request.Context(), body.OriginalURL); err != nil {
+		if isValidationError(err) {
+			response.Fail(c, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		log.Printf("Failed to screen scheduled destination: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to schedule change")
+		return
+	}
+	storedURL, err := urlcrypto.Encrypt(body.OriginalURL)
+	if err != nil {
+		log.Printf("Failed to encrypt scheduled destination: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to schedule change")
+		return
+	}
+
+	query := `
+		INSERT INTO scheduled_changes (short_code, owner, original_url, run_at)
+		SELECT $1, $2, $3, $4
+		WHERE (SELECT count(*) FROM scheduled_changes WHERE short_code = $1 AND status = 'pending') < $5
+		RETURNING ` + scheduledChangeColumns
+	change, err := scanScheduledChange(srv.db.QueryRow(query, u.ShortCode, owner, storedURL, body.RunAt, maxPendingSchedules))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			response.Fail(c, http.StatusConflict, fmt.Sprintf("a link can have at most %d pending changes", maxPendingSchedules))
+			return
+		}
+		log.Printf("Failed to schedule change: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to schedule change")
+		return
+	}
+
+	response.OK(c, http.StatusCreated, change)
+}
+
+// listScheduledChangesHandler lists the changes planned for one of the caller's links, soonest first
+func (srv *server) listScheduledChangesHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	u, ok := srv.ownedLinkParam(c, owner, "scheduled changes")
+	if !ok {
+		return
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT `+scheduledChangeColumns+` FROM scheduled_changes
+		WHERE short_code = $1 AND owner = $2
+		ORDER BY run_at, id
+	`, u.ShortCode, owner)
+	if err != nil {
+		log.Printf("Failed to list scheduled changes: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list scheduled changes")
+		return
+	}
+	defer rows.Close()
+
+	changes := []ScheduledChange{}
+	for rows.Next() {
+		change, err := scanScheduledChange(rows)
+		if err != nil {
+			log.Printf("Failed to list scheduled changes: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list scheduled changes")
+			return
+		}
+		changes = append(changes, *change)
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"changes": changes})
+}
+
+// cancelScheduledChangeHandler cancels one of the caller's pending changes
+func (srv *server) cancelScheduledChangeHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid scheduled change id")
+		return
+	}
+
+	// Changes being applied are locked, so they can't be cancelled halfway
+	var status string
+	err = srv.db.QueryRow(`
+		WITH target AS (
+			SELECT id, status FROM scheduled_changes
+			WHERE id = $1 AND short_code = $2 AND owner = $3
+			FOR UPDATE
+		),
+		cancelled AS (
+			UPDATE scheduled_changes SET status = $4
+			WHERE id = (SELECT id FROM target WHERE status = 'pending')
+		)
+		SELECT status FROM target
+	`, id, c.Param("shortCode"), owner, scheduleStatusCancelled).Scan(&status)
+	if err == sql.ErrNoRows {
+		failCode(c, http.StatusNotFound, codeScheduledChangeNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to cancel scheduled change: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to cancel scheduled change")
+		return
+	}
+	if status != scheduleStatusPending {
+		response.Fail(c, http.StatusConflict, errScheduleNotPending.Error())
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
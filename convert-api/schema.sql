@@ -12,9 +12,520 @@ CREATE TABLE IF NOT EXISTS urls (
 -- Create index on short_code for fast lookups
 CREATE INDEX IF NOT EXISTS idx_urls_short_code ON urls(short_code);
 
+-- With CASE_INSENSITIVE_CODES=true convert-api also creates:
+-- CREATE UNIQUE INDEX IF NOT EXISTS idx_urls_short_code_lower ON urls(lower(short_code));
+-- CREATE INDEX IF NOT EXISTS idx_urls_archive_short_code_lower ON urls_archive(lower(short_code));
+
 -- Create index on created_at for analytics/reporting
 CREATE INDEX IF NOT EXISTS idx_urls_created_at ON urls(created_at);
 
+-- Composite index backing keyset pagination (created_at, id)
+CREATE INDEX IF NOT EXISTS idx_urls_created_at_id ON urls(created_at, id);
+
+-- Owner of the link (Kong consumer that created it)
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_urls_owner ON urls(owner);
+
+-- Why a link was flagged (e.g. by Safe Browsing screening), NULL when clean
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS flag_reason TEXT;
+
+-- Takedowns: disabled links answer 410 Gone in redirect-api
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS disabled_reason TEXT;
+
+-- Last time the background rescanner checked the destination against threat feeds
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS last_scanned_at TIMESTAMP WITH TIME ZONE;
+
+-- Links stop redirecting at expires_at and are then removed by the reaper
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS idx_urls_expires_at ON urls(expires_at) WHERE expires_at IS NOT NULL;
+
+-- Shortener an imported link came from (e.g. bitly); NULL for links created here
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS source TEXT;
+
+-- Generator that produced the short code (counter, or a canary such as permuted); NULL for older and imported links
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS code_generator TEXT;
+
+-- The expiry an owner was last reminded about; a changed expiry is reminded about again
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS expiry_reminder_sent_for TIMESTAMP WITH TIME ZONE;
+
+-- Whether redirect-api serves the link's click stats publicly at /<short_code>+
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS public_stats BOOLEAN NOT NULL DEFAULT false;
+
+-- Rotated links: the code that replaced them and when they stop serving
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS rotated_to VARCHAR(10);
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS retire_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS idx_urls_retire_at ON urls(retire_at) WHERE retire_at IS NOT NULL AND disabled_at IS NULL;
+
+-- Webhooks notified on link lifecycle events
+CREATE TABLE IF NOT EXISTS webhooks (
+    id SERIAL PRIMARY KEY,
+    owner TEXT NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT[] NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_owner ON webhooks(owner);
+
+-- Delivery log, one row per attempt
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    attempt INTEGER NOT NULL,
+    status_code INTEGER,
+    error TEXT,
+    duration_ms INTEGER NOT NULL,
+    delivered_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, delivered_at DESC, id DESC);
+
+-- Destination domain block/allow rules ("example.com" or "*.example.com")
+CREATE TABLE IF NOT EXISTS domain_rules (
+    id SERIAL PRIMARY KEY,
+    pattern TEXT NOT NULL,
+    list TEXT NOT NULL CHECK (list IN ('block', 'allow')),
+    note TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (pattern, list)
+);
+
+-- Public abuse reports and their review state
+CREATE TABLE IF NOT EXISTS abuse_reports (
+    id SERIAL PRIMARY KEY,
+    short_code VARCHAR(10) NOT NULL,
+    reason TEXT NOT NULL,
+    details TEXT NOT NULL DEFAULT '',
+    reporter_email TEXT,
+    reporter_ip TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'open',
+    reviewed_by TEXT,
+    reviewed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_abuse_reports_status ON abuse_reports(status, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_abuse_reports_short_code ON abuse_reports(short_code);
+
+-- Append-only audit log of every mutating action
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    before JSONB,
+    after JSONB,
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target_type, target_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_actor ON audit_log(actor);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    -- GDPR erasure may anonymize rows inside its own transaction; rows are never deleted
+    IF TG_OP = 'UPDATE' AND current_setting('audit_log.erasure', true) = 'on' THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+-- GDPR erasure jobs; subject and email are cleared when a job completes
+CREATE TABLE IF NOT EXISTS erasure_jobs (
+    id SERIAL PRIMARY KEY,
+    subject TEXT,
+    email TEXT,
+    status TEXT NOT NULL DEFAULT 'queued',
+    requested_by TEXT NOT NULL DEFAULT '',
+    report JSONB,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_erasure_jobs_status ON erasure_jobs(status, id);
+
+-- High-water marks of the Redis ID counter, restored after a Redis wipe
+CREATE TABLE IF NOT EXISTS counter_checkpoints (
+    name TEXT PRIMARY KEY,
+    value BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Click counts persisted in batches by redirect-api; kept out of urls so they
+-- don't bump updated_at
+CREATE TABLE IF NOT EXISTS link_clicks (
+    short_code VARCHAR(10) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+    clicks BIGINT NOT NULL DEFAULT 0,
+    last_clicked_at TIMESTAMP WITH TIME ZONE
+);
+
+-- The same clicks per UTC day they were persisted on, for summary reports
+CREATE TABLE IF NOT EXISTS link_clicks_daily (
+    short_code VARCHAR(10) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    clicks BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (short_code, day)
+);
+
+-- Click batches already added to the tables above, so a retried one isn't
+-- counted twice. Rows older than a day are dropped by the next batch.
+CREATE TABLE IF NOT EXISTS click_batches (
+    batch_id TEXT PRIMARY KEY,
+    applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_click_batches_applied_at ON click_batches(applied_at);
+
+-- Expired links moved out of urls by the reaper (EXPIRED_LINK_ACTION=archive)
+CREATE TABLE IF NOT EXISTS urls_archive (
+    id INTEGER PRIMARY KEY,
+    original_url TEXT NOT NULL,
+    short_code VARCHAR(10) NOT NULL,
+    owner TEXT NOT NULL DEFAULT '',
+    flag_reason TEXT,
+    disabled_at TIMESTAMP WITH TIME ZONE,
+    disabled_reason TEXT,
+    clicks BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    archived_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    source TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_urls_archive_short_code ON urls_archive(short_code);
+
+-- One row per reaper run that removed links or failed
+CREATE TABLE IF NOT EXISTS reaper_runs (
+    id SERIAL PRIMARY KEY,
+    action TEXT NOT NULL,
+    reaped INTEGER NOT NULL,
+    cache_keys_removed INTEGER NOT NULL,
+    error TEXT,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    duration_ms INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_reaper_runs_started_at ON reaper_runs(started_at, id);
+
+-- Link-in-bio pages, served by redirect-api at /<slug>
+CREATE TABLE IF NOT EXISTS pages (
+    id SERIAL PRIMARY KEY,
+    slug VARCHAR(40) NOT NULL UNIQUE,
+    owner TEXT NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_pages_owner ON pages(owner);
+
+-- A page's buttons in display order, with their click counts
+CREATE TABLE IF NOT EXISTS page_links (
+    page_id INTEGER NOT NULL REFERENCES pages(id) ON DELETE CASCADE,
+    short_code VARCHAR(10) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    label TEXT NOT NULL,
+    clicks BIGINT NOT NULL DEFAULT 0,
+    last_clicked_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (page_id, short_code)
+);
+
+CREATE INDEX IF NOT EXISTS idx_page_links_short_code ON page_links(short_code);
+
+-- Branded domains: pending until the DNS TXT challenge is found, verified, then
+-- active once a certificate is issued. private_key is encrypted like destinations.
+CREATE TABLE IF NOT EXISTS custom_domains (
+    id SERIAL PRIMARY KEY,
+    domain TEXT NOT NULL UNIQUE,
+    owner TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    verification_token TEXT NOT NULL,
+    verified_at TIMESTAMP WITH TIME ZONE,
+    certificate_pem TEXT,
+    private_key TEXT,
+    certificate_expires_at TIMESTAMP WITH TIME ZONE,
+    kong_certificate_id UUID,
+    provision_started_at TIMESTAMP WITH TIME ZONE,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_custom_domains_owner ON custom_domains(owner);
+
+-- ACME account key per CA directory, shared by all instances
+CREATE TABLE IF NOT EXISTS acme_accounts (
+    directory_url TEXT PRIMARY KEY,
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Where each owner's notification emails go
+CREATE TABLE IF NOT EXISTS notification_settings (
+    owner TEXT PRIMARY KEY,
+    email TEXT NOT NULL,
+    -- NULL uses EXPIRY_REMINDER_DAYS, 0 turns expiry reminders off
+    expiry_reminder_days INTEGER,
+    -- daily or weekly summary emails, NULL for none; summary_sent_through is the last day reported on
+    summary_report TEXT,
+    summary_sent_through DATE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Email queue: messages are rendered from template and data when sent, and
+-- retried with backoff until they are sent or fail for good
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    owner TEXT NOT NULL,
+    recipient TEXT NOT NULL,
+    template TEXT NOT NULL,
+    data JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'queued',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    sent_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_outbox_queued ON email_outbox(next_attempt_at) WHERE status = 'queued';
+CREATE INDEX IF NOT EXISTS idx_email_outbox_status ON email_outbox(status, created_at DESC, id DESC);
+
+-- Features admins enabled per consumer; consumers without a row get the defaults
+CREATE TABLE IF NOT EXISTS tenant_settings (
+    owner TEXT PRIMARY KEY,
+    -- base62, or emoji for codes spelled in emoji
+    code_alphabet TEXT NOT NULL DEFAULT 'base62' CHECK (code_alphabet IN ('base62', 'emoji')),
+    updated_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Branded pages redirect-api serves browsers for an owner's missing, expired or disabled links
+CREATE TABLE IF NOT EXISTS error_pages (
+    owner TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('not_found', 'expired', 'disabled')),
+    -- html/template source
+    html TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (owner, kind)
+);
+
+-- Translations of error_pages, served to visitors whose Accept-Language matches
+CREATE TABLE IF NOT EXISTS error_page_translations (
+    owner TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('not_found', 'expired', 'disabled')),
+    -- BCP 47 tag, e.g. de or pt-BR
+    language TEXT NOT NULL,
+    html TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (owner, kind, language)
+);
+
+-- Offers to hand links over to another owner; links move once the recipient accepts
+CREATE TABLE IF NOT EXISTS link_transfers (
+    id SERIAL PRIMARY KEY,
+    from_owner TEXT NOT NULL,
+    to_owner TEXT NOT NULL,
+    short_codes TEXT[] NOT NULL,
+    -- Destination domain pattern of a campaign transfer
+    domain TEXT,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined', 'cancelled')),
+    -- Links moved on acceptance
+    transferred INTEGER,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    resolved_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_link_transfers_from_owner ON link_transfers(from_owner, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_link_transfers_to_owner ON link_transfers(to_owner, created_at, id);
+
+-- Links each user marked as favorite
+CREATE TABLE IF NOT EXISTS link_favorites (
+    owner TEXT NOT NULL,
+    short_code VARCHAR(10) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (owner, short_code)
+);
+
+-- Nested folders organizing an owner's links
+CREATE TABLE IF NOT EXISTS folders (
+    id SERIAL PRIMARY KEY,
+    owner TEXT NOT NULL,
+    name TEXT NOT NULL,
+    parent_id INTEGER REFERENCES folders(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_owner_parent_name ON folders(owner, COALESCE(parent_id, 0), lower(name));
+CREATE INDEX IF NOT EXISTS idx_folders_parent_id ON folders(parent_id);
+
+-- The folder a link is filed in
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS folder_id INTEGER REFERENCES folders(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_urls_folder_id ON urls(folder_id) WHERE folder_id IS NOT NULL;
+
+-- Background bulk delete, disable and destination rewrite jobs; short_codes is fixed when queued
+CREATE TABLE IF NOT EXISTS bulk_jobs (
+    id SERIAL PRIMARY KEY,
+    owner TEXT NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('delete', 'disable', 'rewrite')),
+    reason TEXT,
+    from_host TEXT,
+    to_host TEXT,
+    short_codes TEXT[] NOT NULL,
+    status TEXT NOT NULL DEFAULT 'queued',
+    processed INTEGER NOT NULL DEFAULT 0,
+    affected INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_status ON bulk_jobs(status, id);
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_owner ON bulk_jobs(owner, id);
+
+-- Deleted links, restorable until purge_at
+CREATE TABLE IF NOT EXISTS urls_trash (
+    id INTEGER PRIMARY KEY,
+    original_url TEXT NOT NULL,
+    short_code VARCHAR(10) NOT NULL UNIQUE,
+    owner TEXT NOT NULL DEFAULT '',
+    flag_reason TEXT,
+    disabled_at TIMESTAMP WITH TIME ZONE,
+    disabled_reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    source TEXT,
+    code_generator TEXT,
+    public_stats BOOLEAN NOT NULL DEFAULT false,
+    rotated_to VARCHAR(10),
+    retire_at TIMESTAMP WITH TIME ZONE,
+    folder_id INTEGER,
+    clicks BIGINT,
+    last_clicked_at TIMESTAMP WITH TIME ZONE,
+    targets JSONB,
+    fallback_url TEXT,
+    deleted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    purge_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_urls_trash_owner ON urls_trash(owner, deleted_at, id);
+CREATE INDEX IF NOT EXISTS idx_urls_trash_purge_at ON urls_trash(purge_at);
+
+-- Changes to each link, readable by its owner
+CREATE TABLE IF NOT EXISTS link_history (
+    id BIGSERIAL PRIMARY KEY,
+    short_code VARCHAR(10) NOT NULL,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    changes JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_link_history_short_code ON link_history(short_code, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_link_history_actor ON link_history(actor);
+
+-- Every destination of each link, for rollback
+CREATE TABLE IF NOT EXISTS link_destinations (
+    short_code VARCHAR(10) NOT NULL,
+    version INTEGER NOT NULL,
+    original_url TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (short_code, version)
+);
+
+-- Destination changes planned for a later time
+CREATE TABLE IF NOT EXISTS scheduled_changes (
+    id SERIAL PRIMARY KEY,
+    short_code VARCHAR(10) NOT NULL,
+    owner TEXT NOT NULL,
+    original_url TEXT NOT NULL,
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    applied_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_changes_due ON scheduled_changes(run_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_scheduled_changes_short_code ON scheduled_changes(short_code, run_at);
+
+-- Weighted targets that share the redirects of a link
+CREATE TABLE IF NOT EXISTS link_targets (
+    short_code VARCHAR(10) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    original_url TEXT NOT NULL,
+    weight INTEGER NOT NULL CHECK (weight > 0),
+    PRIMARY KEY (short_code, position)
+);
+
+-- Served instead of the destination while the health checker has it down
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS fallback_url TEXT;
+
+-- Latest health check of each link's destination; links without a row count as healthy
+CREATE TABLE IF NOT EXISTS destination_health (
+    short_code VARCHAR(10) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+    healthy BOOLEAN NOT NULL,
+    status TEXT NOT NULL,
+    checked_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    unhealthy_since TIMESTAMP WITH TIME ZONE
+);
+
+-- Filled in by the destination health checker
+ALTER TABLE destination_health ADD COLUMN IF NOT EXISTS http_status INTEGER;
+ALTER TABLE destination_health ADD COLUMN IF NOT EXISTS failures INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_destination_health_checked_at ON destination_health(checked_at);
+
+-- Certificate of https destinations, from the same checks
+ALTER TABLE destination_health ADD COLUMN IF NOT EXISTS cert_expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE destination_health ADD COLUMN IF NOT EXISTS cert_error TEXT;
+
+-- Latest screenshot of each link's destination, stored in object storage
+CREATE TABLE IF NOT EXISTS link_screenshots (
+    short_code VARCHAR(10) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+    original_url TEXT NOT NULL,
+    image_url TEXT,
+    captured_at TIMESTAMP WITH TIME ZONE,
+    attempted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    error TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_link_screenshots_attempted_at ON link_screenshots(attempted_at);
+
+-- Daily table sizes for the admin dashboard's storage growth, the last of each day
+CREATE TABLE IF NOT EXISTS storage_snapshots (
+    day DATE NOT NULL,
+    table_name TEXT NOT NULL,
+    live_rows BIGINT NOT NULL,
+    total_bytes BIGINT NOT NULL,
+    PRIMARY KEY (day, table_name)
+);
+
 -- Function to automatically update updated_at timestamp
 CREATE OR REPLACE FUNCTION update_updated_at_column()
 RETURNS TRIGGER AS $$
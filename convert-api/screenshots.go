@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/response"
+	"shared/tracing"
+	"shared/urlcrypto"
+)
+
+// The screenshotter captures the destination of every active, unflagged link
+// through an external screenshot API (SCREENSHOT_API_URL, with {url} replaced
+// by the escaped destination) and uploads the image to an S3-compatible bucket
+// (SCREENSHOT_STORAGE_URL, path-style, signed with the default AWS
+// credentials). Each link has one object, overwritten when its destination
+// changes or the screenshot is older than SCREENSHOT_MAX_AGE; objects of
+// deleted links are left in the bucket. redirect-api shows the screenshot on
+// the link's preview page, but only while it matches the current destination.
+// Batches are claimed with SKIP LOCKED, like health checks.
+var (
+	screenshotAPIURL        = os.Getenv("SCREENSHOT_API_URL")
+	screenshotStorageURL    = strings.TrimSuffix(os.Getenv("SCREENSHOT_STORAGE_URL"), "/")
+	screenshotPublicURL     = strings.TrimSuffix(env.Get("SCREENSHOT_PUBLIC_URL", screenshotStorageURL), "/")
+	screenshotInterval      = env.Duration("SCREENSHOT_INTERVAL", time.Minute)
+	screenshotBatchSize     = env.Int("SCREENSHOT_BATCH_SIZE", 10)
+	screenshotMaxAge        = env.Duration("SCREENSHOT_MAX_AGE", 7*24*time.Hour)
+	screenshotRetryInterval = env.Duration("SCREENSHOT_RETRY_INTERVAL", time.Hour)
+	screenshotTimeout       = env.Duration("SCREENSHOT_TIMEOUT", time.Minute)
+)
+
+const maxScreenshotBytes = 5 << 20
+
+// screenshotAPIClient calls the screenshot API; SCREENSHOT_TIMEOUT bounds each request
+var screenshotAPIClient = tracing.Client(&http.Client{})
+
+// screenshotExtensions are the image types accepted from the screenshot API
+var screenshotExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+}
+
+const screenshotTablesQuery = `
+	CREATE TABLE IF NOT EXISTS link_screenshots (
+		short_code VARCHAR(10) PRIMARY KEY REFERENCES urls(short_code) ON DELETE CASCADE,
+		original_url TEXT NOT NULL,
+		image_url TEXT,
+		captured_at TIMESTAMP WITH TIME ZONE,
+		attempted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		error TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_link_screenshots_attempted_at ON link_screenshots(attempted_at);
+`
+
+var errNoScreenshot = errors.New("no screenshot")
+
+// LinkScreenshot is the latest screenshot of a link's destination
+type LinkScreenshot struct {
+	ImageURL   string    `json:"imageUrl"`
+	CapturedAt time.Time `json:"capturedAt"`
+}
+
+// screenshotStore uploads screenshots to the bucket, nil when capture is off
+var screenshotStore *s3Store
+
+// initScreenshots checks the screenshot configuration; without an API and a
+// bucket the screenshotter stays off
+func initScreenshots() error {
+	if screenshotAPIURL == "" && screenshotStorageURL == "" {
+		return nil
+	}
+	if !strings.Contains(screenshotAPIURL, "{url}") {
+		return errors.New("SCREENSHOT_API_URL must contain {url}")
+	}
+	if _, err := url.ParseRequestURI(screenshotStorageURL); err != nil {
+		return fmt.Errorf("SCREENSHOT_STORAGE_URL must be a URL: %v", err)
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	if cfg.Region == "" {
+		return errors.New("AWS_REGION is required for screenshot storage")
+	}
+	screenshotStore = &s3Store{
+		baseURL: screenshotStorageURL,
+		creds:   cfg.Credentials,
+		region:  cfg.Region,
+		signer:  v4.NewSigner(),
+		client:  tracing.Client(&http.Client{Timeout: 30 * time.Second}),
+	}
+	return nil
+}
+
+// s3Store puts objects into an S3-compatible bucket with SigV4-signed requests
+type s3Store struct {
+	baseURL string
+	creds   aws.CredentialsProvider
+	region  string
+	signer  *v4.Signer
+	client  *http.Client
+}
+
+func (s *s3Store) Put(ctx context.Context, key, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.baseURL+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	creds, err := s.creds.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get AWS credentials: %v", err)
+	}
+	if err := s.signer.SignHTTP(ctx, creds, req, payloadHash, "s3", s.region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign upload: %v", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("storage returned %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// linkScreenshot returns the screenshot of a link's current destination
+func (srv *server) linkScreenshot(shortCode string) (*LinkScreenshot, error) {
+	var s LinkScreenshot
+	err := srv.db.QueryRow(`
+		SELECT s.image_url, s.captured_at
+		FROM link_screenshots s
+		JOIN urls u ON u.short_code = s.short_code AND u.original_url = s.original_url
+		WHERE s.short_code = $1 AND s.image_url IS NOT NULL
+	`, shortCode).Scan(&s.ImageURL, &s.CapturedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errNoScreenshot
+		}
+		return nil, fmt.Errorf("failed to get screenshot: %v", err)
+	}
+	return &s, nil
+}
+
+// claimScreenshotBatch stamps the links whose destination has no current
+// screenshot and returns them with their destination as stored. Links are
+// retried every SCREENSHOT_RETRY_INTERVAL, or at once when the destination
+// changes.
+func (srv *server) claimScreenshotBatch(limit int) ([]scanTarget, error) {
+	rows, err := srv.db.Query(`
+		WITH due AS (
+			SELECT u.short_code, u.original_url FROM urls u
+			LEFT JOIN link_screenshots s ON s.short_code = u.short_code
+			WHERE u.disabled_at IS NULL AND u.flag_reason IS NULL
+				AND (u.expires_at IS NULL OR u.expires_at > CURRENT_TIMESTAMP)
+				AND (s.short_code IS NULL OR s.original_url <> u.original_url
+					OR ((s.captured_at IS NULL OR s.captured_at < $1) AND s.attempted_at < $2))
+			ORDER BY s.attempted_at NULLS FIRST, u.id
+			LIMIT $3
+			FOR UPDATE OF u SKIP LOCKED
+		),
+		claimed AS (
+			INSERT INTO link_screenshots (short_code, original_url)
+			SELECT short_code, original_url FROM due
+			ON CONFLICT (short_code) DO UPDATE SET attempted_at = CURRENT_TIMESTAMP
+		)
+		SELECT short_code, original_url FROM due
+	`, time.Now().Add(-screenshotMaxAge), time.Now().Add(-screenshotRetryInterval), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := []scanTarget{}
+	for rows.Next() {
+		var t scanTarget
+		if err := rows.Scan(&t.ShortCode, &t.OriginalURL); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// captureScreenshot asks the screenshot API for an image of a destination
+func (srv *server) captureScreenshot(destination string) ([]byte, string, error) {
+	parsed, err := url.Parse(destination)
+	if err != nil {
+		return nil, "", err
+	}
+	// Self-hosted browsers run inside our network, so private hosts are refused here
+	if err := srv.validateOutboundHost(parsed.Hostname()); err != nil {
+		return nil, "", err
+	}
+
+	reqCtx, cancel := context.WithTimeout(srv.ctx, screenshotTimeout)
+	defer cancel()
+	apiURL := strings.ReplaceAll(screenshotAPIURL, "{url}", url.QueryEscape(destination))
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := screenshotAPIClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("screenshot API returned %d", resp.StatusCode)
+	}
+
+	contentType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	contentType = strings.TrimSpace(contentType)
+	if _, ok := screenshotExtensions[contentType]; !ok {
+		return nil, "", fmt.Errorf("screenshot API returned %q, expected an image", contentType)
+	}
+	image, err := io.ReadAll(io.LimitReader(resp.Body, maxScreenshotBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(image) > maxScreenshotBytes {
+		return nil, "", fmt.Errorf("screenshot is larger than %d bytes", maxScreenshotBytes)
+	}
+	return image, contentType, nil
+}
+
+// screenshotLink captures and uploads the destination of one claimed link,
+// given as stored, and records the outcome
+func (srv *server) screenshotLink(t scanTarget) error {
+	destination, err := urlcrypto.Decrypt(t.OriginalURL)
+	if err != nil {
+		return srv.recordScreenshotError(t, err)
+	}
+	image, contentType, err := srv.captureScreenshot(destination)
+	if err != nil {
+		return srv.recordScreenshotError(t, err)
+	}
+
+	key := url.PathEscape(t.ShortCode) + screenshotExtensions[contentType]
+	if err := screenshotStore.Put(srv.ctx, key, contentType, image); err != nil {
+		return fmt.Errorf("failed to upload screenshot of %s: %v", t.ShortCode, err)
+	}
+
+	// The version parameter keeps CDNs from serving the object it replaced
+	imageURL := fmt.Sprintf("%s/%s?v=%d", screenshotPublicURL, key, time.Now().Unix())
+	_, err = srv.db.Exec(`
+		UPDATE link_screenshots
+		SET original_url = $2, image_url = $3, captured_at = CURRENT_TIMESTAMP, error = NULL
+		WHERE short_code = $1
+	`, t.ShortCode, t.OriginalURL, imageURL)
+	if err != nil {
+		return fmt.Errorf("failed to record screenshot: %v", err)
+	}
+	return nil
+}
+
+// recordScreenshotError keeps the previous screenshot if it is of the same destination
+func (srv *server) recordScreenshotError(t scanTarget, captureErr error) error {
+	log.Printf("Failed to capture screenshot of %s: %v", t.ShortCode, captureErr)
+	_, err := srv.db.Exec(`
+		UPDATE link_screenshots
+		SET image_url = CASE WHEN original_url = $2 THEN image_url END,
+			captured_at = CASE WHEN original_url = $2 THEN captured_at END,
+			original_url = $2, error = $3
+		WHERE short_code = $1
+	`, t.ShortCode, t.OriginalURL, captureErr.Error())
+	if err != nil {
+		return fmt.Errorf("failed to record screenshot error: %v", err)
+	}
+	return nil
+}
+
+// captureScreenshots screenshots one batch and returns the number of links attempted
+func (srv *server) captureScreenshots() (int, error) {
+	targets, err := srv.claimScreenshotBatch(screenshotBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim screenshot batch: %v", err)
+	}
+	for i, t := range targets {
+		if err := srv.screenshotLink(t); err != nil {
+			return i, err
+		}
+	}
+	return len(targets), nil
+}
+
+// startScreenshotter periodically captures link destinations when screenshot
+// storage is configured; SCREENSHOT_INTERVAL=0 turns it off
+func (srv *server) startScreenshotter() {
+	if screenshotStore == nil || os.Getenv("SCREENSHOT_INTERVAL") == "0" {
+		return
+	}
+
+	srv.scheduleJob("screenshotter", screenshotInterval, func() error {
+		_, err := srv.captureScreenshots()
+		return err
+	})
+
+	log.Printf("Screenshotter started (every %s, batches of %d)", screenshotInterval, screenshotBatchSize)
+}
+
+// getLinkScreenshotHandler returns the screenshot of one of the caller's links
+func (srv *server) getLinkScreenshotHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	u, ok := srv.ownedLinkParam(c, owner, "screenshot")
+	if !ok {
+		return
+	}
+
+	s, err := srv.linkScreenshot(u.ShortCode)
+	if err != nil {
+		if errors.Is(err, errNoScreenshot) {
+			failCode(c, http.StatusNotFound, codeScreenshotNotFound)
+			return
+		}
+		log.Printf("Failed to get screenshot: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get screenshot")
+		return
+	}
+
+	response.OK(c, http.StatusOK, s)
+}
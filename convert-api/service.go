@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"convert-api/dbq"
+
+	"github.com/lib/pq"
+	"shared/slowquery"
+	"shared/tenantcache"
+	"shared/urlcrypto"
+)
+
+var errShortCodeNotFound = errors.New("short code not found")
+
+// errCallerRequired is returned for changes to links by anonymous callers
+var errCallerRequired = errors.New("authentication required")
+var errInvalidURL = errors.New("invalid url")
+var errExpiryInPast = errors.New("expiresAt must be in the future")
+
+// errEncryptedSearch is returned for substring searches on destinations, which
+// can't be evaluated by the database once they are encrypted at rest
+var errEncryptedSearch = errors.New("searching destinations is not available when encryption at rest is enabled")
+
+// shortURLBase is the public prefix short codes are served under
+const shortURLBase = "http://localhost:8000/"
+
+func shortURL(shortCode string) string {
+	return shortURLBase + shortCode
+}
+
+// URLFilter narrows down listURLs results. Owner limits them to one owner's
+// links, Favorite then to those the owner did or didn't mark as favorite, and
+// FolderIDs to the links in those folders.
+type URLFilter struct {
+	OriginalURLContains string
+	CreatedAfter        *time.Time
+	CreatedBefore       *time.Time
+	Owner               string
+	Favorite            *bool
+	FolderIDs           []int64
+	Limit               int
+	After               *pageCursor
+}
+
+// isValidationError reports whether err was caused by the caller's input
+func isValidationError(err error) bool {
+	return errors.Is(err, errInvalidURL) || errors.Is(err, errUnsafeURL) || errors.Is(err, errBlockedDomain) ||
+		errors.Is(err, errPhishingSuspected) || errors.Is(err, errEncryptedSearch) ||
+		errors.Is(err, errExpiryInPast)
+}
+
+// destinationVerdict is the outcome of screening a destination that was not rejected
+type destinationVerdict struct {
+	// FlagReason is stored with the link (e.g. Safe Browsing in flag mode)
+	FlagReason *string
+	// HoldReason disables the link until an admin approves it
+	HoldReason *string
+}
+
+// validateDestination parses the URL and applies the domain policy, phishing
+// heuristics and Safe Browsing screening
+func validateDestination(ctx context.Context, originalURL string) (destinationVerdict, error) {
+	var verdict destinationVerdict
+
+	parsed, err := url.Parse(originalURL)
+	if err != nil {
+		return verdict, errInvalidURL
+	}
+
+	if err := checkDomainPolicy(parsed.Hostname()); err != nil {
+		return verdict, err
+	}
+
+	if verdict.HoldReason, err = checkPhishing(parsed); err != nil {
+		return verdict, err
+	}
+
+	verdict.FlagReason, err = checkURLSafety(ctx, originalURL)
+	return verdict, err
+}
+
+// createShortURL allocates an ID, generates a short code and persists the
+// mapping. The actor becomes the owner of the link. Links with an expiresAt
+// stop redirecting at that time and are removed by the reaper. Its Postgres,
+// Redis and Safe Browsing calls are part of ctx's trace.
+func (srv *server) createShortURL(ctx context.Context, originalURL string, expiresAt *time.Time, actor auditActor) (*URL, error) {
+	if err := validateCreate(originalURL, expiresAt); err != nil {
+		return nil, err
+	}
+
+	originalURL, err := normalizeURL(originalURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Screen the destination before spending an ID on it
+	verdict, err := validateDestination(ctx, originalURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate short code in the tenant's alphabet, from the destination's
+	// hash, or through the canary generator for a share of creates, see
+	// codegen.go and hashcodes.go
+	generator, err := srv.codeGeneratorFor(actor.ID)
+	if err != nil {
+		return nil, err
+	}
+	var shortCode string
+	if generator == codeGeneratorHash {
+		existing, code, err := srv.hashedLink(originalURL, actor.ID, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return existing, nil
+		}
+		shortCode = code
+	}
+	if shortCode == "" {
+		if generator == codeGeneratorHash {
+			generator = codeGeneratorCounter
+		}
+		// Get next ID from Redis
+		id, err := srv.getNextID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		shortCode, generator, err = srv.generateCode(generator, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	newURL := &URL{
+		OriginalURL:    originalURL,
+		ShortCode:      shortCode,
+		Owner:          actor.ID,
+		FlagReason:     verdict.FlagReason,
+		DisabledReason: verdict.HoldReason,
+		ExpiresAt:      expiresAt,
+		CodeGenerator:  &generator,
+	}
+	// Claim the code in the link store, when there is one, see linkstore.go
+	if err := claimShortCode(ctx, newURL); err != nil {
+		return srv.concurrentHashedLink(generator, newURL, err)
+	}
+
+	// Save to PostgreSQL database
+	u, err := srv.saveURL(ctx, newURL, actor)
+	if err != nil {
+		srv.releaseShortCode(shortCode)
+		return srv.concurrentHashedLink(generator, newURL, err)
+	}
+
+	return u, nil
+}
+
+// concurrentHashedLink returns the link a concurrent create of the same
+// destination and expiry saved under u's hash code, or err when there is none
+func (srv *server) concurrentHashedLink(generator string, u *URL, err error) (*URL, error) {
+	if generator != codeGeneratorHash {
+		return nil, err
+	}
+	if existing, _, lookupErr := srv.hashedLink(u.OriginalURL, u.Owner, u.ExpiresAt); lookupErr == nil && existing != nil {
+		return existing, nil
+	}
+	return nil, err
+}
+
+// listURLs returns one page of links, newest first, and the cursor of the next page ("" on the last page)
+func (srv *server) listURLs(filter URLFilter) ([]URL, string, error) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	if filter.OriginalURLContains != "" {
+		if urlcrypto.Enabled() {
+			return nil, "", errEncryptedSearch
+		}
+		args = append(args, "%"+filter.OriginalURLContains+"%")
+		conditions = append(conditions, fmt.Sprintf("original_url ILIKE $%d", len(args)))
+	}
+	if filter.CreatedAfter != nil {
+		args = append(args, *filter.CreatedAfter)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if filter.CreatedBefore != nil {
+		args = append(args, *filter.CreatedBefore)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	if filter.Owner != "" {
+		args = append(args, filter.Owner)
+		conditions = append(conditions, fmt.Sprintf("owner = $%d", len(args)))
+		if filter.Favorite != nil {
+			favorite := fmt.Sprintf("EXISTS (SELECT 1 FROM link_favorites f WHERE f.owner = $%d AND f.short_code = urls.short_code)", len(args))
+			if !*filter.Favorite {
+				favorite = "NOT " + favorite
+			}
+			conditions = append(conditions, favorite)
+		}
+	}
+	if filter.FolderIDs != nil {
+		args = append(args, pq.Array(filter.FolderIDs))
+		conditions = append(conditions, fmt.Sprintf("folder_id = ANY($%d)", len(args)))
+	}
+	if filter.After != nil {
+		var condition string
+		condition, args = keysetCondition("created_at", "id", filter.After, args)
+		conditions = append(conditions, condition)
+	}
+
+	query := `
+		SELECT ` + urlColumns + `
+		FROM urls
+	`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	// Fetch one extra row to know whether another page exists
+	args = append(args, filter.Limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list URLs: %v", err)
+	}
+	defer rows.Close()
+
+	urls := []URL{}
+	for rows.Next() {
+		u, err := scanURL(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to list URLs: %v", err)
+		}
+		urls = append(urls, *u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to list URLs: %v", err)
+	}
+
+	nextCursor := ""
+	if len(urls) > filter.Limit {
+		urls = urls[:filter.Limit]
+		last := urls[len(urls)-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: int64(last.ID)}.encode()
+	}
+
+	return urls, nextCursor, nil
+}
+
+// ownedURL returns owner's link with shortCode; other owners' links are not found
+func (srv *server) ownedURL(owner, shortCode string) (*URL, error) {
+	if owner == "" {
+		return nil, errCallerRequired
+	}
+	u, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, err
+	}
+	if u.Owner != owner {
+		return nil, errShortCodeNotFound
+	}
+	return u, nil
+}
+
+// updateURL points one of owner's short codes at a new destination
+func (srv *server) updateURL(actor auditActor, owner, shortCode, originalURL string) (*URL, error) {
+	if owner == "" {
+		return nil, errCallerRequired
+	}
+	return srv.setURLDestination(actor, auditLinkUpdate, owner, shortCode, originalURL)
+}
+
+// setURLDestination screens and stores a new destination of owner's link,
+// recording it as action
+func (srv *server) setURLDestination(actor auditActor, action, owner, shortCode, originalURL string) (*URL, error) {
+	if err := validateDestinationInput(originalURL); err != nil {
+		return nil, err
+	}
+	originalURL, err := normalizeURL(originalURL)
+	if err != nil {
+		return nil, err
+	}
+	verdict, err := validateDestination(srv.ctx, originalURL)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, err
+	}
+	if before.Owner != owner {
+		return nil, errShortCodeNotFound
+	}
+
+	storedURL, err := urlcrypto.Encrypt(originalURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt URL: %v", err)
+	}
+
+	row, err := srv.queries.UpdateURLDestination(slowquery.Tag(srv.ctx, "", shortCode), dbq.UpdateURLDestinationParams{
+		ShortCode:   shortCode,
+		Owner:       owner,
+		OriginalUrl: storedURL,
+		FlagReason:  toNullString(verdict.FlagReason),
+		HoldReason:  toNullString(verdict.HoldReason),
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShortCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to update URL: %v", err)
+	}
+	u, err := urlFromRow(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update URL: %v", err)
+	}
+
+	srv.invalidateURLCache(shortCode)
+	srv.recordAudit(actor, action, auditTargetLink, shortCode, linkAuditState(before), linkAuditState(u))
+	srv.emitLinkEvent(eventLinkUpdated, u)
+
+	return u, nil
+}
+
+// deleteURL moves one of owner's links to the trash, or deletes it when the trash is off
+func (srv *server) deleteURL(actor auditActor, owner, shortCode string) error {
+	if owner == "" {
+		return errCallerRequired
+	}
+	deleted, err := srv.deleteOwnedURLs(slowquery.Tag(srv.ctx, "", shortCode), owner, []string{shortCode})
+	if err != nil {
+		return fmt.Errorf("failed to delete URL: %v", err)
+	}
+	if len(deleted) == 0 {
+		return errShortCodeNotFound
+	}
+	u := deleted[0]
+
+	srv.invalidateURLCache(shortCode)
+	srv.recordAudit(actor, auditLinkDelete, auditTargetLink, shortCode, linkAuditState(u), nil)
+	srv.emitLinkEvent(eventLinkDeleted, u)
+
+	return nil
+}
+
+// disableURL takes a link down without deleting it; redirect-api answers 410 for it
+func (srv *server) disableURL(actor auditActor, shortCode, reason string) (*URL, error) {
+	before, err := srv.getURLByShortCode(shortCode)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := srv.queries.DisableURL(slowquery.Tag(srv.ctx, "", shortCode), dbq.DisableURLParams{ShortCode: shortCode, DisabledReason: reason})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShortCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to disable URL: %v", err)
+	}
+	u, err := urlFromRow(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to disable URL: %v", err)
+	}
+
+	srv.invalidateURLCache(shortCode)
+	srv.recordAudit(actor, auditLinkDisable, auditTargetLink, shortCode, linkAuditState(before), linkAuditState(u))
+	srv.emitLinkEvent(eventLinkDisabled, u)
+	if before.DisabledAt == nil {
+		srv.notifyLinksDisabled([]*URL{u})
+	}
+
+	return u, nil
+}
+
+// BulkDisableFilter selects the links of a campaign. Set fields are ANDed
+// together, and only active links match unless IncludeDisabled is set.
+type BulkDisableFilter struct {
+	// Domain uses domain rule syntax: "example.com" or "*.example.com"
+	Domain          string
+	Owner           string
+	ShortCodes      []string
+	CreatedAfter    *time.Time
+	CreatedBefore   *time.Time
+	FolderIDs       []int64
+	IncludeDisabled bool
+
+	// ids replaces Domain once it has been matched in Go, see resolve
+	ids []int64
+}
+
+// urlHostExpr extracts the lower-cased host of original_url in SQL
+const urlHostExpr = `lower(substring(original_url from '^[A-Za-z][A-Za-z0-9+.-]*://(?:[^/?#@]*@)?([^/?#:]+)'))`
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (f BulkDisableFilter) where() (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	if !f.IncludeDisabled {
+		conditions = append(conditions, "disabled_at IS NULL")
+	}
+	if f.ids != nil {
+		args = append(args, pq.Array(f.ids))
+		conditions = append(conditions, fmt.Sprintf("id = ANY($%d)", len(args)))
+	} else if f.Domain != "" {
+		if suffix, ok := strings.CutPrefix(f.Domain, "*."); ok {
+			args = append(args, "%."+likeEscaper.Replace(suffix))
+			conditions = append(conditions, fmt.Sprintf("%s LIKE $%d", urlHostExpr, len(args)))
+		} else {
+			args = append(args, f.Domain)
+			conditions = append(conditions, fmt.Sprintf("%s = $%d", urlHostExpr, len(args)))
+		}
+	}
+	if f.Owner != "" {
+		args = append(args, f.Owner)
+		conditions = append(conditions, fmt.Sprintf("owner = $%d", len(args)))
+	}
+	if f.ShortCodes != nil {
+		args = append(args, pq.Array(f.ShortCodes))
+		conditions = append(conditions, fmt.Sprintf("short_code = ANY($%d)", len(args)))
+	}
+	if f.CreatedAfter != nil {
+		args = append(args, *f.CreatedAfter)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if f.CreatedBefore != nil {
+		args = append(args, *f.CreatedBefore)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	if f.FolderIDs != nil {
+		args = append(args, pq.Array(f.FolderIDs))
+		conditions = append(conditions, fmt.Sprintf("folder_id = ANY($%d)", len(args)))
+	}
+	if len(conditions) == 0 {
+		conditions = append(conditions, "true")
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// resolve matches the domain against decrypted destinations when they are
+// encrypted at rest, since the database can only see ciphertext
+func (f BulkDisableFilter) resolve(db *sql.DB) (BulkDisableFilter, error) {
+	if f.Domain == "" || !urlcrypto.Enabled() {
+		return f, nil
+	}
+
+	candidates := f
+	candidates.Domain = ""
+	where, args := candidates.where()
+	rows, err := db.Query(`SELECT id, original_url FROM urls WHERE `+where, args...)
+	if err != nil {
+		return f, fmt.Errorf("failed to match URLs: %v", err)
+	}
+	defer rows.Close()
+
+	f.ids = []int64{}
+	for rows.Next() {
+		var id int64
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			return f, fmt.Errorf("failed to match URLs: %v", err)
+		}
+		originalURL, err := urlcrypto.Decrypt(stored)
+		if err != nil {
+			log.Printf("Skipping URL %d during bulk match: %v", id, err)
+			continue
+		}
+		parsed, err := url.Parse(originalURL)
+		if err != nil {
+			continue
+		}
+		if domainMatches(f.Domain, strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")) {
+			f.ids = append(f.ids, id)
+		}
+	}
+	return f, rows.Err()
+}
+
+// matchBulkDisable returns the short codes a bulk disable would take down
+func (srv *server) matchBulkDisable(filter BulkDisableFilter) ([]string, error) {
+	filter, err := filter.resolve(srv.db)
+	if err != nil {
+		return nil, err
+	}
+	where, args := filter.where()
+	rows, err := srv.db.Query(`SELECT short_code FROM urls WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to match URLs: %v", err)
+	}
+	defer rows.Close()
+
+	codes := []string{}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, fmt.Errorf("failed to match URLs: %v", err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// bulkDisableURLs disables every active link matching the filter in one statement
+func (srv *server) bulkDisableURLs(actor auditActor, filter BulkDisableFilter, reason string) ([]*URL, error) {
+	filter, err := filter.resolve(srv.db)
+	if err != nil {
+		return nil, err
+	}
+	where, args := filter.where()
+	args = append(args, reason)
+	query := fmt.Sprintf(`
+		UPDATE urls
+		SET disabled_at = CURRENT_TIMESTAMP, disabled_reason = $%d, updated_at = CURRENT_TIMESTAMP
+		WHERE %s
+		RETURNING `+urlColumns, len(args), where)
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to disable URLs: %v", err)
+	}
+	defer rows.Close()
+
+	disabled := []*URL{}
+	for rows.Next() {
+		u, err := scanURL(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to disable URLs: %v", err)
+		}
+		disabled = append(disabled, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to disable URLs: %v", err)
+	}
+
+	codes := make([]string, 0, len(disabled))
+	for _, u := range disabled {
+		codes = append(codes, u.ShortCode)
+	}
+	srv.invalidateURLCaches(codes)
+
+	for _, u := range disabled {
+		// Only active links match, so the prior state is the same link without the takedown
+		before := *u
+		before.DisabledAt, before.DisabledReason = nil, nil
+		srv.recordAudit(actor, auditLinkDisable, auditTargetLink, u.ShortCode, linkAuditState(&before), linkAuditState(u))
+		srv.emitLinkEvent(eventLinkDisabled, u)
+	}
+	srv.notifyLinksDisabled(disabled)
+
+	return disabled, nil
+}
+
+// invalidateURLCache drops the redirect-api cache entry so changes are visible
+// immediately, after writing the change through to the link store
+func (srv *server) invalidateURLCache(shortCode string) {
+	srv.syncLinkStore(shortCode)
+	key := urlCacheKey(shortCode)
+	if _, err := tenantcache.Del(srv.ctx, srv.urlCache.Client(key), key); err != nil {
+		log.Printf("Failed to invalidate cache for %s: %v", shortCode, err)
+	}
+}
+
+// cacheInvalidationBatch bounds the keys of a single DEL
+const cacheInvalidationBatch = 500
+
+// invalidateURLCaches is the bulk form of invalidateURLCache: one multi-key
+// delete per batch and cache shard
+func (srv *server) invalidateURLCaches(shortCodes []string) {
+	if len(shortCodes) == 0 {
+		return
+	}
+	for _, code := range shortCodes {
+		srv.syncLinkStore(code)
+	}
+
+	keys := make([]string, len(shortCodes))
+	for i, code := range shortCodes {
+		keys[i] = urlCacheKey(code)
+	}
+	for client, shardKeys := range srv.urlCache.Partition(keys) {
+		for start := 0; start < len(shardKeys); start += cacheInvalidationBatch {
+			end := min(start+cacheInvalidationBatch, len(shardKeys))
+			if _, err := tenantcache.Del(srv.ctx, client, shardKeys[start:end]...); err != nil {
+				log.Printf("Failed to invalidate %d cache entries: %v", end-start, err)
+			}
+		}
+	}
+}
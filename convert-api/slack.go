@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+)
+
+// Slack rejects replayed requests older than this
+const slackMaxRequestAge = 5 * time.Minute
+
+var slackSigningSecret = os.Getenv("SLACK_SIGNING_SECRET")
+
+// slackResponse is the JSON body Slack renders as the command reply. Slack
+// only understands its own shape, so it isn't wrapped in the response envelope.
+type slackResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+func slackEphemeral(c *gin.Context, text string) {
+	c.JSON(http.StatusOK, slackResponse{ResponseType: "ephemeral", Text: text})
+}
+
+// verifySlackSignature implements https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackSignature(header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	signature := header.Get("X-Slack-Signature")
+	if timestamp == "" || signature == "" {
+		return errors.New("missing slack signature headers")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid slack timestamp")
+	}
+	if math.Abs(now.Sub(time.Unix(ts, 0)).Seconds()) > slackMaxRequestAge.Seconds() {
+		return errors.New("stale slack request")
+	}
+
+	mac := hmac.New(sha256.New, []byte(slackSigningSecret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("slack signature mismatch")
+	}
+	return nil
+}
+
+// slackCommandHandler implements the `/shorten <url>` slash command
+func (srv *server) slackCommandHandler(c *gin.Context) {
+	if slackSigningSecret == "" {
+		response.Fail(c, http.StatusServiceUnavailable, "slack integration is not configured")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "failed to read request")
+		return
+	}
+
+	if err := verifySlackSignature(c.Request.Header, body, time.Now()); err != nil {
+		log.Printf("Rejected slack command: %v", err)
+		response.Fail(c, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	// The signature covers the raw body, so parse the form only after verifying it
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid form body")
+		return
+	}
+
+	originalURL := strings.TrimSpace(form.Get("text"))
+	if originalURL == "" {
+		slackEphemeral(c, "Usage: /shorten <url>")
+		return
+	}
+
+	owner := ""
+	if teamID := form.Get("team_id"); teamID != "" {
+		owner = "slack:" + teamID
+	}
+
+	savedURL, err := srv.createShortURL(c.Request.Context(), originalURL, nil, auditActor{ID: owner, IP: c.ClientIP()})
+	if err != nil {
+		if errors.Is(err, errInvalidURL) {
+			slackEphemeral(c, "That doesn't look like a valid URL: "+originalURL)
+			return
+		}
+		if isValidationError(err) {
+			slackEphemeral(c, "That URL can't be shortened: "+err.Error())
+			return
+		}
+		log.Printf("🔥 Failed to create short URL from slack: %v", err)
+		slackEphemeral(c, "Sorry, something went wrong while shortening your link.")
+		return
+	}
+
+	slackEphemeral(c, shortURL(savedURL.ShortCode))
+}
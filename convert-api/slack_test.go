@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerifySlackSignature(t *testing.T) {
+	defer func(secret string) { slackSigningSecret = secret }(slackSigningSecret)
+	slackSigningSecret = "slack-secret"
+
+	body := []byte("command=%2Fshorten&text=https%3A%2F%2Fexample.com")
+	// printf 'v0:1700000000:<body>' | openssl dgst -sha256 -hmac slack-secret
+	const signature = "v0=8d8661094f0d22a99099bc3d39ba8eee430b2b7bf102c02f38b8b97b0cbc358e"
+	sent := time.Unix(1700000000, 0)
+	headers := func(timestamp, signature string) http.Header {
+		h := http.Header{}
+		if timestamp != "" {
+			h.Set("X-Slack-Request-Timestamp", timestamp)
+		}
+		if signature != "" {
+			h.Set("X-Slack-Signature", signature)
+		}
+		return h
+	}
+
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		body   []byte
+		now    time.Time
+		ok     bool
+	}{
+		{"valid", headers("1700000000", signature), body, sent, true},
+		{"clock skew", headers("1700000000", signature), body, sent.Add(-4 * time.Minute), true},
+		{"stale", headers("1700000000", signature), body, sent.Add(6 * time.Minute), false},
+		{"from the future", headers("1700000000", signature), body, sent.Add(-6 * time.Minute), false},
+		{"tampered body", headers("1700000000", signature), append(body, '!'), sent, false},
+		{"other timestamp", headers("1700000001", signature), body, sent, false},
+		{"no signature", headers("1700000000", ""), body, sent, false},
+		{"no timestamp", headers("", signature), body, sent, false},
+		{"bad timestamp", headers("soon", signature), body, sent, false},
+	} {
+		err := verifySlackSignature(tt.header, tt.body, tt.now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/accesslog"
+	"shared/response"
+)
+
+// Started next to Postgres and Redis, the service keeps retrying its
+// connections (see shared/storage). Meanwhile a startup server on the service
+// port answers /api/health, so the process isn't restarted for waiting, and
+// /readyz and everything else with 503.
+
+// readyTimeout bounds each dependency ping in /readyz
+const readyTimeout = 2 * time.Second
+
+// startupHandler answers while the service is still connecting
+func startupHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(accesslog.RequestIDHeader)
+	if !accesslog.ValidRequestID(id) {
+		id = accesslog.NewRequestID()
+	}
+	w.Header().Set(accesslog.RequestIDHeader, id)
+
+	switch r.URL.Path {
+	case "/api/health":
+		response.Write(w, http.StatusOK, map[string]string{"status": "up"})
+	case "/readyz":
+		response.WriteError(w, http.StatusServiceUnavailable, "service is starting")
+	default:
+		w.Header().Set("Retry-After", "5")
+		response.WriteError(w, http.StatusServiceUnavailable, "service is starting")
+	}
+}
+
+// startStartupServer serves startupHandler on addr until stopStartupServer
+func startStartupServer(addr string) *http.Server {
+	server := &http.Server{Addr: addr, Handler: http.HandlerFunc(startupHandler), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Startup server failed: %v", err)
+		}
+	}()
+	return server
+}
+
+// stopStartupServer frees the port for the real server
+func (srv *server) stopStartupServer(server *http.Server) {
+	shutdownCtx, cancel := context.WithTimeout(srv.ctx, 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to stop startup server: %v", err)
+	}
+}
+
+// checkDependencies pings Postgres and both Redis instances and returns the
+// first that doesn't answer
+func (srv *server) checkDependencies(ctx context.Context) (string, error) {
+	pingCtx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	checks := []struct {
+		name string
+		ping func(context.Context) error
+	}{
+		{"postgres", srv.db.PingContext},
+		{"redis", func(ctx context.Context) error { return srv.rdb.Ping(ctx).Err() }},
+		{"cache redis", func(ctx context.Context) error { return srv.cacheRdb.Ping(ctx).Err() }},
+	}
+	for _, check := range checks {
+		if err := check.ping(pingCtx); err != nil {
+			return check.name, err
+		}
+	}
+	return "", nil
+}
+
+// readyzHandler reports whether Postgres and both Redis instances answer, so
+// an instance that lost one is taken out of rotation instead of failing requests
+func (srv *server) readyzHandler(c *gin.Context) {
+	if name, err := srv.checkDependencies(c.Request.Context()); err != nil {
+		log.Printf("Not ready, %s is unreachable: %v", name, err)
+		response.Fail(c, http.StatusServiceUnavailable, name+" is unreachable")
+		return
+	}
+	response.OK(c, http.StatusOK, gin.H{"status": "ready"})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"convert-api/idgen"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"shared/response"
+)
+
+// cacheStatsKeyPrefix is the per-day hash redirect-api counts cache hits and misses in
+const cacheStatsKeyPrefix = "stats:redirect_cache:"
+
+const (
+	defaultStatsDays = 7
+	// maxStatsDays matches how long redirect-api keeps its daily cache stats
+	maxStatsDays = 31
+)
+
+type AdminStats struct {
+	Links   LinkStats    `json:"links"`
+	Daily   []DailyStats `json:"daily"`
+	Tables  []TableStats `json:"tables"`
+	Counter CounterStats `json:"counter"`
+}
+
+type LinkStats struct {
+	Total           int64            `json:"total"`
+	Disabled        int64            `json:"disabled"`
+	Expiring        int64            `json:"expiring"`
+	Unhealthy       int64            `json:"unhealthy"`
+	ByCodeGenerator map[string]int64 `json:"byCodeGenerator"`
+}
+
+// DailyStats covers one UTC day; CacheHitRate is omitted on days without lookups
+type DailyStats struct {
+	Date         string   `json:"date"`
+	LinksCreated int64    `json:"linksCreated"`
+	CacheHits    int64    `json:"cacheHits"`
+	CacheMisses  int64    `json:"cacheMisses"`
+	CacheHitRate *float64 `json:"cacheHitRate,omitempty"`
+}
+
+type TableStats struct {
+	Name       string `json:"name"`
+	Rows       int64  `json:"rows"`
+	TotalBytes int64  `json:"totalBytes"`
+}
+
+// CounterStats shows where the ID counter stands; Value is 0 if Redis has lost it
+type CounterStats struct {
+	Value      int64 `json:"value"`
+	Checkpoint int64 `json:"checkpoint"`
+	Start      int64 `json:"start"`
+	Issued     int64 `json:"issued"`
+}
+
+func (srv *server) linkStats() (LinkStats, error) {
+	var s LinkStats
+	err := srv.db.QueryRow(`
+		SELECT COUNT(*),
+			COUNT(*) FILTER (WHERE disabled_at IS NOT NULL),
+			COUNT(*) FILTER (WHERE expires_at IS NOT NULL),
+			(SELECT COUNT(*) FROM destination_health WHERE NOT healthy)
+		FROM urls
+	`).Scan(&s.Total, &s.Disabled, &s.Expiring, &s.Unhealthy)
+	if err != nil {
+		return s, err
+	}
+
+	rows, err := srv.db.Query(`SELECT code_generator, COUNT(*) FROM urls WHERE code_generator IS NOT NULL GROUP BY 1`)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	s.ByCodeGenerator = map[string]int64{}
+	for rows.Next() {
+		var generator string
+		var count int64
+		if err := rows.Scan(&generator, &count); err != nil {
+			return s, err
+		}
+		s.ByCodeGenerator[generator] = count
+	}
+	return s, rows.Err()
+}
+
+// dailyStats returns the last days UTC days, oldest first, including days without links
+func (srv *server) dailyStats(days int) ([]DailyStats, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, -(days - 1))
+
+	daily := make([]DailyStats, days)
+	index := make(map[string]int, days)
+	for i := range daily {
+		daily[i].Date = first.AddDate(0, 0, i).Format(time.DateOnly)
+		index[daily[i].Date] = i
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD'), COUNT(*)
+		FROM urls
+		WHERE created_at >= $1
+		GROUP BY 1
+	`, first)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date string
+		var count int64
+		if err := rows.Scan(&date, &count); err != nil {
+			return nil, err
+		}
+		if i, ok := index[date]; ok {
+			daily[i].LinksCreated = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Cache stats are best effort: without them the day still reports its links
+	cmds := make([]*redis.SliceCmd, days)
+	_, err = srv.cacheRdb.Pipelined(srv.ctx, func(pipe redis.Pipeliner) error {
+		for i := range daily {
+			cmds[i] = pipe.HMGet(srv.ctx, cacheStatsKeyPrefix+daily[i].Date, "hits", "misses")
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to read redirect cache stats: %v", err)
+		return daily, nil
+	}
+	for i, cmd := range cmds {
+		values := cmd.Val()
+		if len(values) != 2 {
+			continue
+		}
+		daily[i].CacheHits = parseRedisInt(values[0])
+		daily[i].CacheMisses = parseRedisInt(values[1])
+		if lookups := daily[i].CacheHits + daily[i].CacheMisses; lookups > 0 {
+			rate := float64(daily[i].CacheHits) / float64(lookups)
+			daily[i].CacheHitRate = &rate
+		}
+	}
+	return daily, nil
+}
+
+func parseRedisInt(v interface{}) int64 {
+	s, _ := v.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// tableStats uses the planner's row estimates, which stay cheap on large tables
+func (srv *server) tableStats() ([]TableStats, error) {
+	rows, err := srv.db.Query(`
+		SELECT relname, n_live_tup, pg_total_relation_size(relid)
+		FROM pg_stat_user_tables
+		ORDER BY pg_total_relation_size(relid) DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := []TableStats{}
+	for rows.Next() {
+		var t TableStats
+		if err := rows.Scan(&t.Name, &t.Rows, &t.TotalBytes); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, rows.Err()
+}
+
+func (srv *server) counterStats() (CounterStats, error) {
+	s := CounterStats{Start: idgen.Start}
+
+	value, err := srv.ids.Current(srv.ctx)
+	if err != nil {
+		return s, err
+	}
+	s.Value = value
+	if value >= idgen.Start {
+		s.Issued = value - idgen.Start + 1
+	}
+
+	if s.Checkpoint, err = srv.ids.StoredCheckpoint(srv.ctx); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// adminStatsHandler returns the numbers an operator checks daily, over the last ?days (default 7)
+func (srv *server) adminStatsHandler(c *gin.Context) {
+	days := defaultStatsDays
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatsDays {
+			response.Fail(c, http.StatusBadRequest, fmt.Sprintf("days must be between 1 and %d", maxStatsDays))
+			return
+		}
+		days = n
+	}
+
+	stats, err := srv.adminStats(days)
+	if err != nil {
+		log.Printf("Failed to compute admin stats: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to compute stats")
+		return
+	}
+
+	response.OK(c, http.StatusOK, stats)
+}
+
+func (srv *server) adminStats(days int) (*AdminStats, error) {
+	var stats AdminStats
+	var err error
+	if stats.Links, err = srv.linkStats(); err != nil {
+		return nil, fmt.Errorf("failed to count links: %v", err)
+	}
+	if stats.Daily, err = srv.dailyStats(days); err != nil {
+		return nil, fmt.Errorf("failed to count links per day: %v", err)
+	}
+	if stats.Tables, err = srv.tableStats(); err != nil {
+		return nil, fmt.Errorf("failed to read table sizes: %v", err)
+	}
+	if stats.Counter, err = srv.counterStats(); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"shared/env"
+)
+
+// Owners with a notification address can subscribe to a daily or weekly
+// summary of their links, built from link_clicks_daily. Days are UTC, and weeks
+// run Monday to Sunday. notification_settings.summary_sent_through records the
+// last day reported on, so each period is claimed by exactly one instance.
+const (
+	summaryReportOff    = "off"
+	summaryReportDaily  = "daily"
+	summaryReportWeekly = "weekly"
+
+	emailTemplateSummaryReport = "summary_report"
+	summaryReportBatchSize     = 100
+	summaryReportTopLinks      = 5
+)
+
+var summaryReportInterval = env.Duration("SUMMARY_REPORT_INTERVAL", time.Hour)
+
+const summaryReportTablesQuery = `
+	ALTER TABLE notification_settings ADD COLUMN IF NOT EXISTS summary_report TEXT;
+	ALTER TABLE notification_settings ADD COLUMN IF NOT EXISTS summary_sent_through DATE;
+`
+
+func init() {
+	registerEmailTemplate(emailTemplateSummaryReport,
+		`Your short links {{.period}}: {{.clicks}} clicks`,
+		`Hello {{.owner}},
+
+Here is how your short links did {{.period}}.
+
+  Clicks:    {{.clicks}} ({{.change}} on the {{.previous}})
+  New links: {{.linksCreated}}
+{{if .topLinks}}
+Top links:{{range .topLinks}}
+  {{.shortUrl}}  {{.clicks}} clicks{{end}}
+{{end}}
+You get this {{.frequency}} summary because you subscribed to it. To stop it,
+set summaryReport to "off" with PUT /api/v1/notifications.
+`)
+}
+
+// summaryReportEmail is the data of emailTemplateSummaryReport
+type summaryReportEmail struct {
+	Owner        string             `json:"owner"`
+	Frequency    string             `json:"frequency"`
+	Period       string             `json:"period"`
+	Previous     string             `json:"previous"`
+	Clicks       int64              `json:"clicks"`
+	Change       string             `json:"change"`
+	LinksCreated int64              `json:"linksCreated"`
+	TopLinks     []summaryLinkEmail `json:"topLinks"`
+}
+
+type summaryLinkEmail struct {
+	ShortURL string `json:"shortUrl"`
+	Clicks   int64  `json:"clicks"`
+}
+
+// summaryPeriod returns the first and last day of the latest complete period at now
+func summaryPeriod(frequency string, now time.Time) (time.Time, time.Time) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if frequency == summaryReportDaily {
+		day := today.AddDate(0, 0, -1)
+		return day, day
+	}
+	// Monday of this week, then the week before it
+	monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	return monday.AddDate(0, 0, -7), monday.AddDate(0, 0, -1)
+}
+
+// formatClickChange compares a period's clicks with the previous one's
+func formatClickChange(clicks, previous int64) string {
+	if previous == 0 {
+		if clicks == 0 {
+			return "no change"
+		}
+		return "up from none"
+	}
+	percent := (clicks - previous) * 100 / previous
+	return fmt.Sprintf("%+d%%", percent)
+}
+
+// claimSummaryOwners marks up to limit owners subscribed to frequency as
+// reported through periodEnd and returns them
+func (srv *server) claimSummaryOwners(frequency string, periodEnd time.Time, limit int) ([]string, error) {
+	rows, err := srv.db.Query(`
+		UPDATE notification_settings SET summary_sent_through = $2
+		WHERE owner IN (
+			SELECT owner FROM notification_settings
+			WHERE summary_report = $1 AND (summary_sent_through IS NULL OR summary_sent_through < $2)
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING owner
+	`, frequency, periodEnd.Format(time.DateOnly), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := []string{}
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+		owners = append(owners, owner)
+	}
+	return owners, rows.Err()
+}
+
+// ownerClicks sums the owner's clicks between two days, inclusive
+func (srv *server) ownerClicks(owner string, from, to time.Time) (int64, error) {
+	var clicks int64
+	err := srv.db.QueryRow(`
+		SELECT COALESCE(SUM(d.clicks), 0)
+		FROM urls u
+		JOIN link_clicks_daily d ON d.short_code = u.short_code
+		WHERE u.owner = $1 AND d.day BETWEEN $2 AND $3
+	`, owner, from.Format(time.DateOnly), to.Format(time.DateOnly)).Scan(&clicks)
+	return clicks, err
+}
+
+// buildSummaryReport aggregates one owner's period, returning nil when there is nothing to report
+func (srv *server) buildSummaryReport(owner, frequency string, from, to time.Time) (*summaryReportEmail, error) {
+	report := &summaryReportEmail{Owner: owner, Frequency: frequency, TopLinks: []summaryLinkEmail{}}
+	days := int(to.Sub(from).Hours()/24) + 1
+	if frequency == summaryReportDaily {
+		report.Period = "on " + from.Format("Mon, 02 Jan 2006")
+		report.Previous = "day before"
+	} else {
+		report.Period = fmt.Sprintf("in the week of %s to %s", from.Format("02 Jan"), to.Format("02 Jan 2006"))
+		report.Previous = "week before"
+	}
+
+	var err error
+	if report.Clicks, err = srv.ownerClicks(owner, from, to); err != nil {
+		return nil, fmt.Errorf("failed to sum clicks: %v", err)
+	}
+	previous, err := srv.ownerClicks(owner, from.AddDate(0, 0, -days), from.AddDate(0, 0, -1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum clicks: %v", err)
+	}
+	report.Change = formatClickChange(report.Clicks, previous)
+
+	err = srv.db.QueryRow(`
+		SELECT COUNT(*) FROM urls
+		WHERE owner = $1 AND created_at >= $2 AND created_at < $3
+	`, owner, from, to.AddDate(0, 0, 1)).Scan(&report.LinksCreated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count new links: %v", err)
+	}
+
+	if report.Clicks == 0 && previous == 0 && report.LinksCreated == 0 {
+		return nil, nil
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT u.short_code, SUM(d.clicks) AS clicks
+		FROM urls u
+		JOIN link_clicks_daily d ON d.short_code = u.short_code
+		WHERE u.owner = $1 AND d.day BETWEEN $2 AND $3
+		GROUP BY u.short_code
+		ORDER BY clicks DESC, u.short_code
+		LIMIT $4
+	`, owner, from.Format(time.DateOnly), to.Format(time.DateOnly), summaryReportTopLinks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rank links: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		var link summaryLinkEmail
+		if err := rows.Scan(&code, &link.Clicks); err != nil {
+			return nil, fmt.Errorf("failed to rank links: %v", err)
+		}
+		link.ShortURL = shortURL(code)
+		report.TopLinks = append(report.TopLinks, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to rank links: %v", err)
+	}
+	return report, nil
+}
+
+// sendSummaryReports queues the latest complete period's summary for every
+// subscriber who hasn't had it yet
+func (srv *server) sendSummaryReports(frequency string, now time.Time) {
+	from, to := summaryPeriod(frequency, now)
+	sent := 0
+	for {
+		owners, err := srv.claimSummaryOwners(frequency, to, summaryReportBatchSize)
+		if err != nil {
+			log.Printf("Failed to claim %s summary subscribers: %v", frequency, err)
+			return
+		}
+
+		for _, owner := range owners {
+			report, err := srv.buildSummaryReport(owner, frequency, from, to)
+			if err != nil {
+				log.Printf("Failed to build %s summary for %s: %v", frequency, owner, err)
+				continue
+			}
+			if report == nil {
+				continue
+			}
+			srv.notifyOwner(owner, emailTemplateSummaryReport, report)
+			sent++
+		}
+
+		if len(owners) < summaryReportBatchSize {
+			break
+		}
+	}
+	if sent > 0 {
+		log.Printf("Queued %d %s summary reports through %s", sent, frequency, to.Format(time.DateOnly))
+	}
+}
+
+// startSummaryReports checks for due reports on every instance; claiming keeps
+// two instances from sending the same period
+func (srv *server) startSummaryReports() {
+	if emailSenderImpl == nil {
+		return
+	}
+
+	srv.scheduleJobNow("summary-reports", summaryReportInterval, func() error {
+		now := time.Now().UTC()
+		srv.sendSummaryReports(summaryReportDaily, now)
+		srv.sendSummaryReports(summaryReportWeekly, now)
+		return nil
+	})
+}
+
+// validSummaryReport reports whether s is a summaryReport setting
+func validSummaryReport(s string) bool {
+	return s == summaryReportOff || s == summaryReportDaily || s == summaryReportWeekly
+}
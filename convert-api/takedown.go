@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+)
+
+const defaultTakedownReason = "admin_takedown"
+
+type TakedownRequestBody struct {
+	Reason string `json:"reason"`
+}
+
+type BulkTakedownRequestBody struct {
+	Domain string `json:"domain"`
+	Owner  string `json:"owner"`
+	Reason string `json:"reason"`
+	DryRun bool   `json:"dryRun"`
+}
+
+func takedownReason(reason string) string {
+	if reason == "" {
+		return defaultTakedownReason
+	}
+	return reason
+}
+
+// disableLinkHandler takes a single link down
+func (srv *server) disableLinkHandler(c *gin.Context) {
+	var body TakedownRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil && c.Request.ContentLength > 0 {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	shortCode := c.Param("shortCode")
+	u, err := srv.disableURL(actorFromGin(c), shortCode, takedownReason(body.Reason))
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+			return
+		}
+		log.Printf("Failed to disable URL: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to disable URL")
+		return
+	}
+
+	log.Printf("Link %s disabled by %s", shortCode, callerID(c))
+	response.OK(c, http.StatusOK, toLinkResponse(u))
+}
+
+// bulkDisableLinksHandler takes down every active link of a destination domain
+// and/or creator. dryRun reports what would be disabled without touching anything.
+func (srv *server) bulkDisableLinksHandler(c *gin.Context) {
+	var body BulkTakedownRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Domain == "" && body.Owner == "" {
+		response.Fail(c, http.StatusBadRequest, "domain or owner is required")
+		return
+	}
+
+	filter := BulkDisableFilter{Owner: body.Owner}
+	if body.Domain != "" {
+		pattern, ok := normalizeDomainPattern(body.Domain)
+		if !ok {
+			response.Fail(c, http.StatusBadRequest, "invalid domain pattern")
+			return
+		}
+		filter.Domain = pattern
+	}
+
+	if body.DryRun {
+		codes, err := srv.matchBulkDisable(filter)
+		if err != nil {
+			log.Printf("Failed to match URLs for bulk disable: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to disable URLs")
+			return
+		}
+		response.OK(c, http.StatusOK, gin.H{"dryRun": true, "disabled": len(codes), "shortCodes": codes})
+		return
+	}
+
+	disabled, err := srv.bulkDisableURLs(actorFromGin(c), filter, takedownReason(body.Reason))
+	if err != nil {
+		log.Printf("Failed to bulk disable URLs: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to disable URLs")
+		return
+	}
+
+	codes := make([]string, 0, len(disabled))
+	for _, u := range disabled {
+		codes = append(codes, u.ShortCode)
+	}
+
+	log.Printf("Bulk disable by %s (domain=%q owner=%q): %d links", callerID(c), filter.Domain, filter.Owner, len(codes))
+	response.OK(c, http.StatusOK, gin.H{"dryRun": false, "disabled": len(codes), "shortCodes": codes})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+	"shared/urlcrypto"
+)
+
+// A link can spread its redirects over several weighted targets, e.g. mirrors
+// or the old and new site during a migration: redirect-api picks one per
+// click, at random in proportion to its weight. The link's own destination is
+// still what the API shows and what expanders resolve it to; it just gets no
+// redirects while targets are set. Targets are screened like destinations,
+// except that ones which would be flagged or held are rejected outright.
+const (
+	auditLinkTargets = "link.targets"
+
+	// minLinkTargets is the fewest targets worth weighting; up to 10 can be set
+	minLinkTargets = 2
+
+	// weightedCachePrefix marks the cached value of a link with targets,
+	// "w:<stored destination>\n<weight> <stored target>\n...", as redirect-api
+	// reads it. Values without it are a single stored destination.
+	weightedCachePrefix = "w:"
+)
+
+var errTooFewTargets = fmt.Errorf("a link needs at least %d targets, or none", minLinkTargets)
+
+const targetTablesQuery = `
+	CREATE TABLE IF NOT EXISTS link_targets (
+		short_code VARCHAR(10) NOT NULL REFERENCES urls(short_code) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		original_url TEXT NOT NULL,
+		weight INTEGER NOT NULL CHECK (weight > 0),
+		PRIMARY KEY (short_code, position)
+	);
+
+	ALTER TABLE urls_trash ADD COLUMN IF NOT EXISTS targets JSONB;
+`
+
+// linkTargetsColumn selects the targets of the urls row of a query in the
+// cached form, one "<weight> <stored target>" per line, NULL when there are none
+const linkTargetsColumn = `(SELECT string_agg(t.weight || ' ' || t.original_url, E'\n' ORDER BY t.position)
+	FROM link_targets t WHERE t.short_code = urls.short_code)`
+
+// LinkTarget is one destination of a weighted link
+type LinkTarget struct {
+	OriginalURL string `json:"originalUrl" binding:"required"`
+	Weight      int    `json:"weight" binding:"required,min=1,max=1000"`
+}
+
+type TargetsRequestBody struct {
+	// An empty list sends all redirects to the link's destination again
+	Targets []LinkTarget `json:"targets" binding:"required,max=10,dive"`
+}
+
+// linkTargetsState is the audit snapshot of a link's targets, stored as the
+// link's destination is, so encrypted when encryption at rest is on
+type linkTargetsState struct {
+	Targets []LinkTarget `json:"targets"`
+}
+
+// weightedCacheValue is what the redirect cache holds for a link, given its
+// stored destination and its targets as selected by linkTargetsColumn
+func weightedCacheValue(storedURL string, targets *string) string {
+	if targets == nil || *targets == "" {
+		return storedURL
+	}
+	return weightedCachePrefix + storedURL + "\n" + *targets
+}
+
+// cachedDestination returns the stored destination of a cached value,
+// leaving out its targets
+func cachedDestination(value string) string {
+	rest, ok := strings.CutPrefix(value, weightedCachePrefix)
+	if !ok {
+		return value
+	}
+	destination, _, _ := strings.Cut(rest, "\n")
+	return destination
+}
+
+// rowsQuerier is what storedLinkTargets needs of *sql.DB and *sql.Tx
+type rowsQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// storedLinkTargets returns a link's targets as stored, in order
+func storedLinkTargets(q rowsQuerier, shortCode string) ([]LinkTarget, error) {
+	rows, err := q.Query(`
+		SELECT original_url, weight FROM link_targets WHERE short_code = $1 ORDER BY position
+	`, shortCode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get targets: %v", err)
+	}
+	defer rows.Close()
+
+	targets := []LinkTarget{}
+	for rows.Next() {
+		var t LinkTarget
+		if err := rows.Scan(&t.OriginalURL, &t.Weight); err != nil {
+			return nil, fmt.Errorf("failed to get targets: %v", err)
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+// decryptTargets returns a copy of stored targets with their destinations decrypted
+func decryptTargets(stored []LinkTarget) ([]LinkTarget, error) {
+	targets := make([]LinkTarget, len(stored))
+	for i, t := range stored {
+		originalURL, err := urlcrypto.Decrypt(t.OriginalURL)
+		if err != nil {
+			return nil, err
+		}
+		targets[i] = LinkTarget{OriginalURL: originalURL, Weight: t.Weight}
+	}
+	return targets, nil
+}
+
+// screenTarget validates a target or fallback destination. Unlike a link's
+// destination it can't be flagged or held for review, so either is a rejection.
+func (srv *server) screenTarget(originalURL string) error {
+	verdict, err := validateDestination(srv.ctx, originalURL)
+	if err != nil {
+		return err
+	}
+	if verdict.HoldReason != nil {
+		return errPhishingSuspected
+	}
+	if verdict.FlagReason != nil {
+		return errUnsafeURL
+	}
+	return nil
+}
+
+// setLinkTargets replaces the targets of one of owner's links and returns them
+func (srv *server) setLinkTargets(actor auditActor, owner, shortCode string, targets []LinkTarget) ([]LinkTarget, error) {
+	if len(targets) > 0 && len(targets) < minLinkTargets {
+		return nil, errTooFewTargets
+	}
+	stored := make([]LinkTarget, len(targets))
+	for i, t := range targets {
+		if err := srv.screenTarget(t.OriginalURL); err != nil {
+			return nil, fmt.Errorf("target %d: %w", i+1, err)
+		}
+		storedURL, err := urlcrypto.Encrypt(t.OriginalURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt URL: %v", err)
+		}
+		stored[i] = LinkTarget{OriginalURL: storedURL, Weight: t.Weight}
+	}
+
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the link serializes concurrent replacements
+	var locked string
+	err = tx.QueryRow(`SELECT short_code FROM urls WHERE short_code = $1 AND owner = $2 FOR UPDATE`, shortCode, owner).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return nil, errShortCodeNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get URL: %v", err)
+	}
+
+	before, err := storedLinkTargets(tx, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM link_targets WHERE short_code = $1`, shortCode); err != nil {
+		return nil, fmt.Errorf("failed to replace targets: %v", err)
+	}
+	for i, t := range stored {
+		if _, err := tx.Exec(`
+			INSERT INTO link_targets (short_code, position, original_url, weight) VALUES ($1, $2, $3, $4)
+		`, shortCode, i+1, t.OriginalURL, t.Weight); err != nil {
+			return nil, fmt.Errorf("failed to replace targets: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to replace targets: %v", err)
+	}
+
+	srv.invalidateURLCache(shortCode)
+	srv.recordAudit(actor, auditLinkTargets, auditTargetLink, shortCode, linkTargetsState{before}, linkTargetsState{stored})
+
+	return decryptTargets(stored)
+}
+
+// getLinkTargetsHandler lists the targets of one of the caller's links
+func (srv *server) getLinkTargetsHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	u, ok := srv.ownedLinkParam(c, owner, "link targets")
+	if !ok {
+		return
+	}
+
+	stored, err := storedLinkTargets(srv.db, u.ShortCode)
+	if err != nil {
+		log.Printf("Failed to get link targets: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get link targets")
+		return
+	}
+	targets, err := decryptTargets(stored)
+	if err != nil {
+		log.Printf("Failed to get link targets: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get link targets")
+		return
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"targets": targets})
+}
+
+// setLinkTargetsHandler replaces the targets of one of the caller's links
+func (srv *server) setLinkTargetsHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body TargetsRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	targets, err := srv.setLinkTargets(actorFromGin(c), owner, c.Param("shortCode"), body.Targets)
+	if err != nil {
+		switch {
+		case errors.Is(err, errShortCodeNotFound):
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+		case errors.Is(err, errTooFewTargets):
+			response.Fail(c, http.StatusBadRequest, err.Error())
+		case isValidationError(err):
+			response.Fail(c, http.StatusUnprocessableEntity, err.Error())
+		default:
+			log.Printf("Failed to set link targets: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to set link targets")
+		}
+		return
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"targets": targets})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"shared/env"
+	"shared/response"
+	"shared/tenantcache"
+)
+
+// Cache entries are attributed to their tenant, the owner of what they cache,
+// and recorded in its index on each Redis instance, see the tenantcache
+// package. Admins audit a tenant's share of the redirect cache Redis and its
+// shards with GET /api/admin/tenants/{owner}/cache and drop all of it with
+// DELETE, which also evicts the tenant's links from redirect-api's hot
+// snapshots. TENANT_CACHE_MAX_ENTRIES caps each tenant's live entries per
+// instance, enforced here for resolve fills as in redirect-api.
+var tenantCacheMaxEntries = env.Int("TENANT_CACHE_MAX_ENTRIES", 0)
+
+// TenantCacheUsage is a tenant's share of the cache
+type TenantCacheUsage struct {
+	Owner string `json:"owner"`
+	// Entries counts live entries
+	Entries int64            `json:"entries"`
+	ByKind  map[string]int64 `json:"byKind"`
+	// MaxEntries is the limit per Redis instance, 0 for none
+	MaxEntries int `json:"maxEntries"`
+}
+
+type TenantCacheFlushResponse struct {
+	KeysDeleted int64 `json:"keysDeleted"`
+	// Receivers is how many redirect-api instances got the eviction
+	Receivers int64 `json:"receivers"`
+}
+
+// tenantCacheClients are the Redis instances tenant entries live on: the cache
+// Redis and every url:* shard, each once
+func (srv *server) tenantCacheClients() []*redis.Client {
+	clients := []*redis.Client{srv.cacheRdb}
+	for _, node := range srv.urlCache.Nodes() {
+		if node.Client != srv.cacheRdb {
+			clients = append(clients, node.Client)
+		}
+	}
+	return clients
+}
+
+// setTenantCache queues value under key as one of owner's entries
+func (srv *server) setTenantCache(pipe redis.Pipeliner, owner, key string, value interface{}, ttl time.Duration) {
+	tenantcache.Set(srv.ctx, pipe, owner, key, value, ttl, tenantCacheMaxEntries)
+}
+
+// reattributeLinkCaches drops the cached entries of links that changed
+// owner, to be cached again under the new one
+func (srv *server) reattributeLinkCaches(links []*URL) {
+	if len(links) == 0 {
+		return
+	}
+	codes := make([]string, len(links))
+	for i, u := range links {
+		codes[i] = u.ShortCode
+		srv.syncLinkStore(u.ShortCode)
+	}
+	if _, err := srv.invalidateCache(CacheEviction{ShortCodes: codes}); err != nil {
+		log.Printf("Failed to drop cached entries of %d transferred links: %v", len(codes), err)
+	}
+}
+
+func (srv *server) getTenantCacheHandler(c *gin.Context) {
+	owner := c.Param("owner")
+	usage := TenantCacheUsage{Owner: owner, ByKind: map[string]int64{}, MaxEntries: tenantCacheMaxEntries}
+	for _, client := range srv.tenantCacheClients() {
+		counts, err := tenantcache.Count(srv.ctx, client, owner)
+		if err != nil {
+			log.Printf("Failed to count cache entries of %s: %v", owner, err)
+			response.Fail(c, http.StatusInternalServerError, "failed to get tenant cache")
+			return
+		}
+		for kind, n := range counts {
+			usage.ByKind[kind] += n
+			usage.Entries += n
+		}
+	}
+	response.OK(c, http.StatusOK, usage)
+}
+
+// flushTenantCache deletes owner's entries everywhere and evicts its links
+// from the hot snapshots. Deletions are replayed to other regions like any
+// invalidation, though entries only cached there are left to their TTLs.
+func (srv *server) flushTenantCache(owner string) (*TenantCacheFlushResponse, error) {
+	resp := &TenantCacheFlushResponse{}
+	codes := []string{}
+	for _, client := range srv.tenantCacheClients() {
+		keys, err := tenantcache.Flush(srv.ctx, client, owner)
+		resp.KeysDeleted += int64(len(keys))
+		if err != nil {
+			return resp, fmt.Errorf("failed to flush cache entries: %v", err)
+		}
+		for _, key := range keys {
+			if isURLCacheKey(key) {
+				codes = append(codes, strings.TrimPrefix(key, urlCacheKeyPrefix))
+			}
+		}
+	}
+
+	for start := 0; start < len(codes); start += maxInvalidateCodes {
+		end := min(start+maxInvalidateCodes, len(codes))
+		message, err := json.Marshal(CacheEviction{ShortCodes: codes[start:end]})
+		if err != nil {
+			return resp, err
+		}
+		resp.Receivers, err = srv.cacheRdb.Publish(srv.ctx, cacheEvictChannel, message).Result()
+		if err != nil {
+			return resp, fmt.Errorf("failed to broadcast eviction: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+func (srv *server) flushTenantCacheHandler(c *gin.Context) {
+	owner := c.Param("owner")
+	resp, err := srv.flushTenantCache(owner)
+	if err != nil {
+		log.Printf("Failed to flush cache of %s after %d keys: %v", owner, resp.KeysDeleted, err)
+		response.Fail(c, http.StatusInternalServerError, "failed to flush tenant cache")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditTenantCacheFlush, auditTargetTenant, owner, nil, resp)
+	log.Printf("Cache of %s flushed by %s: %d keys deleted", owner, callerID(c), resp.KeysDeleted)
+	response.OK(c, http.StatusOK, resp)
+}
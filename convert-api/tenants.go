@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+)
+
+// Per-tenant features are switched on by admins for a consumer (the link
+// owner). Tenants without a row get the defaults.
+const (
+	codeAlphabetBase62 = "base62"
+	codeAlphabetEmoji  = "emoji"
+)
+
+const tenantTablesQuery = `
+	CREATE TABLE IF NOT EXISTS tenant_settings (
+		owner TEXT PRIMARY KEY,
+		code_alphabet TEXT NOT NULL DEFAULT 'base62' CHECK (code_alphabet IN ('base62', 'emoji')),
+		updated_by TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+// TenantSettings are the features enabled for one consumer
+type TenantSettings struct {
+	Owner        string     `json:"owner"`
+	CodeAlphabet string     `json:"codeAlphabet"`
+	UpdatedBy    string     `json:"updatedBy,omitempty"`
+	UpdatedAt    *time.Time `json:"updatedAt,omitempty"`
+}
+
+type TenantSettingsRequestBody struct {
+	CodeAlphabet string `json:"codeAlphabet" binding:"required"`
+}
+
+// getTenantSettings returns owner's settings, or the defaults when none were saved
+func (srv *server) getTenantSettings(owner string) (*TenantSettings, error) {
+	s := TenantSettings{Owner: owner, CodeAlphabet: codeAlphabetBase62}
+	err := srv.db.QueryRow(`
+		SELECT code_alphabet, updated_by, updated_at FROM tenant_settings WHERE owner = $1
+	`, owner).Scan(&s.CodeAlphabet, &s.UpdatedBy, &s.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get tenant settings: %v", err)
+	}
+	return &s, nil
+}
+
+// codeGeneratorFor returns the generator of a new link of owner: the tenant's
+// alphabet when it isn't base62, otherwise the default or canary generator
+func (srv *server) codeGeneratorFor(owner string) (string, error) {
+	if owner == "" {
+		return pickCodeGenerator(), nil
+	}
+	s, err := srv.getTenantSettings(owner)
+	if err != nil {
+		return "", err
+	}
+	if s.CodeAlphabet == codeAlphabetEmoji {
+		return codeGeneratorEmoji, nil
+	}
+	return pickCodeGenerator(), nil
+}
+
+func (srv *server) getTenantSettingsHandler(c *gin.Context) {
+	s, err := srv.getTenantSettings(c.Param("owner"))
+	if err != nil {
+		log.Printf("Failed to get tenant settings: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get tenant settings")
+		return
+	}
+	response.OK(c, http.StatusOK, s)
+}
+
+func (srv *server) updateTenantSettingsHandler(c *gin.Context) {
+	owner := c.Param("owner")
+
+	var body TenantSettingsRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.CodeAlphabet != codeAlphabetBase62 && body.CodeAlphabet != codeAlphabetEmoji {
+		response.Fail(c, http.StatusBadRequest, "codeAlphabet must be base62 or emoji")
+		return
+	}
+
+	before, err := srv.getTenantSettings(owner)
+	if err != nil {
+		log.Printf("Failed to get tenant settings: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update tenant settings")
+		return
+	}
+
+	actor := actorFromGin(c)
+	s := TenantSettings{Owner: owner}
+	err = srv.db.QueryRow(`
+		INSERT INTO tenant_settings (owner, code_alphabet, updated_by) VALUES ($1, $2, $3)
+		ON CONFLICT (owner) DO UPDATE
+		SET code_alphabet = EXCLUDED.code_alphabet, updated_by = EXCLUDED.updated_by, updated_at = CURRENT_TIMESTAMP
+		RETURNING code_alphabet, updated_by, updated_at
+	`, owner, body.CodeAlphabet, actor.ID).Scan(&s.CodeAlphabet, &s.UpdatedBy, &s.UpdatedAt)
+	if err != nil {
+		log.Printf("Failed to update tenant settings: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update tenant settings")
+		return
+	}
+
+	srv.recordAudit(actor, auditTenantUpdate, auditTargetTenant, owner, before, &s)
+	response.OK(c, http.StatusOK, s)
+}
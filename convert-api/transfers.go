@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/env"
+	"shared/response"
+)
+
+// Owners can hand links over to another user or organization, i.e. another
+// Kong consumer. An offer lists the links, either picked by short code or a
+// whole campaign (the sender's active links to a destination domain), and
+// takes effect only once the recipient accepts it. Links the sender no longer
+// owns by then are skipped. Offers lapse after TRANSFER_OFFER_TTL.
+const (
+	transferPending   = "pending"
+	transferAccepted  = "accepted"
+	transferDeclined  = "declined"
+	transferCancelled = "cancelled"
+	transferExpired   = "expired"
+
+	// maxTransferLinks caps the links of one offer
+	maxTransferLinks = 1000
+)
+
+var transferOfferTTL = env.Duration("TRANSFER_OFFER_TTL", 7*24*time.Hour)
+
+var errTransferClosed = errors.New("transfer is no longer pending")
+
+const transferTablesQuery = `
+	CREATE TABLE IF NOT EXISTS link_transfers (
+		id SERIAL PRIMARY KEY,
+		from_owner TEXT NOT NULL,
+		to_owner TEXT NOT NULL,
+		short_codes TEXT[] NOT NULL,
+		domain TEXT,
+		status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined', 'cancelled')),
+		transferred INTEGER,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		resolved_at TIMESTAMP WITH TIME ZONE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_link_transfers_from_owner ON link_transfers(from_owner, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_link_transfers_to_owner ON link_transfers(to_owner, created_at, id);
+`
+
+// Transfer is an offer of links from one owner to another. Pending offers past
+// their expiry are reported as expired.
+type Transfer struct {
+	ID          int64      `json:"id"`
+	From        string     `json:"from"`
+	To          string     `json:"to"`
+	ShortCodes  []string   `json:"shortCodes"`
+	Domain      *string    `json:"domain,omitempty"`
+	Status      string     `json:"status"`
+	Transferred *int       `json:"transferred,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+}
+
+type TransferRequestBody struct {
+	To         string   `json:"to" binding:"required"`
+	ShortCodes []string `json:"shortCodes"`
+	// Domain transfers a campaign, in domain rule syntax: "example.com" or "*.example.com"
+	Domain string `json:"domain"`
+}
+
+const transferColumns = "id, from_owner, to_owner, short_codes, domain, status, transferred, created_at, expires_at, resolved_at"
+
+func scanTransfer(row rowScanner) (*Transfer, error) {
+	var t Transfer
+	err := row.Scan(&t.ID, &t.From, &t.To, pq.Array(&t.ShortCodes), &t.Domain, &t.Status, &t.Transferred,
+		&t.CreatedAt, &t.ExpiresAt, &t.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if t.Status == transferPending && !t.ExpiresAt.After(clock()) {
+		t.Status = transferExpired
+	}
+	return &t, nil
+}
+
+const emailTemplateTransferOffered = "transfer_offered"
+
+func init() {
+	registerEmailTemplate(emailTemplateTransferOffered,
+		`{{.from}} wants to transfer {{if eq (len .links) 1}}a short link{{else}}{{len .links}} short links{{end}} to you`,
+		`Hello {{.to}},
+
+{{.from}} offered you ownership of the following short {{if eq (len .links) 1}}link{{else}}links{{end}}:
+{{range .links}}
+  {{.}}
+{{- end}}
+
+Accept or decline the offer with POST /api/v1/transfers/{{.id}}/accept or
+/decline before {{.expiresAt}}. Until then the links stay with {{.from}}.
+`)
+}
+
+// transferOfferedEmail is the data of emailTemplateTransferOffered
+type transferOfferedEmail struct {
+	ID        int64    `json:"id"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Links     []string `json:"links"`
+	ExpiresAt string   `json:"expiresAt"`
+}
+
+// ownedShortCodes returns the codes owner owns among codes, deduplicated, or
+// errShortCodeNotFound naming the first one they don't
+func (srv *server) ownedShortCodes(owner string, codes []string) ([]string, error) {
+	rows, err := srv.db.Query(`SELECT short_code FROM urls WHERE short_code = ANY($1) AND owner = $2`, pq.Array(codes), owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up links: %v", err)
+	}
+	defer rows.Close()
+
+	owned := map[string]bool{}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, fmt.Errorf("failed to look up links: %v", err)
+		}
+		owned[code] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to look up links: %v", err)
+	}
+
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !owned[code] {
+			return nil, fmt.Errorf("%w: %s", errShortCodeNotFound, code)
+		}
+		if !seen[code] {
+			seen[code] = true
+			unique = append(unique, code)
+		}
+	}
+	return unique, nil
+}
+
+func (srv *server) createTransferHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body TransferRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.To == owner {
+		response.Fail(c, http.StatusBadRequest, "cannot transfer links to yourself")
+		return
+	}
+	if (len(body.ShortCodes) == 0) == (body.Domain == "") {
+		response.Fail(c, http.StatusBadRequest, "exactly one of shortCodes or domain is required")
+		return
+	}
+
+	var codes []string
+	var domain *string
+	var err error
+	if body.Domain != "" {
+		pattern, ok := normalizeDomainPattern(body.Domain)
+		if !ok {
+			response.Fail(c, http.StatusBadRequest, "invalid domain pattern")
+			return
+		}
+		domain = &pattern
+		codes, err = srv.matchBulkDisable(BulkDisableFilter{Domain: pattern, Owner: owner})
+	} else {
+		if len(body.ShortCodes) > maxTransferLinks {
+			response.Fail(c, http.StatusBadRequest, fmt.Sprintf("shortCodes must contain at most %d codes", maxTransferLinks))
+			return
+		}
+		codes, err = srv.ownedShortCodes(owner, body.ShortCodes)
+	}
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			failNotFound(c, err)
+			return
+		}
+		log.Printf("Failed to match links for transfer: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to create transfer")
+		return
+	}
+	if len(codes) == 0 {
+		response.Fail(c, http.StatusUnprocessableEntity, "no active links match the domain")
+		return
+	}
+	if len(codes) > maxTransferLinks {
+		response.Fail(c, http.StatusUnprocessableEntity, fmt.Sprintf("the campaign has %d links, at most %d can be transferred at once", len(codes), maxTransferLinks))
+		return
+	}
+
+	query := `
+		INSERT INTO link_transfers (from_owner, to_owner, short_codes, domain, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))
+		RETURNING ` + transferColumns
+	t, err := scanTransfer(srv.db.QueryRow(query, owner, body.To, pq.Array(codes), domain, transferOfferTTL.Seconds()))
+	if err != nil {
+		log.Printf("Failed to create transfer: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to create transfer")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditTransferCreate, auditTargetTransfer, strconv.FormatInt(t.ID, 10), nil, t)
+	links := make([]string, len(t.ShortCodes))
+	for i, code := range t.ShortCodes {
+		links[i] = shortURL(code)
+	}
+	srv.notifyOwner(t.To, emailTemplateTransferOffered, transferOfferedEmail{
+		ID: t.ID, From: t.From, To: t.To, Links: links,
+		ExpiresAt: t.ExpiresAt.UTC().Format("Mon, 02 Jan 2006 15:04 MST"),
+	})
+
+	response.OK(c, http.StatusCreated, t)
+}
+
+// listTransfersHandler lists the caller's offers, newest first: those made to
+// them (?direction=incoming, the default) or by them (outgoing)
+func (srv *server) listTransfersHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	column := "to_owner"
+	switch c.DefaultQuery("direction", "incoming") {
+	case "incoming":
+	case "outgoing":
+		column = "from_owner"
+	default:
+		response.Fail(c, http.StatusBadRequest, "direction must be incoming or outgoing")
+		return
+	}
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{owner}
+	query := `SELECT ` + transferColumns + ` FROM link_transfers WHERE ` + column + ` = $1`
+	if after != nil {
+		var cond string
+		cond, args = keysetCondition("created_at", "id", after, args)
+		query += " AND " + cond
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list transfers: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list transfers")
+		return
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			log.Printf("Failed to list transfers: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list transfers")
+			return
+		}
+		transfers = append(transfers, *t)
+	}
+
+	nextCursor := ""
+	if len(transfers) > limit {
+		transfers = transfers[:limit]
+		last := transfers[len(transfers)-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: last.ID}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"transfers": transfers}, nextCursor)
+}
+
+// transferParam loads the :id transfer if the caller is one of its parties
+func (srv *server) transferParam(c *gin.Context, owner string) (*Transfer, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid transfer id")
+		return nil, false
+	}
+
+	query := `SELECT ` + transferColumns + ` FROM link_transfers WHERE id = $1 AND (from_owner = $2 OR to_owner = $2)`
+	t, err := scanTransfer(srv.db.QueryRow(query, id, owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeTransferNotFound)
+			return nil, false
+		}
+		log.Printf("Failed to get transfer: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get transfer")
+		return nil, false
+	}
+	return t, true
+}
+
+func (srv *server) getTransferHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	t, ok := srv.transferParam(c, owner)
+	if !ok {
+		return
+	}
+	response.OK(c, http.StatusOK, t)
+}
+
+// acceptTransfer moves the offered links the sender still owns to the
+// recipient, and closes the offer in the same transaction
+func (srv *server) acceptTransfer(t *Transfer) ([]*URL, *Transfer, error) {
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := srv.queries.WithTx(tx).TransferURLs(srv.ctx, dbq.TransferURLsParams{ShortCodes: t.ShortCodes, Owner: t.From, NewOwner: t.To})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to transfer links: %v", err)
+	}
+	moved, err := urlsFromRows(rows)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to transfer links: %v", err)
+	}
+
+	// Only a still pending offer can be accepted, so concurrent accepts move the links once
+	query := `
+		UPDATE link_transfers SET status = $2, transferred = $3, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'pending' AND expires_at > CURRENT_TIMESTAMP
+		RETURNING ` + transferColumns
+	after, err := scanTransfer(tx.QueryRow(query, t.ID, transferAccepted, len(moved)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, errTransferClosed
+		}
+		return nil, nil, fmt.Errorf("failed to accept transfer: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return moved, after, nil
+}
+
+// resolveTransferHandler returns the handler of one way of closing an offer:
+// the recipient accepts or declines it, the sender cancels it
+func (srv *server) resolveTransferHandler(status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		owner, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+		t, ok := srv.transferParam(c, owner)
+		if !ok {
+			return
+		}
+
+		party := t.To
+		if status == transferCancelled {
+			party = t.From
+		}
+		if owner != party {
+			response.Fail(c, http.StatusForbidden, fmt.Sprintf("only %s can do this", party))
+			return
+		}
+		if t.Status == transferExpired {
+			response.Fail(c, http.StatusGone, "transfer offer expired")
+			return
+		}
+		if t.Status != transferPending {
+			response.Fail(c, http.StatusConflict, "transfer is already "+t.Status)
+			return
+		}
+
+		actor := actorFromGin(c)
+		var after *Transfer
+		var err error
+		if status == transferAccepted {
+			var moved []*URL
+			moved, after, err = srv.acceptTransfer(t)
+			if err == nil {
+				for _, u := range moved {
+					before := *u
+					before.Owner, before.FolderID = t.From, nil
+					srv.recordAudit(actor, auditLinkTransfer, auditTargetLink, u.ShortCode, linkAuditState(&before), linkAuditState(u))
+					srv.emitLinkEvent(eventLinkUpdated, u)
+				}
+				srv.reattributeLinkCaches(moved)
+			}
+		} else {
+			query := `
+				UPDATE link_transfers SET status = $2, resolved_at = CURRENT_TIMESTAMP
+				WHERE id = $1 AND status = 'pending'
+				RETURNING ` + transferColumns
+			after, err = scanTransfer(srv.db.QueryRow(query, t.ID, status))
+			if err == sql.ErrNoRows {
+				err = errTransferClosed
+			}
+		}
+		if err != nil {
+			if errors.Is(err, errTransferClosed) {
+				response.Fail(c, http.StatusConflict, err.Error())
+				return
+			}
+			log.Printf("Failed to resolve transfer %d: %v", t.ID, err)
+			response.Fail(c, http.StatusInternalServerError, "failed to update transfer")
+			return
+		}
+
+		srv.recordAudit(actor, auditTransferResolve, auditTargetTransfer, strconv.FormatInt(t.ID, 10), t, after)
+		response.OK(c, http.StatusOK, after)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"convert-api/dbq"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/env"
+	"shared/response"
+	"shared/slowquery"
+	"shared/urlcrypto"
+)
+
+// Deleted links go to urls_trash for TRASH_RETENTION, during which their owner
+// can restore them with the same short code, settings and click total; the
+// purger then removes them for good. A trashed link is gone for redirect-api
+// and every list, and its code stays reserved. TRASH_RETENTION=0 deletes
+// links at once. Erasure and the expiry reaper bypass the trash.
+const auditLinkRestore = "link.restore"
+
+var (
+	trashEnabled       = os.Getenv("TRASH_RETENTION") != "0"
+	trashRetention     = env.Duration("TRASH_RETENTION", 30*24*time.Hour)
+	trashPurgeInterval = env.Duration("TRASH_PURGE_INTERVAL", time.Minute)
+)
+
+var errCodeInUse = errors.New("the short code is in use by another link")
+
+const trashTablesQuery = `
+	CREATE TABLE IF NOT EXISTS urls_trash (
+		id INTEGER PRIMARY KEY,
+		original_url TEXT NOT NULL,
+		short_code VARCHAR(10) NOT NULL UNIQUE,
+		owner TEXT NOT NULL DEFAULT '',
+		flag_reason TEXT,
+		disabled_at TIMESTAMP WITH TIME ZONE,
+		disabled_reason TEXT,
+		created_at TIMESTAMP WITH TIME ZONE,
+		updated_at TIMESTAMP WITH TIME ZONE,
+		expires_at TIMESTAMP WITH TIME ZONE,
+		source TEXT,
+		code_generator TEXT,
+		public_stats BOOLEAN NOT NULL DEFAULT false,
+		rotated_to VARCHAR(10),
+		retire_at TIMESTAMP WITH TIME ZONE,
+		folder_id INTEGER,
+		clicks BIGINT,
+		last_clicked_at TIMESTAMP WITH TIME ZONE,
+		deleted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		purge_at TIMESTAMP WITH TIME ZONE NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_urls_trash_owner ON urls_trash(owner, deleted_at, id);
+	CREATE INDEX IF NOT EXISTS idx_urls_trash_purge_at ON urls_trash(purge_at);
+`
+
+// TrashedLink is a deleted link that can still be restored
+type TrashedLink struct {
+	ID          int64     `json:"-"`
+	ShortCode   string    `json:"shortCode"`
+	OriginalURL string    `json:"originalUrl"`
+	Clicks      int64     `json:"clicks"`
+	DeletedAt   time.Time `json:"deletedAt"`
+	PurgeAt     time.Time `json:"purgeAt"`
+}
+
+// deleteOwnedURLs deletes the owner's links among codes and returns them;
+// with the trash enabled they are moved to urls_trash in the same statement
+func (srv *server) deleteOwnedURLs(ctx context.Context, owner string, codes []string) ([]*URL, error) {
+	if !trashEnabled {
+		rows, err := srv.queries.DeleteOwnedURLs(ctx, dbq.DeleteOwnedURLsParams{ShortCodes: codes, Owner: owner})
+		if err != nil {
+			return nil, err
+		}
+		return urlsFromRows(rows)
+	}
+
+	rows, err := srv.queries.TrashOwnedURLs(ctx, dbq.TrashOwnedURLsParams{
+		ShortCodes:       codes,
+		Owner:            owner,
+		RetentionSeconds: trashRetention.Seconds(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]dbq.Url, len(rows))
+	for i, row := range rows {
+		deleted[i] = dbq.Url(row)
+	}
+	return urlsFromRows(deleted)
+}
+
+// restoreURL moves one of owner's trashed links back, see RestoreTrashedURL
+func (srv *server) restoreURL(actor auditActor, owner, shortCode string) (*URL, error) {
+	row, err := srv.queries.RestoreTrashedURL(slowquery.Tag(srv.ctx, "", shortCode), dbq.RestoreTrashedURLParams{ShortCode: shortCode, Owner: owner})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShortCodeNotFound
+		}
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, errCodeInUse
+		}
+		return nil, fmt.Errorf("failed to restore URL: %v", err)
+	}
+	u, err := urlFromRow(dbq.Url(row))
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore URL: %v", err)
+	}
+
+	srv.syncLinkStore(shortCode)
+	srv.recordAudit(actor, auditLinkRestore, auditTargetLink, shortCode, nil, linkAuditState(u))
+	srv.emitLinkEvent(eventLinkRestored, u)
+
+	return u, nil
+}
+
+// purgeTrash removes the trashed links whose retention is over, with their history and versions
+func (srv *server) purgeTrash() (int64, error) {
+	var purged int64
+	err := srv.db.QueryRow(`
+		WITH purged AS (
+			DELETE FROM urls_trash WHERE purge_at <= CURRENT_TIMESTAMP
+			RETURNING short_code
+		),
+		history AS (
+			DELETE FROM link_history WHERE short_code IN (SELECT short_code FROM purged)
+		),
+		versions AS (
+			DELETE FROM link_destinations WHERE short_code IN (SELECT short_code FROM purged)
+		)
+		SELECT count(*) FROM purged
+	`).Scan(&purged)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge trash: %v", err)
+	}
+	return purged, nil
+}
+
+func (srv *server) startTrashPurger() {
+	if os.Getenv("TRASH_PURGE_INTERVAL") == "0" {
+		return
+	}
+
+	srv.scheduleJob("trash-purger", trashPurgeInterval, func() error {
+		purged, err := srv.purgeTrash()
+		if err != nil {
+			return err
+		}
+		if purged > 0 {
+			log.Printf("Purged %d trashed links", purged)
+		}
+		return nil
+	})
+}
+
+// restoreLinkHandler brings one of the caller's trashed links back
+func (srv *server) restoreLinkHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	u, err := srv.restoreURL(actorFromGin(c), owner, c.Param("shortCode"))
+	if err != nil {
+		switch {
+		case errors.Is(err, errShortCodeNotFound):
+			failCode(c, http.StatusNotFound, codeTrashedLinkNotFound)
+		case errors.Is(err, errCodeInUse):
+			response.Fail(c, http.StatusConflict, err.Error())
+		default:
+			log.Printf("Failed to restore short code: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to restore URL")
+		}
+		return
+	}
+
+	response.OK(c, http.StatusOK, toLinkResponse(u))
+}
+
+// listTrashHandler lists the caller's trashed links, most recently deleted first
+func (srv *server) listTrashHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{owner}
+	query := `SELECT id, short_code, original_url, COALESCE(clicks, 0), deleted_at, purge_at FROM urls_trash WHERE owner = $1`
+	if after != nil {
+		var cond string
+		cond, args = keysetCondition("deleted_at", "id", after, args)
+		query += " AND " + cond
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY deleted_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list trash: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list trash")
+		return
+	}
+	defer rows.Close()
+
+	links := []TrashedLink{}
+	for rows.Next() {
+		var l TrashedLink
+		if err := rows.Scan(&l.ID, &l.ShortCode, &l.OriginalURL, &l.Clicks, &l.DeletedAt, &l.PurgeAt); err != nil {
+			log.Printf("Failed to list trash: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list trash")
+			return
+		}
+		if l.OriginalURL, err = urlcrypto.Decrypt(l.OriginalURL); err != nil {
+			log.Printf("Failed to list trash: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list trash")
+			return
+		}
+		links = append(links, l)
+	}
+
+	nextCursor := ""
+	if len(links) > limit {
+		links = links[:limit]
+		last := links[len(links)-1]
+		nextCursor = pageCursor{Time: last.DeletedAt, ID: last.ID}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"urls": links}, nextCursor)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"shared/shardcache"
+	"shared/storage"
+)
+
+// redirect-api can spread its url:* cache entries over several Redis
+// instances (URL_CACHE_SHARDS, host:port separated by commas, or this
+// region's entry of REGION_URL_CACHE_SHARDS, see region.go). convert-api
+// lists the same shards to read, fill and invalidate those entries, which the
+// shardcache package places identically in both services. Other cache keys
+// stay in the cache Redis, and without shards url:* entries do too.
+var urlCacheShards = os.Getenv("URL_CACHE_SHARDS")
+
+const urlCacheKeyPrefix = "url:"
+
+func (srv *server) initURLCache() {
+	addrs := urlCacheShardAddrs()
+	if len(addrs) == 0 {
+		srv.urlCache = shardcache.New(shardcache.Node{Client: srv.cacheRdb})
+		return
+	}
+
+	var nodes []shardcache.Node
+	for _, addr := range addrs {
+		node := shardcache.Node{Addr: addr}
+		err := storage.Retry("cache shard "+addr, func() (err error) {
+			node.Client, err = storage.NewRedis(srv.ctx, addr)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Failed to connect to cache shard %s: %v", addr, err)
+		}
+		addRegionReplayHook(node.Client)
+		nodes = append(nodes, node)
+	}
+	srv.urlCache = shardcache.New(nodes...)
+	fmt.Printf("Connected to %d cache shards successfully\n", len(nodes))
+}
+
+// isURLCacheKey reports whether key is a url:* entry, kept in urlCache
+func isURLCacheKey(key string) bool {
+	return strings.HasPrefix(key, urlCacheKeyPrefix)
+}
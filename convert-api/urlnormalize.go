@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Destinations are stored in a canonical form, so equivalent spellings of a
+// URL group together in listings, analytics and hash codes: the scheme and host
+// are lower-cased, Unicode hostnames converted to punycode (see shared/idn),
+// default ports dropped, "." and ".." path segments resolved, an empty path
+// becomes "/" and query parameters are sorted by name, keeping the order of
+// repeated ones. Other trailing slashes, the encoding of the path and query
+// and the fragment are kept, since servers may tell them apart. Only http and
+// https URLs are rewritten.
+
+// hostnameProfile converts hostnames like a lookup would, except that it
+// keeps underscores, which some real hostnames have
+var hostnameProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// normalizeURL returns the canonical form of a submitted destination
+func normalizeURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", errInvalidURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return u.String(), nil
+	}
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if !strings.HasPrefix(u.Host, "[") {
+		if host, err = hostnameProfile.ToASCII(host); err != nil {
+			return "", errInvalidURL
+		}
+	} else {
+		host = "[" + host + "]"
+	}
+	if port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+	u.Host = host
+
+	escaped := removeDotSegments(u.EscapedPath())
+	if escaped == "" {
+		escaped = "/"
+	}
+	if u.Path, err = url.PathUnescape(escaped); err != nil {
+		return "", errInvalidURL
+	}
+	u.RawPath = escaped
+
+	u.RawQuery = sortQuery(u.RawQuery)
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// removeDotSegments resolves "." and ".." in an absolute path, as in RFC 3986
+// section 5.2.4
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, "/.") {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, s := range segments {
+		last := i == len(segments)-1
+		switch s {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// sortQuery orders the parameters of a raw query by name without re-encoding them
+func sortQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	params := strings.Split(rawQuery, "&")
+	sort.SliceStable(params, func(i, j int) bool {
+		ki, _, _ := strings.Cut(params[i], "=")
+		kj, _, _ := strings.Cut(params[j], "=")
+		return ki < kj
+	})
+	return strings.Join(params, "&")
+}
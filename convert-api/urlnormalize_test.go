@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestNormalizeURL(t *testing.T) {
+	for _, tt := range []struct {
+		raw, want string
+	}{
+		{"HTTPS://Example.COM", "https://example.com/"},
+		{"  https://example.com/a  ", "https://example.com/a"},
+		{"http://example.com:80/a", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:8443/a", "https://example.com:8443/a"},
+		{"http://example.com:443/a", "http://example.com:443/a"},
+		{"https://example.com/a/./b/../c", "https://example.com/a/c"},
+		{"https://example.com/a/..", "https://example.com/"},
+		{"https://example.com/../a", "https://example.com/a"},
+		{"https://example.com/a/", "https://example.com/a/"},
+		{"https://example.com/a%2Fb", "https://example.com/a%2Fb"},
+		{"https://example.com/?b=2&a=1&b=1", "https://example.com/?a=1&b=2&b=1"},
+		{"https://example.com/?", "https://example.com/"},
+		{"https://example.com/a#Frag", "https://example.com/a#Frag"},
+		{"https://Bücher.example/", "https://xn--bcher-kva.example/"},
+		{"https://my_host.example/", "https://my_host.example/"},
+		{"https://[2001:DB8::1]:443/", "https://[2001:db8::1]/"},
+		{"https://[2001:db8::1]:8443/", "https://[2001:db8::1]:8443/"},
+		{"FTP://Example.com/a/../b", "ftp://Example.com/a/../b"},
+	} {
+		got, err := normalizeURL(tt.raw)
+		if err != nil {
+			t.Errorf("normalizeURL(%q): %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeURLInvalid(t *testing.T) {
+	for _, raw := range []string{
+		"https://exa mple.com/",
+		"http://%zz/",
+		"https://xn--a.example/",
+	} {
+		if got, err := normalizeURL(raw); err != errInvalidURL {
+			t.Errorf("normalizeURL(%q) = %q, %v, want errInvalidURL", raw, got, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"shared/env"
+)
+
+// Create and edit requests are checked field by field before anything else
+// runs, and every problem is reported at once as a FieldError in the details
+// of the response's error, e.g.
+//
+//	{"message": "invalid request", "details": [{"field": "originalUrl", "code": "too_long", "message": "must be at most 8192 bytes"}]}
+//
+// Destinations are limited to MAX_URL_LENGTH bytes and may not contain
+// control characters or unescaped whitespace, which browsers and servers
+// handle inconsistently and which can smuggle headers into a redirect.
+var maxURLLength = env.Int("MAX_URL_LENGTH", 8192)
+
+const (
+	fieldRequired         = "required"
+	fieldTooLong          = "too_long"
+	fieldControlCharacter = "control_character"
+	fieldWhitespace       = "whitespace"
+	fieldInvalid          = "invalid"
+	fieldInPast           = "in_past"
+)
+
+// FieldError is one problem with one field of a request. Message is in
+// English until failValidation translates it, see errormessages.go.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	messageCode string
+	args        []interface{}
+}
+
+// validationError holds the field errors of a request. It matches
+// errInvalidURL and errExpiryInPast when it has errors of those fields, so
+// callers that only know the sentinels keep working.
+type validationError struct {
+	Fields []FieldError
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = f.Field + " " + f.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *validationError) Unwrap() []error {
+	errs := []error{}
+	for _, f := range e.Fields {
+		switch f.Field {
+		case "originalUrl":
+			errs = append(errs, errInvalidURL)
+		case "expiresAt":
+			errs = append(errs, errExpiryInPast)
+		}
+	}
+	return errs
+}
+
+func (e *validationError) add(field, code string, args ...interface{}) {
+	e.addMessage(field, code, fieldMessagePrefix+code, args...)
+}
+
+// addMessage adds an error of code with a message other than code's own
+func (e *validationError) addMessage(field, code, messageCode string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{
+		Field:       field,
+		Code:        code,
+		Message:     errorMessages.Message(errorMessages.Default(), messageCode, args...),
+		messageCode: messageCode,
+		args:        args,
+	})
+}
+
+// orNil returns e when it holds any field errors
+func (e *validationError) orNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// checkOriginalURL adds the problems of a submitted destination to e
+func checkOriginalURL(e *validationError, field, originalURL string) {
+	trimmed := strings.TrimSpace(originalURL)
+	if trimmed == "" {
+		e.add(field, fieldRequired)
+		return
+	}
+	if len(trimmed) > maxURLLength {
+		e.add(field, fieldTooLong, maxURLLength)
+		return
+	}
+	for _, r := range trimmed {
+		if unicode.IsControl(r) {
+			e.add(field, fieldControlCharacter)
+			return
+		}
+	}
+	if strings.IndexFunc(trimmed, unicode.IsSpace) >= 0 {
+		e.add(field, fieldWhitespace)
+	}
+}
+
+// validateCreate checks the fields of a new link
+func validateCreate(originalURL string, expiresAt *time.Time) error {
+	e := &validationError{}
+	checkOriginalURL(e, "originalUrl", originalURL)
+	if expiresAt != nil && !expiresAt.After(clock()) {
+		e.add("expiresAt", fieldInPast)
+	}
+	return e.orNil()
+}
+
+// validateDestinationInput checks a new destination of an existing link
+func validateDestinationInput(originalURL string) error {
+	e := &validationError{}
+	checkOriginalURL(e, "originalUrl", originalURL)
+	return e.orNil()
+}
+
+// bindingError turns a request body gin couldn't bind into field errors
+func bindingError(err error) error {
+	var fieldErrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	e := &validationError{}
+	switch {
+	case errors.As(err, &fieldErrs):
+		for _, f := range fieldErrs {
+			field := jsonFieldName(f.Field())
+			if f.Tag() == "required" {
+				e.add(field, fieldRequired)
+			} else {
+				e.add(field, fieldInvalid)
+			}
+		}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		e.addMessage(typeErr.Field, fieldInvalid, fieldMessageInvalidType, typeErr.Type.String())
+	default:
+		return err
+	}
+	return e
+}
+
+// jsonFieldName is the request field of a struct field, e.g. originalUrl for OriginalUrl
+func jsonFieldName(name string) string {
+	if name == "" {
+		return name
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// fieldErrors returns the field errors of a validationError
+func fieldErrors(err error) ([]FieldError, bool) {
+	var v *validationError
+	if errors.As(err, &v) {
+		return v.Fields, true
+	}
+	return nil, false
+}
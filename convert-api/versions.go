@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/response"
+	"shared/urlcrypto"
+)
+
+// Every destination a link has pointed at is kept in link_destinations,
+// numbered from 1, so its owner can roll back to an earlier one. A rollback
+// is an edit like any other: the destination is screened again, the redirect
+// cache is dropped, and it becomes the newest version. Links created before
+// versioning get their first version on their first destination change.
+const auditLinkRollback = "link.rollback"
+
+var errVersionNotFound = errors.New("version not found")
+
+const versionTablesQuery = `
+	CREATE TABLE IF NOT EXISTS link_destinations (
+		short_code VARCHAR(10) NOT NULL,
+		version INTEGER NOT NULL,
+		original_url TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (short_code, version)
+	);
+`
+
+// LinkVersion is one destination of a link
+type LinkVersion struct {
+	Version     int       `json:"version"`
+	OriginalURL string    `json:"originalUrl"`
+	Actor       string    `json:"actor"`
+	Current     bool      `json:"current"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// writeLinkVersion keeps a new destination of a link, from the destination
+// change of its history. Values are as the audit snapshot has them, so they
+// stay encrypted when encryption at rest is on.
+func writeLinkVersion(exec execer, actor auditActor, shortCode string, change LinkChange) error {
+	var from, to *string
+	if err := json.Unmarshal(change.From, &from); change.From != nil && err != nil {
+		return fmt.Errorf("failed to decode destination version: %v", err)
+	}
+	if err := json.Unmarshal(change.To, &to); err != nil || to == nil {
+		return nil
+	}
+
+	// The destination a link had before versioning becomes its first version
+	if from != nil {
+		if _, err := exec.Exec(`
+			INSERT INTO link_destinations (short_code, version, original_url, actor)
+			SELECT $1, 1, $2, ''
+			WHERE NOT EXISTS (SELECT 1 FROM link_destinations WHERE short_code = $1)
+			ON CONFLICT DO NOTHING
+		`, shortCode, *from); err != nil {
+			return fmt.Errorf("failed to record destination version: %v", err)
+		}
+	}
+
+	if _, err := exec.Exec(`
+		INSERT INTO link_destinations (short_code, version, original_url, actor)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3 FROM link_destinations WHERE short_code = $1
+	`, shortCode, *to, actor.ID); err != nil {
+		return fmt.Errorf("failed to record destination version: %v", err)
+	}
+	return nil
+}
+
+// linkVersion returns the destination of one version of a link
+func (srv *server) linkVersion(shortCode string, version int) (string, error) {
+	var stored string
+	err := srv.db.QueryRow(`
+		SELECT original_url FROM link_destinations WHERE short_code = $1 AND version = $2
+	`, shortCode, version).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return "", errVersionNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get version: %v", err)
+	}
+	return urlcrypto.Decrypt(stored)
+}
+
+// rollbackURL points one of owner's links back at the destination of an
+// earlier version
+func (srv *server) rollbackURL(actor auditActor, owner, shortCode string, version int) (*URL, error) {
+	u, err := srv.ownedURL(owner, shortCode)
+	if err != nil {
+		return nil, err
+	}
+
+	originalURL, err := srv.linkVersion(shortCode, version)
+	if err != nil {
+		return nil, err
+	}
+	if originalURL == u.OriginalURL {
+		return u, nil
+	}
+	return srv.setURLDestination(actor, auditLinkRollback, owner, shortCode, originalURL)
+}
+
+// ownedLinkParam loads the :shortCode link if the caller owns it, writing the error response otherwise
+func (srv *server) ownedLinkParam(c *gin.Context, owner, what string) (*URL, bool) {
+	u, err := srv.getURLByShortCode(c.Param("shortCode"))
+	if err == nil && u.Owner != owner {
+		err = errShortCodeNotFound
+	}
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+			return nil, false
+		}
+		log.Printf("Failed to get %s: %v", what, err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get "+what)
+		return nil, false
+	}
+	return u, true
+}
+
+// listLinkVersionsHandler lists the destinations of one of the caller's links, newest first
+func (srv *server) listLinkVersionsHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	u, ok := srv.ownedLinkParam(c, owner, "link versions")
+	if !ok {
+		return
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT version, original_url, actor, created_at FROM link_destinations
+		WHERE short_code = $1
+		ORDER BY version DESC
+	`, u.ShortCode)
+	if err != nil {
+		log.Printf("Failed to list link versions: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list link versions")
+		return
+	}
+	defer rows.Close()
+
+	versions := []LinkVersion{}
+	for rows.Next() {
+		var v LinkVersion
+		if err := rows.Scan(&v.Version, &v.OriginalURL, &v.Actor, &v.CreatedAt); err != nil {
+			log.Printf("Failed to list link versions: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list link versions")
+			return
+		}
+		if v.OriginalURL, err = urlcrypto.Decrypt(v.OriginalURL); err != nil {
+			log.Printf("Failed to list link versions: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list link versions")
+			return
+		}
+		versions = append(versions, v)
+	}
+	for i := range versions {
+		if versions[i].OriginalURL == u.OriginalURL {
+			versions[i].Current = true
+			break
+		}
+	}
+
+	response.OK(c, http.StatusOK, gin.H{"versions": versions})
+}
+
+// rollbackLinkHandler restores an earlier destination of one of the caller's links
+func (srv *server) rollbackLinkHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(c.Query("version"))
+	if err != nil || version < 1 {
+		response.Fail(c, http.StatusBadRequest, "version must be a positive integer")
+		return
+	}
+
+	u, err := srv.rollbackURL(actorFromGin(c), owner, c.Param("shortCode"), version)
+	if err != nil {
+		switch {
+		case errors.Is(err, errShortCodeNotFound):
+			failCode(c, http.StatusNotFound, codeShortCodeNotFound)
+		case errors.Is(err, errVersionNotFound):
+			failNotFound(c, err)
+		case isValidationError(err):
+			response.Fail(c, http.StatusUnprocessableEntity, err.Error())
+		default:
+			log.Printf("Failed to roll back short code: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to roll back URL")
+		}
+		return
+	}
+
+	response.OK(c, http.StatusOK, toLinkResponse(u))
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"shared/response"
+)
+
+const (
+	eventLinkCreated  = "link.created"
+	eventLinkUpdated  = "link.updated"
+	eventLinkDeleted  = "link.deleted"
+	eventLinkDisabled = "link.disabled"
+	eventLinkExpired  = "link.expired"
+	eventLinkRestored = "link.restored"
+	eventLinkBroken   = "link.broken"
+)
+
+var webhookEvents = []string{eventLinkCreated, eventLinkUpdated, eventLinkDeleted, eventLinkDisabled, eventLinkExpired, eventLinkRestored, eventLinkBroken}
+
+const webhookMaxAttempts = 3
+
+var webhookClient = newOutboundClient(5 * time.Second)
+
+const webhookTablesQuery = `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		owner TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_webhooks_owner ON webhooks(owner);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		duration_ms INTEGER NOT NULL,
+		delivered_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, delivered_at DESC, id DESC);
+`
+
+// Webhook is a tenant-registered endpoint receiving link lifecycle events
+type Webhook struct {
+	ID        int       `json:"id"`
+	Owner     string    `json:"owner"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// WebhookDelivery records a single delivery attempt
+type WebhookDelivery struct {
+	ID          int64     `json:"id"`
+	EventID     string    `json:"eventId"`
+	Event       string    `json:"event"`
+	Attempt     int       `json:"attempt"`
+	StatusCode  *int      `json:"statusCode"`
+	Error       *string   `json:"error"`
+	DurationMs  int       `json:"durationMs"`
+	DeliveredAt time.Time `json:"deliveredAt"`
+}
+
+type WebhookRequestBody struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// linkEventPayload is the signed JSON body POSTed to webhook endpoints
+type linkEventPayload struct {
+	ID        string        `json:"id"`
+	Type      string        `json:"type"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Data      linkEventData `json:"data"`
+}
+
+type linkEventData struct {
+	ShortCode   string    `json:"shortCode"`
+	ShortURL    string    `json:"shortUrl"`
+	OriginalURL string    `json:"originalUrl"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+const webhookColumns = "id, owner, url, events, active, created_at, updated_at"
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var w Webhook
+	err := row.Scan(&w.ID, &w.Owner, &w.URL, pq.Array(&w.Events), &w.Active, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validateWebhookRequest checks the target URL and defaults events to all of them
+func (srv *server) validateWebhookRequest(body *WebhookRequestBody) error {
+	target, err := url.Parse(body.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("url must be an absolute http(s) URL")
+	}
+	if err := srv.validateOutboundHost(target.Hostname()); err != nil {
+		return fmt.Errorf("url is not allowed: %v", err)
+	}
+
+	if len(body.Events) == 0 {
+		body.Events = webhookEvents
+		return nil
+	}
+
+	for _, event := range body.Events {
+		known := false
+		for _, e := range webhookEvents {
+			if event == e {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// requireCaller rejects anonymous requests; webhooks always belong to a consumer
+func requireCaller(c *gin.Context) (string, bool) {
+	owner := callerID(c)
+	if owner == "" {
+		response.Fail(c, http.StatusUnauthorized, "authentication required")
+		return "", false
+	}
+	return owner, true
+}
+
+func webhookIDParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, "invalid webhook id")
+		return 0, false
+	}
+	return id, true
+}
+
+func (srv *server) createWebhookHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var body WebhookRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := srv.validateWebhookRequest(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	active := true
+	if body.Active != nil {
+		active = *body.Active
+	}
+	secret := "whsec_" + randomHex(24)
+
+	query := `
+		INSERT INTO webhooks (owner, url, secret, events, active)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + webhookColumns
+
+	webhook, err := scanWebhook(srv.db.QueryRow(query, owner, body.URL, secret, pq.Array(body.Events), active))
+	if err != nil {
+		log.Printf("Failed to create webhook: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to create webhook")
+		return
+	}
+
+	// Audited before the secret is attached so it never lands in the log
+	srv.recordAudit(actorFromGin(c), auditWebhookCreate, auditTargetWebhook, strconv.Itoa(webhook.ID), nil, webhook)
+
+	// The signing secret is only returned once, at creation time
+	webhook.Secret = secret
+	response.OK(c, http.StatusCreated, webhook)
+}
+
+func (srv *server) listWebhooksHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{owner}
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE owner = $1`
+	if after != nil {
+		var condition string
+		condition, args = keysetCondition("created_at", "id", after, args)
+		query += " AND " + condition
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list webhooks: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list webhooks")
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			log.Printf("Failed to list webhooks: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list webhooks")
+			return
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	nextCursor := ""
+	if len(webhooks) > limit {
+		webhooks = webhooks[:limit]
+		last := webhooks[len(webhooks)-1]
+		nextCursor = pageCursor{Time: last.CreatedAt, ID: int64(last.ID)}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"webhooks": webhooks}, nextCursor)
+}
+
+func (srv *server) getWebhookHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := webhookIDParam(c)
+	if !ok {
+		return
+	}
+
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = $1 AND owner = $2`
+	webhook, err := scanWebhook(srv.db.QueryRow(query, id, owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeWebhookNotFound)
+			return
+		}
+		log.Printf("Failed to get webhook: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to get webhook")
+		return
+	}
+
+	response.OK(c, http.StatusOK, webhook)
+}
+
+func (srv *server) updateWebhookHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := webhookIDParam(c)
+	if !ok {
+		return
+	}
+
+	var body WebhookRequestBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := srv.validateWebhookRequest(&body); err != nil {
+		response.Fail(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	before, err := scanWebhook(srv.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = $1 AND owner = $2`, id, owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeWebhookNotFound)
+			return
+		}
+		log.Printf("Failed to update webhook: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update webhook")
+		return
+	}
+
+	query := `
+		UPDATE webhooks
+		SET url = $3, events = $4, active = COALESCE($5, active), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND owner = $2
+		RETURNING ` + webhookColumns
+
+	webhook, err := scanWebhook(srv.db.QueryRow(query, id, owner, body.URL, pq.Array(body.Events), body.Active))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeWebhookNotFound)
+			return
+		}
+		log.Printf("Failed to update webhook: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to update webhook")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditWebhookUpdate, auditTargetWebhook, strconv.Itoa(id), before, webhook)
+
+	response.OK(c, http.StatusOK, webhook)
+}
+
+func (srv *server) deleteWebhookHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := webhookIDParam(c)
+	if !ok {
+		return
+	}
+
+	query := `DELETE FROM webhooks WHERE id = $1 AND owner = $2 RETURNING ` + webhookColumns
+	webhook, err := scanWebhook(srv.db.QueryRow(query, id, owner))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			failCode(c, http.StatusNotFound, codeWebhookNotFound)
+			return
+		}
+		log.Printf("Failed to delete webhook: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to delete webhook")
+		return
+	}
+
+	srv.recordAudit(actorFromGin(c), auditWebhookDelete, auditTargetWebhook, strconv.Itoa(id), webhook, nil)
+
+	c.Status(http.StatusNoContent)
+}
+
+func (srv *server) listWebhookDeliveriesHandler(c *gin.Context) {
+	owner, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	id, ok := webhookIDParam(c)
+	if !ok {
+		return
+	}
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	args := []interface{}{id, owner}
+	query := `
+		SELECT d.id, d.event_id, d.event, d.attempt, d.status_code, d.error, d.duration_ms, d.delivered_at
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.webhook_id = $1 AND w.owner = $2
+	`
+	if after != nil {
+		var condition string
+		condition, args = keysetCondition("d.delivered_at", "d.id", after, args)
+		query += " AND " + condition
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" ORDER BY d.delivered_at DESC, d.id DESC LIMIT $%d", len(args))
+
+	rows, err := srv.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to list webhook deliveries: %v", err)
+		response.Fail(c, http.StatusInternalServerError, "failed to list deliveries")
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.EventID, &d.Event, &d.Attempt, &d.StatusCode, &d.Error, &d.DurationMs, &d.DeliveredAt); err != nil {
+			log.Printf("Failed to list webhook deliveries: %v", err)
+			response.Fail(c, http.StatusInternalServerError, "failed to list deliveries")
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	nextCursor := ""
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		last := deliveries[len(deliveries)-1]
+		nextCursor = pageCursor{Time: last.DeliveredAt, ID: last.ID}.encode()
+	}
+
+	setPageLinks(c, nextCursor)
+	response.List(c, gin.H{"deliveries": deliveries}, nextCursor)
+}
+
+// emitLinkEvent queues an event for the link owner's webhooks, see eventoutbox.go
+func (srv *server) emitLinkEvent(event string, u *URL) {
+	if u.Owner == "" {
+		return
+	}
+
+	if err := writeLinkEvent(srv.db, event, u); err != nil {
+		log.Printf("Failed to emit %s for %s: %v", event, u.ShortCode, err)
+		return
+	}
+	wakeLinkEventRelay()
+}
+
+func (srv *server) dispatchLinkEvent(owner string, payload linkEventPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook payload: %v", err)
+		return
+	}
+
+	query := `
+		SELECT id, url, secret FROM webhooks
+		WHERE owner = $1 AND active AND $2 = ANY(events)
+	`
+	rows, err := srv.db.Query(query, owner, payload.Type)
+	if err != nil {
+		log.Printf("Failed to load webhooks for %s: %v", owner, err)
+		return
+	}
+
+	type target struct {
+		id     int
+		url    string
+		secret string
+	}
+	targets := []target{}
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.id, &t.url, &t.secret); err != nil {
+			log.Printf("Failed to load webhooks for %s: %v", owner, err)
+			rows.Close()
+			return
+		}
+		targets = append(targets, t)
+	}
+	rows.Close()
+
+	for _, t := range targets {
+		go srv.deliverWebhook(t.id, t.url, t.secret, payload, body)
+	}
+}
+
+// signWebhookPayload computes the X-Webhook-Signature value over "<timestamp>.<body>"
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook POSTs the payload with exponential backoff, logging every attempt
+func (srv *server) deliverWebhook(webhookID int, targetURL, secret string, payload linkEventPayload, body []byte) {
+	backoff := time.Second
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		started := time.Now()
+
+		var statusCode *int
+		var deliveryErr *string
+
+		req, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", "url-shortener-webhooks/1.0")
+			req.Header.Set("X-Webhook-Id", payload.ID)
+			req.Header.Set("X-Webhook-Event", payload.Type)
+			req.Header.Set("X-Webhook-Timestamp", timestamp)
+			req.Header.Set("X-Webhook-Signature", signWebhookPayload(secret, timestamp, body))
+
+			var resp *http.Response
+			resp, err = webhookClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				statusCode = &resp.StatusCode
+				if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+					err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+				}
+			}
+		}
+		if err != nil {
+			msg := err.Error()
+			deliveryErr = &msg
+		}
+
+		_, logErr := srv.db.Exec(`
+			INSERT INTO webhook_deliveries (webhook_id, event_id, event, attempt, status_code, error, duration_ms)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, webhookID, payload.ID, payload.Type, attempt, statusCode, deliveryErr, time.Since(started).Milliseconds())
+		if logErr != nil {
+			log.Printf("Failed to record webhook delivery: %v", logErr)
+		}
+
+		if err == nil {
+			return
+		}
+
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 4
+		}
+	}
+
+	log.Printf("Webhook %d gave up delivering %s after %d attempts", webhookID, payload.ID, webhookMaxAttempts)
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestSignWebhookPayload(t *testing.T) {
+	// printf '1700000000.{"type":"link.created"}' | openssl dgst -sha256 -hmac whsec_test
+	const want = "sha256=a8bc0e81c6d690227723d3996e08475a00b6e8824f86e0ac87eff09a0215ef05"
+	if got := signWebhookPayload("whsec_test", "1700000000", []byte(`{"type":"link.created"}`)); got != want {
+		t.Errorf("Signed %s, want %s", got, want)
+	}
+	if signWebhookPayload("whsec_other", "1700000000", []byte(`{"type":"link.created"}`)) == want {
+		t.Error("Signature ignores the secret")
+	}
+	if signWebhookPayload("whsec_test", "1700000001", []byte(`{"type":"link.created"}`)) == want {
+		t.Error("Signature ignores the timestamp")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"convert-api/dbq"
+
+	"shared/env"
+	"shared/slowquery"
+	"shared/urlcrypto"
+)
+
+// The write buffer groups concurrent creates into multi-row INSERTs. A worker
+// takes the first pending insert, waits up to WRITE_BUFFER_WINDOW for more (or
+// until WRITE_BUFFER_MAX_BATCH), and inserts them in one statement; each caller
+// is answered once the statement has committed. Unset WRITE_BUFFER_WINDOW
+// disables buffering, since it adds up to one window of latency per create.
+var (
+	writeBufferWindow   = env.Duration("WRITE_BUFFER_WINDOW", 0)
+	writeBufferMaxBatch = env.Int("WRITE_BUFFER_MAX_BATCH", 500)
+	writeBufferWorkers  = env.Int("WRITE_BUFFER_WORKERS", 4)
+)
+
+type pendingInsert struct {
+	ctx    context.Context
+	url    *URL
+	actor  auditActor
+	result chan insertResult
+}
+
+type insertResult struct {
+	url *URL
+	err error
+}
+
+// insertQueue is nil while buffering is disabled
+var insertQueue chan pendingInsert
+
+// bufferInsert queues u for the next batch. A caller whose ctx ends before the
+// batch is written is answered with its error, and its row is left out unless
+// the batch was already being written.
+func bufferInsert(ctx context.Context, u *URL, actor auditActor) (*URL, error) {
+	result := make(chan insertResult, 1)
+	select {
+	case insertQueue <- pendingInsert{ctx: ctx, url: u, actor: actor, result: result}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case r := <-result:
+		return r.url, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (srv *server) startWriteBuffer() {
+	if writeBufferWindow <= 0 {
+		return
+	}
+
+	insertQueue = make(chan pendingInsert, writeBufferMaxBatch*writeBufferWorkers)
+	for i := 0; i < writeBufferWorkers; i++ {
+		go srv.writeBufferWorker()
+	}
+	log.Printf("Write buffer enabled: %s window, batches of up to %d", writeBufferWindow, writeBufferMaxBatch)
+}
+
+func (srv *server) writeBufferWorker() {
+	for first := range insertQueue {
+		batch := []pendingInsert{first}
+		timer := time.NewTimer(writeBufferWindow)
+	collect:
+		for len(batch) < writeBufferMaxBatch {
+			select {
+			case p := <-insertQueue:
+				batch = append(batch, p)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		srv.flushInserts(batch)
+	}
+}
+
+// flushInserts writes a batch, retrying row by row when the batch fails so one
+// bad row only fails its own request
+func (srv *server) flushInserts(batch []pendingInsert) {
+	live := batch[:0]
+	for _, p := range batch {
+		if err := p.ctx.Err(); err != nil {
+			p.result <- insertResult{nil, err}
+			continue
+		}
+		live = append(live, p)
+	}
+	batch = live
+	if len(batch) == 0 {
+		return
+	}
+	if len(batch) == 1 {
+		u, err := srv.insertURL(batch[0].ctx, batch[0].url, batch[0].actor)
+		batch[0].result <- insertResult{u, err}
+		return
+	}
+
+	saved, err := srv.insertURLs(batch)
+	if err != nil {
+		log.Printf("Batch insert of %d URLs failed, retrying individually: %v", len(batch), err)
+		for _, p := range batch {
+			u, err := srv.insertURL(p.ctx, p.url, p.actor)
+			p.result <- insertResult{u, err}
+		}
+		return
+	}
+
+	for i, p := range batch {
+		p.result <- insertResult{saved[i], nil}
+	}
+}
+
+// insertURLs inserts several mappings in one statement, with their audit
+// entries and events in the same transaction, and returns them in input order.
+// It runs with the first request's context, without its cancellation, so one
+// caller going away doesn't fail the others.
+func (srv *server) insertURLs(batch []pendingInsert) ([]*URL, error) {
+	var params dbq.InsertURLsParams
+	for _, p := range batch {
+		u := p.url
+		storedURL, err := urlcrypto.Encrypt(u.OriginalURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt URL: %v", err)
+		}
+		expiresAt := ""
+		if u.ExpiresAt != nil {
+			expiresAt = u.ExpiresAt.Format(time.RFC3339Nano)
+		}
+		params.OriginalUrls = append(params.OriginalUrls, storedURL)
+		params.ShortCodes = append(params.ShortCodes, u.ShortCode)
+		params.Owners = append(params.Owners, u.Owner)
+		params.FlagReasons = append(params.FlagReasons, stringOrEmpty(u.FlagReason))
+		params.DisabledReasons = append(params.DisabledReasons, stringOrEmpty(u.DisabledReason))
+		params.ExpiresAt = append(params.ExpiresAt, expiresAt)
+		params.CodeGenerators = append(params.CodeGenerators, stringOrEmpty(u.CodeGenerator))
+	}
+
+	batchCtx := context.WithoutCancel(batch[0].ctx)
+	tx, err := srv.db.BeginTx(batchCtx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save URLs: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := srv.queries.WithTx(tx).InsertURLs(slowquery.Tag(batchCtx, "", ""), params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save URLs: %v", err)
+	}
+	inserted, err := urlsFromRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save URLs: %v", err)
+	}
+
+	// RETURNING order isn't guaranteed, so match rows back by short code
+	byCode := make(map[string]*URL, len(batch))
+	for _, u := range inserted {
+		byCode[u.ShortCode] = u
+	}
+
+	saved := make([]*URL, len(batch))
+	for i, p := range batch {
+		if saved[i] = byCode[p.url.ShortCode]; saved[i] == nil {
+			return nil, fmt.Errorf("failed to save URLs: %s missing from result", p.url.ShortCode)
+		}
+		if err := writeCreation(tx, p.actor, saved[i]); err != nil {
+			return nil, fmt.Errorf("failed to save URLs: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to save URLs: %v", err)
+	}
+	wakeLinkEventRelay()
+	return saved, nil
+}
+
+// stringOrEmpty is *s, or "" for nil, which InsertURLs reads as NULL
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,10 @@
+// Package e2e holds the end-to-end suite, which runs both services, Postgres,
+// the two Redis instances and the Kong gateway in throwaway containers and
+// goes through a link's life over the public HTTP API. It needs Docker and
+// only builds with the e2e tag:
+//
+//	cd e2e && go test -tags e2e -v ./...
+//
+// Without the tag only the checks of the gateway config run, which need
+// nothing else.
+package e2e
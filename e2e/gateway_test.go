@@ -0,0 +1,97 @@
+package e2e
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// gatewayRoutes reads the routes of api-gateway/kong.yml by service
+func gatewayRoutes(t *testing.T) map[string][]string {
+	t.Helper()
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(root, "api-gateway", "kong.yml"))
+	if err != nil {
+		t.Fatalf("Failed to read the gateway config: %v", err)
+	}
+	var config struct {
+		Services []struct {
+			Name   string
+			Routes []struct {
+				Paths []string
+			}
+		}
+	}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		t.Fatalf("Failed to parse the gateway config: %v", err)
+	}
+
+	paths := map[string][]string{}
+	for _, service := range config.Services {
+		for _, route := range service.Routes {
+			paths[service.Name] = append(paths[service.Name], route.Paths...)
+		}
+	}
+	return paths
+}
+
+// kongRegex compiles a Kong regex path, which is anchored at the start of the
+// request path and names groups the PCRE way
+func kongRegex(t *testing.T, path string) *regexp.Regexp {
+	t.Helper()
+	re, err := regexp.Compile("^" + strings.ReplaceAll(strings.TrimPrefix(path, "~"), "(?<", "(?P<"))
+	if err != nil {
+		t.Fatalf("Failed to compile %s: %v", path, err)
+	}
+	return re
+}
+
+// TestGatewayRedirectRoutes checks which public paths Kong hands to
+// redirect-api, without starting anything
+func TestGatewayRedirectRoutes(t *testing.T) {
+	var routes []*regexp.Regexp
+	for _, path := range gatewayRoutes(t)["redirect-api"] {
+		if strings.HasPrefix(path, "~") {
+			routes = append(routes, kongRegex(t, path))
+		}
+	}
+	if len(routes) == 0 {
+		t.Fatal("No regex route for redirect-api")
+	}
+	routed := func(path string) bool {
+		for _, re := range routes {
+			if re.MatchString(path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/aB3dE5g", true},
+		{"/my-campaign", true},
+		{"/aB3dE5g+", true},
+		{"/aB3dE5g/stats", true},
+		{"/aB3dE5g/preview", true},
+		{"/😀🚀", true},
+		{"/😀🚀/preview", true},
+		{"/aB3dE5g/previews", false},
+		{"/aB3dE5g/preview/extra", false},
+		{"/api/v1/urls", false},
+		{"/api/health", false},
+	} {
+		if got := routed(tt.path); got != tt.want {
+			t.Errorf("%s routed to redirect-api: %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
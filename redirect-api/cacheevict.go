@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+)
+
+// convert-api's cache invalidation endpoint deletes the Redis entries itself
+// and publishes the codes and patterns on cacheEvictChannel; every instance
+// drops them from its hot snapshot, which would otherwise keep serving the
+// stale destination if Redis became unreachable before the next rebuild.
+const cacheEvictChannel = "cache:evict"
+
+// CacheEviction is the message convert-api publishes
+type CacheEviction struct {
+	ShortCodes []string `json:"shortCodes"`
+	Patterns   []string `json:"patterns"`
+}
+
+// matches reports whether the eviction covers a code. Patterns use Redis glob
+// syntax, which path.Match shares for codes without slashes.
+func (e *CacheEviction) matches(code string) bool {
+	for _, c := range e.ShortCodes {
+		if normalizeShortCode(c) == code {
+			return true
+		}
+	}
+	for _, p := range e.Patterns {
+		if ok, _ := path.Match(normalizeShortCode(p), code); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// evictHotSnapshot swaps in a copy of the snapshot without the evicted codes
+func evictHotSnapshot(eviction *CacheEviction) int {
+	for {
+		current := hotSnapshot.Load()
+		if current == nil {
+			return 0
+		}
+		snapshot := make(map[string]string, len(*current))
+		for code, value := range *current {
+			if !eviction.matches(code) {
+				snapshot[code] = value
+			}
+		}
+		evicted := len(*current) - len(snapshot)
+		if evicted == 0 || hotSnapshot.CompareAndSwap(current, &snapshot) {
+			return evicted
+		}
+	}
+}
+
+// startCacheEvictions listens for evictions; go-redis resubscribes after a
+// dropped connection, though evictions published meanwhile are missed
+func (srv *server) startCacheEvictions() {
+	if hotSnapshotSize == 0 {
+		return
+	}
+
+	pubsub := srv.rdb.Subscribe(srv.ctx, cacheEvictChannel)
+	go func() {
+		for msg := range pubsub.Channel() {
+			var eviction CacheEviction
+			if err := json.Unmarshal([]byte(msg.Payload), &eviction); err != nil {
+				log.Printf("Ignoring malformed cache eviction: %v", err)
+				continue
+			}
+			if n := evictHotSnapshot(&eviction); n > 0 {
+				log.Printf("Evicted %d links from the hot snapshot", n)
+			}
+		}
+	}()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"shared/env"
+	"shared/tenantcache"
+)
+
+// A cache hit with less than CACHE_REFRESH_AHEAD of its TTL left reloads the
+// entry from Postgres in the background, so links that keep being visited
+// never expire and fall through to the database on the request path.
+var cacheRefreshAhead = env.Duration("CACHE_REFRESH_AHEAD", 5*time.Minute)
+
+// cacheRefreshLockTTL bounds how long one instance holds the refresh of a key
+const cacheRefreshLockTTL = 10 * time.Second
+
+// refreshing dedupes refreshes within this instance
+var refreshing sync.Map
+
+func (srv *server) refreshAhead(shortCode string, ttl time.Duration) {
+	// PTTL is negative for keys without an expiry or that just disappeared
+	if ttl <= 0 || ttl > cacheRefreshAhead {
+		return
+	}
+	if _, busy := refreshing.LoadOrStore(shortCode, struct{}{}); busy {
+		return
+	}
+
+	go func() {
+		defer refreshing.Delete(shortCode)
+
+		// Only one instance refreshes a given key
+		locked, err := srv.rdb.SetNX(srv.ctx, "refresh:url:"+shortCode, 1, cacheRefreshLockTTL).Result()
+		if err != nil || !locked {
+			return
+		}
+		srv.refreshURLCache(shortCode)
+	}()
+}
+
+// refreshURLCache reloads a cached destination, dropping it if the link is gone or disabled
+func (srv *server) refreshURLCache(shortCode string) {
+	urlData, err := srv.lookupURL(srv.ctx, shortCode)
+	if errors.Is(err, errShortCodeNotFound) || (err == nil && urlData.DisabledAt != nil) {
+		key := "url:" + shortCode
+		tenantcache.Del(srv.ctx, srv.urlCache.Client(key), key)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to refresh cache for %s: %v", shortCode, err)
+		return
+	}
+	srv.saveURLCache(srv.ctx, shortCode, urlData.Owner, urlData.cacheValue(), urlData.ExpiresAt)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"shared/env"
+	"shared/storage"
+)
+
+// CLICK_TRANSPORT=stream or nats sends clicks as events instead of through
+// the tenants' clicks:pending hashes, for deployments that want click events
+// without running Kafka. Every flush publishes one event holding that
+// instance's counts of all tenants, keyed like the hash fields. Instances consume the events as one
+// group and acknowledge them once their clicks have committed; events a
+// crashed or failing instance leaves unacknowledged are delivered again after
+// clicksAbandonedAfter. Other consumers, such as an analytics pipeline, can
+// read the same events through their own group. Events are kept up to about
+// CLICK_STREAM_MAXLEN, so ones no group got to in time are dropped.
+// convert-api's live click counts only include persisted clicks in this mode.
+const (
+	clickTransportHash   = "hash"
+	clickTransportStream = "stream"
+	clickTransportNATS   = "nats"
+	clickEventBatch      = 500
+	// clickEventRegionField carries the publishing instance's REGION in stream events
+	clickEventRegionField = "region"
+)
+
+var (
+	clickTransport         = env.Get("CLICK_TRANSPORT", clickTransportHash)
+	clickStreamGroup       = env.Get("CLICK_STREAM_GROUP", "click-persister")
+	clickStreamMaxLen      = env.Int("CLICK_STREAM_MAXLEN", 100000)
+	clickStreamConsumer, _ = os.Hostname()
+)
+
+// clickEvents is a transport for click events
+type clickEvents interface {
+	// Connect prepares the transport once Redis is up
+	Connect() error
+	// Publish sends one flush's counts
+	Publish(counts map[string]int64) error
+	// Persist adds a batch of events, including ones other consumers left
+	// unacknowledged too long, to the click tables in one transaction and
+	// acknowledges them. It returns how many events it read.
+	Persist() (int, error)
+}
+
+// clickEventTransport is nil when clicks go through the hash
+var clickEventTransport clickEvents
+
+func (srv *server) initClickTransport() error {
+	if clickTransport != clickTransportHash && clickStreamMaxLen <= 0 {
+		return fmt.Errorf("CLICK_STREAM_MAXLEN must be positive")
+	}
+	switch clickTransport {
+	case clickTransportHash:
+		return nil
+	case clickTransportStream:
+		clickEventTransport = &redisClickStream{srv: srv, key: env.Get("CLICK_STREAM_KEY", "clicks:stream")}
+		return nil
+	case clickTransportNATS:
+		clickEventTransport = &natsClickStream{
+			srv:     srv,
+			url:     env.Get("NATS_URL", "nats://localhost:4222"),
+			stream:  env.Get("NATS_CLICK_STREAM", "CLICKS"),
+			subject: env.Get("NATS_CLICK_SUBJECT", "clicks.redirect"),
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown CLICK_TRANSPORT %q, expected hash, stream or nats", clickTransport)
+	}
+}
+
+// connectClickTransport connects the event transport, if any, at startup
+func connectClickTransport() {
+	if clickEventTransport == nil {
+		return
+	}
+	err := storage.Retry("click transport", clickEventTransport.Connect)
+	if err != nil {
+		log.Fatalf("Failed to connect the %s click transport: %v", clickTransport, err)
+	}
+}
+
+// persistClickEvents drains the transport batch by batch
+func persistClickEvents() {
+	for {
+		n, err := clickEventTransport.Persist()
+		if err != nil {
+			log.Printf("Failed to persist click events: %v", err)
+			return
+		}
+		if n < clickEventBatch {
+			return
+		}
+	}
+}
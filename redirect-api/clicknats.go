@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// natsClickStream carries click events as JSON messages on NATS_CLICK_SUBJECT,
+// kept by the JetStream stream NATS_CLICK_STREAM and read by instances through
+// the shared durable pull consumer CLICK_STREAM_GROUP. Both are created or
+// updated on startup. Messages carry the instance's REGION in a Region header.
+type natsClickStream struct {
+	srv      *server
+	url      string
+	stream   string
+	subject  string
+	js       jetstream.JetStream
+	consumer jetstream.Consumer
+}
+
+// natsTimeout bounds each publish and setup call
+const natsTimeout = 5 * time.Second
+
+func (s *natsClickStream) Connect() error {
+	nc, err := nats.Connect(s.url, nats.Name("redirect-api"), nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+
+	setupCtx, cancel := context.WithTimeout(s.srv.ctx, natsTimeout)
+	defer cancel()
+	_, err = js.CreateOrUpdateStream(setupCtx, jetstream.StreamConfig{
+		Name:     s.stream,
+		Subjects: []string{s.subject},
+		MaxMsgs:  int64(clickStreamMaxLen),
+		Discard:  jetstream.DiscardOld,
+	})
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("failed to set up stream %s: %v", s.stream, err)
+	}
+	consumer, err := js.CreateOrUpdateConsumer(setupCtx, s.stream, jetstream.ConsumerConfig{
+		Durable:   clickStreamGroup,
+		AckPolicy: jetstream.AckExplicitPolicy,
+		// Unacknowledged events go to another instance after this long
+		AckWait: clicksAbandonedAfter,
+	})
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("failed to set up consumer %s: %v", clickStreamGroup, err)
+	}
+	s.js, s.consumer = js, consumer
+	return nil
+}
+
+func (s *natsClickStream) Publish(counts map[string]int64) error {
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	publishCtx, cancel := context.WithTimeout(s.srv.ctx, natsTimeout)
+	defer cancel()
+	msg := nats.NewMsg(s.subject)
+	msg.Data = data
+	if region != "" {
+		msg.Header.Set("Region", region)
+	}
+	_, err = s.js.PublishMsg(publishCtx, msg)
+	return err
+}
+
+func (s *natsClickStream) Persist() (int, error) {
+	batch, err := s.consumer.FetchNoWait(clickEventBatch)
+	if err != nil {
+		return 0, err
+	}
+	// Each event is a batch of its own, named by its stream sequence, so one
+	// redelivered after a failed acknowledgement is skipped by writeClicks
+	batches := []clickBatch{}
+	messages := []jetstream.Msg{}
+	for msg := range batch.Messages() {
+		messages = append(messages, msg)
+		var event map[string]int64
+		// Malformed events are acknowledged with the batch and skipped
+		if err := json.Unmarshal(msg.Data(), &event); err != nil {
+			continue
+		}
+		counts := map[string]int64{}
+		for field, n := range event {
+			if n > 0 {
+				counts[field] += n
+			}
+		}
+		var id string
+		if meta, err := msg.Metadata(); err == nil {
+			id = fmt.Sprintf("nats:%s:%d", s.stream, meta.Sequence.Stream)
+		}
+		batches = append(batches, clickBatch{id: id, counts: counts})
+	}
+	if err := batch.Error(); err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	if err := s.srv.writeClicks(batches); err != nil {
+		return 0, err
+	}
+	for _, msg := range messages {
+		if err := msg.Ack(); err != nil {
+			return len(messages), fmt.Errorf("failed to acknowledge click events: %v", err)
+		}
+	}
+	return len(messages), nil
+}
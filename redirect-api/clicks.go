@@ -0,0 +1,488 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"shared/env"
+	"shared/tenantcache"
+)
+
+// Clicks are counted write-behind: redirects increment an in-process map, which
+// is added to the owner's clicks:pending hash under its tenant prefix (and the
+// popularity sets) every CLICK_FLUSH_INTERVAL, see the tenantcache package.
+// Owners with pending clicks are listed in clickTenantsKey. Every
+// CLICK_PERSIST_INTERVAL one instance renames their hashes away and adds them
+// to link_clicks in Postgres in a single statement, so redirects never write
+// to the database. Link-in-bio button clicks travel in the page owner's hash
+// as "page:<page id>:<short code>" fields and end up in page_links.
+// CLICK_TRANSPORT can replace the hashes with an event transport, see
+// clickevents.go.
+const (
+	clicksPendingKey     = "clicks:pending"
+	clickTenantsKey      = "clicks:tenants"
+	pageClickFieldPrefix = "page:"
+	clicksPersistingKey  = "clicks:persisting:"
+	clicksAbandonedAfter = time.Minute
+)
+
+// Redirect cache hits and misses are counted per UTC day in
+// "stats:redirect_cache:<YYYY-MM-DD>" for convert-api's admin stats, and
+// redirect outcomes by status code in "stats:redirects:<YYYY-MM-DD>" for its
+// dashboard's error rates
+const (
+	cacheStatsKeyPrefix    = "stats:redirect_cache:"
+	redirectStatsKeyPrefix = "stats:redirects:"
+	cacheStatsRetention    = 31 * 24 * time.Hour
+)
+
+var (
+	clickFlushInterval   = env.Duration("CLICK_FLUSH_INTERVAL", time.Second)
+	clickPersistInterval = env.Duration("CLICK_PERSIST_INTERVAL", 5*time.Second)
+)
+
+// tenantCounts are counts by owner, then by short code or pageClickField
+type tenantCounts map[string]map[string]int64
+
+func (c tenantCounts) add(owner, field string, n int64) {
+	if c[owner] == nil {
+		c[owner] = map[string]int64{}
+	}
+	c[owner][field] += n
+}
+
+// hits counts redirects per owner and short code between flushes, so
+// recording one is a map increment
+var hits = struct {
+	sync.Mutex
+	counts tenantCounts
+}{counts: tenantCounts{}}
+
+func recordHit(owner, shortCode string) {
+	hits.Lock()
+	hits.counts.add(owner, shortCode, 1)
+	hits.Unlock()
+}
+
+// pageHits counts link-in-bio button clicks per page owner and
+// pageClickField between flushes
+var pageHits = struct {
+	sync.Mutex
+	counts tenantCounts
+}{counts: tenantCounts{}}
+
+func pageClickField(pageID int, shortCode string) string {
+	return pageClickFieldPrefix + strconv.Itoa(pageID) + ":" + shortCode
+}
+
+func recordPageClick(owner string, pageID int, shortCode string) {
+	field := pageClickField(pageID, shortCode)
+	pageHits.Lock()
+	pageHits.counts.add(owner, field, 1)
+	pageHits.Unlock()
+}
+
+var cacheHits, cacheMisses atomic.Int64
+
+// redirectStatuses counts redirect outcomes by status code between flushes
+var redirectStatuses = struct {
+	sync.Mutex
+	counts map[int]int64
+}{counts: map[int]int64{}}
+
+func recordRedirectStatus(status int) {
+	redirectStatuses.Lock()
+	redirectStatuses.counts[status]++
+	redirectStatuses.Unlock()
+}
+
+// recordCacheLookup counts one redirect cache lookup that reached Redis
+func recordCacheLookup(hit bool) {
+	if hit {
+		cacheHits.Add(1)
+	} else {
+		cacheMisses.Add(1)
+	}
+}
+
+// flushHits adds the local counts to Redis in one pipeline. On failure they are
+// dropped rather than kept, so a Redis outage can't grow the map without bound.
+func (srv *server) flushHits() error {
+	hits.Lock()
+	counts := hits.counts
+	hits.counts = make(tenantCounts, len(counts))
+	hits.Unlock()
+
+	pageHits.Lock()
+	pageCounts := pageHits.counts
+	pageHits.counts = make(tenantCounts, len(pageCounts))
+	pageHits.Unlock()
+
+	redirectStatuses.Lock()
+	statusCounts := redirectStatuses.counts
+	redirectStatuses.counts = make(map[int]int64, len(statusCounts))
+	redirectStatuses.Unlock()
+
+	cacheHitCount, cacheMissCount := cacheHits.Swap(0), cacheMisses.Swap(0)
+
+	if len(counts) == 0 && len(pageCounts) == 0 && len(statusCounts) == 0 && cacheHitCount == 0 && cacheMissCount == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	_, err := srv.rdb.Pipelined(srv.ctx, func(pipe redis.Pipeliner) error {
+		if cacheHitCount > 0 || cacheMissCount > 0 {
+			statsKey := cacheStatsKeyPrefix + now.UTC().Format(time.DateOnly)
+			pipe.HIncrBy(srv.ctx, statsKey, "hits", cacheHitCount)
+			pipe.HIncrBy(srv.ctx, statsKey, "misses", cacheMissCount)
+			pipe.Expire(srv.ctx, statsKey, cacheStatsRetention)
+		}
+		if len(statusCounts) > 0 {
+			statsKey := redirectStatsKeyPrefix + now.UTC().Format(time.DateOnly)
+			for status, n := range statusCounts {
+				pipe.HIncrBy(srv.ctx, statsKey, strconv.Itoa(status), n)
+			}
+			pipe.Expire(srv.ctx, statsKey, cacheStatsRetention)
+		}
+		if clickEventTransport == nil && (len(counts) > 0 || len(pageCounts) > 0) {
+			owners := []interface{}{}
+			for _, byOwner := range []tenantCounts{counts, pageCounts} {
+				for owner, fields := range byOwner {
+					for field, n := range fields {
+						pipe.HIncrBy(srv.ctx, tenantcache.Key(owner, clicksPendingKey), field, n)
+					}
+					owners = append(owners, owner)
+				}
+			}
+			// Listed after the increments, so a claim between the two
+			// never misses a hash, see claimPendingClicks
+			pipe.SAdd(srv.ctx, clickTenantsKey, owners...)
+		}
+		if hotSnapshotSize > 0 && len(counts) > 0 {
+			owners := make([]interface{}, 0, len(counts))
+			for owner, codes := range counts {
+				popularity := tenantcache.Key(owner, popularityKey(now))
+				for code, n := range codes {
+					pipe.ZIncrBy(srv.ctx, popularity, float64(n), code)
+				}
+				pipe.Expire(srv.ctx, popularity, popularityWindow+popularityBucket)
+				owners = append(owners, owner)
+			}
+			pipe.SAdd(srv.ctx, popularTenantsKey(now), owners...)
+			pipe.Expire(srv.ctx, popularTenantsKey(now), popularityWindow+popularityBucket)
+		}
+		return nil
+	})
+
+	// Events don't depend on Redis, so they are published even if it failed
+	if clickEventTransport != nil && (len(counts) > 0 || len(pageCounts) > 0) {
+		events := map[string]int64{}
+		for _, byOwner := range []tenantCounts{counts, pageCounts} {
+			for _, fields := range byOwner {
+				for field, n := range fields {
+					events[field] += n
+				}
+			}
+		}
+		if publishErr := clickEventTransport.Publish(events); err == nil {
+			err = publishErr
+		}
+	}
+	return err
+}
+
+// claimPendingClicks renames the pending hash of each owner in
+// clickTenantsKey to a key only this call knows, so increments arriving
+// meanwhile start a fresh hash. An owner leaves the list before its hash is
+// renamed: a hash started in between is listed again by the flush that
+// started it. The unprefixed hash of instances not upgraded yet is claimed too.
+func (srv *server) claimPendingClicks() ([]string, error) {
+	owners, err := srv.rdb.SMembers(srv.ctx, clickTenantsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	keys := []string{}
+	claim := func(prefix string) error {
+		key := fmt.Sprintf("%s%s%d:%s:%x", prefix, clicksPersistingKey, time.Now().Unix(), hostname, rand.Uint64())
+		if err := srv.rdb.Rename(srv.ctx, prefix+clicksPendingKey, key).Err(); err != nil {
+			if strings.Contains(err.Error(), "no such key") {
+				return nil
+			}
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	}
+
+	for _, owner := range owners {
+		if err := srv.rdb.SRem(srv.ctx, clickTenantsKey, owner).Err(); err != nil {
+			return keys, err
+		}
+		if err := claim(tenantcache.Prefix(owner)); err != nil {
+			return keys, err
+		}
+	}
+	return keys, claim("")
+}
+
+// abandonedClickKeys finds persisting hashes left behind by an instance that
+// died mid-persist, and claims each by renaming it
+func (srv *server) abandonedClickKeys() ([]string, error) {
+	keys := []string{}
+	iter := srv.rdb.Scan(srv.ctx, 0, "*"+clicksPersistingKey+"*", 100).Iterator()
+	for iter.Next(srv.ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	claimed := []string{}
+	cutoff := time.Now().Add(-clicksAbandonedAfter).Unix()
+	for _, key := range keys {
+		i := strings.Index(key, clicksPersistingKey)
+		prefix, rest := key[:i], key[i+len(clicksPersistingKey):]
+		stamp, _, _ := strings.Cut(rest, ":")
+		created, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil || created > cutoff {
+			continue
+		}
+		// Renaming to a fresh timestamp makes the claim exclusive across instances
+		newKey := fmt.Sprintf("%s%s%d:recovered:%s", prefix, clicksPersistingKey, time.Now().Unix(), rest)
+		if err := srv.rdb.Rename(srv.ctx, key, newKey).Err(); err == nil {
+			claimed = append(claimed, newKey)
+		}
+	}
+	return claimed, nil
+}
+
+// clickBatchID names the claimed hash at key in click_batches. Recovering an
+// abandoned hash renames it, so the ID is the name it was first claimed under,
+// after the tenant prefix.
+func clickBatchID(key string) string {
+	id := key
+	if i := strings.Index(key, clicksPersistingKey); i >= 0 {
+		id = key[i+len(clicksPersistingKey):]
+	}
+	for {
+		_, rest, ok := strings.Cut(id, ":recovered:")
+		if !ok {
+			return "hash:" + id
+		}
+		id = rest
+	}
+}
+
+// persistClicks adds one claimed hash to the click tables and deletes it. A
+// hash whose delete fails is claimed again once abandoned and skipped by
+// writeClicks, which recorded it as applied.
+func (srv *server) persistClicks(key string) error {
+	fields, err := srv.rdb.HGetAll(srv.ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int64, len(fields))
+	for field, v := range fields {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			counts[field] += n
+		}
+	}
+	if err := srv.writeClicks([]clickBatch{{id: clickBatchID(key), counts: counts}}); err != nil {
+		return err
+	}
+	return srv.rdb.Del(srv.ctx, key).Err()
+}
+
+// clickBatch is click counts, keyed like the clicks:pending hashes, that are
+// retried until they are acknowledged: a claimed hash or one click event. A
+// batch without an ID is applied every time.
+type clickBatch struct {
+	id     string
+	counts map[string]int64
+}
+
+// clickBatchRetention is how long click_batches remembers an applied batch,
+// well past the time a failed acknowledgement takes to be retried
+const clickBatchRetention = "1 day"
+
+// writeClicks adds the batches not applied before to link_clicks,
+// link_clicks_daily and page_links, recording them in click_batches in the same
+// transaction. Codes of links and buttons deleted in the meantime are skipped
+// by the joins.
+func (srv *server) writeClicks(batches []clickBatch) error {
+	ids := make([]string, 0, len(batches))
+	for _, batch := range batches {
+		if batch.id != "" {
+			ids = append(ids, batch.id)
+		}
+	}
+
+	// Totals, daily aggregates, page buttons and the batches they came from
+	// are written together, so a batch retried later is never counted twice
+	tx, err := srv.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		INSERT INTO click_batches (batch_id) SELECT unnest($1::text[])
+		ON CONFLICT (batch_id) DO NOTHING
+		RETURNING batch_id
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	fresh := make(map[string]bool, len(ids))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		fresh[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	counts := map[string]int64{}
+	for _, batch := range batches {
+		if batch.id != "" && !fresh[batch.id] {
+			log.Printf("Skipping click batch %s, already persisted", batch.id)
+			continue
+		}
+		// A batch read twice in one call still counts once
+		delete(fresh, batch.id)
+		for field, n := range batch.counts {
+			counts[field] += n
+		}
+	}
+
+	codes := make([]string, 0, len(counts))
+	clicks := make([]int64, 0, len(counts))
+	var pageIDs []int64
+	var pageCodes []string
+	var pageClicks []int64
+	for field, n := range counts {
+		if n <= 0 {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(field, pageClickFieldPrefix); ok {
+			id, code, _ := strings.Cut(rest, ":")
+			pageID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				continue
+			}
+			pageIDs = append(pageIDs, pageID)
+			pageCodes = append(pageCodes, code)
+			pageClicks = append(pageClicks, n)
+			continue
+		}
+		codes = append(codes, field)
+		clicks = append(clicks, n)
+	}
+
+	// Clicks are counted by normalized code, see shortcodes.go
+	if len(codes) > 0 {
+		query := `
+			INSERT INTO link_clicks (short_code, clicks, last_clicked_at)
+			SELECT urls.short_code, c.clicks, CURRENT_TIMESTAMP
+			FROM unnest($1::text[], $2::bigint[]) AS c(short_code, clicks)
+			JOIN urls ON ` + shortCodeColumn("urls.") + ` = c.short_code
+			ON CONFLICT (short_code) DO UPDATE
+			SET clicks = link_clicks.clicks + EXCLUDED.clicks, last_clicked_at = EXCLUDED.last_clicked_at
+		`
+		if _, err := tx.Exec(query, pq.Array(codes), pq.Array(clicks)); err != nil {
+			return err
+		}
+
+		// Clicks count towards the UTC day they are persisted on
+		query = `
+			INSERT INTO link_clicks_daily (short_code, day, clicks)
+			SELECT urls.short_code, (CURRENT_TIMESTAMP AT TIME ZONE 'UTC')::date, c.clicks
+			FROM unnest($1::text[], $2::bigint[]) AS c(short_code, clicks)
+			JOIN urls ON ` + shortCodeColumn("urls.") + ` = c.short_code
+			ON CONFLICT (short_code, day) DO UPDATE
+			SET clicks = link_clicks_daily.clicks + EXCLUDED.clicks
+		`
+		if _, err := tx.Exec(query, pq.Array(codes), pq.Array(clicks)); err != nil {
+			return err
+		}
+	}
+
+	if len(pageIDs) > 0 {
+		query := `
+			UPDATE page_links pl
+			SET clicks = pl.clicks + c.clicks, last_clicked_at = CURRENT_TIMESTAMP
+			FROM unnest($1::bigint[], $2::text[], $3::bigint[]) AS c(page_id, short_code, clicks)
+			WHERE pl.page_id = c.page_id AND pl.short_code = c.short_code
+		`
+		if _, err := tx.Exec(query, pq.Array(pageIDs), pq.Array(pageCodes), pq.Array(pageClicks)); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DELETE FROM click_batches WHERE applied_at < CURRENT_TIMESTAMP - $1::interval`, clickBatchRetention)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (srv *server) persistPendingClicks() {
+	keys, err := srv.abandonedClickKeys()
+	if err != nil {
+		log.Printf("Failed to look for abandoned click counts: %v", err)
+	}
+
+	claimed, err := srv.claimPendingClicks()
+	if err != nil {
+		log.Printf("Failed to claim pending click counts: %v", err)
+	}
+	keys = append(keys, claimed...)
+
+	for _, key := range keys {
+		// A failed key stays in Redis and is picked up again once abandoned,
+		// see persistClicks
+		if err := srv.persistClicks(key); err != nil {
+			log.Printf("Failed to persist click counts from %s: %v", key, err)
+		}
+	}
+}
+
+func (srv *server) startClickCounters() {
+	go func() {
+		ticker := time.NewTicker(clickFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := srv.flushHits(); err != nil {
+				log.Printf("Failed to record clicks: %v", err)
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(clickPersistInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			// Also drains the hash after a switch to events
+			srv.persistPendingClicks()
+			if clickEventTransport != nil {
+				persistClickEvents()
+			}
+		}
+	}()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"shared/tenantcache"
+)
+
+func TestClickBatchID(t *testing.T) {
+	for _, tt := range []struct {
+		key, want string
+	}{
+		{"clicks:persisting:1700000000:host-a:9f", "hash:1700000000:host-a:9f"},
+		{"clicks:persisting:1700000090:recovered:1700000000:host-a:9f", "hash:1700000000:host-a:9f"},
+		{"clicks:persisting:1700000200:recovered:1700000090:recovered:1700000000:host-a:9f", "hash:1700000000:host-a:9f"},
+		{"tenant:acme:clicks:persisting:1700000090:recovered:1700000000:host-a:9f", "hash:1700000000:host-a:9f"},
+	} {
+		if got := clickBatchID(tt.key); got != tt.want {
+			t.Errorf("clickBatchID(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestClicksPendPerTenant(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	srv := &server{ctx: context.Background(), rdb: rdb}
+
+	recordHit("acme", "abc1234")
+	recordHit("acme", "abc1234")
+	recordHit("other", "xyz9876")
+	recordPageClick("acme", 7, "abc1234")
+	if err := srv.flushHits(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]map[string]string{
+		tenantcache.Key("acme", clicksPendingKey):  {"abc1234": "2", pageClickField(7, "abc1234"): "1"},
+		tenantcache.Key("other", clicksPendingKey): {"xyz9876": "1"},
+	} {
+		if got, _ := mr.HKeys(key); len(got) != len(want) {
+			t.Fatalf("%s holds %q", key, got)
+		}
+		for field, n := range want {
+			if got := mr.HGet(key, field); got != n {
+				t.Errorf("Counted %s clicks of %s in %s, want %s", got, field, key, n)
+			}
+		}
+	}
+
+	// Clicks of an instance not upgraded yet are claimed along
+	mr.HSet(clicksPendingKey, "old1234", "4")
+	keys, err := srv.claimPendingClicks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("Claimed %q, want 3 hashes", keys)
+	}
+	for _, key := range keys {
+		if !strings.Contains(key, clicksPersistingKey) || !strings.HasPrefix(clickBatchID(key), "hash:") {
+			t.Errorf("Claimed %q", key)
+		}
+	}
+	if mr.Exists(clickTenantsKey) {
+		t.Fatal("Tenants still listed after the claim")
+	}
+}
+
+// clickDB is a database/sql driver standing in for Postgres in writeClicks:
+// it keeps click_batches and records the link_clicks inserts
+type clickDB struct {
+	mu      sync.Mutex
+	batches map[string]bool
+	// clicks are the codes and counts of every link_clicks insert
+	clicks map[string]int64
+}
+
+func (d *clickDB) Open(string) (driver.Conn, error) { return clickConn{d}, nil }
+
+type clickConn struct{ db *clickDB }
+
+func (c clickConn) Prepare(query string) (driver.Stmt, error) {
+	return clickStmt{c.db, query}, nil
+}
+func (c clickConn) Close() error              { return nil }
+func (c clickConn) Begin() (driver.Tx, error) { return clickTx{}, nil }
+
+type clickTx struct{}
+
+func (clickTx) Commit() error   { return nil }
+func (clickTx) Rollback() error { return nil }
+
+type clickStmt struct {
+	db    *clickDB
+	query string
+}
+
+func (s clickStmt) Close() error  { return nil }
+func (s clickStmt) NumInput() int { return -1 }
+
+func (s clickStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if strings.Contains(s.query, "INSERT INTO link_clicks ") {
+		var codes pq.StringArray
+		var clicks pq.Int64Array
+		if err := codes.Scan(args[0]); err != nil {
+			return nil, err
+		}
+		if err := clicks.Scan(args[1]); err != nil {
+			return nil, err
+		}
+		for i, code := range codes {
+			s.db.clicks[code] += clicks[i]
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s clickStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	var ids pq.StringArray
+	if err := ids.Scan(args[0]); err != nil {
+		return nil, err
+	}
+	rows := &clickRows{}
+	for _, id := range ids {
+		if !s.db.batches[id] {
+			s.db.batches[id] = true
+			rows.ids = append(rows.ids, id)
+		}
+	}
+	return rows, nil
+}
+
+type clickRows struct{ ids []string }
+
+func (r *clickRows) Columns() []string { return []string{"batch_id"} }
+func (r *clickRows) Close() error      { return nil }
+func (r *clickRows) Next(dest []driver.Value) error {
+	if len(r.ids) == 0 {
+		return io.EOF
+	}
+	dest[0], r.ids = r.ids[0], r.ids[1:]
+	return nil
+}
+
+func TestWriteClicksSkipsAppliedBatches(t *testing.T) {
+	fake := &clickDB{batches: map[string]bool{}, clicks: map[string]int64{}}
+	sql.Register("clicks-"+t.Name(), fake)
+	db, err := sql.Open("clicks-"+t.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := &server{db: db}
+
+	batch := clickBatch{id: "hash:1700000000:host-a:9f", counts: map[string]int64{"abc1234": 3}}
+	if err := srv.writeClicks([]clickBatch{batch}); err != nil {
+		t.Fatal(err)
+	}
+	// Retried after its delete failed, alongside a new batch and an unnamed one
+	retry := []clickBatch{
+		batch,
+		{id: "stream:clicks:stream:1-0", counts: map[string]int64{"abc1234": 2}},
+		{counts: map[string]int64{"abc1234": 1}},
+	}
+	if err := srv.writeClicks(retry); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.clicks["abc1234"]; got != 6 {
+		t.Fatalf("Counted %d clicks, want 6", got)
+	}
+
+	// The same batch twice in one call counts once
+	twice := clickBatch{id: "stream:clicks:stream:2-0", counts: map[string]int64{"abc1234": 5}}
+	if err := srv.writeClicks([]clickBatch{twice, twice}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.clicks["abc1234"]; got != 11 {
+		t.Fatalf("Counted %d clicks, want 11", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisClickStream carries click events through the Redis Stream
+// CLICK_STREAM_KEY, read by instances as consumers of CLICK_STREAM_GROUP.
+// The entry ID carries the time, and a region field the instance's REGION,
+// which persisting skips like any field that isn't a count.
+type redisClickStream struct {
+	srv *server
+	key string
+}
+
+func (s *redisClickStream) Connect() error {
+	return nil
+}
+
+func (s *redisClickStream) Publish(counts map[string]int64) error {
+	values := make([]interface{}, 0, 2*len(counts)+2)
+	for field, n := range counts {
+		values = append(values, field, n)
+	}
+	if region != "" {
+		values = append(values, clickEventRegionField, region)
+	}
+	return s.srv.rdb.XAdd(s.srv.ctx, &redis.XAddArgs{
+		Stream: s.key,
+		MaxLen: int64(clickStreamMaxLen),
+		Approx: true,
+		Values: values,
+	}).Err()
+}
+
+// read claims entries other consumers left pending too long, then reads new ones
+func (s *redisClickStream) read() ([]redis.XMessage, error) {
+	abandoned, _, err := s.srv.rdb.XAutoClaim(s.srv.ctx, &redis.XAutoClaimArgs{
+		Stream:   s.key,
+		Group:    clickStreamGroup,
+		Consumer: clickStreamConsumer,
+		MinIdle:  clicksAbandonedAfter,
+		Start:    "0-0",
+		Count:    clickEventBatch,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	streams, err := s.srv.rdb.XReadGroup(s.srv.ctx, &redis.XReadGroupArgs{
+		Group:    clickStreamGroup,
+		Consumer: clickStreamConsumer,
+		Streams:  []string{s.key, ">"},
+		Count:    clickEventBatch,
+		Block:    -1,
+	}).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	messages := abandoned
+	for _, stream := range streams {
+		messages = append(messages, stream.Messages...)
+	}
+	return messages, nil
+}
+
+func (s *redisClickStream) Persist() (int, error) {
+	messages, err := s.read()
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		// First run, or Redis lost the stream
+		err = s.srv.rdb.XGroupCreateMkStream(s.srv.ctx, s.key, clickStreamGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return 0, fmt.Errorf("failed to create consumer group: %v", err)
+		}
+		messages, err = s.read()
+	}
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+
+	// Each entry is a batch of its own, so one redelivered after a failed
+	// acknowledgement is skipped by writeClicks
+	batches := make([]clickBatch, len(messages))
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+		counts := map[string]int64{}
+		for field, v := range m.Values {
+			value, _ := v.(string)
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+				counts[field] += n
+			}
+		}
+		batches[i] = clickBatch{id: "stream:" + s.key + ":" + m.ID, counts: counts}
+	}
+	if err := s.srv.writeClicks(batches); err != nil {
+		return 0, err
+	}
+	if err := s.srv.rdb.XAck(s.srv.ctx, s.key, clickStreamGroup, ids...).Err(); err != nil {
+		return len(messages), fmt.Errorf("failed to acknowledge click events: %v", err)
+	}
+	return len(messages), nil
+}
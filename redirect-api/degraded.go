@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"shared/env"
+	"shared/tenantcache"
+)
+
+// When a lookup finds Postgres (or the link store) unreachable, redirect-api
+// goes degraded instead of failing every request: cache and hot snapshot hits
+// keep redirecting, cache entries close to expiry are extended to
+// DEGRADED_TTL_EXTENSION rather than refreshed, and only codes found in
+// neither answer 503 with a Retry-After of DEGRADED_RETRY_AFTER. Those misses
+// skip the database, except for one lookup every degradedProbeInterval that
+// checks whether it is back; the first to succeed ends degraded mode. Extended
+// entries don't know their link's expiry, so like snapshot hits they can
+// outlive it until Postgres returns.
+var (
+	degradedTTLExtension = env.Duration("DEGRADED_TTL_EXTENSION", 30*time.Minute)
+	degradedRetryAfter   = env.Duration("DEGRADED_RETRY_AFTER", 30*time.Second)
+)
+
+const degradedProbeInterval = time.Second
+
+// retryAfterHeader is the Retry-After of a degraded miss, in whole seconds
+var retryAfterHeader = []string{strconv.Itoa(max(1, int(degradedRetryAfter/time.Second)))}
+
+var (
+	// degradedSince is when degraded mode started, in Unix nanoseconds; 0 when healthy
+	degradedSince atomic.Int64
+	nextDBProbe   atomic.Int64
+
+	degradedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "redirect_degraded",
+		Help: "1 while redirects are served without Postgres, 0 otherwise.",
+	})
+)
+
+func dbDegraded() bool {
+	return degradedSince.Load() != 0
+}
+
+// startDegraded enters degraded mode after a failed lookup
+func startDegraded(err error) {
+	now := time.Now()
+	nextDBProbe.Store(now.Add(degradedProbeInterval).UnixNano())
+	if degradedSince.CompareAndSwap(0, now.UnixNano()) {
+		degradedGauge.Set(1)
+		log.Printf("Database unreachable, serving cached links only: %v", err)
+	}
+}
+
+// endDegraded leaves degraded mode after a lookup the database answered
+func endDegraded() {
+	if degradedSince.Load() == 0 {
+		return
+	}
+	if since := degradedSince.Swap(0); since != 0 {
+		degradedGauge.Set(0)
+		log.Printf("Database back after %s of degraded mode", time.Since(time.Unix(0, since)).Round(time.Second))
+	}
+}
+
+// skipDBLookup reports whether a cache miss should be answered without the
+// database, letting one lookup per degradedProbeInterval through
+func skipDBLookup() bool {
+	if !dbDegraded() {
+		return false
+	}
+	next := nextDBProbe.Load()
+	now := time.Now().UnixNano()
+	return now < next || !nextDBProbe.CompareAndSwap(next, now+int64(degradedProbeInterval))
+}
+
+// extendCacheTTL keeps a cache hit that refreshAhead would reload from
+// expiring while the database can't refill it
+func (srv *server) extendCacheTTL(shortCode string, ttl time.Duration) {
+	if ttl <= 0 || ttl > cacheRefreshAhead {
+		return
+	}
+	key := "url:" + shortCode
+	if err := tenantcache.Expire(srv.ctx, srv.urlCache.Client(key), key, degradedTTLExtension); err != nil {
+		log.Printf("Failed to extend cache entry of %s: %v", shortCode, err)
+	}
+}
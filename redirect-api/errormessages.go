@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+
+	"shared/i18n"
+	"shared/response"
+)
+
+// Error bodies are answered in the language the caller's Accept-Language asks
+// for, with a stable code next to the message:
+//
+//	{"code": "short_code_not_found", "message": "Kurzcode nicht gefunden"}
+//
+// They are prebuilt for every language, so the redirect path still never
+// encodes JSON, and the access log records the code (errorCode) rather than
+// the message.
+const (
+	codeShortCodeRequired    = "short_code_required"
+	codeShortCodeNotFound    = "short_code_not_found"
+	codeLinkDisabled         = "link_disabled"
+	codeLookupFailed         = "lookup_failed"
+	codeShortCodeUnavailable = "short_code_unavailable"
+	codePageNotFound         = "page_not_found"
+	codeStatsNotFound        = "stats_not_found"
+)
+
+var errorCatalog = i18n.Catalog{
+	codeShortCodeRequired: {
+		"en": "short code is required",
+		"de": "Kurzcode ist erforderlich",
+		"es": "el código corto es obligatorio",
+		"fr": "le code court est obligatoire",
+		"th": "ต้องระบุรหัสลิงก์สั้น",
+	},
+	codeShortCodeNotFound: {
+		"en": "short code not found",
+		"de": "Kurzcode nicht gefunden",
+		"es": "código corto no encontrado",
+		"fr": "code court introuvable",
+		"th": "ไม่พบรหัสลิงก์สั้น",
+	},
+	codeLinkDisabled: {
+		"en": "link has been disabled",
+		"de": "Link wurde deaktiviert",
+		"es": "el enlace ha sido desactivado",
+		"fr": "le lien a été désactivé",
+		"th": "ลิงก์นี้ถูกปิดใช้งานแล้ว",
+	},
+	codeLookupFailed: {
+		"en": "failed to retrieve URL",
+		"de": "URL konnte nicht abgerufen werden",
+		"es": "no se pudo obtener la URL",
+		"fr": "impossible de récupérer l'URL",
+		"th": "ไม่สามารถดึง URL ได้",
+	},
+	codeShortCodeUnavailable: {
+		"en": "short code is temporarily unavailable",
+		"de": "Kurzcode ist vorübergehend nicht verfügbar",
+		"es": "el código corto no está disponible temporalmente",
+		"fr": "le code court est temporairement indisponible",
+		"th": "รหัสลิงก์สั้นไม่พร้อมใช้งานชั่วคราว",
+	},
+	codePageNotFound: {
+		"en": "page not found",
+		"de": "Seite nicht gefunden",
+		"es": "página no encontrada",
+		"fr": "page introuvable",
+		"th": "ไม่พบหน้า",
+	},
+	codeStatsNotFound: {
+		"en": "stats not found",
+		"de": "Statistik nicht gefunden",
+		"es": "estadísticas no encontradas",
+		"fr": "statistiques introuvables",
+		"th": "ไม่พบสถิติ",
+	},
+}
+
+var errorMessages = i18n.New(errorCatalog, "en", "de", "es", "fr", "th")
+
+// redirectErrorCodes are the codes of the statuses resolveShortCode answers
+var redirectErrorCodes = map[int]string{
+	http.StatusBadRequest:          codeShortCodeRequired,
+	http.StatusNotFound:            codeShortCodeNotFound,
+	http.StatusGone:                codeLinkDisabled,
+	http.StatusInternalServerError: codeLookupFailed,
+	http.StatusServiceUnavailable:  codeShortCodeUnavailable,
+}
+
+// errorBodies holds the prebuilt body of every code, by language and code
+var errorBodies = prebuildErrorBodies()
+
+func prebuildErrorBodies() map[string]map[string]response.Prebuilt {
+	bodies := map[string]map[string]response.Prebuilt{}
+	for _, lang := range errorMessages.Languages() {
+		bodies[lang] = map[string]response.Prebuilt{}
+		for code := range errorCatalog {
+			bodies[lang][code] = response.Prebuild(code, errorMessages.Message(lang, code))
+		}
+	}
+	return bodies
+}
+
+// writeError answers status with the body of code in the caller's language
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	lang := errorMessages.Negotiate(r.Header.Get("Accept-Language"))
+	h := w.Header()
+	h["Content-Type"] = jsonContentType
+	h["Content-Language"] = []string{lang}
+	h.Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	errorBodies[lang][code].Write(w)
+}
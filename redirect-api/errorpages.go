@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/text/language"
+	"shared/tenantcache"
+)
+
+// Browsers hitting a missing, expired or disabled link get the owner's branded
+// page when they uploaded one through convert-api (error_pages), in the
+// translation (error_page_translations) that best matches their
+// Accept-Language, else the owner's default; without one they get our own
+// page in their language, see pagemessages.go. Everyone else keeps getting
+// the JSON error. Links are attributed to their owner, live or archived by
+// the reaper, and missing ones to the owner of the custom domain they were
+// requested on. None of this runs on the redirect path.
+const (
+	errorPageNotFound = "not_found"
+	errorPageExpired  = "expired"
+	errorPageDisabled = "disabled"
+
+	errorPageCacheKeyPrefix = "error-pages:"
+	errorPageCacheTTL       = 5 * time.Minute
+)
+
+// errorPageCSP lets tenant pages style themselves but never run scripts on our origin
+const errorPageCSP = "sandbox; default-src 'none'; img-src https: data:; style-src 'unsafe-inline' https:; font-src https:"
+
+// errorPageData is what templates can use; keep in sync with convert-api
+type errorPageData struct {
+	ShortCode string
+	ShortURL  string
+	Host      string
+	Status    int
+	ExpiredAt string
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// requestHost is the host the client asked for; Kong passes it on in X-Forwarded-Host
+func requestHost(r *http.Request) string {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// errorPageOwner finds which kind of page to show and whose, "" when the link
+// turned out to be fine or the owner is unknown
+func (srv *server) errorPageOwner(shortCode, host string) (string, string, *time.Time, error) {
+	var owner string
+	var disabled bool
+	var expiresAt *time.Time
+	err := srv.db.QueryRow(`
+		SELECT owner, disabled_at IS NOT NULL, expires_at FROM urls WHERE `+shortCodeColumn("")+` = $1
+		UNION ALL
+		SELECT owner, false, expires_at FROM urls_archive WHERE `+shortCodeColumn("")+` = $1
+		LIMIT 1
+	`, shortCode).Scan(&owner, &disabled, &expiresAt)
+	switch {
+	case err == nil && disabled:
+		return owner, errorPageDisabled, nil, nil
+	case err == nil && expiresAt != nil && !expiresAt.After(time.Now()):
+		return owner, errorPageExpired, expiresAt, nil
+	case err == nil:
+		// Changed since it was resolved
+		return "", "", nil, nil
+	case err != sql.ErrNoRows:
+		return "", "", nil, fmt.Errorf("failed to get link owner: %v", err)
+	}
+
+	err = srv.db.QueryRow(`
+		SELECT owner FROM custom_domains WHERE domain = $1 AND status IN ('verified', 'active')
+	`, host).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", errorPageNotFound, nil, nil
+	}
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to get domain owner: %v", err)
+	}
+	return owner, errorPageNotFound, nil, nil
+}
+
+// getErrorPages returns the owner's templates of a kind by language, the
+// default under "". They are cached together under the owner's prefix;
+// convert-api drops the entry when any of them changes.
+func (srv *server) getErrorPages(owner, kind string) (map[string]string, error) {
+	key := tenantcache.Key(owner, errorPageCacheKeyPrefix+kind)
+	cached, err := srv.rdb.Get(srv.ctx, key).Bytes()
+	if err == nil {
+		var pages map[string]string
+		if err := json.Unmarshal(cached, &pages); err == nil {
+			return pages, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Failed to read cached %s pages of %s: %v", kind, owner, err)
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT '' AS language, html FROM error_pages WHERE owner = $1 AND kind = $2
+		UNION ALL
+		SELECT language, html FROM error_page_translations WHERE owner = $1 AND kind = $2
+	`, owner, kind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get error pages: %v", err)
+	}
+	defer rows.Close()
+	pages := map[string]string{}
+	for rows.Next() {
+		var lang, html string
+		if err := rows.Scan(&lang, &html); err != nil {
+			return nil, fmt.Errorf("failed to scan error page: %v", err)
+		}
+		pages[lang] = html
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get error pages: %v", err)
+	}
+	if b, err := json.Marshal(pages); err == nil {
+		setTenantCache(srv.ctx, srv.rdb, owner, key, b, errorPageCacheTTL)
+	}
+	return pages, nil
+}
+
+// pickErrorPage returns the template of the translation that best matches
+// acceptLanguage, else the default template, with its language ("" for the
+// default). ok is false when neither exists.
+func pickErrorPage(pages map[string]string, acceptLanguage string) (src, lang string, ok bool) {
+	var langs []string
+	var tags []language.Tag
+	for l := range pages {
+		if tag, err := language.Parse(l); err == nil && l != "" {
+			langs = append(langs, l)
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 && acceptLanguage != "" {
+		if accepted, _, err := language.ParseAcceptLanguage(acceptLanguage); err == nil && len(accepted) > 0 {
+			_, i, confidence := language.NewMatcher(tags).Match(accepted...)
+			if confidence != language.No {
+				return pages[langs[i]], langs[i], true
+			}
+		}
+	}
+	src, ok = pages[""]
+	return src, "", ok
+}
+
+// renderErrorPage renders the page for a failed lookup, with its language ("" when
+// unknown), nil when the link turned out to be fine
+func (srv *server) renderErrorPage(r *http.Request, shortCode string, status int) ([]byte, string, error) {
+	host := requestHost(r)
+	owner, kind, expiresAt, err := srv.errorPageOwner(shortCode, host)
+	if err != nil || kind == "" {
+		return nil, "", err
+	}
+
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+	}
+	data := errorPageData{ShortCode: shortCode, ShortURL: scheme + "://" + host + "/" + shortCode, Host: host, Status: status}
+	if expiresAt != nil {
+		data.ExpiredAt = expiresAt.UTC().Format(time.RFC1123)
+	}
+	acceptLanguage := r.Header.Get("Accept-Language")
+
+	if owner != "" {
+		pages, err := srv.getErrorPages(owner, kind)
+		if err != nil {
+			return nil, "", err
+		}
+		if src, lang, ok := pickErrorPage(pages, acceptLanguage); ok {
+			tmpl, err := template.New(kind).Parse(src)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to parse %s page of %s: %v", kind, owner, err)
+			}
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, data); err != nil {
+				return nil, "", fmt.Errorf("failed to render %s page of %s: %v", kind, owner, err)
+			}
+			return buf.Bytes(), lang, nil
+		}
+	}
+
+	lang := pageMessages.Negotiate(acceptLanguage)
+	messages := defaultErrorPageMessages[kind]
+	var buf bytes.Buffer
+	err = defaultErrorPageTemplate.Execute(&buf, struct {
+		Lang, Title, Message string
+	}{lang, pageMessages.Message(lang, messages[0]), pageMessages.Message(lang, messages[1], data.ShortURL)})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to render default %s page: %v", kind, err)
+	}
+	return buf.Bytes(), lang, nil
+}
+
+// serveErrorPage answers with the error page, reporting whether there was one
+func (srv *server) serveErrorPage(w http.ResponseWriter, r *http.Request, shortCode string, status int) bool {
+	page, lang, err := srv.renderErrorPage(r, shortCode, status)
+	if err != nil {
+		log.Printf("Failed to serve error page for %s: %v", shortCode, err)
+		return false
+	}
+	if page == nil {
+		return false
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Security-Policy", errorPageCSP)
+	h.Set("Cache-Control", "no-store")
+	if lang != "" {
+		h.Set("Content-Language", lang)
+	}
+	h.Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	w.Write(page)
+	return true
+}
+
+// writeResolved answers a short code lookup, with an error page for
+// browsers when the link is missing, expired or disabled, and counts the
+// outcome, see clicks.go
+func (srv *server) writeResolved(w http.ResponseWriter, r *http.Request, shortCode, target string, status int) {
+	recordRedirectStatus(status)
+	if (status == http.StatusNotFound || status == http.StatusGone) && acceptsHTML(r) && srv.serveErrorPage(w, r, shortCode, status) {
+		return
+	}
+	writeRedirect(w, r, target, status)
+}
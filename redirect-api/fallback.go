@@ -0,0 +1,11 @@
+package main
+
+// Links can have a fallback destination, set in convert-api, which is served
+// instead of their own while the destination health checker has that marked
+// down. The choice is made when the link is loaded from Postgres; convert-api
+// drops the cached entry whenever a destination goes down or recovers.
+
+// servedURLColumn selects the stored destination to serve for the urls row of a query
+const servedURLColumn = `CASE WHEN urls.fallback_url IS NOT NULL AND EXISTS (
+		SELECT 1 FROM destination_health h WHERE h.short_code = urls.short_code AND NOT h.healthy
+	) THEN urls.fallback_url ELSE urls.original_url END`
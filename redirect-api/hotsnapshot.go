@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"shared/env"
+	"shared/tenantcache"
+)
+
+// Popularity is tracked in one sorted set per tenant and minute
+// ("popular:<unix minute>" under the tenant prefix), fed by every instance's
+// click flushes (see clicks.go). The tenants with clicks in a minute are listed
+// in "popular:tenants:<unix minute>", and the sets are merged over
+// popularityWindow into popularLinksKey.
+// The hottest HOT_SNAPSHOT_SIZE links are then copied into process memory every
+// HOT_SNAPSHOT_INTERVAL, so they keep redirecting while Redis is unreachable.
+const (
+	popularityKeyPrefix  = "popular:"
+	popularTenantsPrefix = "popular:tenants:"
+	popularLinksKey      = "popular:links"
+	popularityBucket     = time.Minute
+	popularityWindow     = 10 * time.Minute
+)
+
+// HOT_SNAPSHOT_SIZE=0 turns off both popularity tracking and the snapshot
+var (
+	hotSnapshotSize     = hotSnapshotSizeEnv()
+	hotSnapshotInterval = env.Duration("HOT_SNAPSHOT_INTERVAL", 5*time.Second)
+)
+
+func hotSnapshotSizeEnv() int {
+	if os.Getenv("HOT_SNAPSHOT_SIZE") == "0" {
+		return 0
+	}
+	return env.Int("HOT_SNAPSHOT_SIZE", 1000)
+}
+
+// hotSnapshot maps short codes to cached values; replaced wholesale, never mutated
+var hotSnapshot atomic.Pointer[map[string]string]
+
+// popularityBucketOf is the unix minute of t
+func popularityBucketOf(t time.Time) string {
+	return strconv.FormatInt(t.Unix()/int64(popularityBucket/time.Second), 10)
+}
+
+// popularityKey is a tenant's set for the minute of t, under its prefix
+func popularityKey(t time.Time) string {
+	return popularityKeyPrefix + popularityBucketOf(t)
+}
+
+// popularTenantsKey lists the tenants with clicks in the minute of t
+func popularTenantsKey(t time.Time) string {
+	return popularTenantsPrefix + popularityBucketOf(t)
+}
+
+// hotShortCodes merges the popularity window and returns the top codes
+func (srv *server) hotShortCodes() ([]string, error) {
+	now := time.Now()
+	buckets := []time.Time{}
+	tenantKeys := []string{}
+	for t := now.Add(-popularityWindow + popularityBucket); !t.After(now); t = t.Add(popularityBucket) {
+		buckets = append(buckets, t)
+		tenantKeys = append(tenantKeys, popularTenantsKey(t))
+	}
+	owners, err := srv.rdb.SUnion(srv.ctx, tenantKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, owner := range owners {
+		for _, t := range buckets {
+			keys = append(keys, tenantcache.Key(owner, popularityKey(t)))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// Every instance recomputes the same union, so concurrent writers agree
+	if err := srv.rdb.ZUnionStore(srv.ctx, popularLinksKey, &redis.ZStore{Keys: keys}).Err(); err != nil {
+		return nil, err
+	}
+	srv.rdb.Expire(srv.ctx, popularLinksKey, popularityWindow)
+
+	return srv.rdb.ZRevRange(srv.ctx, popularLinksKey, 0, int64(hotSnapshotSize-1)).Result()
+}
+
+// loadHotSnapshot resolves the hottest codes from the cache, falling back to
+// Postgres for entries that expired, and swaps the snapshot in
+func (srv *server) loadHotSnapshot() error {
+	codes, err := srv.hotShortCodes()
+	if err != nil {
+		return fmt.Errorf("failed to rank links: %v", err)
+	}
+
+	snapshot := make(map[string]string, len(codes))
+	if len(codes) > 0 {
+		keys := make([]string, len(codes))
+		for i, code := range codes {
+			keys[i] = "url:" + code
+		}
+		values, err := srv.urlCache.Read(srv.ctx, tenantcache.MGet, keys...)
+		if err != nil {
+			return fmt.Errorf("failed to read cached links: %v", err)
+		}
+
+		missing := []string{}
+		for i, v := range values {
+			if s, ok := v.(string); ok {
+				snapshot[codes[i]] = s
+			} else {
+				missing = append(missing, codes[i])
+			}
+		}
+
+		if len(missing) > 0 {
+			rows, err := srv.db.Query(`
+				SELECT short_code, `+servedURLColumn+`, `+linkTargetsColumn+` FROM urls
+				WHERE short_code = ANY($1) AND disabled_at IS NULL
+					AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+			`, pq.Array(missing))
+			if err != nil {
+				return fmt.Errorf("failed to load links: %v", err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var code, originalURL string
+				var targets *string
+				if err := rows.Scan(&code, &originalURL, &targets); err != nil {
+					return fmt.Errorf("failed to load links: %v", err)
+				}
+				snapshot[code] = weightedCacheValue(originalURL, targets)
+			}
+			if err := rows.Err(); err != nil {
+				return fmt.Errorf("failed to load links: %v", err)
+			}
+		}
+	}
+
+	hotSnapshot.Store(&snapshot)
+	return nil
+}
+
+// lookupHotSnapshot returns the cached value of a hot link
+func lookupHotSnapshot(shortCode string) (string, bool) {
+	snapshot := hotSnapshot.Load()
+	if snapshot == nil {
+		return "", false
+	}
+	stored, ok := (*snapshot)[shortCode]
+	return stored, ok
+}
+
+// startHotSnapshot rebuilds the snapshot in the background. Failures keep the
+// previous snapshot, which is the point during an outage.
+func (srv *server) startHotSnapshot() {
+	if hotSnapshotSize == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(hotSnapshotInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := srv.loadHotSnapshot(); err != nil {
+				log.Printf("Failed to refresh hot snapshot: %v", err)
+			}
+		}
+	}()
+}
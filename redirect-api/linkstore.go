@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"shared/env"
+	"shared/tracing"
+)
+
+// LINK_STORE=dynamodb resolves redirect cache misses from the DynamoDB table
+// LINK_STORE_TABLE instead of Postgres. convert-api keeps the table in sync
+// with Postgres and writes every change through before it drops the cached
+// redirect, see its linkstore package. Stats, previews and pages still read
+// Postgres.
+var (
+	linkStoreBackend = os.Getenv("LINK_STORE")
+	linkStoreTable   = env.Get("LINK_STORE_TABLE", "links")
+)
+
+// linkStoreClient is nil unless LINK_STORE is set
+var linkStoreClient *dynamodb.Client
+
+func initLinkStore() error {
+	switch linkStoreBackend {
+	case "":
+		return nil
+	case "dynamodb":
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to load AWS config: %v", err)
+		}
+		if cfg.Region == "" {
+			return errors.New("AWS_REGION is required for the DynamoDB link store")
+		}
+		linkStoreClient = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			o.HTTPClient = tracing.Client(&http.Client{Timeout: 2 * time.Second})
+		})
+		return nil
+	default:
+		return fmt.Errorf("unknown LINK_STORE %q, expected dynamodb", linkStoreBackend)
+	}
+}
+
+// getURLFromLinkStore reads a mapping from the link store. Its OriginalURL
+// holds the cached form, weighted targets included.
+func getURLFromLinkStore(ctx context.Context, shortCode string) (*URL, error) {
+	// Strongly consistent, or a redirect right after a change could cache
+	// the old mapping again
+	out, err := linkStoreClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:            aws.String(linkStoreTable),
+		Key:                  map[string]types.AttributeValue{"short_code": &types.AttributeValueMemberS{Value: shortCode}},
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#value, disabled, expires_at, #owner"),
+		// value and owner are reserved words
+		ExpressionAttributeNames: map[string]string{"#value": "value", "#owner": "owner"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get URL from the link store: %v", err)
+	}
+	if out.Item == nil {
+		return nil, errShortCodeNotFound
+	}
+
+	url := URL{ShortCode: shortCode}
+	if v, ok := out.Item["value"].(*types.AttributeValueMemberS); ok {
+		url.OriginalURL = v.Value
+	}
+	if v, ok := out.Item["owner"].(*types.AttributeValueMemberS); ok {
+		url.Owner = v.Value
+	}
+	if v, ok := out.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		if unix, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+			expiresAt := time.Unix(unix, 0)
+			url.ExpiresAt = &expiresAt
+		}
+	}
+	// Expired items stay until the table's TTL removes them
+	if url.ExpiresAt != nil && !url.ExpiresAt.After(time.Now()) {
+		return nil, errShortCodeNotFound
+	}
+	if v, ok := out.Item["disabled"].(*types.AttributeValueMemberBOOL); ok && v.Value {
+		// When isn't stored, only that it is
+		disabledAt := time.Time{}
+		url.DisabledAt = &disabledAt
+	}
+	return &url, nil
+}
+
+// lookupURL reads a short code's redirect mapping from the link store when
+// there is one, Postgres otherwise
+func (srv *server) lookupURL(ctx context.Context, shortCode string) (*URL, error) {
+	if linkStoreClient != nil {
+		return getURLFromLinkStore(ctx, shortCode)
+	}
+	return srv.getURLByShortCode(ctx, shortCode)
+}
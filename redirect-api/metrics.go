@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"shared/env"
+)
+
+// Prometheus metrics are served at /metrics, which the load balancer should
+// keep off the public route. Each redirect lookup records the layers it went
+// through: redis (the redirect cache), local (the hot snapshot, consulted only
+// while Redis or Postgres is unreachable) and db (Postgres, or the link store when
+// LINK_STORE is set), with the result of each: hit, miss or error.
+const (
+	layerLocal = "local"
+	layerRedis = "redis"
+	layerDB    = "db"
+
+	lookupHit   = "hit"
+	lookupMiss  = "miss"
+	lookupError = "error"
+)
+
+// cacheRatioWindow is how far back the hit ratio gauges look
+var cacheRatioWindow = env.Duration("CACHE_RATIO_WINDOW", time.Minute)
+
+var (
+	layerLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redirect_layer_lookups_total",
+		Help: "Redirect lookups per layer and result.",
+	}, []string{"layer", "result"})
+
+	layerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "redirect_layer_duration_seconds",
+		Help: "Time spent in each redirect lookup layer.",
+		// 1µs for the in-memory snapshot up to 4s for a struggling database
+		Buckets: prometheus.ExponentialBuckets(0.000001, 4, 12),
+	}, []string{"layer"})
+
+	layerHitRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "redirect_layer_hit_ratio",
+		Help: "Share of lookups that hit, per layer, over the last CACHE_RATIO_WINDOW.",
+	}, []string{"layer"})
+)
+
+// layerMetric holds a layer's series, resolved once so the redirect path
+// doesn't hash label values, and its totals for the hit ratio
+type layerMetric struct {
+	duration prometheus.Observer
+	results  map[string]prometheus.Counter
+	hits     atomic.Int64
+	lookups  atomic.Int64
+}
+
+var layerMetrics = newLayerMetrics()
+
+func newLayerMetrics() map[string]*layerMetric {
+	metrics := map[string]*layerMetric{}
+	for _, layer := range []string{layerLocal, layerRedis, layerDB} {
+		m := &layerMetric{duration: layerDuration.WithLabelValues(layer), results: map[string]prometheus.Counter{}}
+		for _, result := range []string{lookupHit, lookupMiss, lookupError} {
+			m.results[result] = layerLookups.WithLabelValues(layer, result)
+		}
+		metrics[layer] = m
+	}
+	return metrics
+}
+
+// observeLayer records one lookup in a layer that started at start
+func observeLayer(layer string, start time.Time, result string) {
+	m := layerMetrics[layer]
+	m.duration.Observe(time.Since(start).Seconds())
+	m.results[result].Inc()
+	m.lookups.Add(1)
+	if result == lookupHit {
+		m.hits.Add(1)
+	}
+}
+
+// lookupResult classifies a layer's error, notFound being its miss
+func lookupResult(err, notFound error) string {
+	switch {
+	case err == nil:
+		return lookupHit
+	case errors.Is(err, notFound):
+		return lookupMiss
+	default:
+		return lookupError
+	}
+}
+
+// startHitRatios updates the hit ratio gauges every window. Layers without
+// lookups in a window keep their last ratio.
+func startHitRatios() {
+	type snapshot struct{ hits, lookups int64 }
+	last := map[string]snapshot{}
+	go func() {
+		ticker := time.NewTicker(cacheRatioWindow)
+		defer ticker.Stop()
+		for range ticker.C {
+			for layer, m := range layerMetrics {
+				current := snapshot{m.hits.Load(), m.lookups.Load()}
+				if lookups := current.lookups - last[layer].lookups; lookups > 0 {
+					ratio := float64(current.hits-last[layer].hits) / float64(lookups)
+					layerHitRatio.WithLabelValues(layer).Set(ratio)
+				}
+				last[layer] = current
+			}
+		}
+	}()
+}
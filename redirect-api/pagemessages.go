@@ -0,0 +1,137 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"shared/i18n"
+)
+
+// The HTML pages visitors see, the preview and the default not-found, expired
+// and disabled pages, are in the language their Accept-Language asks for,
+// announced in Content-Language. Tenants override the error pages per
+// language through convert-api, see errorpages.go.
+const (
+	pageNotFoundTitle      = "page.not_found.title"
+	pageNotFoundMessage    = "page.not_found.message"
+	pageExpiredTitle       = "page.expired.title"
+	pageExpiredMessage     = "page.expired.message"
+	pageDisabledTitle      = "page.disabled.title"
+	pageDisabledMessage    = "page.disabled.message"
+	pagePreviewTitle       = "page.preview.title"
+	pagePreviewHostWarning = "page.preview.host_warning"
+	pagePreviewScreenshot  = "page.preview.screenshot"
+	pagePreviewContinue    = "page.preview.continue"
+)
+
+var pageMessages = i18n.New(i18n.Catalog{
+	pageNotFoundTitle: {
+		"en": "Link not found",
+		"de": "Link nicht gefunden",
+		"es": "Enlace no encontrado",
+		"fr": "Lien introuvable",
+		"th": "ไม่พบลิงก์",
+	},
+	pageNotFoundMessage: {
+		"en": "There is no link at %s. Check that it was typed correctly.",
+		"de": "Unter %s gibt es keinen Link. Prüfe, ob er richtig eingegeben wurde.",
+		"es": "No hay ningún enlace en %s. Comprueba que esté bien escrito.",
+		"fr": "Aucun lien ne correspond à %s. Vérifiez qu'il a été saisi correctement.",
+		"th": "ไม่มีลิงก์ที่ %s โปรดตรวจสอบว่าพิมพ์ถูกต้อง",
+	},
+	pageExpiredTitle: {
+		"en": "Link expired",
+		"de": "Link abgelaufen",
+		"es": "Enlace caducado",
+		"fr": "Lien expiré",
+		"th": "ลิงก์หมดอายุแล้ว",
+	},
+	pageExpiredMessage: {
+		"en": "The link %s has expired and no longer leads anywhere.",
+		"de": "Der Link %s ist abgelaufen und führt nirgendwo mehr hin.",
+		"es": "El enlace %s ha caducado y ya no lleva a ninguna parte.",
+		"fr": "Le lien %s a expiré et ne mène plus nulle part.",
+		"th": "ลิงก์ %s หมดอายุแล้วและไม่สามารถใช้งานได้อีก",
+	},
+	pageDisabledTitle: {
+		"en": "Link disabled",
+		"de": "Link deaktiviert",
+		"es": "Enlace desactivado",
+		"fr": "Lien désactivé",
+		"th": "ลิงก์ถูกปิดใช้งาน",
+	},
+	pageDisabledMessage: {
+		"en": "The link %s has been disabled.",
+		"de": "Der Link %s wurde deaktiviert.",
+		"es": "El enlace %s ha sido desactivado.",
+		"fr": "Le lien %s a été désactivé.",
+		"th": "ลิงก์ %s ถูกปิดใช้งานแล้ว",
+	},
+	pagePreviewTitle: {
+		"en": "/%s leads to %s",
+		"de": "/%s führt zu %s",
+		"es": "/%s lleva a %s",
+		"fr": "/%s mène à %s",
+		"th": "/%s ไปยัง %s",
+	},
+	pagePreviewHostWarning: {
+		"en": "This address uses letters from another alphabet that look like familiar ones. Make sure it is the site you expect before continuing.",
+		"de": "Diese Adresse enthält Buchstaben aus einem anderen Alphabet, die bekannten ähneln. Vergewissere dich, dass es die erwartete Website ist, bevor du fortfährst.",
+		"es": "Esta dirección usa letras de otro alfabeto que se parecen a otras conocidas. Asegúrate de que es el sitio que esperas antes de continuar.",
+		"fr": "Cette adresse utilise des lettres d'un autre alphabet qui ressemblent à des lettres familières. Vérifiez qu'il s'agit bien du site attendu avant de continuer.",
+		"th": "ที่อยู่นี้ใช้ตัวอักษรจากภาษาอื่นที่ดูคล้ายตัวอักษรที่คุ้นเคย โปรดตรวจสอบว่าเป็นเว็บไซต์ที่คุณต้องการก่อนดำเนินการต่อ",
+	},
+	pagePreviewScreenshot: {
+		"en": "Screenshot of %s",
+		"de": "Screenshot von %s",
+		"es": "Captura de pantalla de %s",
+		"fr": "Capture d'écran de %s",
+		"th": "ภาพหน้าจอของ %s",
+	},
+	pagePreviewContinue: {
+		"en": "Continue to %s",
+		"de": "Weiter zu %s",
+		"es": "Continuar a %s",
+		"fr": "Continuer vers %s",
+		"th": "ไปยัง %s",
+	},
+}, "en", "de", "es", "fr", "th")
+
+// pageLanguage is the language of the page r asks for, announced on w
+func pageLanguage(w http.ResponseWriter, r *http.Request) string {
+	lang := pageMessages.Negotiate(r.Header.Get("Accept-Language"))
+	h := w.Header()
+	h.Set("Content-Language", lang)
+	h.Add("Vary", "Accept-Language")
+	return lang
+}
+
+// defaultErrorPageMessages are the title and message of each kind of default page
+var defaultErrorPageMessages = map[string][2]string{
+	errorPageNotFound: {pageNotFoundTitle, pageNotFoundMessage},
+	errorPageExpired:  {pageExpiredTitle, pageExpiredMessage},
+	errorPageDisabled: {pageDisabledTitle, pageDisabledMessage},
+}
+
+var defaultErrorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+<style>
+body{margin:0;padding:32px 16px;font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,sans-serif;background:#f4f4f5;color:#18181b;text-align:center}
+main{max-width:640px;margin:0 auto}
+h1{font-size:1.5rem;margin:0 0 8px}
+p{margin:0;color:#52525b;overflow-wrap:anywhere}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</main>
+</body>
+</html>
+`))
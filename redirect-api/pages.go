@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"shared/tenantcache"
+)
+
+// Link-in-bio pages are managed by convert-api and served here at /<slug>.
+// Slugs contain a hyphen or are longer than 10 characters, so they never
+// collide with short codes and are told apart without a lookup. Buttons link
+// to /<slug>?to=<shortCode>, which counts the button click and then redirects
+// like the short link itself.
+const (
+	pageCacheKeyPrefix = "page:"
+	pageCacheTTL       = 5 * time.Minute
+)
+
+var errPageNotFound = errors.New("page not found")
+
+// Page is what a page renders from, as cached in Redis. Buttons of disabled or
+// expired links are left out.
+type Page struct {
+	ID          int        `json:"id"`
+	Slug        string     `json:"slug"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Links       []PageLink `json:"links"`
+	Owner       string     `json:"-"`
+}
+
+type PageLink struct {
+	ShortCode string `json:"shortCode"`
+	Label     string `json:"label"`
+}
+
+// isPageSlug tells page slugs from short codes: slugs are ASCII and have a
+// hyphen or more than 10 characters
+func isPageSlug(s string) bool {
+	return !isEmojiCode(s) && (strings.IndexByte(s, '-') >= 0 || len(s) > maxShortCodeChars)
+}
+
+func (p *Page) hasLink(shortCode string) bool {
+	for _, link := range p.Links {
+		if link.ShortCode == shortCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *server) getPageFromDB(slug string) (*Page, error) {
+	p := Page{Slug: slug, Links: []PageLink{}}
+	err := srv.db.QueryRow(`SELECT id, title, COALESCE(description, ''), owner FROM pages WHERE slug = $1`, slug).
+		Scan(&p.ID, &p.Title, &p.Description, &p.Owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errPageNotFound
+		}
+		return nil, fmt.Errorf("failed to get page: %v", err)
+	}
+
+	rows, err := srv.db.Query(`
+		SELECT pl.short_code, pl.label
+		FROM page_links pl
+		JOIN urls u ON u.short_code = pl.short_code
+		WHERE pl.page_id = $1 AND u.disabled_at IS NULL
+			AND (u.expires_at IS NULL OR u.expires_at > CURRENT_TIMESTAMP)
+		ORDER BY pl.position
+	`, p.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page links: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var link PageLink
+		if err := rows.Scan(&link.ShortCode, &link.Label); err != nil {
+			return nil, fmt.Errorf("failed to get page links: %v", err)
+		}
+		p.Links = append(p.Links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get page links: %v", err)
+	}
+	return &p, nil
+}
+
+// getPage reads the page from the cache, falling back to Postgres. convert-api
+// drops the cached copy when the page changes.
+func (srv *server) getPage(slug string) (*Page, error) {
+	key := pageCacheKeyPrefix + slug
+	cached, err := tenantcache.Get(srv.ctx, srv.rdb, key)
+	if err == nil {
+		var p Page
+		if err := json.Unmarshal([]byte(cached.Value), &p); err == nil {
+			return &p, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Failed to read cached page %s: %v", slug, err)
+	}
+
+	p, err := srv.getPageFromDB(slug)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := json.Marshal(p); err == nil {
+		setTenantCache(srv.ctx, srv.rdb, p.Owner, key, b, pageCacheTTL)
+	}
+	return p, nil
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body{margin:0;padding:32px 16px;font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,sans-serif;background:#f4f4f5;color:#18181b;text-align:center}
+main{max-width:480px;margin:0 auto}
+h1{font-size:1.5rem;margin:0 0 8px}
+p{margin:0 0 24px;color:#52525b}
+a{display:block;margin:0 0 12px;padding:14px 16px;border-radius:12px;background:#18181b;color:#fff;text-decoration:none;font-weight:600;overflow-wrap:anywhere}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+{{range .Links}}<a href="/{{$.Slug}}?to={{.ShortCode}}" rel="nofollow">{{.Label}}</a>
+{{end}}</main>
+</body>
+</html>
+`))
+
+// servePage renders a page, or follows one of its buttons when ?to= is set
+func (srv *server) servePage(w http.ResponseWriter, r *http.Request, slug string) {
+	p, err := srv.getPage(slug)
+	if err != nil {
+		if errors.Is(err, errPageNotFound) {
+			writeError(w, r, http.StatusNotFound, codePageNotFound)
+			return
+		}
+		log.Printf("Failed to get page %s: %v", slug, err)
+		writeError(w, r, http.StatusInternalServerError, codeLookupFailed)
+		return
+	}
+
+	if to := r.URL.Query().Get("to"); to != "" {
+		// Only the page's own buttons count, so ?to= can't inflate other links
+		if !p.hasLink(to) {
+			writeRedirect(w, r, "", http.StatusNotFound)
+			return
+		}
+		target, status := srv.resolveShortCode(r.Context(), normalizeShortCode(to))
+		if status == http.StatusFound {
+			recordPageClick(p.Owner, p.ID, to)
+		}
+		writeRedirect(w, r, target, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, p); err != nil {
+		log.Printf("Failed to render page %s: %v", slug, err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"shared/idn"
+	"shared/response"
+	"shared/slowquery"
+	"shared/tenantcache"
+	"shared/urlcrypto"
+)
+
+// Every link has a preview page at /<shortCode>/preview that shows where it
+// leads before the visitor follows it: the destination, its screenshot when
+// convert-api's screenshotter has one of the current destination, and a
+// button to the short link itself, so the click is counted as usual. Send
+// Accept: application/json or ?format=json for the same data as JSON. Previews
+// are cached for a minute, so edits and takedowns show up within one.
+const (
+	previewCacheKeyPrefix = "preview:"
+	previewCacheTTL       = time.Minute
+)
+
+// Preview is a link's preview, as cached in Redis with the destination as stored
+type Preview struct {
+	ShortCode     string     `json:"shortCode"`
+	OriginalURL   string     `json:"originalUrl"`
+	ScreenshotURL *string    `json:"screenshotUrl,omitempty"`
+	CapturedAt    *time.Time `json:"capturedAt,omitempty"`
+	// DisplayURL and HostWarnings are set when the hostname is punycode, see shared/idn
+	DisplayURL   string   `json:"displayUrl,omitempty"`
+	HostWarnings []string `json:"hostWarnings,omitempty"`
+	Disabled     bool     `json:"-"`
+	Owner        string   `json:"-"`
+}
+
+func (srv *server) getPreviewFromDB(shortCode string) (*Preview, error) {
+	var p Preview
+	err := srv.db.QueryRowContext(slowquery.Tag(srv.ctx, "getPreview", shortCode), `
+		SELECT urls.short_code, `+servedURLColumn+`, urls.disabled_at IS NOT NULL, s.image_url, s.captured_at, urls.owner
+		FROM urls
+		LEFT JOIN link_screenshots s ON s.short_code = urls.short_code
+			AND s.original_url = `+servedURLColumn+` AND s.image_url IS NOT NULL
+		WHERE `+shortCodeColumn("urls.")+` = $1 AND (urls.expires_at IS NULL OR urls.expires_at > CURRENT_TIMESTAMP)
+	`, shortCode).Scan(&p.ShortCode, &p.OriginalURL, &p.Disabled, &p.ScreenshotURL, &p.CapturedAt, &p.Owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShortCodeNotFound
+		}
+		return nil, fmt.Errorf("failed to get preview: %v", err)
+	}
+	return &p, nil
+}
+
+// getPreview reads the preview from the cache, falling back to Postgres
+func (srv *server) getPreview(shortCode string) (*Preview, error) {
+	key := previewCacheKeyPrefix + shortCode
+	cached, err := tenantcache.Get(srv.ctx, srv.rdb, key)
+	if err == nil {
+		var p Preview
+		if err := json.Unmarshal([]byte(cached.Value), &p); err == nil {
+			return &p, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Failed to read cached preview of %s: %v", shortCode, err)
+	}
+
+	p, err := srv.getPreviewFromDB(shortCode)
+	if err != nil {
+		return nil, err
+	}
+	// Disabled links are never cached, like their redirects
+	if !p.Disabled {
+		if b, err := json.Marshal(p); err == nil {
+			setTenantCache(srv.ctx, srv.rdb, p.Owner, key, b, previewCacheTTL)
+		}
+	}
+	return p, nil
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+<style>
+body{margin:0;padding:32px 16px;font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,sans-serif;background:#f4f4f5;color:#18181b;text-align:center}
+main{max-width:640px;margin:0 auto}
+h1{font-size:1.5rem;margin:0 0 8px;overflow-wrap:anywhere}
+p{margin:0 0 24px;color:#52525b;overflow-wrap:anywhere}
+img{display:block;width:100%;margin:0 0 24px;border-radius:12px;border:1px solid #e4e4e7;background:#fff}
+.warning{padding:12px 16px;border-radius:12px;background:#fef3c7;color:#92400e}
+a{display:inline-block;padding:14px 24px;border-radius:12px;background:#18181b;color:#fff;text-decoration:none;font-weight:600}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+<p>{{.Shown}}</p>
+{{if .HostWarnings}}<p class="warning">{{.HostWarning}}</p>
+{{end}}{{if .ScreenshotURL}}<img src="{{.ScreenshotURL}}" alt="{{.ScreenshotAlt}}" loading="lazy">
+{{end}}<a href="/{{.ShortCode}}" rel="nofollow">{{.Continue}}</a>
+</main>
+</body>
+</html>
+`))
+
+// servePreview renders a link's preview page, in the caller's language
+func (srv *server) servePreview(w http.ResponseWriter, r *http.Request, shortCode string) {
+	if isEmojiCode(shortCode) && !validEmojiCode(shortCode) {
+		writeRedirect(w, r, "", http.StatusNotFound)
+		return
+	}
+	p, err := srv.getPreview(shortCode)
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			writeRedirect(w, r, "", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to get preview of %s: %v", shortCode, err)
+		writeRedirect(w, r, "", http.StatusInternalServerError)
+		return
+	}
+	if p.Disabled {
+		writeRedirect(w, r, "", http.StatusGone)
+		return
+	}
+
+	destination, err := urlcrypto.Decrypt(p.OriginalURL)
+	if err != nil {
+		log.Printf("Failed to decrypt URL for %s: %v", shortCode, err)
+		writeRedirect(w, r, "", http.StatusInternalServerError)
+		return
+	}
+	preview := *p
+	preview.OriginalURL = destination
+	preview.DisplayURL, preview.HostWarnings, _ = idn.DisplayURL(destination)
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if wantsJSON(r) {
+		response.Write(w, http.StatusOK, preview)
+		return
+	}
+
+	shown := destination
+	if preview.DisplayURL != "" {
+		shown = preview.DisplayURL
+	}
+	host := shown
+	if i := strings.Index(shown, "://"); i >= 0 {
+		host = shown[i+len("://"):]
+		if j := strings.IndexAny(host, "/?#"); j >= 0 {
+			host = host[:j]
+		}
+		host = host[strings.LastIndex(host, "@")+1:]
+	}
+	lang := pageLanguage(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = previewTemplate.Execute(w, struct {
+		Preview
+		Lang, Shown, Title, HostWarning, ScreenshotAlt, Continue string
+	}{
+		Preview:       preview,
+		Lang:          lang,
+		Shown:         shown,
+		Title:         pageMessages.Message(lang, pagePreviewTitle, preview.ShortCode, host),
+		HostWarning:   pageMessages.Message(lang, pagePreviewHostWarning),
+		ScreenshotAlt: pageMessages.Message(lang, pagePreviewScreenshot, host),
+		Continue:      pageMessages.Message(lang, pagePreviewContinue, host),
+	})
+	if err != nil {
+		log.Printf("Failed to render preview of %s: %v", shortCode, err)
+	}
+}
+
+// previewHandler serves /<shortCode>/preview
+func (srv *server) previewHandler(c *gin.Context) {
+	srv.servePreview(c.Writer, c.Request, normalizeShortCode(c.Param("shortCode")))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"shared/response"
+	"shared/slowquery"
+	"shared/tenantcache"
+)
+
+// Links whose owner turned on public stats (urls.public_stats, managed by
+// convert-api) have a read-only stats page at /<shortCode>+ and
+// /<shortCode>/stats, as HTML or, with Accept: application/json or
+// ?format=json, as JSON. Links without it answer 404, the same as unknown ones.
+const (
+	publicStatsSuffix         = "+"
+	publicStatsCacheKeyPrefix = "stats:public:"
+	publicStatsCacheTTL       = time.Minute
+	publicStatsDays           = 30
+)
+
+var errStatsNotFound = errors.New("stats not found")
+
+// PublicStats is a link's public stats, as cached in Redis
+type PublicStats struct {
+	ShortCode     string        `json:"shortCode"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	TotalClicks   int64         `json:"totalClicks"`
+	LastClickedAt *time.Time    `json:"lastClickedAt,omitempty"`
+	Daily         []DailyClicks `json:"daily"`
+	Owner         string        `json:"-"`
+}
+
+// DailyClicks is one UTC day of the trend, oldest first
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+// isStatsPath reports whether a root path segment asks for a link's stats page
+func isStatsPath(s string) bool {
+	return len(s) > 1 && strings.HasSuffix(s, publicStatsSuffix)
+}
+
+func (srv *server) getPublicStatsFromDB(shortCode string) (*PublicStats, error) {
+	var s PublicStats
+	var public bool
+	queryCtx := slowquery.Tag(srv.ctx, "getPublicStats", shortCode)
+	err := srv.db.QueryRowContext(queryCtx, `
+		SELECT u.short_code, u.created_at, u.public_stats AND u.disabled_at IS NULL, COALESCE(lc.clicks, 0), lc.last_clicked_at, u.owner
+		FROM urls u
+		LEFT JOIN link_clicks lc ON lc.short_code = u.short_code
+		WHERE `+shortCodeColumn("u.")+` = $1 AND (u.expires_at IS NULL OR u.expires_at > CURRENT_TIMESTAMP)
+	`, shortCode).Scan(&s.ShortCode, &s.CreatedAt, &public, &s.TotalClicks, &s.LastClickedAt, &s.Owner)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errStatsNotFound
+		}
+		return nil, fmt.Errorf("failed to get stats: %v", err)
+	}
+	if !public {
+		return nil, errStatsNotFound
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, -(publicStatsDays - 1))
+	byDay := map[string]int64{}
+	rows, err := srv.db.QueryContext(queryCtx, `
+		SELECT to_char(day, 'YYYY-MM-DD'), clicks FROM link_clicks_daily
+		WHERE short_code = $1 AND day >= $2
+	`, s.ShortCode, first.Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get daily clicks: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day string
+		var clicks int64
+		if err := rows.Scan(&day, &clicks); err != nil {
+			return nil, fmt.Errorf("failed to get daily clicks: %v", err)
+		}
+		byDay[day] = clicks
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get daily clicks: %v", err)
+	}
+
+	// Clicks not persisted yet belong to today
+	pending, err := srv.rdb.HGet(srv.ctx, tenantcache.Key(s.Owner, clicksPendingKey), shortCode).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to get pending clicks for %s: %v", shortCode, err)
+	}
+	s.TotalClicks += pending
+	byDay[today.Format(time.DateOnly)] += pending
+
+	s.Daily = make([]DailyClicks, 0, publicStatsDays)
+	for day := first; !day.After(today); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		s.Daily = append(s.Daily, DailyClicks{Date: date, Clicks: byDay[date]})
+	}
+	return &s, nil
+}
+
+// getPublicStats reads the stats from the cache, falling back to Postgres.
+// convert-api drops the cached copy when public stats are turned off.
+func (srv *server) getPublicStats(shortCode string) (*PublicStats, error) {
+	if isEmojiCode(shortCode) && !validEmojiCode(shortCode) {
+		return nil, errStatsNotFound
+	}
+	key := publicStatsCacheKeyPrefix + shortCode
+	cached, err := tenantcache.Get(srv.ctx, srv.rdb, key)
+	if err == nil {
+		var s PublicStats
+		if err := json.Unmarshal([]byte(cached.Value), &s); err == nil {
+			return &s, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Failed to read cached stats of %s: %v", shortCode, err)
+	}
+
+	s, err := srv.getPublicStatsFromDB(shortCode)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := json.Marshal(s); err == nil {
+		setTenantCache(srv.ctx, srv.rdb, s.Owner, key, b, publicStatsCacheTTL)
+	}
+	return s, nil
+}
+
+// statsBar is one day of the HTML chart
+type statsBar struct {
+	DailyClicks
+	Percent int64
+}
+
+var statsTemplate = template.Must(template.New("stats").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Stats for /{{.ShortCode}}</title>
+<style>
+body{margin:0;padding:32px 16px;font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,sans-serif;background:#f4f4f5;color:#18181b}
+main{max-width:640px;margin:0 auto}
+h1{font-size:1.5rem;margin:0 0 4px;overflow-wrap:anywhere}
+p{margin:0 0 24px;color:#52525b}
+.total{font-size:2.5rem;font-weight:700;margin:0}
+.chart{display:flex;align-items:flex-end;gap:2px;height:160px;margin:24px 0 8px;padding:8px;background:#fff;border-radius:12px}
+.chart div{flex:1;min-height:1px;background:#18181b;border-radius:2px 2px 0 0}
+.axis{display:flex;justify-content:space-between;font-size:.75rem;color:#71717a}
+</style>
+</head>
+<body>
+<main>
+<h1>/{{.ShortCode}}</h1>
+<p>Created {{.CreatedAt.Format "02 Jan 2006"}}</p>
+<p class="total">{{.TotalClicks}}</p>
+<p>total clicks{{if .LastClickedAt}}, last on {{.LastClickedAt.Format "02 Jan 2006"}}{{end}}</p>
+<div class="chart">{{range .Bars}}<div style="height:{{.Percent}}%" title="{{.Date}}: {{.Clicks}} clicks"></div>{{end}}</div>
+<div class="axis"><span>{{.From}}</span><span>Clicks per day (UTC)</span><span>{{.To}}</span></div>
+</main>
+</body>
+</html>
+`))
+
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// serveStats renders a link's public stats page
+func (srv *server) serveStats(w http.ResponseWriter, r *http.Request, shortCode string) {
+	s, err := srv.getPublicStats(shortCode)
+	if err != nil {
+		if errors.Is(err, errStatsNotFound) {
+			writeError(w, r, http.StatusNotFound, codeStatsNotFound)
+			return
+		}
+		log.Printf("Failed to get stats of %s: %v", shortCode, err)
+		writeError(w, r, http.StatusInternalServerError, codeLookupFailed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if wantsJSON(r) {
+		response.Write(w, http.StatusOK, s)
+		return
+	}
+
+	var peak int64
+	for _, d := range s.Daily {
+		peak = max(peak, d.Clicks)
+	}
+	bars := make([]statsBar, len(s.Daily))
+	for i, d := range s.Daily {
+		bars[i] = statsBar{DailyClicks: d}
+		if peak > 0 {
+			bars[i].Percent = d.Clicks * 100 / peak
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = statsTemplate.Execute(w, struct {
+		*PublicStats
+		Bars     []statsBar
+		From, To string
+	}{s, bars, s.Daily[0].Date, s.Daily[len(s.Daily)-1].Date})
+	if err != nil {
+		log.Printf("Failed to render stats of %s: %v", shortCode, err)
+	}
+}
+
+// statsHandler serves /<shortCode>/stats
+func (srv *server) statsHandler(c *gin.Context) {
+	srv.serveStats(c.Writer, c.Request, normalizeShortCode(c.Param("shortCode")))
+}
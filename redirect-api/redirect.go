@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
+	"shared/accesslog"
+	"shared/response"
+	"shared/tracing"
+	"shared/urlcrypto"
+)
+
+var jsonContentType = []string{"application/json; charset=utf-8"}
+
+// resolveShortCode finds the destination of a short code, from the cache first
+// and then Postgres, and returns the status to answer with (http.StatusFound on
+// success). The cache hit path stays free of fmt, JSON encoding and gin.H.
+func (srv *server) resolveShortCode(ctx context.Context, shortCode string) (string, int) {
+	if shortCode == "" {
+		return "", http.StatusBadRequest
+	}
+	if isEmojiCode(shortCode) && !validEmojiCode(shortCode) {
+		return "", http.StatusNotFound
+	}
+
+	start := time.Now()
+	cached, err := srv.getURLByShortCodeCache(ctx, shortCode)
+	observeLayer(layerRedis, start, lookupResult(err, redis.Nil))
+	if err == nil || err == redis.Nil {
+		recordCacheLookup(err == nil)
+	}
+	if err == nil {
+		target, err := urlcrypto.Decrypt(pickDestination(cached.Value))
+		if err == nil {
+			recordHit(cached.Owner, shortCode)
+			if dbDegraded() {
+				srv.extendCacheTTL(shortCode, cached.TTL)
+			} else {
+				srv.refreshAhead(shortCode, cached.TTL)
+			}
+			return target, http.StatusFound
+		}
+		log.Printf("Failed to decrypt cached URL for %s: %v", shortCode, err)
+	} else if err != redis.Nil || dbDegraded() {
+		// Redis is unreachable, or can't be refilled from Postgres: hot links
+		// are still served from memory
+		if target, ok := resolveFromSnapshot(shortCode); ok {
+			return target, http.StatusFound
+		}
+	}
+
+	// Get URL from the link store or database, see degraded.go for outages
+	if skipDBLookup() {
+		return "", http.StatusServiceUnavailable
+	}
+	start = time.Now()
+	urlData, err := srv.lookupURL(ctx, shortCode)
+	observeLayer(layerDB, start, lookupResult(err, errShortCodeNotFound))
+	if err != nil {
+		if errors.Is(err, errShortCodeNotFound) {
+			endDegraded()
+			return "", http.StatusNotFound
+		}
+		log.Printf("Failed to get URL from database: %v", err)
+		startDegraded(err)
+		return "", http.StatusServiceUnavailable
+	}
+	endDegraded()
+
+	// Disabled links (e.g. abuse takedowns) are never cached
+	if urlData.DisabledAt != nil {
+		return "", http.StatusGone
+	}
+
+	value := urlData.cacheValue()
+	target, err := urlcrypto.Decrypt(pickDestination(value))
+	if err != nil {
+		log.Printf("Failed to decrypt URL for %s: %v", shortCode, err)
+		return "", http.StatusInternalServerError
+	}
+
+	srv.saveURLCache(ctx, shortCode, urlData.Owner, value, urlData.ExpiresAt)
+	recordHit(urlData.Owner, shortCode)
+	return target, http.StatusFound
+}
+
+// resolveFromSnapshot looks a short code up in the hot snapshot
+func resolveFromSnapshot(shortCode string) (string, bool) {
+	start := time.Now()
+	stored, ok := lookupHotSnapshot(shortCode)
+	result := lookupMiss
+	if ok {
+		result = lookupHit
+	}
+	observeLayer(layerLocal, start, result)
+	if !ok {
+		return "", false
+	}
+	target, err := urlcrypto.Decrypt(pickDestination(stored))
+	return target, err == nil
+}
+
+// writeRedirect answers a resolved short code. Unlike http.Redirect it writes no
+// HTML body and skips header canonicalization, since targets are always absolute.
+func writeRedirect(w http.ResponseWriter, r *http.Request, target string, status int) {
+	h := w.Header()
+	if status == http.StatusFound {
+		h["Location"] = []string{target}
+		w.WriteHeader(status)
+		return
+	}
+
+	if status == http.StatusServiceUnavailable {
+		h["Retry-After"] = retryAfterHeader
+	}
+	writeError(w, r, status, redirectErrorCodes[status])
+}
+
+func (srv *server) redirectHandler(c *gin.Context) {
+	shortCode := normalizeShortCode(c.Param("shortCode"))
+	if isStatsPath(shortCode) {
+		srv.serveStats(c.Writer, c.Request, strings.TrimSuffix(shortCode, publicStatsSuffix))
+		return
+	}
+	if isPageSlug(shortCode) {
+		srv.servePage(c.Writer, c.Request, shortCode)
+		return
+	}
+	target, status := srv.resolveShortCode(c.Request.Context(), shortCode)
+	srv.writeResolved(c.Writer, c.Request, shortCode, target, status)
+	if status != http.StatusFound {
+		c.Set(response.ErrorCodeKey, redirectErrorCodes[status])
+	}
+}
+
+// skipRedirectLogs keeps the access log, and its formatting, off successful redirects
+func skipRedirectLogs(c *gin.Context) bool {
+	return c.Writer.Status() == http.StatusFound
+}
+
+// REDIRECT_SERVER_MODE=stdlib serves short codes from a bare net/http handler,
+// skipping gin's router and middleware; gin still serves everything else
+var redirectServerMode = os.Getenv("REDIRECT_SERVER_MODE")
+
+// stdlibRedirectHandler answers GET /{shortCode} itself, with the request IDs
+// and access log gin's middleware would add, and passes every other request,
+// such as /api/health, /readyz and /metrics, to the gin engine
+type stdlibRedirectHandler struct {
+	management http.Handler
+	redirects  http.Handler
+}
+
+func newStdlibRedirectHandler(srv *server, management http.Handler) (http.Handler, error) {
+	redirects, err := accesslog.Handler(http.HandlerFunc(srv.serveStdlibRedirect), skipStdlibRedirectLogs, region)
+	if err != nil {
+		return nil, err
+	}
+	return stdlibRedirectHandler{management: management, redirects: redirects}, nil
+}
+
+func (h stdlibRedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if r.Method == http.MethodGet && len(path) > 1 && strings.IndexByte(path[1:], '/') < 0 && path != "/readyz" && path != "/metrics" {
+		h.redirects.ServeHTTP(w, r)
+		return
+	}
+	h.management.ServeHTTP(w, r)
+}
+
+func (srv *server) serveStdlibRedirect(w http.ResponseWriter, r *http.Request) {
+	shortCode := normalizeShortCode(r.URL.Path[1:])
+	if isStatsPath(shortCode) {
+		srv.serveStats(w, r, strings.TrimSuffix(shortCode, publicStatsSuffix))
+		return
+	}
+	if isPageSlug(shortCode) {
+		srv.servePage(w, r, shortCode)
+		return
+	}
+	trace.SpanFromContext(r.Context()).SetName("GET /:shortCode")
+	target, status := srv.resolveShortCode(r.Context(), shortCode)
+	srv.writeResolved(w, r, shortCode, target, status)
+	if status != http.StatusFound {
+		accesslog.SetErrorCode(r, redirectErrorCodes[status])
+	}
+}
+
+// skipStdlibRedirectLogs is skipRedirectLogs for the stdlib handler
+func skipStdlibRedirectLogs(status int) bool {
+	return status == http.StatusFound
+}
+
+// serve runs the HTTP server in the configured mode
+func (srv *server) serve(addr string, r *gin.Engine) error {
+	switch redirectServerMode {
+	case "", "gin":
+		return http.ListenAndServe(addr, tracing.Handler(r.Handler(), serviceName))
+	case "stdlib":
+		handler, err := newStdlibRedirectHandler(srv, r)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           tracing.Handler(handler, serviceName),
+			ReadHeaderTimeout: 5 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+		}
+		return server.ListenAndServe()
+	default:
+		return fmt.Errorf("unknown REDIRECT_SERVER_MODE %q, expected gin or stdlib", redirectServerMode)
+	}
+}
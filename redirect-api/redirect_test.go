@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"shared/accesslog"
+	"shared/shardcache"
+	"shared/tenantcache"
+)
+
+// Tests and benchmarks of the redirect hot path, against an in-memory Redis so
+// they measure this code rather than the network. The benchmarks run with:
+//
+//	go test -run '^$' -bench . -benchmem
+
+const (
+	benchShortCode   = "aB3dE5g"
+	benchDestination = "https://example.com/articles/2024/06/benchmarks?utm_source=bench"
+)
+
+// startBenchCache returns a server on a fresh in-memory Redis holding value
+// under benchShortCode, for longer than the refresh-ahead window
+func startBenchCache(b testing.TB, value string) *server {
+	b.Helper()
+	mr := miniredis.RunT(b)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b.Cleanup(func() { rdb.Close() })
+	srv := &server{
+		ctx:      context.Background(),
+		rdb:      rdb,
+		urlCache: shardcache.New(shardcache.Node{Addr: mr.Addr(), Client: rdb}),
+	}
+
+	if err := tenantcache.Set(srv.ctx, rdb, "", "url:"+benchShortCode, value, cacheTTL, 0).Err(); err != nil {
+		b.Fatal(err)
+	}
+	return srv
+}
+
+func TestRedirectHandlerCacheHit(t *testing.T) {
+	targets := "3 https://a.example.com/\n1 https://b.example.com/"
+	for _, tt := range []struct {
+		name, value string
+		want        []string
+	}{
+		{"cache hit", benchDestination, []string{benchDestination}},
+		{"weighted cache hit", weightedCacheValue(benchDestination, &targets), []string{"https://a.example.com/", "https://b.example.com/"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startBenchCache(t, tt.value)
+			handler, err := newStdlibRedirectHandler(srv, http.NotFoundHandler())
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+benchShortCode, nil))
+			if w.Code != http.StatusFound {
+				t.Fatalf("Answered %d", w.Code)
+			}
+			location := w.Header().Get("Location")
+			for _, want := range tt.want {
+				if location == want {
+					return
+				}
+			}
+			t.Fatalf("Redirected to %q, want one of %q", location, tt.want)
+		})
+	}
+}
+
+func TestStdlibRedirectErrorsCarryRequestID(t *testing.T) {
+	srv := startBenchCache(t, benchDestination)
+	handler, err := newStdlibRedirectHandler(srv, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sent := range []string{"", "req-123"} {
+		// An emoji code with ASCII in it is answered without a lookup
+		req := httptest.NewRequest(http.MethodGet, "/%F0%9F%8D%95a", nil)
+		if sent != "" {
+			req.Header.Set(accesslog.RequestIDHeader, sent)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("Answered %d", w.Code)
+		}
+		id := w.Header().Get(accesslog.RequestIDHeader)
+		if id == "" || (sent != "" && id != sent) {
+			t.Fatalf("Answered with request ID %q, sent %q", id, sent)
+		}
+		var body struct {
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.RequestID != id {
+			t.Fatalf("Body has request_id %q, header %q", body.RequestID, id)
+		}
+	}
+}
+
+func BenchmarkResolveShortCode(b *testing.B) {
+	targets := "3 https://a.example.com/\n1 https://b.example.com/"
+	for _, bench := range []struct {
+		name, value string
+	}{
+		{"cache hit", benchDestination},
+		{"weighted cache hit", weightedCacheValue(benchDestination, &targets)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			srv := startBenchCache(b, bench.value)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, status := srv.resolveShortCode(srv.ctx, benchShortCode); status != http.StatusFound {
+					b.Fatalf("Resolved with status %d", status)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRedirectHandler is a cache hit served by the stdlib server mode,
+// including writing the response
+func BenchmarkRedirectHandler(b *testing.B) {
+	srv := startBenchCache(b, benchDestination)
+	handler, err := newStdlibRedirectHandler(srv, http.NotFoundHandler())
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/"+benchShortCode, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusFound {
+			b.Fatalf("Answered %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkCacheReads(b *testing.B) {
+	b.Run("redis", func(b *testing.B) {
+		srv := startBenchCache(b, benchDestination)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := srv.getURLByShortCodeCache(srv.ctx, benchShortCode); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("hot snapshot", func(b *testing.B) {
+		prev := hotSnapshot.Load()
+		defer hotSnapshot.Store(prev)
+		snapshot := map[string]string{benchShortCode: benchDestination}
+		hotSnapshot.Store(&snapshot)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := lookupHotSnapshot(benchShortCode); !ok {
+				b.Fatal("Missing from the snapshot")
+			}
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"shared/env"
+	"shared/storage"
+)
+
+// redirect-api can run active-active in several regions. Each region has its
+// own Redis and, optionally, a Postgres read replica for lookups, while
+// writes (clicks) go to DATABASE_URL, the primary region's database. REGION
+// names this instance's region; REGION_REDIS_URLS and
+// REGION_DATABASE_REPLICA_URLS map regions to their endpoints as
+// region=endpoint pairs separated by commas, so every region can share one
+// configuration. A region missing from REGION_REDIS_URLS uses REDIS_URL.
+// REGION_URL_CACHE_SHARDS lists each region's url:* cache shards the same
+// way, separated by |, in place of URL_CACHE_SHARDS.
+// The region is exported as redirect_region_info and added to access log
+// lines and click events.
+var (
+	region                    = os.Getenv("REGION")
+	primaryRegion             = env.Get("PRIMARY_REGION", region)
+	regionRedisURLs           = os.Getenv("REGION_REDIS_URLS")
+	regionDatabaseReplicaURLs = os.Getenv("REGION_DATABASE_REPLICA_URLS")
+	regionURLCacheShards      = os.Getenv("REGION_URL_CACHE_SHARDS")
+)
+
+var regionInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "redirect_region_info",
+	Help: "Always 1, labelled with the region of the instance and whether it is the primary.",
+}, []string{"region", "primary"})
+
+// parseRegionMap parses region=endpoint pairs
+func parseRegionMap(key, value string) (map[string]string, error) {
+	endpoints := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, endpoint, ok := strings.Cut(pair, "=")
+		name, endpoint = strings.TrimSpace(name), strings.TrimSpace(endpoint)
+		if !ok || name == "" || endpoint == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected region=endpoint", key, pair)
+		}
+		endpoints[name] = endpoint
+	}
+	return endpoints, nil
+}
+
+// regionEndpoint returns this region's endpoint in a region map, "" when it has none
+func regionEndpoint(key, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if region == "" {
+		return "", fmt.Errorf("%s needs REGION", key)
+	}
+	endpoints, err := parseRegionMap(key, value)
+	if err != nil {
+		return "", err
+	}
+	return endpoints[region], nil
+}
+
+// initRegion checks the region configuration
+func initRegion() error {
+	if _, err := regionEndpoint("REGION_REDIS_URLS", regionRedisURLs); err != nil {
+		return err
+	}
+	if _, err := regionEndpoint("REGION_DATABASE_REPLICA_URLS", regionDatabaseReplicaURLs); err != nil {
+		return err
+	}
+	if _, err := regionEndpoint("REGION_URL_CACHE_SHARDS", regionURLCacheShards); err != nil {
+		return err
+	}
+	if region != "" {
+		regionInfo.WithLabelValues(region, fmt.Sprint(region == primaryRegion)).Set(1)
+	}
+	return nil
+}
+
+// regionRedisAddr is the address of this region's Redis, "" for REDIS_URL
+func regionRedisAddr() string {
+	addr, _ := regionEndpoint("REGION_REDIS_URLS", regionRedisURLs)
+	return addr
+}
+
+// initReplica connects to this region's read replica, if it has one
+func (srv *server) initReplica() {
+	replicaURL, _ := regionEndpoint("REGION_DATABASE_REPLICA_URLS", regionDatabaseReplicaURLs)
+	if replicaURL == "" {
+		return
+	}
+	connector, err := pq.NewConnector(replicaURL)
+	if err != nil {
+		log.Fatalf("Invalid read replica URL of %s: %v", region, err)
+	}
+	err = storage.Retry("PostgreSQL replica", func() (err error) {
+		srv.replicaDB, err = openDatabase(connector)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Failed to ping read replica: %v", err)
+	}
+	fmt.Printf("Connected to the %s read replica successfully\n", region)
+}
+
+// lookupDB is the database link lookups read from: the region's replica when
+// it has one
+func (srv *server) lookupDB() *sql.DB {
+	if srv.replicaDB != nil {
+		return srv.replicaDB
+	}
+	return srv.db
+}
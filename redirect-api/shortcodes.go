@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"shared/env"
+)
+
+// Tenants can have short codes spelled in emoji (convert-api's emoji
+// alphabet). Clients send them percent-encoded and net/http decodes the path,
+// so handlers see the UTF-8 code, which is also its cache key. Codes are
+// either all ASCII or all emoji, so the first byte tells them apart without
+// slowing down base62 lookups.
+const maxShortCodeChars = 10 // urls.short_code is VARCHAR(10)
+
+// CASE_INSENSITIVE_CODES=true (set on both services) lower-cases ASCII codes
+// before anything else sees them, so the cache, click counts and
+// getURLByShortCode's functional index lookup all use the lower-case form
+var caseInsensitiveCodes = env.Get("CASE_INSENSITIVE_CODES", "false") == "true"
+
+// emojiVariationSelector is appended by some keyboards and never part of a stored code
+const emojiVariationSelector = "\uFE0F"
+
+func isEmojiCode(s string) bool {
+	return s != "" && s[0] >= utf8.RuneSelf
+}
+
+// normalizeShortCode strips variation selectors from emoji codes and, with
+// case-insensitive codes, lower-cases the others
+func normalizeShortCode(s string) string {
+	if !isEmojiCode(s) {
+		if caseInsensitiveCodes {
+			return strings.ToLower(s)
+		}
+		return s
+	}
+	return strings.ReplaceAll(s, emojiVariationSelector, "")
+}
+
+// shortCodeColumn is the urls expression matched against normalized codes
+func shortCodeColumn(prefix string) string {
+	if caseInsensitiveCodes {
+		return "lower(" + prefix + "short_code)"
+	}
+	return prefix + "short_code"
+}
+
+// validEmojiCode rejects malformed emoji codes before they reach Redis or Postgres
+func validEmojiCode(s string) bool {
+	if !utf8.ValidString(s) || utf8.RuneCountInString(s) > maxShortCodeChars {
+		return false
+	}
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Links can spread their redirects over weighted targets, set in convert-api.
+// They are cached with the link as "w:<stored destination>\n<weight> <stored
+// target>\n..." and every redirect picks one target at random, in proportion
+// to its weight. Values without the prefix are a single stored destination.
+const weightedCachePrefix = "w:"
+
+// linkTargetsColumn selects the targets of the urls row of a query in the
+// cached form, NULL when there are none
+const linkTargetsColumn = `(SELECT string_agg(t.weight || ' ' || t.original_url, E'\n' ORDER BY t.position)
+	FROM link_targets t WHERE t.short_code = urls.short_code)`
+
+// weightedCacheValue is what the cache holds for a link, given its stored
+// destination and its targets as selected by linkTargetsColumn
+func weightedCacheValue(storedURL string, targets *string) string {
+	if targets == nil || *targets == "" {
+		return storedURL
+	}
+	return weightedCachePrefix + storedURL + "\n" + *targets
+}
+
+// pickDestination returns the stored destination to redirect to for a cached
+// value. Malformed targets are skipped; with none left the link's own
+// destination is used.
+func pickDestination(value string) string {
+	rest, ok := strings.CutPrefix(value, weightedCachePrefix)
+	if !ok {
+		return value
+	}
+	destination, targets, _ := strings.Cut(rest, "\n")
+
+	total := 0
+	for lines := targets; lines != ""; {
+		var line string
+		line, lines, _ = strings.Cut(lines, "\n")
+		if weight, _, ok := parseTarget(line); ok {
+			total += weight
+		}
+	}
+	if total == 0 {
+		return destination
+	}
+
+	n := rand.Intn(total)
+	for lines := targets; lines != ""; {
+		var line string
+		line, lines, _ = strings.Cut(lines, "\n")
+		weight, target, ok := parseTarget(line)
+		if !ok {
+			continue
+		}
+		if n < weight {
+			return target
+		}
+		n -= weight
+	}
+	return destination
+}
+
+// parseTarget splits one "<weight> <stored target>" line
+func parseTarget(line string) (int, string, bool) {
+	w, target, ok := strings.Cut(line, " ")
+	if !ok || target == "" {
+		return 0, "", false
+	}
+	weight, err := strconv.Atoi(w)
+	if err != nil || weight <= 0 {
+		return 0, "", false
+	}
+	return weight, target, true
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"shared/env"
+	"shared/tenantcache"
+)
+
+// Every cache entry counts towards its tenant, the owner of the link, page or
+// error page it caches, see the tenantcache package. A tenant already holding
+// TENANT_CACHE_MAX_ENTRIES live entries on a Redis instance (0, the default,
+// for no limit) is served from Postgres for anything more until some expire,
+// so one tenant can't crowd the others out of the cache. convert-api audits
+// and flushes a tenant's entries.
+var tenantCacheMaxEntries = env.Int("TENANT_CACHE_MAX_ENTRIES", 0)
+
+// setTenantCache caches value under key on client as one of owner's
+// entries. Like any cache write, failures leave the next request a miss.
+func setTenantCache(ctx context.Context, client redis.Scripter, owner, key string, value interface{}, ttl time.Duration) {
+	tenantcache.Set(ctx, client, owner, key, value, ttl, tenantCacheMaxEntries)
+}
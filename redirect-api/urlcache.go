@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"shared/shardcache"
+	"shared/storage"
+)
+
+// The redirect cache entries (url:*) can be spread over several independent
+// Redis instances by listing them in URL_CACHE_SHARDS, host:port separated by
+// commas, so the cache outgrows one instance without Redis Cluster. Every
+// other key (clicks, popularity, previews, locks, evictions) stays in
+// REDIS_URL. Each short code belongs to one shard by consistent hashing, see
+// the shardcache package; convert-api must list the same shards to
+// invalidate them. In a multi-region deployment, this region's entry of
+// REGION_URL_CACHE_SHARDS replaces URL_CACHE_SHARDS. A shard that is down turns its links' lookups into cache
+// errors, served from the hot snapshot or Postgres like a Redis outage,
+// without moving its keys to the other shards.
+var urlCacheShards = os.Getenv("URL_CACHE_SHARDS")
+
+func (srv *server) initURLCache() {
+	shards, sep := urlCacheShards, ","
+	if regional, _ := regionEndpoint("REGION_URL_CACHE_SHARDS", regionURLCacheShards); regional != "" {
+		shards, sep = regional, "|"
+	}
+	if shards == "" {
+		srv.urlCache = shardcache.New(shardcache.Node{Client: srv.rdb})
+		return
+	}
+
+	var nodes []shardcache.Node
+	for _, addr := range strings.Split(shards, sep) {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		node := shardcache.Node{Addr: addr}
+		err := storage.Retry("cache shard "+addr, func() (err error) {
+			node.Client, err = storage.NewRedis(srv.ctx, addr)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Failed to connect to cache shard %s: %v", addr, err)
+		}
+		nodes = append(nodes, node)
+	}
+	srv.urlCache = shardcache.New(nodes...)
+	fmt.Printf("Connected to %d cache shards successfully\n", len(nodes))
+}
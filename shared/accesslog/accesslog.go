@@ -0,0 +1,252 @@
+// Package accesslog sets up the services' gin engines: request IDs, the
+// access log and panic recovery. Handler gives bare net/http handlers the
+// same request IDs and access log.
+//
+// Requests are logged as one JSON object per line on stdout, for log
+// pipelines; ACCESS_LOG_FORMAT=text brings back gin's console logger and off
+// disables it. Gin runs in release mode unless GIN_MODE says otherwise
+// (debug prints every route at startup).
+package accesslog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"shared/env"
+	"shared/response"
+	"shared/tracing"
+)
+
+var format = env.Get("ACCESS_LOG_FORMAT", "json")
+
+// RequestIDHeader carries a request's ID: the caller's (e.g. the gateway's)
+// when it sends a usable one, a random one otherwise. It is echoed on the
+// response and logged with the request.
+const (
+	RequestIDHeader    = response.RequestIDHeader
+	maxRequestIDLength = 128
+)
+
+// accessLog writes entries without the timestamp prefix of the standard logger
+var accessLog = log.New(os.Stdout, "", 0)
+
+type entry struct {
+	Time      string  `json:"time"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Bytes     int     `json:"bytes"`
+	ClientIP  string  `json:"clientIp"`
+	RequestID string  `json:"requestId"`
+	TraceID   string  `json:"traceId,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	ErrorCode string  `json:"errorCode,omitempty"`
+	Region    string  `json:"region,omitempty"`
+}
+
+// NewRouter returns a gin engine with request IDs, the configured access log
+// (skipping requests skip matches, entries tagged with region) and panic
+// recovery
+func NewRouter(skip gin.Skipper, region string) (*gin.Engine, error) {
+	if os.Getenv("GIN_MODE") == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	r := gin.New()
+	r.Use(RequestID, tracing.Route)
+	switch format {
+	case "json":
+		r.Use(jsonAccessLog(skip, region))
+	case "text":
+		r.Use(gin.LoggerWithConfig(gin.LoggerConfig{Skip: skip}))
+	case "off":
+	default:
+		return nil, fmt.Errorf("unknown ACCESS_LOG_FORMAT %q, expected json, text or off", format)
+	}
+	r.Use(gin.Recovery())
+	return r, nil
+}
+
+// ValidRequestID accepts IDs of printable ASCII without spaces, so they are
+// safe to echo in a header
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestID makes sure every request has an ID, on the request for handlers
+// and on the response for the caller
+func RequestID(c *gin.Context) {
+	setRequestID(c.Writer, c.Request)
+	c.Next()
+}
+
+func setRequestID(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if !ValidRequestID(id) {
+		id = NewRequestID()
+		r.Header.Set(RequestIDHeader, id)
+	}
+	w.Header().Set(RequestIDHeader, id)
+}
+
+// jsonAccessLog logs each request once it has been served. Paths are logged
+// without their query, which may carry tokens.
+func jsonAccessLog(skip gin.Skipper, region string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		if skip != nil && skip(c) {
+			return
+		}
+
+		line, err := json.Marshal(entry{
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Status:    c.Writer.Status(),
+			LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			Bytes:     max(c.Writer.Size(), 0),
+			ClientIP:  c.ClientIP(),
+			RequestID: c.Request.Header.Get(RequestIDHeader),
+			TraceID:   tracing.TraceID(c.Request.Context()),
+			Error:     c.Errors.ByType(gin.ErrorTypePrivate).String(),
+			ErrorCode: c.GetString(response.ErrorCodeKey),
+			Region:    region,
+		})
+		if err != nil {
+			log.Printf("Failed to encode access log entry: %v", err)
+			return
+		}
+		accessLog.Print(string(line))
+	}
+}
+
+// errorCodeKey is the context key of the code SetErrorCode leaves for Handler
+type errorCodeKey struct{}
+
+// SetErrorCode records the code of the error a Handler request is answered
+// with, for the access log; the counterpart of response.ErrorCodeKey
+func SetErrorCode(r *http.Request, code string) {
+	if p, ok := r.Context().Value(errorCodeKey{}).(*string); ok {
+		*p = code
+	}
+}
+
+// statusWriter remembers the status and size of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Handler wraps next, a handler served outside gin, with the request IDs and
+// configured access log of NewRouter (skipping responses whose status skip
+// matches, entries tagged with region)
+func Handler(next http.Handler, skip func(status int) bool, region string) (http.Handler, error) {
+	if format != "json" && format != "text" && format != "off" {
+		return nil, fmt.Errorf("unknown ACCESS_LOG_FORMAT %q, expected json, text or off", format)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRequestID(w, r)
+		if format == "off" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		var errorCode string
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), errorCodeKey{}, &errorCode)))
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if skip != nil && skip(status) {
+			return
+		}
+
+		latency := time.Since(start)
+		if format == "text" {
+			// The layout of gin's console logger, without colors
+			accessLog.Printf("[GIN] %v | %3d | %13v | %15s | %-7s %#v",
+				start.Format("2006/01/02 - 15:04:05"), status, latency, clientIP(r), r.Method, r.URL.Path)
+			return
+		}
+		line, err := json.Marshal(entry{
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    status,
+			LatencyMs: float64(latency.Microseconds()) / 1000,
+			Bytes:     sw.bytes,
+			ClientIP:  clientIP(r),
+			RequestID: r.Header.Get(RequestIDHeader),
+			TraceID:   tracing.TraceID(r.Context()),
+			ErrorCode: errorCode,
+			Region:    region,
+		})
+		if err != nil {
+			log.Printf("Failed to encode access log entry: %v", err)
+			return
+		}
+		accessLog.Print(string(line))
+	}), nil
+}
+
+// clientIP picks the client address the way gin does with its default
+// trusted proxies: the first X-Forwarded-For hop, X-Real-Ip, then the peer
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		first, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(first)
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,203 @@
+// Package chaos slows down and fails a share of Postgres and Redis calls, so
+// timeouts and fallbacks can be exercised in staging. It needs
+// CHAOS_ENABLED=true on top of the rates, and only starts once the service has
+// connected, so a bad setting can't stop it from booting. Never enable it in
+// production.
+package chaos
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"shared/env"
+)
+
+var (
+	chaosEnabled        = env.Get("CHAOS_ENABLED", "false") == "true"
+	chaosDBLatency      = env.Duration("CHAOS_DB_LATENCY", 0)
+	chaosDBErrorRate    = env.Rate("CHAOS_DB_ERROR_RATE", 0)
+	chaosRedisLatency   = env.Duration("CHAOS_REDIS_LATENCY", 0)
+	chaosRedisErrorRate = env.Rate("CHAOS_REDIS_ERROR_RATE", 0)
+)
+
+var errChaos = errors.New("chaos: injected fault")
+
+// chaosArmed is set by Start; until then every call goes through untouched
+var chaosArmed atomic.Bool
+
+// Start arms chaos mode when it is configured
+func Start() {
+	if !chaosEnabled {
+		return
+	}
+	log.Printf("WARNING: chaos mode on: Postgres +%s and %g%% errors, Redis +%s and %g%% errors",
+		chaosDBLatency, chaosDBErrorRate*100, chaosRedisLatency, chaosRedisErrorRate*100)
+	chaosArmed.Store(true)
+}
+
+// injectChaos waits out the latency, unless ctx ends first, and then fails the
+// call at errorRate
+func injectChaos(ctx context.Context, latency time.Duration, errorRate float64) error {
+	if !chaosArmed.Load() {
+		return nil
+	}
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if errorRate > 0 && rand.Float64() < errorRate {
+		return errChaos
+	}
+	return nil
+}
+
+func injectDBChaos(ctx context.Context) error {
+	return injectChaos(ctx, chaosDBLatency, chaosDBErrorRate)
+}
+
+// Connector wraps the database connector when chaos mode is configured
+func Connector(c driver.Connector) driver.Connector {
+	if !chaosEnabled {
+		return c
+	}
+	return chaosConnector{c}
+}
+
+type chaosConnector struct {
+	driver.Connector
+}
+
+func (c chaosConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := injectDBChaos(ctx); err != nil {
+		return nil, err
+	}
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return chaosConn{conn}, nil
+}
+
+// chaosConn injects before each statement, prepare and transaction. The
+// context variants delegate to lib/pq's, which implements all of them.
+type chaosConn struct {
+	driver.Conn
+}
+
+func (c chaosConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := injectDBChaos(ctx); err != nil {
+		return nil, err
+	}
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c chaosConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := injectDBChaos(ctx); err != nil {
+		return nil, err
+	}
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c chaosConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := injectDBChaos(ctx); err != nil {
+		return nil, err
+	}
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c chaosConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := injectDBChaos(ctx); err != nil {
+		return nil, err
+	}
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c chaosConn) Ping(ctx context.Context) error {
+	if err := injectDBChaos(ctx); err != nil {
+		return err
+	}
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c chaosConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c chaosConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// AddRedisHook makes client's commands and pipelines slow and flaky when chaos mode is configured
+func AddRedisHook(client *redis.Client) {
+	if chaosEnabled {
+		client.AddHook(chaosRedisHook{})
+	}
+}
+
+type chaosRedisHook struct{}
+
+func (chaosRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err := injectChaos(ctx, chaosRedisLatency, chaosRedisErrorRate); err != nil {
+			return nil, err
+		}
+		return next(ctx, network, addr)
+	}
+}
+
+func (chaosRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := injectChaos(ctx, chaosRedisLatency, chaosRedisErrorRate); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (chaosRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := injectChaos(ctx, chaosRedisLatency, chaosRedisErrorRate); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
@@ -0,0 +1,60 @@
+// Package env reads the services' settings from the environment, falling back
+// to defaults when a variable is unset or invalid
+package env
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Get reads an environment variable, falling back to a default when unset
+func Get(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Duration reads a duration such as "30s" or "1h", falling back to a default when unset or invalid
+func Duration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// Int reads a positive integer, falling back to a default when unset or invalid
+func Int(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Rate reads a fraction between 0 and 1, falling back to a default when unset or invalid
+func Rate(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f > 1 {
+		log.Printf("Invalid %s %q, using %g", key, value, fallback)
+		return fallback
+	}
+	return f
+}
@@ -0,0 +1,69 @@
+// Package i18n looks client-facing messages up by a stable code in the
+// language an Accept-Language header asks for. Responses carry the code next
+// to the message, so clients and logs can match on the code whatever the
+// language. Each service has its own Catalog.
+package i18n
+
+import (
+	"fmt"
+
+	"golang.org/x/text/language"
+)
+
+// Catalog maps a code to its message format per language, e.g.
+// Catalog{"page_not_found": {"en": "page not found", "de": "Seite nicht gefunden"}}
+type Catalog map[string]map[string]string
+
+// Localizer picks languages and messages from a Catalog
+type Localizer struct {
+	catalog   Catalog
+	languages []string
+	matcher   language.Matcher
+}
+
+// New returns a Localizer for languages, BCP 47 tags such as "en" or "de".
+// The first is the fallback for requests asking for none of them and for
+// messages missing in a language.
+func New(catalog Catalog, languages ...string) *Localizer {
+	tags := make([]language.Tag, len(languages))
+	for i, l := range languages {
+		tags[i] = language.MustParse(l)
+	}
+	return &Localizer{catalog: catalog, languages: languages, matcher: language.NewMatcher(tags)}
+}
+
+// Default returns the fallback language
+func (l *Localizer) Default() string {
+	return l.languages[0]
+}
+
+// Languages returns the supported languages, the fallback first
+func (l *Localizer) Languages() []string {
+	return l.languages
+}
+
+// Negotiate returns the language that best matches an Accept-Language header
+func (l *Localizer) Negotiate(acceptLanguage string) string {
+	if acceptLanguage == "" {
+		return l.languages[0]
+	}
+	_, i := language.MatchStrings(l.matcher, acceptLanguage)
+	return l.languages[i]
+}
+
+// Message formats the message of code in lang with args. Unknown codes come
+// back as the code itself.
+func (l *Localizer) Message(lang, code string, args ...interface{}) string {
+	formats, ok := l.catalog[code]
+	if !ok {
+		return code
+	}
+	format, ok := formats[lang]
+	if !ok {
+		format = formats[l.languages[0]]
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,95 @@
+// Package idn shows internationalized hostnames, stored in their ASCII
+// (punycode) form, in Unicode. HostSpoofWarnings flags the labels of a
+// hostname that could pass for another domain: ones mixing Latin with
+// Cyrillic or Greek letters ("pаypal" with a Cyrillic а), and ones written
+// entirely in Cyrillic or Greek letters that look Latin ("аррӏе").
+package idn
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	WarningMixedScript    = "mixed_script"
+	WarningLatinLookalike = "latin_lookalike"
+)
+
+// latinLookalikes are the Cyrillic and Greek letters that pass for Latin ones
+const latinLookalikes = "аеорсухіјѕԁһӏԛԝвкмнтαοριτκνυ"
+
+// DisplayURL returns rawURL with its hostname in Unicode and the hostname's
+// spoofing warnings. ok is false when the hostname isn't internationalized.
+func DisplayURL(rawURL string) (display string, warnings []string, ok bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !strings.Contains(u.Hostname(), "xn--") {
+		return "", nil, false
+	}
+	// The Display profile refuses labels that don't decode to a valid hostname
+	host, err := idna.Display.ToUnicode(u.Hostname())
+	if err != nil {
+		return "", nil, false
+	}
+
+	// url.URL would percent-encode the Unicode hostname, so it is swapped
+	// into the authority of the original string instead
+	start := strings.Index(rawURL, "://")
+	if start < 0 {
+		return "", nil, false
+	}
+	start += len("://")
+	end := len(rawURL)
+	if i := strings.IndexAny(rawURL[start:], "/?#"); i >= 0 {
+		end = start + i
+	}
+	authority := rawURL[start:end]
+	i := strings.LastIndex(authority, u.Hostname())
+	if i < 0 {
+		return "", nil, false
+	}
+	display = rawURL[:start] + authority[:i] + host + authority[i+len(u.Hostname()):] + rawURL[end:]
+	return display, HostSpoofWarnings(host), true
+}
+
+// HostSpoofWarnings returns the warnings of a Unicode hostname, each once
+func HostSpoofWarnings(host string) []string {
+	var warnings []string
+	add := func(warning string) {
+		for _, w := range warnings {
+			if w == warning {
+				return
+			}
+		}
+		warnings = append(warnings, warning)
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		var latin, cyrillic, greek, lookalikes, letters int
+		for _, r := range label {
+			if !unicode.IsLetter(r) {
+				continue
+			}
+			letters++
+			switch {
+			case unicode.Is(unicode.Latin, r):
+				latin++
+			case unicode.Is(unicode.Cyrillic, r):
+				cyrillic++
+			case unicode.Is(unicode.Greek, r):
+				greek++
+			}
+			if strings.ContainsRune(latinLookalikes, r) {
+				lookalikes++
+			}
+		}
+		if (latin > 0 && cyrillic+greek > 0) || (cyrillic > 0 && greek > 0) {
+			add(WarningMixedScript)
+		} else if latin == 0 && letters > 0 && lookalikes == letters {
+			add(WarningLatinLookalike)
+		}
+	}
+	return warnings
+}
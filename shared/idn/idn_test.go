@@ -0,0 +1,49 @@
+package idn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDisplayURL(t *testing.T) {
+	for _, tt := range []struct {
+		raw      string
+		display  string
+		warnings []string
+		ok       bool
+	}{
+		{"https://example.com/a", "", nil, false},
+		{"https://xn--bcher-kva.example/b%C3%BCcher?q=1#top", "https://bücher.example/b%C3%BCcher?q=1#top", nil, true},
+		{"https://user@xn--bcher-kva.example:8443", "https://user@bücher.example:8443", nil, true},
+		{"https://xn--80ak6aa92e.com/", "https://аррӏе.com/", []string{WarningLatinLookalike}, true},
+		{"https://xn--pypal-4ve.com/login", "https://pаypal.com/login", []string{WarningMixedScript}, true},
+		{"https://xn--a.example/", "", nil, false},
+		{"xn--bcher-kva.example/a", "", nil, false},
+	} {
+		display, warnings, ok := DisplayURL(tt.raw)
+		if display != tt.display || !reflect.DeepEqual(warnings, tt.warnings) || ok != tt.ok {
+			t.Errorf("DisplayURL(%q) = %q, %v, %v, want %q, %v, %v", tt.raw, display, warnings, ok, tt.display, tt.warnings, tt.ok)
+		}
+	}
+}
+
+func TestHostSpoofWarnings(t *testing.T) {
+	for _, tt := range []struct {
+		host string
+		want []string
+	}{
+		{"example.com", nil},
+		{"bücher.example", nil},
+		{"яндекс.рф", nil},
+		{"ελλάδα.gr", nil},
+		{"аррӏе.com", []string{WarningLatinLookalike}},
+		{"pаypal.com", []string{WarningMixedScript}},
+		{"сοм.example", []string{WarningMixedScript}},
+		{"pаypal.аррӏе.pаypal", []string{WarningMixedScript, WarningLatinLookalike}},
+		{"123.example", nil},
+	} {
+		if got := HostSpoofWarnings(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("HostSpoofWarnings(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package response writes the JSON envelope every API response of
+// convert-api and redirect-api shares:
+//
+//	{"data": {"shortCode": "G80003UE"}, "error": null, "meta": null, "request_id": "3f2a9c0e..."}
+//	{"data": null, "error": {"code": "short_code_not_found", "message": "short code not found"}, "meta": null, "request_id": "3f2a9c0e..."}
+//
+// Successes set data, and meta for pages of a list; failures set error, with
+// details such as per-field problems when there are any. Localized errors
+// (see the i18n package) also carry a stable code. request_id is the
+// request's X-Request-ID, so a failure reported by a caller can be found in
+// the access log.
+package response
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader carries a request's ID. The request ID middleware sets it
+// on every response before handlers run.
+const RequestIDHeader = "X-Request-ID"
+
+// ErrorCodeKey is the gin context key under which FailWith leaves the code of
+// the error, for the access log
+const ErrorCodeKey = "response.errorCode"
+
+// Envelope is the body of every JSON response
+type Envelope struct {
+	Data      interface{} `json:"data"`
+	Error     *Error      `json:"error"`
+	Meta      interface{} `json:"meta"`
+	RequestID string      `json:"request_id"`
+}
+
+// Error says why a request failed
+type Error struct {
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Page is the meta of a page of a list; NextCursor is empty on the last page
+type Page struct {
+	NextCursor string `json:"nextCursor"`
+}
+
+var jsonContentType = []string{"application/json; charset=utf-8"}
+
+// RequestID returns the ID of the request c answers
+func RequestID(c *gin.Context) string {
+	return c.Writer.Header().Get(RequestIDHeader)
+}
+
+// OK writes data
+func OK(c *gin.Context, status int, data interface{}) {
+	c.JSON(status, Envelope{Data: data, RequestID: RequestID(c)})
+}
+
+// WithMeta writes data with meta, e.g. a Page
+func WithMeta(c *gin.Context, status int, data, meta interface{}) {
+	c.JSON(status, Envelope{Data: data, Meta: meta, RequestID: RequestID(c)})
+}
+
+// List writes a page of a list
+func List(c *gin.Context, data interface{}, nextCursor string) {
+	WithMeta(c, http.StatusOK, data, Page{NextCursor: nextCursor})
+}
+
+// Fail writes an error
+func Fail(c *gin.Context, status int, message string) {
+	c.JSON(status, Envelope{Error: &Error{Message: message}, RequestID: RequestID(c)})
+}
+
+// FailWithDetails writes an error with details of what was wrong
+func FailWithDetails(c *gin.Context, status int, message string, details interface{}) {
+	c.JSON(status, Envelope{Error: &Error{Message: message, Details: details}, RequestID: RequestID(c)})
+}
+
+// FailWith writes e
+func FailWith(c *gin.Context, status int, e Error) {
+	if e.Code != "" {
+		c.Set(ErrorCodeKey, e.Code)
+	}
+	c.JSON(status, Envelope{Error: &e, RequestID: RequestID(c)})
+}
+
+// Abort writes an error and stops the remaining handlers, for middleware
+func Abort(c *gin.Context, status int, message string) {
+	c.Abort()
+	Fail(c, status, message)
+}
+
+// Write writes data from a plain net/http handler
+func Write(w http.ResponseWriter, status int, data interface{}) {
+	writeEnvelope(w, status, Envelope{Data: data, RequestID: w.Header().Get(RequestIDHeader)})
+}
+
+// WriteError writes an error from a plain net/http handler
+func WriteError(w http.ResponseWriter, status int, message string) {
+	writeEnvelope(w, status, Envelope{Error: &Error{Message: message}, RequestID: w.Header().Get(RequestIDHeader)})
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, e Envelope) {
+	w.Header()["Content-Type"] = jsonContentType
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// Prebuilt is an error body encoded ahead of time, for paths that shouldn't
+// encode JSON per request: only the request ID is added when it is written.
+// It holds the envelope up to the value of request_id.
+type Prebuilt []byte
+
+// Prebuild encodes the error body of code and message
+func Prebuild(code, message string) Prebuilt {
+	body, _ := json.Marshal(Envelope{Error: &Error{Code: code, Message: message}})
+	return Prebuilt(body[:len(body)-len(`""}`)])
+}
+
+// Write writes the body with the request ID set on w. Request IDs are
+// printable ASCII, which strconv quotes the way JSON does.
+func (p Prebuilt) Write(w http.ResponseWriter) {
+	id := w.Header().Get(RequestIDHeader)
+	body := make([]byte, 0, len(p)+len(id)+4)
+	body = append(body, p...)
+	body = strconv.AppendQuote(body, id)
+	body = append(body, '}')
+	w.Write(body)
+}
@@ -0,0 +1,181 @@
+// Package shardcache spreads a cache namespace over several independent Redis
+// instances with consistent hashing, so cache capacity grows by adding
+// instances rather than by running Redis Cluster. Each instance owns many
+// points on a hash ring, and a key belongs to the instance owning the first
+// point at or after the key's hash: adding or removing an instance only moves
+// about its share of the keys. Points are derived from the instances'
+// addresses, so every process given the same addresses, in any order, agrees
+// on where each key lives.
+package shardcache
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pointsPerNode is how many points each instance owns; more points spread
+// keys more evenly
+const pointsPerNode = 160
+
+// ErrNoNodes is returned by the commands of a Ring without instances
+var ErrNoNodes = errors.New("shardcache: no nodes")
+
+// Node is one Redis instance of a Ring
+type Node struct {
+	Addr   string
+	Client *redis.Client
+}
+
+type point struct {
+	hash uint32
+	node int
+}
+
+// Ring maps keys to the Redis instance that holds them
+type Ring struct {
+	nodes  []Node
+	points []point
+}
+
+// New returns a Ring over nodes. A Ring of one node sends every key to it; a
+// Ring of none holds no key.
+func New(nodes ...Node) *Ring {
+	r := &Ring{nodes: nodes}
+	for i, n := range nodes {
+		for p := 0; p < pointsPerNode; p++ {
+			r.points = append(r.points, point{hash: crc32.ChecksumIEEE([]byte(n.Addr + "#" + strconv.Itoa(p))), node: i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		// Ties go to the lower address whatever the configured order
+		return r.nodes[r.points[i].node].Addr < r.nodes[r.points[j].node].Addr
+	})
+	return r
+}
+
+// node returns the index of the node holding key, -1 on an empty ring
+func (r *Ring) node(key string) int {
+	switch len(r.nodes) {
+	case 0:
+		return -1
+	case 1:
+		return 0
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Client returns the client of the instance holding key, nil on an empty ring
+func (r *Ring) Client(key string) *redis.Client {
+	n := r.node(key)
+	if n < 0 {
+		return nil
+	}
+	return r.nodes[n].Client
+}
+
+// Nodes returns the instances of the ring
+func (r *Ring) Nodes() []Node {
+	return r.nodes
+}
+
+// Partition groups keys by the instance holding them, for callers that
+// pipeline their own commands per instance. An empty ring has no groups.
+func (r *Ring) Partition(keys []string) map[*redis.Client][]string {
+	parts := map[*redis.Client][]string{}
+	if len(r.nodes) == 0 {
+		return parts
+	}
+	for _, key := range keys {
+		client := r.Client(key)
+		parts[client] = append(parts[client], key)
+	}
+	return parts
+}
+
+// Reader reads keys from one instance, a value or nil for each
+type Reader func(ctx context.Context, client *redis.Client, keys ...string) ([]interface{}, error)
+
+// MGet reads keys with one MGET per instance, run concurrently. Values are
+// in the order of keys, nil for missing keys; the first error is returned
+// along with the values that could be read.
+func (r *Ring) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	return r.Read(ctx, mget, keys...)
+}
+
+func mget(ctx context.Context, client *redis.Client, keys ...string) ([]interface{}, error) {
+	return client.MGet(ctx, keys...).Result()
+}
+
+// Read is MGet with read in place of MGET, for entries read through a script
+func (r *Ring) Read(ctx context.Context, read Reader, keys ...string) ([]interface{}, error) {
+	values := make([]interface{}, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	if len(r.nodes) == 0 {
+		return values, ErrNoNodes
+	}
+	byNode := map[int][]int{}
+	for i, key := range keys {
+		n := r.node(key)
+		byNode[n] = append(byNode[n], i)
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for n, indexes := range byNode {
+		wg.Add(1)
+		go func(client *redis.Client, indexes []int) {
+			defer wg.Done()
+			nodeKeys := make([]string, len(indexes))
+			for j, i := range indexes {
+				nodeKeys[j] = keys[i]
+			}
+			got, err := read(ctx, client, nodeKeys...)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for j, i := range indexes {
+				values[i] = got[j]
+			}
+		}(r.nodes[n].Client, indexes)
+	}
+	wg.Wait()
+	return values, firstErr
+}
+
+// Del deletes keys with one DEL per instance and returns how many existed
+func (r *Ring) Del(ctx context.Context, keys ...string) (int64, error) {
+	if len(r.nodes) == 0 && len(keys) > 0 {
+		return 0, ErrNoNodes
+	}
+	var deleted int64
+	for client, nodeKeys := range r.Partition(keys) {
+		n, err := client.Del(ctx, nodeKeys...).Result()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
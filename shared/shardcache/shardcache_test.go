@@ -0,0 +1,183 @@
+package shardcache
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// addrs returns the nodes for addrs, without clients: placement only
+// depends on the addresses
+func addrs(addrs ...string) []Node {
+	nodes := make([]Node, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = Node{Addr: addr}
+	}
+	return nodes
+}
+
+// owner returns the address of the node holding key
+func owner(r *Ring, key string) string {
+	return r.nodes[r.node(key)].Addr
+}
+
+func TestRingOrderIndependent(t *testing.T) {
+	keys := benchKeys(2000)
+	for _, tt := range []struct {
+		name string
+		a, b []string
+	}{
+		{"one node", []string{"cache-1:6379"}, []string{"cache-1:6379"}},
+		{"reversed", []string{"cache-1:6379", "cache-2:6379", "cache-3:6379"}, []string{"cache-3:6379", "cache-2:6379", "cache-1:6379"}},
+		{"rotated", []string{"cache-1:6379", "cache-2:6379", "cache-3:6379", "cache-4:6379"}, []string{"cache-3:6379", "cache-4:6379", "cache-1:6379", "cache-2:6379"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := New(addrs(tt.a...)...), New(addrs(tt.b...)...)
+			for _, key := range keys {
+				if owner(a, key) != owner(b, key) {
+					t.Fatalf("%s goes to %s and %s", key, owner(a, key), owner(b, key))
+				}
+			}
+		})
+	}
+}
+
+func TestRingRemoveNode(t *testing.T) {
+	keys := benchKeys(2000)
+	all := []string{"cache-1:6379", "cache-2:6379", "cache-3:6379", "cache-4:6379"}
+	for _, removed := range all {
+		t.Run(removed, func(t *testing.T) {
+			var rest []string
+			for _, addr := range all {
+				if addr != removed {
+					rest = append(rest, addr)
+				}
+			}
+			before, after := New(addrs(all...)...), New(addrs(rest...)...)
+			moved := 0
+			for _, key := range keys {
+				from, to := owner(before, key), owner(after, key)
+				if from == removed {
+					moved++
+					continue
+				}
+				if from != to {
+					t.Fatalf("%s moved from %s to %s", key, from, to)
+				}
+			}
+			if moved == 0 {
+				t.Errorf("%s held none of %d keys", removed, len(keys))
+			}
+		})
+	}
+}
+
+func TestRingEmpty(t *testing.T) {
+	r := New()
+	if client := r.Client("url:abc1234"); client != nil {
+		t.Fatalf("Client = %v, want nil", client)
+	}
+	if parts := r.Partition([]string{"url:abc1234"}); len(parts) != 0 {
+		t.Fatalf("Partition = %v, want no groups", parts)
+	}
+	values, err := r.MGet(context.Background(), "url:abc1234", "url:def5678")
+	if err != ErrNoNodes {
+		t.Fatalf("MGet error = %v, want ErrNoNodes", err)
+	}
+	if len(values) != 2 || values[0] != nil || values[1] != nil {
+		t.Fatalf("MGet = %v, want two misses", values)
+	}
+	if _, err := r.Del(context.Background(), "url:abc1234"); err != ErrNoNodes {
+		t.Fatalf("Del error = %v, want ErrNoNodes", err)
+	}
+	// Nothing asked, nothing to fail
+	if values, err := r.MGet(context.Background()); err != nil || len(values) != 0 {
+		t.Fatalf("MGet() = %v, %v", values, err)
+	}
+	if n, err := r.Del(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Del() = %d, %v", n, err)
+	}
+}
+
+func TestRingMGet(t *testing.T) {
+	keys := benchKeys(50)
+	r := benchRing(t, 3, keys[:40])
+	values, err := r.MGet(context.Background(), keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		want := interface{}(nil)
+		if i < 40 {
+			want = "https://example.com/" + key
+		}
+		if values[i] != want {
+			t.Fatalf("%s = %v, want %v", key, values[i], want)
+		}
+	}
+	if n, err := r.Del(context.Background(), keys...); err != nil || n != 40 {
+		t.Fatalf("Del = %d, %v, want 40", n, err)
+	}
+}
+
+// benchRing is a Ring over shards in-memory Redis instances, each holding
+// the keys it owns out of keys
+func benchRing(b testing.TB, shards int, keys []string) *Ring {
+	b.Helper()
+	var nodes []Node
+	for i := 0; i < shards; i++ {
+		mr := miniredis.RunT(b)
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		b.Cleanup(func() { client.Close() })
+		nodes = append(nodes, Node{Addr: mr.Addr(), Client: client})
+	}
+	r := New(nodes...)
+	for _, key := range keys {
+		if err := r.Client(key).Set(context.Background(), key, "https://example.com/"+key, 0).Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return r
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "url:" + strconv.Itoa(1000000+i)
+	}
+	return keys
+}
+
+// BenchmarkClient is the ring lookup every cache read and write goes through
+func BenchmarkClient(b *testing.B) {
+	keys := benchKeys(1024)
+	r := benchRing(b, 3, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Client(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkMGet(b *testing.B) {
+	keys := benchKeys(100)
+	for _, shards := range []int{1, 3} {
+		b.Run(strconv.Itoa(shards)+" shards", func(b *testing.B) {
+			r := benchRing(b, shards, keys)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				values, err := r.MGet(context.Background(), keys...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if values[0] == nil {
+					b.Fatal("Missing value")
+				}
+			}
+		})
+	}
+}
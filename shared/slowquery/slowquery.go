@@ -0,0 +1,161 @@
+// Package slowquery logs statements that take longer than
+// SLOW_QUERY_THRESHOLD (0 turns it off) with their tag and short code, and
+// counts them in db_slow_queries_total. A query's time runs until Postgres
+// starts answering, so reading a large result doesn't count against it. The
+// tag is the one set with Tag, else the sqlc query name, else "untagged"; the
+// statement itself is logged without its arguments.
+package slowquery
+
+import (
+	"context"
+	"database/sql/driver"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"shared/env"
+)
+
+var slowQueryThreshold = slowQueryThresholdEnv()
+
+func slowQueryThresholdEnv() time.Duration {
+	if os.Getenv("SLOW_QUERY_THRESHOLD") == "0" {
+		return 0
+	}
+	return env.Duration("SLOW_QUERY_THRESHOLD", 200*time.Millisecond)
+}
+
+// maxSlowQueryLogLength bounds the statement text in a slow query log line
+const maxSlowQueryLogLength = 300
+
+var slowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "db_slow_queries_total",
+	Help: "Postgres statements slower than SLOW_QUERY_THRESHOLD, per query tag.",
+}, []string{"tag"})
+
+type queryTagContextKey struct{}
+
+type queryTag struct {
+	tag       string
+	shortCode string
+}
+
+// Tag names the statements run with ctx, and the short code they are about,
+// in slow query logs. An empty tag keeps sqlc's query names.
+func Tag(ctx context.Context, tag, shortCode string) context.Context {
+	return context.WithValue(ctx, queryTagContextKey{}, queryTag{tag, shortCode})
+}
+
+// recordQuery logs and counts the statement if it was slow
+func recordQuery(ctx context.Context, query string, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed < slowQueryThreshold {
+		return
+	}
+	t, _ := ctx.Value(queryTagContextKey{}).(queryTag)
+	if t.tag == "" {
+		t.tag = sqlcQueryName(query)
+	}
+	slowQueries.WithLabelValues(t.tag).Inc()
+
+	statement := strings.Join(strings.Fields(query), " ")
+	if len(statement) > maxSlowQueryLogLength {
+		statement = statement[:maxSlowQueryLogLength] + "..."
+	}
+	if t.shortCode != "" {
+		t.tag += " for " + t.shortCode
+	}
+	log.Printf("Slow query %s took %dms: %s", t.tag, elapsed.Milliseconds(), statement)
+}
+
+// sqlcQueryName reads the name sqlc puts at the start of its queries
+func sqlcQueryName(query string) string {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(query), "-- name: ")
+	if !ok {
+		return "untagged"
+	}
+	name, _, _ := strings.Cut(rest, " ")
+	return name
+}
+
+// Connector wraps the database connector unless slow query logging is off
+func Connector(c driver.Connector) driver.Connector {
+	if slowQueryThreshold == 0 {
+		return c
+	}
+	return slowQueryConnector{c}
+}
+
+type slowQueryConnector struct {
+	driver.Connector
+}
+
+func (c slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slowQueryConn{conn}, nil
+}
+
+// slowQueryConn times each statement, in or out of a transaction. Like the
+// chaos package's, it delegates to lib/pq's context variants.
+type slowQueryConn struct {
+	driver.Conn
+}
+
+func (c slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer recordQuery(ctx, query, time.Now())
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer recordQuery(ctx, query, time.Now())
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c slowQueryConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c slowQueryConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c slowQueryConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+// Package storage connects the services to Postgres and Redis: credentials
+// from the secrets backend, tracing, the slow query log and fault injection,
+// retried while the dependencies are still starting.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"shared/chaos"
+	"shared/env"
+	"shared/secrets"
+	"shared/slowquery"
+	"shared/tracing"
+)
+
+// Started next to Postgres and Redis (docker-compose, a Kubernetes rollout),
+// a service usually comes up first. Instead of exiting on the first failed
+// connection it retries with a doubling delay, STARTUP_RETRY_DELAY up to
+// STARTUP_RETRY_MAX_DELAY, for STARTUP_RETRY_ATTEMPTS attempts before giving up.
+var (
+	startupRetryAttempts = env.Int("STARTUP_RETRY_ATTEMPTS", 10)
+	startupRetryDelay    = env.Duration("STARTUP_RETRY_DELAY", time.Second)
+	startupRetryMaxDelay = env.Duration("STARTUP_RETRY_MAX_DELAY", 30*time.Second)
+)
+
+// Retry runs connect until it succeeds or the attempts run out, returning
+// the last error
+func Retry(what string, connect func() error) error {
+	delay := startupRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		if attempt >= startupRetryAttempts {
+			return fmt.Errorf("%v (gave up after %d attempts)", err, attempt)
+		}
+		log.Printf("Failed to connect to %s (attempt %d/%d), retrying in %s: %v", what, attempt, startupRetryAttempts, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > startupRetryMaxDelay {
+			delay = startupRetryMaxDelay
+		}
+	}
+}
+
+// OpenPostgres opens a connection pool through connector and checks that it
+// answers. Pool sizes are left to the caller.
+func OpenPostgres(connector driver.Connector) (*sql.DB, error) {
+	conn := tracing.OpenDB(slowquery.Connector(chaos.Connector(connector)))
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetConnMaxLifetime(5 * time.Minute)
+	return conn, nil
+}
+
+// NewRedis connects to the Redis at addr and checks that it answers
+func NewRedis(ctx context.Context, addr string) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:                addr,                     // Redis server address
+		CredentialsProvider: secrets.RedisCredentials, // REDIS_PASSWORD, from the secrets backend if configured
+		DB:                  0,                        // Default DB
+	})
+	chaos.AddRedisHook(client)
+	if err := tracing.Redis(client); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,331 @@
+// Package tenantcache keeps cache entries and counters under the prefix of
+// the tenant (the consumer owning the link, page or domain) they were filled
+// for, tenant:<owner>:, so one tenant's keys can be audited, limited, flushed
+// or covered by a Redis ACL without touching the others'.
+//
+// Entries are named by what they are looked up by: url:<short code>,
+// page:<slug>, or, for keys a service looks up by owner, the already prefixed
+// Key(owner, name). A redirect only learns the tenant from the entry it looks
+// up, so each entry has a pointer, tenant-key:<name>, holding the entry's key
+// with the same TTL; Get and MGet follow it in a script. Every entry is also
+// recorded in its tenant's index on the Redis instance holding it, a sorted
+// set of names scored by expiry. Writes go through Set, which keeps the
+// pointer and the index and enforces the per-tenant limit in the same script,
+// and invalidations through Del, which drops the pointers, so an entry stops
+// being found even where only its name is known. An entry, its pointer and
+// its index live on the same instance: callers pick it by the entry's name.
+package tenantcache
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyPrefix starts every tenant-prefixed key
+const keyPrefix = "tenant:"
+
+// pointerPrefix starts the key holding where an entry is stored
+const pointerPrefix = "tenant-key:"
+
+// Prefix is the prefix of owner's keys. Owners are escaped so that one
+// owner's prefix is never the start of another's, and glob characters can't
+// widen a match; links without an owner share the empty tenant.
+func Prefix(owner string) string {
+	return keyPrefix + url.QueryEscape(owner) + ":"
+}
+
+// Key is owner's key of name
+func Key(owner, name string) string {
+	return Prefix(owner) + name
+}
+
+// IndexKey is owner's index on each instance
+func IndexKey(owner string) string {
+	return Key(owner, "cache")
+}
+
+// storedKey is where the entry name of owner is stored. Names looked up by
+// owner are already prefixed.
+func storedKey(owner, name string) string {
+	if strings.HasPrefix(name, keyPrefix) {
+		return name
+	}
+	return Key(owner, name)
+}
+
+// OwnerKey is the pointer of name, holding the key its entry is stored under
+func OwnerKey(name string) string {
+	return pointerPrefix + name
+}
+
+// Name is the entry name a key belongs to, without its pointer or tenant
+// prefix, to pick the instance the key lives on by
+func Name(key string) string {
+	if name, ok := strings.CutPrefix(key, pointerPrefix); ok {
+		key = name
+	}
+	if strings.HasPrefix(key, keyPrefix) {
+		if _, name, ok := strings.Cut(key[len(keyPrefix):], ":"); ok {
+			return name
+		}
+	}
+	return key
+}
+
+// Owner is the tenant of a prefixed key
+func Owner(key string) string {
+	escaped, _, _ := strings.Cut(strings.TrimPrefix(key, keyPrefix), ":")
+	owner, err := url.QueryUnescape(escaped)
+	if err != nil {
+		return escaped
+	}
+	return owner
+}
+
+// indexOf is the index of the tenant a prefixed key belongs to
+func indexOf(key string) string {
+	escaped, _, _ := strings.Cut(strings.TrimPrefix(key, keyPrefix), ":")
+	return keyPrefix + escaped + ":cache"
+}
+
+// IsIndexKey reports whether key is a tenant's index
+func IsIndexKey(key string) bool {
+	return strings.HasPrefix(key, keyPrefix) && strings.HasSuffix(key, ":cache")
+}
+
+// Kind is the kind of entry name holds, its name up to the last colon without
+// any tenant prefix: url, preview, stats:public, page or error-pages
+func Kind(name string) string {
+	name = Name(name)
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// setScript drops expired names from the index (KEYS[1]) and, unless the
+// tenant is at its limit without the name (ARGV[5]) already cached, stores the
+// value under KEYS[2], records its expiry and points KEYS[3] at it. The index
+// lives as long as its longest entry.
+var setScript = redis.NewScript(`
+local now, ttl, limit, name = tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4]), ARGV[5]
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if limit > 0 and not redis.call('ZSCORE', KEYS[1], name) and redis.call('ZCARD', KEYS[1]) >= limit then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[1], 'PX', ttl)
+redis.call('SET', KEYS[3], KEYS[2], 'PX', ttl)
+local indexTTL = redis.call('PTTL', KEYS[1])
+redis.call('ZADD', KEYS[1], now + ttl, name)
+if indexTTL < ttl then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// Set caches value under name for ttl as one of owner's entries. With limit
+// above zero, a tenant already holding limit live entries on the instance
+// gets nothing new cached there and the command's value is 0, 1 otherwise.
+// In a pipeline the script is sent in full, as a missing script can't be
+// retried there.
+func Set(ctx context.Context, c redis.Scripter, owner, name string, value interface{}, ttl time.Duration, limit int) *redis.Cmd {
+	keys := []string{IndexKey(owner), storedKey(owner, name), OwnerKey(name)}
+	args := []interface{}{value, time.Now().UnixMilli(), max(ttl.Milliseconds(), 1), limit, name}
+	if _, ok := c.(redis.Pipeliner); ok {
+		return setScript.Eval(ctx, c, keys, args...)
+	}
+	return setScript.Run(ctx, c, keys, args...)
+}
+
+// getScript follows the pointer KEYS[1] and returns the entry's value, its
+// key and its remaining TTL in milliseconds
+var getScript = redis.NewScript(`
+local key = redis.call('GET', KEYS[1])
+if not key then
+	return false
+end
+local value = redis.call('GET', key)
+if not value then
+	return false
+end
+return {value, key, redis.call('PTTL', key)}
+`)
+
+// Entry is a cached value with its tenant
+type Entry struct {
+	Value string
+	Owner string
+	// TTL is the time the entry has left, negative when it has no expiry
+	TTL time.Duration
+}
+
+// Get reads the entry of name, redis.Nil when there is none
+func Get(ctx context.Context, c redis.Scripter, name string) (Entry, error) {
+	result, err := getScript.Run(ctx, c, []string{OwnerKey(name)}).Slice()
+	if err != nil {
+		return Entry{}, err
+	}
+	value, _ := result[0].(string)
+	key, _ := result[1].(string)
+	ttl, _ := result[2].(int64)
+	return Entry{Value: value, Owner: Owner(key), TTL: time.Duration(ttl) * time.Millisecond}, nil
+}
+
+// mgetScript follows the pointers in KEYS and returns the entries' values,
+// false for missing ones
+var mgetScript = redis.NewScript(`
+local values = {}
+for i, pointer in ipairs(KEYS) do
+	local key = redis.call('GET', pointer)
+	values[i] = key and redis.call('GET', key) or false
+end
+return values
+`)
+
+// MGet reads the values of names like MGET, nil for missing entries. It is a
+// shardcache.Reader.
+func MGet(ctx context.Context, client *redis.Client, names ...string) ([]interface{}, error) {
+	if len(names) == 0 {
+		return []interface{}{}, nil
+	}
+	pointers := make([]string, len(names))
+	for i, name := range names {
+		pointers[i] = OwnerKey(name)
+	}
+	return mgetScript.Run(ctx, client, pointers).Slice()
+}
+
+// expireScript sets the TTL of the entry KEYS[1] points at, and of the
+// pointer, and moves its expiry in the index
+var expireScript = redis.NewScript(`
+local key = redis.call('GET', KEYS[1])
+if not key then
+	return 0
+end
+local ttl = tonumber(ARGV[1])
+redis.call('PEXPIRE', key, ttl)
+redis.call('PEXPIRE', KEYS[1], ttl)
+redis.call('ZADD', string.match(key, '^tenant:[^:]*:') .. 'cache', 'XX', tonumber(ARGV[2]) + ttl, ARGV[3])
+return 1
+`)
+
+// Expire keeps the entry of name for ttl from now
+func Expire(ctx context.Context, c redis.Scripter, name string, ttl time.Duration) error {
+	return expireScript.Run(ctx, c, []string{OwnerKey(name)}, max(ttl.Milliseconds(), 1), time.Now().UnixMilli(), name).Err()
+}
+
+// scanBatch is how many index entries are read at a time
+const scanBatch = 1000
+
+// Del deletes the entries of names, all on client's instance, with their
+// pointers, and drops them from their indexes. It returns how many of the
+// entries existed. Only DEL and ZREM are sent, so hooks replaying deletes to
+// other instances see every change; there, deleting the pointer is enough
+// for an entry not to be found.
+func Del(ctx context.Context, client redis.Cmdable, names ...string) (int64, error) {
+	if len(names) == 0 {
+		return 0, nil
+	}
+	pointers := make([]string, len(names))
+	for i, name := range names {
+		pointers[i] = OwnerKey(name)
+	}
+	stored, err := client.MGet(ctx, pointers...).Result()
+	if err != nil {
+		return 0, err
+	}
+	keys := []string{}
+	members := map[string][]interface{}{}
+	for i, key := range stored {
+		key, ok := key.(string)
+		if !ok && strings.HasPrefix(names[i], keyPrefix) {
+			key, ok = names[i], true
+		}
+		if ok {
+			keys = append(keys, key)
+			members[indexOf(key)] = append(members[indexOf(key)], names[i])
+		}
+	}
+
+	var deleted *redis.IntCmd
+	_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(keys) > 0 {
+			deleted = pipe.Del(ctx, keys...)
+		}
+		pipe.Del(ctx, pointers...)
+		for index, indexMembers := range members {
+			pipe.ZRem(ctx, index, indexMembers...)
+		}
+		return nil
+	})
+	if err != nil || deleted == nil {
+		return 0, err
+	}
+	return deleted.Val(), nil
+}
+
+// Count returns how many of owner's entries the instance holds, by kind.
+// Entries deleted without Del are counted until they would have expired.
+func Count(ctx context.Context, client *redis.Client, owner string) (map[string]int64, error) {
+	index := IndexKey(owner)
+	now := time.Now().UnixMilli()
+	if err := client.ZRemRangeByScore(ctx, index, "-inf", strconv.FormatInt(now, 10)).Err(); err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	var cursor uint64
+	for {
+		members, next, err := client.ZScan(ctx, index, cursor, "", scanBatch).Result()
+		if err != nil {
+			return nil, err
+		}
+		// ZSCAN returns members and scores alternately
+		for i := 0; i < len(members); i += 2 {
+			counts[Kind(members[i])]++
+		}
+		cursor = next
+		if cursor == 0 {
+			return counts, nil
+		}
+	}
+}
+
+// Flush deletes owner's entries on the instance along with their pointers
+// and its index, and returns the names of the deleted entries. Entries cached
+// while it runs are flushed too.
+func Flush(ctx context.Context, client *redis.Client, owner string) ([]string, error) {
+	index := IndexKey(owner)
+	flushed := []string{}
+	for {
+		names, err := client.ZRange(ctx, index, 0, scanBatch-1).Result()
+		if err != nil {
+			return flushed, err
+		}
+		if len(names) == 0 {
+			return flushed, nil
+		}
+		members := make([]interface{}, len(names))
+		keys := make([]string, len(names))
+		pointers := make([]string, len(names))
+		for i, name := range names {
+			members[i] = name
+			keys[i] = storedKey(owner, name)
+			pointers[i] = OwnerKey(name)
+		}
+		_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, keys...)
+			pipe.Del(ctx, pointers...)
+			pipe.ZRem(ctx, index, members...)
+			return nil
+		})
+		if err != nil {
+			return flushed, err
+		}
+		flushed = append(flushed, names...)
+	}
+}
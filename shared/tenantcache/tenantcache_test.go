@@ -0,0 +1,182 @@
+package tenantcache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func startRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+func TestDelDropsIndexEntries(t *testing.T) {
+	ctx := context.Background()
+	mr, client := startRedis(t)
+
+	for _, name := range []string{"url:aaa", "url:bbb"} {
+		if err := Set(ctx, client, "acme", name, "https://example.com/", time.Hour, 2).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stored, _ := Set(ctx, client, "acme", "url:ccc", "https://example.com/", time.Hour, 2).Int(); stored != 0 {
+		t.Fatal("Cached past the tenant's limit")
+	}
+
+	deleted, err := Del(ctx, client, "url:aaa", "url:missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Fatalf("Deleted %d keys, want 1", deleted)
+	}
+	if mr.Exists(OwnerKey("url:aaa")) || mr.Exists("tenant:acme:url:aaa") {
+		t.Fatal("Entry or pointer left behind")
+	}
+	counts, err := Count(ctx, client, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["url"] != 1 {
+		t.Fatalf("Counted %d url entries after the delete, want 1", counts["url"])
+	}
+
+	// The freed slot takes a new entry
+	if stored, _ := Set(ctx, client, "acme", "url:ccc", "https://example.com/", time.Hour, 2).Int(); stored != 1 {
+		t.Fatal("Limit still counts the deleted entry")
+	}
+}
+
+func TestEntriesLiveUnderTheTenantPrefix(t *testing.T) {
+	ctx := context.Background()
+	mr, client := startRedis(t)
+
+	if err := Set(ctx, client, "acme corp", "url:aaa", "https://example.com/", time.Hour, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(ctx, client, "acme", Key("acme", "error-pages:404"), "<html>", time.Hour, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.Keys(); !reflect.DeepEqual(got, []string{
+		"tenant-key:tenant:acme:error-pages:404",
+		"tenant-key:url:aaa",
+		"tenant:acme+corp:cache",
+		"tenant:acme+corp:url:aaa",
+		"tenant:acme:cache",
+		"tenant:acme:error-pages:404",
+	}) {
+		t.Fatalf("Keys %q", got)
+	}
+
+	entry, err := Get(ctx, client, "url:aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Value != "https://example.com/" || entry.Owner != "acme corp" || entry.TTL <= 0 || entry.TTL > time.Hour {
+		t.Fatalf("Got %+v", entry)
+	}
+	if _, err := Get(ctx, client, "url:missing"); err != redis.Nil {
+		t.Fatalf("Missing entry: %v, want redis.Nil", err)
+	}
+
+	values, err := MGet(ctx, client, "url:missing", "url:aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []interface{}{nil, "https://example.com/"}) {
+		t.Fatalf("MGet = %v", values)
+	}
+
+	// Entries looked up by owner are deleted by their key
+	if n, err := Del(ctx, client, Key("acme", "error-pages:404")); err != nil || n != 1 {
+		t.Fatalf("Del = %d, %v", n, err)
+	}
+}
+
+func TestDelWithoutEntry(t *testing.T) {
+	ctx := context.Background()
+	mr, client := startRedis(t)
+	// The pointer alone, as left where only a replayed delete arrives
+	mr.Set(OwnerKey("url:aaa"), "tenant:acme:url:aaa")
+	if n, err := Del(ctx, client, "url:aaa"); err != nil || n != 0 {
+		t.Fatalf("Del = %d, %v", n, err)
+	}
+	if mr.Exists(OwnerKey("url:aaa")) {
+		t.Fatal("Pointer left behind")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	mr, client := startRedis(t)
+	for _, owner := range []string{"acme", "other"} {
+		if err := Set(ctx, client, owner, "url:"+owner, "https://example.com/", time.Hour, 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flushed, err := Flush(ctx, client, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(flushed, []string{"url:acme"}) {
+		t.Fatalf("Flushed %q", flushed)
+	}
+	if got := mr.Keys(); !reflect.DeepEqual(got, []string{"tenant-key:url:other", "tenant:other:cache", "tenant:other:url:other"}) {
+		t.Fatalf("Left %q", got)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	mr, client := startRedis(t)
+	if err := Set(ctx, client, "acme", "url:aaa", "https://example.com/", time.Minute, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Expire(ctx, client, "url:aaa", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tenant:acme:url:aaa", OwnerKey("url:aaa")} {
+		if ttl := mr.TTL(key); ttl != time.Hour {
+			t.Errorf("%s expires in %s, want 1h", key, ttl)
+		}
+	}
+	// Nothing to extend
+	if err := Expire(ctx, client, "url:missing", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, tt := range []struct {
+		key, name, kind string
+	}{
+		{"url:aaa", "url:aaa", "url"},
+		{"tenant:acme:url:aaa", "url:aaa", "url"},
+		{"tenant-key:url:aaa", "url:aaa", "url"},
+		{"tenant:acme:error-pages:404", "error-pages:404", "error-pages"},
+		{"tenant-key:tenant:acme:error-pages:404", "error-pages:404", "error-pages"},
+		{"stats:public:aaa", "stats:public:aaa", "stats:public"},
+	} {
+		if got := Name(tt.key); got != tt.name {
+			t.Errorf("Name(%q) = %q, want %q", tt.key, got, tt.name)
+		}
+		if got := Kind(tt.key); got != tt.kind {
+			t.Errorf("Kind(%q) = %q, want %q", tt.key, got, tt.kind)
+		}
+	}
+	if got := Owner(Key("a:b c", "url:aaa")); got != "a:b c" {
+		t.Errorf("Owner = %q", got)
+	}
+	if got := Owner(Key("", "url:aaa")); got != "" {
+		t.Errorf("Owner of the empty tenant = %q", got)
+	}
+}
@@ -0,0 +1,111 @@
+// Package tracing continues the W3C trace context (traceparent and
+// tracestate) requests arrive with, from the gateway or another service: the
+// request's span is a child of it, Postgres, Redis and outbound HTTP calls
+// made with the request's context are children of the request, and outbound
+// calls carry the trace on. Spans are exported over OTLP/HTTP when
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set,
+// sampled as the caller decided unless OTEL_TRACES_SAMPLER says otherwise.
+// Without an exporter nothing is recorded, but an incoming trace is still
+// forwarded as it came.
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"os"
+
+	"github.com/XSAM/otelsql"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// noPropagation keeps the trace to ourselves on calls to user-supplied URLs
+var noPropagation = propagation.NewCompositeTextMapPropagator()
+
+// Init sets up propagation and, when an endpoint is configured, the exporter
+// for serviceName's spans
+func Init(ctx context.Context, serviceName string) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx, resource.WithAttributes(semconv.ServiceName(serviceName)), resource.WithFromEnv())
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)))
+	return nil
+}
+
+// Handler starts each request's span from its trace context. Probes are left
+// out, they would only be noise.
+func Handler(h http.Handler, serviceName string) http.Handler {
+	return otelhttp.NewHandler(h, serviceName,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method }),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/api/health" && r.URL.Path != "/readyz"
+		}),
+	)
+}
+
+// Route names the request's span after the gin route it matched
+func Route(c *gin.Context) {
+	c.Next()
+	if route := c.FullPath(); route != "" {
+		span := trace.SpanFromContext(c.Request.Context())
+		span.SetName(c.Request.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	}
+}
+
+// Client makes the client's calls spans and forwards the trace to the
+// services it calls
+func Client(client *http.Client) *http.Client {
+	client.Transport = otelhttp.NewTransport(client.Transport)
+	return client
+}
+
+// DestinationClient records the client's calls as spans without sending the
+// trace context, since it calls user-supplied URLs
+func DestinationClient(client *http.Client) *http.Client {
+	client.Transport = otelhttp.NewTransport(client.Transport, otelhttp.WithPropagators(noPropagation))
+	return client
+}
+
+// TraceID is the ID of the trace ctx belongs to, "" outside of one
+func TraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// OpenDB opens a pool whose queries are spans of their context
+func OpenDB(connector driver.Connector) *sql.DB {
+	return otelsql.OpenDB(connector,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}),
+	)
+}
+
+// Redis makes the client's commands spans of their context
+func Redis(client *redis.Client) error {
+	return redisotel.InstrumentTracing(client)
+}
@@ -0,0 +1,193 @@
+// Package urlcrypto encrypts link destinations at rest. convert-api encrypts
+// with the active key; the redirect path only decrypts, so it needs every key
+// still in use, not the active one.
+package urlcrypto
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// Encrypted destinations are stored as "enc:v1:<keyID>:<base64url(nonce|ciphertext)>".
+// Values without the prefix are plaintext, so encryption can be enabled on an
+// existing database and rows are encrypted as they are written.
+const encryptedURLPrefix = "enc:v1:"
+
+var errUnknownURLKey = errors.New("unknown url encryption key")
+
+// Keys come from URL_ENCRYPTION_KEYS ("id:base64key,...", 32-byte AES-256 keys)
+// or URL_ENCRYPTION_KMS_KEYS ("id:base64(KMS ciphertext blob),..." data keys
+// wrapped by AWS KMS). URL_ENCRYPTION_ACTIVE_KEY picks the key for new writes;
+// the others stay available for decryption during rotation.
+var (
+	urlEncryptionKeys      = os.Getenv("URL_ENCRYPTION_KEYS")
+	urlEncryptionKMSKeys   = os.Getenv("URL_ENCRYPTION_KMS_KEYS")
+	urlEncryptionActiveKey = os.Getenv("URL_ENCRYPTION_ACTIVE_KEY")
+)
+
+// urlKeyring caches one AEAD per key ID. KMS-wrapped keys are unwrapped on first use.
+var urlKeyring = struct {
+	sync.Mutex
+	raw     map[string]string
+	wrapped map[string]string
+	aeads   map[string]cipher.AEAD
+}{aeads: map[string]cipher.AEAD{}}
+
+// Enabled reports whether new destinations are encrypted
+func Enabled() bool {
+	return urlEncryptionActiveKey != ""
+}
+
+func parseKeyList(list string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, value, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || value == "" {
+			return nil, fmt.Errorf("invalid key entry %q, expected id:base64", entry)
+		}
+		keys[id] = value
+	}
+	return keys, nil
+}
+
+// Init validates the key configuration and warms the active key
+func Init() error {
+	var err error
+	if urlKeyring.raw, err = parseKeyList(urlEncryptionKeys); err != nil {
+		return fmt.Errorf("URL_ENCRYPTION_KEYS: %v", err)
+	}
+	if urlKeyring.wrapped, err = parseKeyList(urlEncryptionKMSKeys); err != nil {
+		return fmt.Errorf("URL_ENCRYPTION_KMS_KEYS: %v", err)
+	}
+
+	if !Enabled() {
+		return nil
+	}
+	if _, err := urlAEAD(urlEncryptionActiveKey); err != nil {
+		return fmt.Errorf("active key %q: %v", urlEncryptionActiveKey, err)
+	}
+	return nil
+}
+
+func urlAEAD(keyID string) (cipher.AEAD, error) {
+	urlKeyring.Lock()
+	defer urlKeyring.Unlock()
+
+	if aead, ok := urlKeyring.aeads[keyID]; ok {
+		return aead, nil
+	}
+
+	var key []byte
+	var err error
+	if encoded, ok := urlKeyring.raw[keyID]; ok {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	} else if wrapped, ok := urlKeyring.wrapped[keyID]; ok {
+		key, err = unwrapKMSKey(wrapped)
+	} else {
+		return nil, errUnknownURLKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key %q must be 32 bytes, got %d", keyID, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	urlKeyring.aeads[keyID] = aead
+	return aead, nil
+}
+
+// unwrapKMSKey decrypts a data key with AWS KMS, using the standard AWS credential chain
+func unwrapKMSKey(wrapped string) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	out, err := kms.NewFromConfig(cfg).Decrypt(context.Background(), &kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt failed: %v", err)
+	}
+	return out.Plaintext, nil
+}
+
+// Encrypt seals a destination with the active key; a no-op when encryption is off
+func Encrypt(plaintext string) (string, error) {
+	if !Enabled() {
+		return plaintext, nil
+	}
+
+	aead, err := urlAEAD(urlEncryptionActiveKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return encryptedURLPrefix + urlEncryptionActiveKey + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a stored destination, passing plaintext values through
+func Decrypt(stored string) (string, error) {
+	rest, ok := strings.CutPrefix(stored, encryptedURLPrefix)
+	if !ok {
+		return stored, nil
+	}
+
+	keyID, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted url")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted url: %v", err)
+	}
+
+	aead, err := urlAEAD(keyID)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted url")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt url: %v", err)
+	}
+	return string(plaintext), nil
+}